@@ -8,20 +8,41 @@ package auditor
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"hash/crc32"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
 	"time"
 
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/DataDog/datadog-log-agent/pkg/wal"
 )
 
 const defaultFlushPeriod = 1 * time.Second
 const defaultCleanupPeriod = 300 * time.Second
 const defaultTTL = 23 * time.Hour
+const defaultTimestampTTL = 7 * 24 * time.Hour
+const defaultCommitEventsSize = 1000
+const defaultMaxFlushDuration = 1 * time.Second
+
+const (
+	// OFFSET_ENTRY is the kind of entries tracking an offset in a file
+	OFFSET_ENTRY = "offset"
+	// TIMESTAMP_ENTRY is the kind of entries tracking the timestamp of the last log
+	// of a source that can't be seeked, like a container
+	TIMESTAMP_ENTRY = "timestamp"
+	// META_ENTRY is the kind of entries that only hold metadata,
+	// nothing has been commited for their source yet
+	META_ENTRY = "meta"
+)
+
+// registryVersion is the version of the registries written on disk
+const registryVersion = 2
 
 // A RegistryEntry represends an entry in the registry where we keep track
 // of current offsets
@@ -29,6 +50,46 @@ type RegistryEntry struct {
 	Timestamp   string
 	Offset      int64
 	LastUpdated time.Time
+	Kind        string `json:",omitempty"`
+	// Line is the number of lines before Offset, when the source numbers its lines
+	Line int64 `json:",omitempty"`
+	// Meta holds the state of a source that must survive restarts
+	Meta map[string]string `json:",omitempty"`
+
+	// updated is when the entry was last updated by this process, it keeps
+	// the monotonic clock reading so that its age ignores wall clock steps
+	updated time.Time
+	// dirty is true until the entry is flushed in the registry store
+	dirty bool
+	// regressed is true once an offset regression was reported for the entry
+	regressed bool
+}
+
+// age returns for how long the entry has not been updated, it is never negative
+func (e *RegistryEntry) age(now time.Time) time.Duration {
+	var age time.Duration
+	if !e.updated.IsZero() {
+		age = now.Sub(e.updated)
+	} else {
+		age = now.Sub(e.LastUpdated)
+	}
+	if age < 0 {
+		// the wall clock stepped backward since the entry was written
+		return 0
+	}
+	return age
+}
+
+// copy returns a copy of the entry that doesn't share its metadata
+func (e RegistryEntry) copy() RegistryEntry {
+	if e.Meta != nil {
+		meta := make(map[string]string, len(e.Meta))
+		for key, value := range e.Meta {
+			meta[key] = value
+		}
+		e.Meta = meta
+	}
+	return e
 }
 
 // An Auditor handles messages successfully submitted to the intake
@@ -36,98 +97,493 @@ type Auditor struct {
 	inputChan     chan message.Message
 	registry      map[string]*RegistryEntry
 	registryMutex *sync.Mutex
-	registryPath  string
+	registryStore RegistryStore
+	// flushMutex serializes the flushes of the registry store
+	flushMutex sync.Mutex
 
-	flushTicker   *time.Ticker
+	flushTicker   clock.Ticker
 	flushPeriod   time.Duration
-	cleanupTicker *time.Ticker
+	cleanupTicker clock.Ticker
 	cleanupPeriod time.Duration
-	entryTTL      time.Duration
+	entryTTLs     map[string]time.Duration
+	clock         clock.Clock
+	// keyDatePattern matches the dates embedded in the registry keys, their entries
+	// are removed once the date is older than keyMaxAge
+	keyDatePattern *regexp.Regexp
+	keyDateLayout  string
+	keyMaxAge      time.Duration
+	// maxEntries caps the size of the registry, when it is positive
+	maxEntries int
+	// recency orders the entries of the registry by update, to evict the oldest ones
+	recency *lru
+	// rejectOffsetRegressions keeps the commited offsets when lower ones are
+	// commited without their file being rotated or truncated
+	rejectOffsetRegressions bool
+
+	// flushErr is the error of the last flush, the auditor is unhealthy until a flush succeeds
+	flushErr      error
+	flushErrMutex sync.Mutex
+	// flushDuration is how long the last flush took, the auditor
+	// is unhealthy while it is longer than maxFlushDuration
+	flushDuration    time.Duration
+	maxFlushDuration time.Duration
+
+	// wal holds the messages of the sources that can't be read again until
+	// they are commited, it is opened by the first source using it
+	wal      *wal.WAL
+	walPath  string
+	walOnce  sync.Once
+	walBytes int64
+
+	// fences hold back the messages of each stream received out of order
+	fences      map[uint64]*fence
+	fencesMutex sync.Mutex
+
+	// heartbeats are when the idle sources last notified they were healthy, by identifier
+	heartbeats      map[string]time.Time
+	heartbeatsMutex sync.Mutex
+
+	// subscribers receive the offsets saved in the registry store
+	subscribers       []chan CommitEvent
+	subscribersClosed bool
+	subscribersMutex  sync.Mutex
+	commitEventsSize  int
+
+	done    chan struct{}
+	runDone chan struct{}
+	// stopped is closed once the registry is flushed a last time
+	stopped chan struct{}
+	// periodic tracks the goroutines flushing and cleaning up the registry
+	periodic sync.WaitGroup
+	stopOnce sync.Once
 }
 
 // New returns an initialized Auditor
 func New(inputChan chan message.Message) *Auditor {
+	commitEventsSize := config.LogsAgent.GetInt("commit_events_size")
+	if commitEventsSize <= 0 {
+		commitEventsSize = defaultCommitEventsSize
+	}
+	keyDateLayout := config.LogsAgent.GetString("registry_key_date_layout")
+	if keyDateLayout == "" {
+		keyDateLayout = defaultKeyDateLayout
+	}
+	keyMaxAge := time.Duration(config.LogsAgent.GetInt("registry_key_max_age")) * time.Hour
+	if keyMaxAge <= 0 {
+		keyMaxAge = defaultKeyMaxAge
+	}
+	maxFlushDuration := time.Duration(config.LogsAgent.GetInt("registry_flush_max_duration")) * time.Millisecond
+	if maxFlushDuration <= 0 {
+		maxFlushDuration = defaultMaxFlushDuration
+	}
 	return &Auditor{
 		inputChan:     inputChan,
-		registryPath:  filepath.Join(config.LogsAgent.GetString("run_path"), "registry.json"),
 		registryMutex: &sync.Mutex{},
+		registryStore: NewRegistryStore(
+			config.LogsAgent.GetString("registry_type"),
+			filepath.Join(config.LogsAgent.GetString("run_path"), "registry.json"),
+		),
 
 		flushPeriod:   defaultFlushPeriod,
 		cleanupPeriod: defaultCleanupPeriod,
-		entryTTL:      defaultTTL,
+		entryTTLs: map[string]time.Duration{
+			OFFSET_ENTRY:    defaultTTL,
+			TIMESTAMP_ENTRY: defaultTimestampTTL,
+		},
+		clock:                   clock.New(),
+		keyDatePattern:          newKeyDatePattern(),
+		keyDateLayout:           keyDateLayout,
+		keyMaxAge:               keyMaxAge,
+		maxFlushDuration:        maxFlushDuration,
+		maxEntries:              config.LogsAgent.GetInt("max_registry_entries"),
+		recency:                 newLRU(nil),
+		rejectOffsetRegressions: config.LogsAgent.GetBool("reject_offset_regressions"),
+		walPath:                 filepath.Join(config.LogsAgent.GetString("run_path"), "wal.log"),
+		walBytes:                int64(config.LogsAgent.GetInt("wal_max_bytes")),
+		commitEventsSize:        commitEventsSize,
+		fences:                  make(map[uint64]*fence),
+		heartbeats:              make(map[string]time.Time),
+
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 }
 
 // Start starts the Auditor
 func (a *Auditor) Start() {
-	a.registry = a.recoverRegistry(a.registryPath)
+	if store, ok := a.registryStore.(checkedRegistryStore); ok {
+		if err := store.CheckWritable(); err != nil {
+			// offsets are still commited in memory, and saved as soon as possible
+			log.Println("Can't save the registry, offsets will be lost on restart: check the permissions of run_path or use the memory registry_type:", err)
+			a.setFlushError(err)
+		}
+	}
+	a.registry = a.registryStore.Recover()
 	a.cleanupRegistry(a.registry)
+	a.recency = newLRU(a.registry)
+	a.runDone = make(chan struct{})
 	go a.run()
+	a.periodic.Add(2)
 	go a.flushRegistryPediodically()
 	go a.cleanupRegistryPeriodically()
 }
 
+// Stop stops the Auditor: it commits the messages it already received
+// and flushes the registry a last time. It is safe to call Stop several times.
+// The auditor also stops once its input channel is closed and drained
+func (a *Auditor) Stop() {
+	a.stopOnce.Do(func() {
+		defer close(a.stopped)
+		// the subscribers get the events of the last flush
+		defer a.closeSubscribers()
+		close(a.done)
+		if a.runDone == nil {
+			// the auditor was never started, there is nothing to flush
+			return
+		}
+		<-a.runDone
+		// a periodic flush must not overwrite the last one
+		a.periodic.Wait()
+		err := a.flushRegistry(a.registry)
+		if err != nil {
+			log.Println(err)
+		}
+		a.setFlushError(err)
+		if a.wal != nil {
+			a.wal.Close()
+		}
+	})
+}
+
+// Done returns a channel closed once the auditor is stopped
+// and the registry is flushed a last time
+func (a *Auditor) Done() <-chan struct{} {
+	return a.stopped
+}
+
+// WAL returns the WAL of the messages that can't be read again, opening it
+// the first time. It returns nil when the WAL can't be opened
+func (a *Auditor) WAL() *wal.WAL {
+	a.walOnce.Do(func() {
+		w, err := wal.Open(a.walPath, a.walBytes)
+		if err != nil {
+			log.Println("Can't open the WAL, in-flight messages will be lost on restart:", err)
+			return
+		}
+		a.wal = w
+	})
+	return a.wal
+}
+
 // flushRegistryPediodically periodically saves the registry in its current state
 func (a *Auditor) flushRegistryPediodically() {
-	a.flushTicker = time.NewTicker(a.flushPeriod)
+	defer a.periodic.Done()
+	a.flushTicker = a.clock.NewTicker(a.flushPeriod)
+	defer a.flushTicker.Stop()
 	for {
 		select {
-		case <-a.flushTicker.C:
-			err := a.flushRegistry(a.registry, a.registryPath)
-			if err != nil {
-				log.Println(err)
-			}
+		case <-a.done:
+			return
+		case <-a.flushTicker.C():
+			a.flushRegistryAndReport()
 		}
 	}
 }
 
-// cleanupRegistryPeriodically periodically removes from the registry expired offsets
+// Flush saves the registry right away, it is safe to call it
+// while the auditor flushes the registry periodically
+func (a *Auditor) Flush() error {
+	return a.flushRegistryAndReport()
+}
+
+// flushRegistryAndReport saves the registry and updates the health of the auditor,
+// a failure is only logged when the flushes start or stop failing
+func (a *Auditor) flushRegistryAndReport() error {
+	err := a.flushRegistry(a.registry)
+	if err != nil {
+		metrics.RegistryFlushErrors.Add(1)
+	}
+	switch previousErr := a.setFlushError(err); {
+	case err != nil && previousErr == nil:
+		log.Println("Can't save the registry, offsets will be lost on restart until it succeeds:", err)
+	case err == nil && previousErr != nil:
+		log.Println("The registry is saved again")
+	}
+	return err
+}
+
+// setFlushError records the result of a flush, and returns the previous one
+func (a *Auditor) setFlushError(err error) error {
+	a.flushErrMutex.Lock()
+	defer a.flushErrMutex.Unlock()
+	previousErr := a.flushErr
+	a.flushErr = err
+	return previousErr
+}
+
+// setFlushDuration records how long a flush took
+func (a *Auditor) setFlushDuration(duration time.Duration) {
+	a.flushErrMutex.Lock()
+	defer a.flushErrMutex.Unlock()
+	a.flushDuration = duration
+}
+
+// Health returns an error while the registry can't be saved,
+// or while saving it takes longer than registry_flush_max_duration
+func (a *Auditor) Health() error {
+	a.flushErrMutex.Lock()
+	defer a.flushErrMutex.Unlock()
+	if a.flushErr != nil {
+		return a.flushErr
+	}
+	if a.flushDuration > a.maxFlushDuration {
+		return fmt.Errorf("the last flush of the registry took %v, over %v", a.flushDuration, a.maxFlushDuration)
+	}
+	return nil
+}
+
+// cleanupRegistryPeriodically periodically removes from the registry expired offsets,
+// and forgets the fences of the streams that are over and the old heartbeats
 func (a *Auditor) cleanupRegistryPeriodically() {
-	a.cleanupTicker = time.NewTicker(a.cleanupPeriod)
+	defer a.periodic.Done()
+	a.cleanupTicker = a.clock.NewTicker(a.cleanupPeriod)
+	defer a.cleanupTicker.Stop()
 	for {
 		select {
-		case <-a.cleanupTicker.C:
+		case <-a.done:
+			return
+		case <-a.cleanupTicker.C():
 			a.cleanupRegistry(a.registry)
+			a.cleanupFences()
+			a.cleanupHeartbeats()
 		}
 	}
 }
 
-// run lets the auditor update the registry
+// run lets the auditor update the registry. When its input channel is closed,
+// all its messages are commited before the registry is flushed a last time
 func (a *Auditor) run() {
-	for msg := range a.inputChan {
-		// An empty Identifier means that we don't want to track down the offset
-		// This is useful for origins that don't have offsets (networks), or when we
-		// specially want to avoid storing the offset
-		if msg.GetOrigin().Identifier != "" {
-			a.updateRegistry(msg.GetOrigin().Identifier, msg.GetOrigin().Offset, msg.GetOrigin().Timestamp)
+	if closed := a.handleMessages(); closed {
+		close(a.runDone)
+		// the final flush waits for run to be done
+		go a.Stop()
+		return
+	}
+	close(a.runDone)
+}
+
+// handleMessages handles the messages of the input channel until it is closed,
+// or until the auditor is stopped. It returns true when the channel was closed
+func (a *Auditor) handleMessages() bool {
+	for {
+		select {
+		case msg, ok := <-a.inputChan:
+			if !ok {
+				return true
+			}
+			a.handleMessage(msg)
+		case <-a.done:
+			a.drain()
+			return false
+		}
+	}
+}
+
+// drain handles the messages that are already buffered in the input channel
+func (a *Auditor) drain() {
+	for {
+		select {
+		case msg, ok := <-a.inputChan:
+			if !ok {
+				return
+			}
+			a.handleMessage(msg)
+		default:
+			return
+		}
+	}
+}
+
+// handleMessage commits the offset of a message successfully submitted to the intake
+func (a *Auditor) handleMessage(msg message.Message) {
+	if batch, ok := msg.(*message.MessageBatch); ok {
+		// messages are commited in order, the last offset of each identifier wins
+		for _, m := range batch.Messages() {
+			a.handleMessage(m)
+		}
+		return
+	}
+	if msg.GetOrigin() == nil {
+		// a malformed message, there is nothing to commit
+		return
+	}
+	if _, ok := msg.(*message.HeartbeatMessage); ok {
+		a.recordHeartbeat(msg.GetOrigin().Identifier)
+		return
+	}
+	for _, released := range a.release(msg) {
+		a.commitMessage(released)
+	}
+}
+
+// commitMessage commits the offset of a message, once the messages of its stream before it are
+func (a *Auditor) commitMessage(msg message.Message) {
+	a.freeMessage(msg)
+	// An empty Identifier means that we don't want to track down the offset
+	// This is useful for origins that don't have offsets (networks), or when we
+	// specially want to avoid storing the offset
+	if msg.GetOrigin().Identifier != "" {
+		if a.isOffsetRegression(msg.GetOrigin()) && a.rejectOffsetRegressions {
+			return
+		}
+		line := msg.GetOrigin().Line
+		if msg.GetOrigin().Partial && line > 0 {
+			// the offset is in the middle of the line
+			line--
+		}
+		a.updateRegistry(msg.GetOrigin().Identifier, msg.GetOrigin().Offset, msg.GetOrigin().Timestamp, line)
+	}
+}
+
+// freeMessage releases the bytes of a message that are no longer in flight,
+// and its line kept in the WAL
+func (a *Auditor) freeMessage(msg message.Message) {
+	metrics.InFlightBytes.Add(-msg.GetOrigin().InFlightBytes)
+	if seq := msg.GetOrigin().WALSeq; seq > 0 && a.wal != nil {
+		if err := a.wal.Ack(seq); err != nil {
+			log.Println("Can't ack a message in the WAL:", err)
 		}
 	}
 }
 
-// updateRegistry updates the offset of identifier in the auditor's registry
-func (a *Auditor) updateRegistry(identifier string, offset int64, timestamp string) {
+// isOffsetRegression returns true if the offset of origin is lower than the one commited,
+// while its file was neither rotated nor truncated: lines would be sent again.
+// A regression is only logged once until an offset is commited again
+func (a *Auditor) isOffsetRegression(origin *message.MessageOrigin) bool {
 	a.registryMutex.Lock()
 	defer a.registryMutex.Unlock()
+	entry, ok := a.registry[origin.Identifier]
+	if !ok || entry.Kind != OFFSET_ENTRY || origin.Timestamp != "" || origin.OffsetReset || origin.Offset >= entry.Offset {
+		return false
+	}
+	metrics.OffsetRegressions.Add(1)
+	if !entry.regressed {
+		log.Println("Warning: the offset of", origin.Identifier, "goes back from", entry.Offset, "to", origin.Offset, "while the file was neither rotated nor truncated")
+		entry.regressed = true
+	}
+	return true
+}
+
+// updateRegistry updates the offset of identifier in the auditor's registry,
+// along with the number of lines before it when it is known
+func (a *Auditor) updateRegistry(identifier string, offset int64, timestamp string, line int64) {
+	a.registryMutex.Lock()
+	defer a.registryMutex.Unlock()
+	kind := OFFSET_ENTRY
+	if timestamp != "" {
+		kind = TIMESTAMP_ENTRY
+	}
+	var meta map[string]string
+	if entry, ok := a.registry[identifier]; ok {
+		meta = entry.Meta
+	}
+	now := a.clock.Now()
 	a.registry[identifier] = &RegistryEntry{
-		LastUpdated: time.Now().UTC(),
+		updated:     now,
+		LastUpdated: now.UTC(),
 		Offset:      offset,
 		Timestamp:   timestamp,
+		Kind:        kind,
+		Line:        line,
+		Meta:        meta,
+		dirty:       true,
 	}
+	a.recency.touch(identifier)
+	a.evictEntries()
 }
 
-// recoverRegistry rebuilds the registry from the state file found at path
-func (a *Auditor) recoverRegistry(path string) map[string]*RegistryEntry {
-	mr, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Println(err)
-		return make(map[string]*RegistryEntry)
+// evictEntries removes the least recently updated entries while the registry
+// has more than maxEntries. Only entries already flushed are evicted,
+// so that no commited offset is lost
+func (a *Auditor) evictEntries() {
+	if a.maxEntries <= 0 {
+		return
 	}
-	r, err := a.unmarshalRegistry(mr)
-	if err != nil {
-		log.Println(err)
-		return make(map[string]*RegistryEntry)
+	for len(a.registry) > a.maxEntries {
+		oldest, ok := a.recency.oldest()
+		if !ok {
+			return
+		}
+		entry, ok := a.registry[oldest]
+		if !ok {
+			a.recency.remove(oldest)
+			continue
+		}
+		if entry.dirty {
+			// a flush saves all the entries updated before it, so the ones
+			// updated after the oldest are not flushed either
+			return
+		}
+		delete(a.registry, oldest)
+		a.recency.remove(oldest)
 	}
-	return r
+}
+
+// ResetOffset forgets the offset commited for identifier, so that its source
+// is tailed from its end the next time it starts. Its metadata are kept
+func (a *Auditor) ResetOffset(identifier string) {
+	a.registryMutex.Lock()
+	defer a.registryMutex.Unlock()
+	entry, ok := a.registry[identifier]
+	if !ok {
+		return
+	}
+	if len(entry.Meta) == 0 {
+		delete(a.registry, identifier)
+		a.recency.remove(identifier)
+		return
+	}
+	now := a.clock.Now()
+	a.registry[identifier] = &RegistryEntry{
+		Kind:        META_ENTRY,
+		Meta:        entry.Meta,
+		updated:     now,
+		LastUpdated: now.UTC(),
+		dirty:       true,
+	}
+	a.recency.touch(identifier)
+}
+
+// SetMeta stores a value in the metadata of identifier, it is persisted with the registry
+func (a *Auditor) SetMeta(identifier, key, value string) {
+	a.registryMutex.Lock()
+	defer a.registryMutex.Unlock()
+	entry, ok := a.registry[identifier]
+	if !ok {
+		entry = &RegistryEntry{Kind: META_ENTRY}
+		a.registry[identifier] = entry
+	}
+	if entry.Meta == nil {
+		entry.Meta = make(map[string]string)
+	}
+	entry.Meta[key] = value
+	now := a.clock.Now()
+	entry.updated = now
+	entry.LastUpdated = now.UTC()
+	entry.dirty = true
+	a.recency.touch(identifier)
+	a.evictEntries()
+}
+
+// GetMeta returns a value from the metadata of identifier, or an empty string
+func (a *Auditor) GetMeta(identifier, key string) string {
+	a.registryMutex.Lock()
+	defer a.registryMutex.Unlock()
+	entry, ok := a.registry[identifier]
+	if !ok {
+		return ""
+	}
+	return entry.Meta[key]
 }
 
 // readOnlyRegistryCopy returns a read only copy of the registry
@@ -136,83 +592,160 @@ func (a *Auditor) readOnlyRegistryCopy(registry map[string]*RegistryEntry) map[s
 	defer a.registryMutex.Unlock()
 	r := make(map[string]RegistryEntry)
 	for path, entry := range registry {
-		r[path] = *entry
+		r[path] = entry.copy()
 	}
 	return r
 }
 
-// flushRegistry writes on disk the registry at the given path
-func (a *Auditor) flushRegistry(registry map[string]*RegistryEntry, path string) error {
-	r := a.readOnlyRegistryCopy(registry)
-	mr, err := a.marshalRegistry(r)
+// flushRegistry saves the registry in its store, the entries that were
+// not updated in the meantime can then be evicted
+func (a *Auditor) flushRegistry(registry map[string]*RegistryEntry) error {
+	a.flushMutex.Lock()
+	defer a.flushMutex.Unlock()
+	flushed := a.readOnlyRegistryCopy(registry)
+	start := a.clock.Now()
+	err := a.registryStore.Flush(flushed)
+	duration := a.clock.Since(start)
+	metrics.RegistryFlushDuration.Observe(duration.Seconds())
+	a.setFlushDuration(duration)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, mr, 0644)
+	if store, ok := a.registryStore.(sizedRegistryStore); ok {
+		metrics.RegistrySize.Set(store.Size())
+	}
+	a.publishCommits(flushed)
+	a.registryMutex.Lock()
+	defer a.registryMutex.Unlock()
+	for identifier, entry := range registry {
+		if flushedEntry, ok := flushed[identifier]; ok && flushedEntry.updated.Equal(entry.updated) && flushedEntry.LastUpdated.Equal(entry.LastUpdated) {
+			entry.dirty = false
+		}
+	}
+	a.evictEntries()
+	return nil
+}
+
+// GetRegistrySnapshot returns a copy of the registry in its current state
+func (a *Auditor) GetRegistrySnapshot() map[string]RegistryEntry {
+	return a.readOnlyRegistryCopy(a.registry)
 }
 
 // GetLastCommitedOffset returns the last commited offset for a given identifier
 func (a *Auditor) GetLastCommitedOffset(identifier string) (int64, int) {
 	r := a.readOnlyRegistryCopy(a.registry)
 	entry, ok := r[identifier]
-	if !ok {
+	if !ok || entry.Kind == META_ENTRY {
 		return 0, os.SEEK_END
 	}
 	return entry.Offset, os.SEEK_CUR
 }
 
+// GetLastCommitedLine returns the number of lines before the last commited offset
+// for a given identifier, zero when it is unknown
+func (a *Auditor) GetLastCommitedLine(identifier string) int64 {
+	r := a.readOnlyRegistryCopy(a.registry)
+	entry, ok := r[identifier]
+	if !ok || entry.Kind == META_ENTRY {
+		return 0
+	}
+	return entry.Line
+}
+
 // GetLastCommitedTimestamp returns the last commited offset for a given identifier
 func (a *Auditor) GetLastCommitedTimestamp(identifier string) string {
 	r := a.readOnlyRegistryCopy(a.registry)
 	entry, ok := r[identifier]
-	if !ok {
+	if !ok || entry.Kind == META_ENTRY {
 		return ""
 	}
 	return entry.Timestamp
 }
 
-// cleanupRegistry removes expired entries from the registry
+// cleanupRegistry removes expired entries from the registry, each kind of entry
+// has its own time to live, unless its key embeds a date
 func (a *Auditor) cleanupRegistry(registry map[string]*RegistryEntry) {
-	expireBefore := time.Now().UTC().Add(-a.entryTTL)
+	now := a.clock.Now()
 	a.registryMutex.Lock()
 	defer a.registryMutex.Unlock()
 	for path, entry := range registry {
-		if entry.LastUpdated.Before(expireBefore) {
+		if a.isExpired(path, entry, now) {
 			delete(registry, path)
+			a.recency.remove(path)
 		}
 	}
 }
 
+// entryTTL returns the time to live of an entry, entries written
+// before kinds were introduced are expired like offsets
+func (a *Auditor) entryTTL(entry *RegistryEntry) time.Duration {
+	ttl, ok := a.entryTTLs[entry.Kind]
+	if !ok {
+		return a.entryTTLs[OFFSET_ENTRY]
+	}
+	return ttl
+}
+
 // JsonRegistry represents the registry that will be written on disk
 type JsonRegistry struct {
 	Version  int
 	Registry map[string]RegistryEntry
+	Checksum string
+}
+
+// rawJsonRegistry gives access to the registry payload as it is
+// written on disk, to compute its checksum
+type rawJsonRegistry struct {
+	Version  int
+	Registry json.RawMessage
+	Checksum string
+}
+
+// registryChecksum returns the checksum of a marshaled registry payload
+func registryChecksum(payload []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload))
 }
 
 // marshalRegistry marshals a registry
-func (a *Auditor) marshalRegistry(registry map[string]RegistryEntry) ([]byte, error) {
-	r := JsonRegistry{
-		Version:  1,
-		Registry: registry,
+func marshalRegistry(registry map[string]RegistryEntry) ([]byte, error) {
+	payload, err := json.Marshal(registry)
+	if err != nil {
+		return nil, err
+	}
+	r := rawJsonRegistry{
+		Version:  registryVersion,
+		Registry: payload,
+		Checksum: registryChecksum(payload),
 	}
 	return json.Marshal(r)
 }
 
-// unmarshalRegistry unmarshals a registry
-func (a *Auditor) unmarshalRegistry(b []byte) (map[string]*RegistryEntry, error) {
+// unmarshalRegistry unmarshals a registry, and returns an error
+// if its content does not match its checksum
+func unmarshalRegistry(b []byte) (map[string]*RegistryEntry, error) {
+	var raw rawJsonRegistry
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	// registries written before checksums were introduced don't have one
+	if raw.Checksum != "" && raw.Checksum != registryChecksum(raw.Registry) {
+		return nil, fmt.Errorf("registry checksum mismatch")
+	}
 	var r JsonRegistry
-	err := json.Unmarshal(b, &r)
+	err = json.Unmarshal(b, &r)
 	if err != nil {
 		return nil, err
 	}
 	registry := make(map[string]*RegistryEntry)
-	if r.Version == 1 {
+	// from v1 to v2, entries got their metadata
+	if r.Version == 1 || r.Version == 2 {
 		for path, entry := range r.Registry {
 			newEntry := entry
 			registry[path] = &newEntry
 		}
 	} else if r.Version == 0 {
-		return a.unmarshalRegistryV0(b)
+		return unmarshalRegistryV0(b)
 	}
 	return registry, nil
 }
@@ -230,7 +763,7 @@ type JsonRegistryV0 struct {
 	Registry map[string]RegistryEntryV0
 }
 
-func (a *Auditor) unmarshalRegistryV0(b []byte) (map[string]*RegistryEntry, error) {
+func unmarshalRegistryV0(b []byte) (map[string]*RegistryEntry, error) {
 	var r JsonRegistryV0
 	err := json.Unmarshal(b, &r)
 	if err != nil {
@@ -6,14 +6,22 @@
 package auditor
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/DataDog/datadog-log-agent/pkg/wal"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -41,7 +49,7 @@ func (suite *AuditorTestSuite) SetupTest() {
 
 	suite.inputChan = make(chan message.Message)
 	suite.a = New(suite.inputChan)
-	suite.a.registryPath = suite.testPath
+	suite.a.registryStore = NewFileRegistryStore(suite.testPath)
 	suite.source = &config.IntegrationConfigLogSource{Path: testpath}
 }
 
@@ -52,15 +60,17 @@ func (suite *AuditorTestSuite) TearDownTest() {
 func (suite *AuditorTestSuite) TestAuditorUpdatesRegistry() {
 	suite.a.registry = make(map[string]*RegistryEntry)
 	suite.Equal(0, len(suite.a.registry))
-	suite.a.updateRegistry(suite.source.Path, 42, "")
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
 	suite.Equal(1, len(suite.a.registry))
 	suite.Equal(int64(42), suite.a.registry[suite.source.Path].Offset)
 	suite.Equal("", suite.a.registry[suite.source.Path].Timestamp)
-	suite.a.updateRegistry(suite.source.Path, 43, "")
+	suite.a.updateRegistry(suite.source.Path, 43, "", 0)
 	suite.Equal(int64(43), suite.a.registry[suite.source.Path].Offset)
 	ts := time.Now().UTC().Format("2006-01-02T15:04:05.000000")
-	suite.a.updateRegistry("containerid", 0, ts)
+	suite.a.updateRegistry("containerid", 0, ts, 0)
 	suite.Equal(ts, suite.a.registry["containerid"].Timestamp)
+	suite.Equal(TIMESTAMP_ENTRY, suite.a.registry["containerid"].Kind)
+	suite.Equal(OFFSET_ENTRY, suite.a.registry[suite.source.Path].Kind)
 }
 
 func (suite *AuditorTestSuite) TestAuditorFlushesAndRecoversRegistry() {
@@ -69,16 +79,78 @@ func (suite *AuditorTestSuite) TestAuditorFlushesAndRecoversRegistry() {
 		LastUpdated: time.Date(2006, time.January, 12, 1, 1, 1, 1, time.UTC),
 		Offset:      42,
 	}
-	suite.a.flushRegistry(suite.a.registry, suite.testPath)
+	suite.a.flushRegistry(suite.a.registry)
 	r, err := ioutil.ReadFile(suite.testPath)
 	suite.Nil(err)
-	suite.Equal("{\"Version\":1,\"Registry\":{\"testpath\":{\"Timestamp\":\"\",\"Offset\":42,\"LastUpdated\":\"2006-01-12T01:01:01.000000001Z\"}}}", string(r))
+	suite.Equal("{\"Version\":2,\"Registry\":{\"testpath\":{\"Timestamp\":\"\",\"Offset\":42,\"LastUpdated\":\"2006-01-12T01:01:01.000000001Z\"}},\"Checksum\":\"db636ef3\"}", string(r))
 
 	suite.a.registry = make(map[string]*RegistryEntry)
-	suite.a.registry = suite.a.recoverRegistry(suite.testPath)
+	suite.a.registry = suite.a.registryStore.Recover()
 	suite.Equal(int64(42), suite.a.registry[suite.source.Path].Offset)
 }
 
+func (suite *AuditorTestSuite) TestAuditorRetriesToRecoverRegistry() {
+	suite.a.registry = map[string]*RegistryEntry{suite.source.Path: {Offset: 42}}
+	suite.Nil(suite.a.flushRegistry(suite.a.registry))
+
+	// the run_path is not mounted yet on the first reads
+	store := NewFileRegistryStore(suite.testPath)
+	store.recoveryRetries = 3
+	store.recoveryBackoff = time.Millisecond
+	reads := 0
+	store.readFile = func(path string) ([]byte, error) {
+		reads++
+		if reads < 3 {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.ReadFile(path)
+	}
+	suite.Equal(int64(42), store.Recover()[suite.source.Path].Offset)
+	suite.Equal(3, reads)
+
+	// the registry starts empty once the retries are exhausted
+	reads = 0
+	store.readFile = func(path string) ([]byte, error) {
+		reads++
+		return nil, fmt.Errorf("transport endpoint is not connected")
+	}
+	suite.Equal(0, len(store.Recover()))
+	suite.Equal(4, reads)
+
+	// a read that hangs counts as a failed attempt
+	store.recoveryRetries = 0
+	store.recoveryTimeout = time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	store.readFile = func(path string) ([]byte, error) {
+		<-block
+		return nil, nil
+	}
+	suite.Equal(0, len(store.Recover()))
+}
+
+func (suite *AuditorTestSuite) TestAuditorResetsTamperedRegistry() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.registry[suite.source.Path] = &RegistryEntry{Offset: 42}
+	suite.a.flushRegistry(suite.a.registry)
+
+	r, err := ioutil.ReadFile(suite.testPath)
+	suite.Nil(err)
+	tampered := strings.Replace(string(r), "\"Offset\":42", "\"Offset\":46", 1)
+	suite.NotEqual(string(r), tampered)
+	err = ioutil.WriteFile(suite.testPath, []byte(tampered), 0644)
+	suite.Nil(err)
+
+	_, err = unmarshalRegistry([]byte(tampered))
+	suite.NotNil(err)
+	suite.Equal(0, len(suite.a.registryStore.Recover()))
+
+	backup, err := ioutil.ReadFile(fmt.Sprintf("%s.corrupted", suite.testPath))
+	suite.Nil(err)
+	suite.Equal(tampered, string(backup))
+	os.Remove(fmt.Sprintf("%s.corrupted", suite.testPath))
+}
+
 func (suite *AuditorTestSuite) TestAuditorRecoversRegistryForOffset() {
 	suite.a.registry = make(map[string]*RegistryEntry)
 	suite.a.registry[suite.source.Path] = &RegistryEntry{
@@ -118,7 +190,7 @@ func (suite *AuditorTestSuite) TestAuditorCleansupRegistry() {
 		LastUpdated: time.Now().UTC(),
 		Offset:      43,
 	}
-	suite.a.flushRegistry(suite.a.registry, suite.testPath)
+	suite.a.flushRegistry(suite.a.registry)
 	suite.Equal(2, len(suite.a.registry))
 
 	suite.a.cleanupRegistry(suite.a.registry)
@@ -126,6 +198,250 @@ func (suite *AuditorTestSuite) TestAuditorCleansupRegistry() {
 	suite.Equal(int64(43), suite.a.registry[otherpath].Offset)
 }
 
+func (suite *AuditorTestSuite) TestAuditorCleansupRegistryPerKind() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.entryTTLs = map[string]time.Duration{
+		OFFSET_ENTRY:    time.Hour,
+		TIMESTAMP_ENTRY: 3 * time.Hour,
+	}
+	lastUpdated := time.Now().UTC().Add(-2 * time.Hour)
+	suite.a.registry[suite.source.Path] = &RegistryEntry{
+		LastUpdated: lastUpdated,
+		Offset:      42,
+		Kind:        OFFSET_ENTRY,
+	}
+	suite.a.registry["containerid"] = &RegistryEntry{
+		LastUpdated: lastUpdated,
+		Timestamp:   lastUpdated.Format("2006-01-02T15:04:05.000000"),
+		Kind:        TIMESTAMP_ENTRY,
+	}
+
+	suite.a.cleanupRegistry(suite.a.registry)
+	suite.Equal(1, len(suite.a.registry))
+	suite.NotNil(suite.a.registry["containerid"])
+}
+
+func (suite *AuditorTestSuite) TestAuditorCleansupDatedKeysByTheirDate() {
+	now := time.Date(2024, time.June, 2, 10, 0, 0, 0, time.Local)
+	suite.a.clock = clock.NewMock(now)
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.entryTTLs = map[string]time.Duration{OFFSET_ENTRY: time.Hour}
+	suite.a.keyDatePattern = regexp.MustCompile(`/logs/(\d{4}-\d{2}-\d{2})/`)
+	suite.a.keyDateLayout = "2006-01-02"
+	suite.a.keyMaxAge = 24 * time.Hour
+
+	quiet := now.Add(-2 * time.Hour)
+	suite.a.registry["file:/logs/2024-06-01/app.log"] = &RegistryEntry{LastUpdated: now, Offset: 42}
+	suite.a.registry["file:/logs/2024-06-02/app.log"] = &RegistryEntry{LastUpdated: quiet, Offset: 43}
+	suite.a.registry["file:/var/log/app.log"] = &RegistryEntry{LastUpdated: quiet, Offset: 44}
+
+	suite.a.cleanupRegistry(suite.a.registry)
+	// yesterday's file is removed even though it was just updated, while
+	// today's file is kept even though it has been quiet for longer than its ttl
+	suite.Equal(1, len(suite.a.registry))
+	suite.Equal(int64(43), suite.a.registry["file:/logs/2024-06-02/app.log"].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorSetsAndGetsMeta() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.Equal("", suite.a.GetMeta(suite.source.Path, "generation"))
+
+	// metadata set before any commit doesn't make the source resume
+	suite.a.SetMeta(suite.source.Path, "generation", "3")
+	suite.Equal("3", suite.a.GetMeta(suite.source.Path, "generation"))
+	_, whence := suite.a.GetLastCommitedOffset(suite.source.Path)
+	suite.Equal(os.SEEK_END, whence)
+
+	// commits keep the metadata
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
+	suite.a.SetMeta(suite.source.Path, "target", "/var/log/app-2.log")
+	suite.Equal("3", suite.a.GetMeta(suite.source.Path, "generation"))
+	suite.Equal("/var/log/app-2.log", suite.a.GetMeta(suite.source.Path, "target"))
+	offset, _ := suite.a.GetLastCommitedOffset(suite.source.Path)
+	suite.Equal(int64(42), offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorPersistsMeta() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
+	suite.a.SetMeta(suite.source.Path, "generation", "3")
+	suite.Nil(suite.a.flushRegistry(suite.a.registry))
+
+	r := suite.a.registryStore.Recover()
+	suite.Equal(int64(42), r[suite.source.Path].Offset)
+	suite.Equal(map[string]string{"generation": "3"}, r[suite.source.Path].Meta)
+}
+
+func (suite *AuditorTestSuite) TestAuditorCleanupSurvivesBackwardClockStep() {
+	mock := clock.NewMock(time.Now())
+	suite.a.clock = mock
+	suite.a.registry = make(map[string]*RegistryEntry)
+	// an entry recovered from disk, and one updated by this process
+	suite.a.registry["recovered"] = &RegistryEntry{LastUpdated: mock.Now().UTC(), Offset: 42}
+	suite.a.updateRegistry(suite.source.Path, 43, "", 0)
+	suite.a.registry["stale"] = &RegistryEntry{LastUpdated: mock.Now().UTC().Add(-2 * defaultTTL), Offset: 44}
+
+	// the clock steps three days backward
+	mock.Add(-72 * time.Hour)
+	suite.a.cleanupRegistry(suite.a.registry)
+	suite.Equal(3, len(suite.a.registry))
+
+	mock.Add(72 * time.Hour)
+	suite.a.cleanupRegistry(suite.a.registry)
+	suite.Equal(2, len(suite.a.registry))
+	suite.Nil(suite.a.registry["stale"])
+	suite.Equal(int64(43), suite.a.registry[suite.source.Path].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorEvictsOldestFlushedEntries() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.maxEntries = 3
+	mock := clock.NewMock(time.Now())
+	suite.a.clock = mock
+
+	// entries that are not flushed yet are never evicted
+	for i := 0; i < 5; i++ {
+		mock.Add(time.Second)
+		suite.a.updateRegistry(fmt.Sprintf("file:%d.log", i), int64(i), "", 0)
+	}
+	suite.Equal(5, len(suite.a.registry))
+	suite.Nil(suite.a.flushRegistry(suite.a.registry))
+	suite.Equal(3, len(suite.a.registry))
+	suite.Nil(suite.a.registry["file:0.log"])
+	suite.Nil(suite.a.registry["file:1.log"])
+
+	// past the cap, the least recently updated entries are evicted right away
+	mock.Add(time.Second)
+	suite.a.updateRegistry("file:2.log", 42, "", 0)
+	mock.Add(time.Second)
+	suite.a.updateRegistry("file:5.log", 5, "", 0)
+	suite.Equal(3, len(suite.a.registry))
+	suite.Nil(suite.a.registry["file:3.log"])
+	suite.Equal(int64(42), suite.a.registry["file:2.log"].Offset)
+	suite.NotNil(suite.a.registry["file:4.log"])
+	suite.NotNil(suite.a.registry["file:5.log"])
+}
+
+func (suite *AuditorTestSuite) TestAuditorEvictsOldestRecoveredEntries() {
+	now := time.Now()
+	suite.a.registry = map[string]*RegistryEntry{
+		"file:new.log":    {LastUpdated: now, Offset: 1},
+		"file:oldest.log": {LastUpdated: now.Add(-2 * time.Hour), Offset: 2},
+		"file:old.log":    {LastUpdated: now.Add(-time.Hour), Offset: 3},
+	}
+	suite.a.recency = newLRU(suite.a.registry)
+	suite.a.maxEntries = 3
+
+	suite.a.updateRegistry("file:other.log", 4, "", 0)
+	suite.Equal(3, len(suite.a.registry))
+	suite.Nil(suite.a.registry["file:oldest.log"])
+
+	suite.a.ResetOffset("file:old.log")
+	suite.a.updateRegistry("file:another.log", 5, "", 0)
+	suite.Equal(3, len(suite.a.registry))
+	suite.NotNil(suite.a.registry["file:new.log"])
+}
+
+func (suite *AuditorTestSuite) TestAuditorReportsUnwritableRunPath() {
+	readOnlyDir := fmt.Sprintf("%s/readonly", suite.testDir)
+	suite.Nil(os.MkdirAll(readOnlyDir, 0555))
+	defer os.RemoveAll(readOnlyDir)
+	// a run_path that is a file can't be written either, even by root
+	notADir := fmt.Sprintf("%s/notadir", suite.testDir)
+	suite.Nil(ioutil.WriteFile(notADir, nil, 0644))
+	defer os.Remove(notADir)
+
+	runPaths := []string{notADir}
+	if os.Geteuid() != 0 {
+		runPaths = append(runPaths, readOnlyDir)
+	}
+	for _, runPath := range runPaths {
+		metrics.RegistryFlushErrors.Set(0)
+		a := New(nil)
+		a.registryStore = NewFileRegistryStore(fmt.Sprintf("%s/registry.json", runPath))
+		a.Start()
+		suite.NotNil(a.Health())
+
+		a.flushRegistryAndReport()
+		suite.NotNil(a.Health())
+		suite.Equal(int64(1), metrics.RegistryFlushErrors.Value())
+		a.Stop()
+	}
+
+	// the auditor is healthy again once the registry can be saved
+	a := New(nil)
+	a.registryStore = NewFileRegistryStore(suite.testPath)
+	a.setFlushError(fmt.Errorf("permission denied"))
+	a.Start()
+	a.flushRegistryAndReport()
+	suite.Nil(a.Health())
+	a.Stop()
+}
+
+func (suite *AuditorTestSuite) TestAuditorFlushWritesRegistryRightAway() {
+	suite.a.flushPeriod = time.Millisecond
+	suite.a.Start()
+	defer suite.a.Stop()
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
+
+	// flushes can run concurrently with the periodic ones
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() { done <- suite.a.Flush() }()
+	}
+	for i := 0; i < 5; i++ {
+		suite.Nil(<-done)
+	}
+
+	suite.Nil(suite.a.Flush())
+	content, err := ioutil.ReadFile(suite.testPath)
+	suite.Nil(err)
+	r, err := unmarshalRegistry(content)
+	suite.Nil(err)
+	suite.Equal(int64(42), r[suite.source.Path].Offset)
+}
+
+// slowRegistryStore is a file registry store whose flushes take flushDuration on a mock clock
+type slowRegistryStore struct {
+	*FileRegistryStore
+	clock         *clock.Mock
+	flushDuration time.Duration
+}
+
+func (s *slowRegistryStore) Flush(registry map[string]RegistryEntry) error {
+	s.clock.Add(s.flushDuration)
+	return s.FileRegistryStore.Flush(registry)
+}
+
+func (suite *AuditorTestSuite) TestAuditorMeasuresFlushes() {
+	metrics.RegistryFlushDuration.Reset()
+	metrics.RegistrySize.Set(0)
+	mock := clock.NewMock(time.Now())
+	store := &slowRegistryStore{FileRegistryStore: NewFileRegistryStore(suite.testPath), clock: mock, flushDuration: 50 * time.Millisecond}
+	suite.a.registryStore = store
+	suite.a.clock = mock
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
+
+	suite.Nil(suite.a.Flush())
+	suite.Equal(int64(1), metrics.RegistryFlushDuration.Count())
+	suite.Contains(metrics.RegistryFlushDuration.String(), `"0.1":1`)
+	info, err := os.Stat(suite.testPath)
+	suite.Nil(err)
+	suite.Equal(info.Size(), metrics.RegistrySize.Value())
+	suite.Nil(suite.a.Health())
+
+	// the auditor is unhealthy while flushes are too long
+	store.flushDuration = 2 * suite.a.maxFlushDuration
+	suite.Nil(suite.a.Flush())
+	suite.Equal(int64(2), metrics.RegistryFlushDuration.Count())
+	suite.NotNil(suite.a.Health())
+
+	store.flushDuration = 0
+	suite.Nil(suite.a.Flush())
+	suite.Nil(suite.a.Health())
+}
+
 func (suite *AuditorTestSuite) TestAuditorUnmarshalRegistryV0() {
 	input := `{
 	    "Registry": {
@@ -142,7 +458,7 @@ func (suite *AuditorTestSuite) TestAuditorUnmarshalRegistryV0() {
 	    },
 	    "Version": 0
 	}`
-	r, err := suite.a.unmarshalRegistry([]byte(input))
+	r, err := unmarshalRegistry([]byte(input))
 	suite.Nil(err)
 	suite.Equal(r["file:path1.log"].Offset, int64(1))
 	suite.Equal(r["file:path1.log"].LastUpdated.Second(), 1)
@@ -166,7 +482,7 @@ func (suite *AuditorTestSuite) TestAuditorUnmarshalRegistryV1() {
 	    },
 	    "Version": 1
 	}`
-	r, err := suite.a.unmarshalRegistry([]byte(input))
+	r, err := unmarshalRegistry([]byte(input))
 	suite.Nil(err)
 	suite.Equal(r["path1.log"].Offset, int64(1))
 	suite.Equal(r["path1.log"].LastUpdated.Second(), 1)
@@ -177,6 +493,450 @@ func (suite *AuditorTestSuite) TestAuditorUnmarshalRegistryV1() {
 	suite.Equal(r["path2.log"].Timestamp, "2006-01-12T01:01:03.000000001Z")
 }
 
+func (suite *AuditorTestSuite) TestAuditorStopCommitsAndFlushes() {
+	inputChan := make(chan message.Message, 10)
+	a := New(inputChan)
+	a.registryStore = NewFileRegistryStore(suite.testPath)
+	a.Start()
+
+	for _, offset := range []int64{10, 20, 30} {
+		msg := message.NewFileMessage(nil)
+		msgOrigin := message.NewOrigin()
+		msgOrigin.Identifier = suite.source.Path
+		msgOrigin.Offset = offset
+		msg.SetOrigin(msgOrigin)
+		inputChan <- msg
+	}
+	a.Stop()
+	a.Stop()
+
+	r := a.registryStore.Recover()
+	suite.Equal(int64(30), r[suite.source.Path].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorDrainsItsClosedInputBeforeTheLastFlush() {
+	inputChan := make(chan message.Message, 10)
+	a := New(inputChan)
+	a.registryStore = NewFileRegistryStore(suite.testPath)
+	a.Start()
+
+	identifiers := []string{"file:a", "file:b", "file:c"}
+	for i, identifier := range identifiers {
+		msg := message.NewFileMessage(nil)
+		msg.SetOrigin(message.NewOriginBuilder().Identifier(identifier).Offset(int64(10 * (i + 1))).Build())
+		inputChan <- msg
+	}
+	close(inputChan)
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second):
+		suite.Fail("the auditor didn't stop once its input channel was closed")
+	}
+	// stopping it again waits for the same flush
+	a.Stop()
+
+	r := a.registryStore.Recover()
+	for i, identifier := range identifiers {
+		suite.Equal(int64(10*(i+1)), r[identifier].Offset)
+	}
+}
+
+func (suite *AuditorTestSuite) TestAuditorCommitsBatches() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	messages := []message.Message{}
+	for i, identifier := range []string{"file:a", "file:b", "file:a"} {
+		msg := message.NewFileMessage(nil)
+		msgOrigin := message.NewOrigin()
+		msgOrigin.Identifier = identifier
+		msgOrigin.Offset = int64(10 * (i + 1))
+		msg.SetOrigin(msgOrigin)
+		messages = append(messages, msg)
+	}
+	suite.a.handleMessage(message.NewMessageBatch(messages))
+	suite.Equal(int64(30), suite.a.registry["file:a"].Offset)
+	suite.Equal(int64(20), suite.a.registry["file:b"].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorRecordsTheHeartbeatsWithoutCommittingThem() {
+	mock := clock.NewMock(time.Now())
+	suite.a.clock = mock
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.True(suite.a.GetLastHeartbeat("file:a").IsZero())
+
+	heartbeat := message.NewHeartbeatMessage([]byte("tailer healthy at offset 42"))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = "file:a"
+	msgOrigin.Offset = 42
+	heartbeat.SetOrigin(msgOrigin)
+	suite.a.handleMessage(heartbeat)
+	suite.Equal(mock.Now(), suite.a.GetLastHeartbeat("file:a"))
+	suite.Equal(0, len(suite.a.registry))
+
+	// the heartbeats are forgotten like the offsets
+	mock.Add(defaultTTL)
+	suite.a.cleanupHeartbeats()
+	suite.True(suite.a.GetLastHeartbeat("file:a").IsZero())
+}
+
+func (suite *AuditorTestSuite) TestAuditorAcksCommitedMessagesInWAL() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.walPath = fmt.Sprintf("%s/wal.log", suite.testDir)
+	suite.a.walBytes = 1024
+	defer os.Remove(suite.a.walPath)
+	w := suite.a.WAL()
+	suite.NotNil(w)
+	seq, err := w.Append("tcp:10514", []byte("hello"))
+	suite.Nil(err)
+
+	msg := message.NewNetworkMessage([]byte("hello"))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.WALSeq = seq
+	msg.SetOrigin(msgOrigin)
+	suite.a.handleMessage(msg)
+	suite.Nil(w.Close())
+
+	w, err = wal.Open(suite.a.walPath, suite.a.walBytes)
+	suite.Nil(err)
+	defer w.Close()
+	suite.Equal(0, len(w.Recovered("tcp:10514")))
+}
+
+func (suite *AuditorTestSuite) TestAuditorOnlyCommitsTheContiguousMessagesOfAStream() {
+	metrics.FencedMessages.Set(0)
+	metrics.OffsetRegressions.Set(0)
+	ack := func(seq uint64) {
+		msg := message.NewFileMessage(nil)
+		msg.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(int64(10*seq)).Seq(7, seq).Build())
+		suite.a.handleMessage(msg)
+	}
+	offset := func() int64 {
+		offset, _ := suite.a.GetLastCommitedOffset(suite.source.Path)
+		return offset
+	}
+	suite.a.registry = make(map[string]*RegistryEntry)
+
+	ack(1)
+	suite.Equal(int64(10), offset())
+
+	// the messages acknowledged past a gap are held back
+	ack(3)
+	ack(5)
+	suite.Equal(int64(10), offset())
+	suite.Equal(int64(2), metrics.FencedMessages.Value())
+
+	// the gap is filled, the offset moves to the next one
+	ack(2)
+	suite.Equal(int64(30), offset())
+	ack(4)
+	suite.Equal(int64(50), offset())
+	suite.Equal(int64(0), metrics.FencedMessages.Value())
+	suite.Equal(int64(0), metrics.OffsetRegressions.Value())
+
+	// the fence is forgotten once the stream ended and all its messages are commited
+	suite.a.EndStream(7, 6)
+	suite.Equal(1, len(suite.a.fences))
+	ack(6)
+	suite.Equal(int64(60), offset())
+	suite.Equal(0, len(suite.a.fences))
+}
+
+func (suite *AuditorTestSuite) TestAuditorSkipsTheMessagesOfAStreamNeverCommited() {
+	metrics.FencedMessages.Set(0)
+	mock := clock.NewMock(time.Now())
+	suite.a.clock = mock
+	ack := func(seq uint64) {
+		msg := message.NewFileMessage(nil)
+		msg.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(int64(10*seq)).Seq(8, seq).Build())
+		suite.a.handleMessage(msg)
+	}
+	offset := func() int64 {
+		offset, _ := suite.a.GetLastCommitedOffset(suite.source.Path)
+		return offset
+	}
+	suite.a.registry = make(map[string]*RegistryEntry)
+
+	// the second message is dropped mid-stream and never commited
+	ack(1)
+	ack(3)
+	mock.Add(time.Minute)
+	ack(4)
+	suite.Equal(int64(10), offset())
+	suite.Equal(int64(2), metrics.FencedMessages.Value())
+
+	// the gap is skipped once the messages after it were held back for too long
+	mock.Add(fenceTimeout)
+	ack(5)
+	suite.Equal(int64(50), offset())
+	suite.Equal(int64(0), metrics.FencedMessages.Value())
+	ack(6)
+	suite.Equal(int64(60), offset())
+
+	// a message of the gap received late doesn't move the offset back,
+	// its bytes are no longer in flight
+	metrics.InFlightBytes.Set(0)
+	msg := message.NewFileMessage([]byte("late"))
+	msg.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(20).Seq(8, 2).InFlightBytes(4).Build())
+	metrics.InFlightBytes.Add(4)
+	suite.a.handleMessage(msg)
+	suite.Equal(int64(60), offset())
+	suite.Equal(int64(0), metrics.InFlightBytes.Value())
+
+	// the fence is kept until no message of the gap is expected anymore
+	suite.a.EndStream(8, 6)
+	suite.Equal(1, len(suite.a.fences))
+	mock.Add(fenceTimeout)
+	suite.a.cleanupFences()
+	suite.Equal(0, len(suite.a.fences))
+}
+
+func (suite *AuditorTestSuite) TestAuditorForgetsTheFencesOfEndedStreams() {
+	metrics.FencedMessages.Set(0)
+	mock := clock.NewMock(time.Now())
+	suite.a.clock = mock
+	suite.a.registry = make(map[string]*RegistryEntry)
+	msg := message.NewFileMessage(nil)
+	msg.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(20).Seq(9, 2).Build())
+	suite.a.handleMessage(msg)
+	suite.a.EndStream(9, 2)
+	live := message.NewFileMessage(nil)
+	live.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(10).Seq(10, 1).Build())
+	suite.a.handleMessage(live)
+
+	// the first message of the ended stream was lost, the one after it is never commited
+	mock.Add(fenceTimeout)
+	suite.a.cleanupFences()
+	suite.Equal(1, len(suite.a.fences))
+	suite.NotNil(suite.a.fences[10])
+	suite.Equal(int64(0), metrics.FencedMessages.Value())
+	offset, _ := suite.a.GetLastCommitedOffset(suite.source.Path)
+	suite.Equal(int64(10), offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorWarnsAboutOffsetRegressions() {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	metrics.OffsetRegressions.Set(0)
+	commit := func(offset int64, reset bool) {
+		msg := message.NewFileMessage(nil)
+		msg.SetOrigin(message.NewOriginBuilder().Identifier(suite.source.Path).Offset(offset).OffsetReset(reset).Build())
+		suite.a.handleMessage(msg)
+	}
+	suite.a.registry = make(map[string]*RegistryEntry)
+	commit(42, false)
+
+	// the file was truncated, the offset goes back legitimately
+	commit(10, true)
+	suite.Equal(int64(10), suite.a.registry[suite.source.Path].Offset)
+	suite.Equal(int64(0), metrics.OffsetRegressions.Value())
+	suite.Equal("", logs.String())
+
+	// an unexplained regression is reported, and accepted by default
+	commit(5, false)
+	suite.Equal(int64(5), suite.a.registry[suite.source.Path].Offset)
+	suite.Equal(int64(1), metrics.OffsetRegressions.Value())
+	suite.Contains(logs.String(), "goes back from 10 to 5")
+
+	// or rejected
+	logs.Reset()
+	suite.a.rejectOffsetRegressions = true
+	commit(3, false)
+	commit(4, false)
+	suite.Equal(int64(5), suite.a.registry[suite.source.Path].Offset)
+	suite.Equal(int64(3), metrics.OffsetRegressions.Value())
+	suite.Equal(1, strings.Count(logs.String(), "goes back"))
+	commit(6, false)
+	suite.Equal(int64(6), suite.a.registry[suite.source.Path].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorResetsOffset() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.updateRegistry("file:a.log", 42, "", 0)
+	suite.a.updateRegistry("file:b.log", 42, "", 0)
+	suite.a.SetMeta("file:b.log", "generation", "3")
+
+	suite.a.ResetOffset("file:a.log")
+	suite.a.ResetOffset("file:b.log")
+	suite.a.ResetOffset("file:unknown.log")
+	_, whence := suite.a.GetLastCommitedOffset("file:a.log")
+	suite.Equal(os.SEEK_END, whence)
+	_, ok := suite.a.registry["file:a.log"]
+	suite.False(ok)
+	_, whence = suite.a.GetLastCommitedOffset("file:b.log")
+	suite.Equal(os.SEEK_END, whence)
+	suite.Equal("3", suite.a.GetMeta("file:b.log", "generation"))
+}
+
+func (suite *AuditorTestSuite) TestAuditorSendsCommitEventsOnFlush() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.commitEventsSize = 2
+	events := suite.a.Subscribe()
+	suite.a.updateRegistry("file:b.log", 42, "", 0)
+	suite.a.updateRegistry("file:a.log", 12, "", 0)
+	suite.a.SetMeta("file:c.log", "generation", "3")
+	// nothing is sent until the offsets are flushed
+	suite.Equal(0, len(events))
+
+	suite.Nil(suite.a.Flush())
+	suite.Equal(2, len(events))
+	event := <-events
+	suite.Equal("file:a.log", event.Identifier)
+	suite.Equal(int64(12), event.Offset)
+	event = <-events
+	suite.Equal("file:b.log", event.Identifier)
+	suite.Equal(int64(42), event.Offset)
+
+	// only the offsets commited since the previous flush are sent
+	suite.a.updateRegistry("file:a.log", 24, "", 0)
+	suite.Nil(suite.a.Flush())
+	suite.Equal(1, len(events))
+	event = <-events
+	suite.Equal("file:a.log", event.Identifier)
+	suite.Equal(int64(24), event.Offset)
+
+	// a full channel doesn't block the flush
+	for i := 0; i < 3; i++ {
+		suite.a.updateRegistry(fmt.Sprintf("file:%d.log", i), int64(i), "", 0)
+	}
+	dropped := metrics.CommitEventsDropped.Value()
+	suite.Nil(suite.a.Flush())
+	suite.Equal(2, len(events))
+	suite.Equal(dropped+1, metrics.CommitEventsDropped.Value())
+
+	// the channel is closed once the auditor is stopped
+	suite.a.Stop()
+	<-events
+	<-events
+	_, ok := <-events
+	suite.False(ok)
+}
+
+func (suite *AuditorTestSuite) TestAuditorIgnoresMessagesWithoutOrigin() {
+	suite.a.registry = make(map[string]*RegistryEntry)
+	suite.a.updateRegistry(suite.source.Path, 42, "", 0)
+	suite.NotPanics(func() {
+		suite.a.handleMessage(message.NewFileMessage([]byte("hello")))
+		suite.a.handleMessage(message.NewStopMessage())
+	})
+	suite.Equal(1, len(suite.a.registry))
+	suite.Equal(int64(42), suite.a.registry[suite.source.Path].Offset)
+}
+
+func (suite *AuditorTestSuite) TestAuditorInMemoryRegistry() {
+	os.Remove(suite.testPath)
+	inputChan := make(chan message.Message, 10)
+	a := New(inputChan)
+	a.registryStore = NewRegistryStore(MEMORY_REGISTRY, suite.testPath)
+	a.Start()
+
+	msg := message.NewFileMessage(nil)
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = suite.source.Path
+	msgOrigin.Offset = 42
+	msg.SetOrigin(msgOrigin)
+	inputChan <- msg
+	a.Stop()
+
+	offset, whence := a.GetLastCommitedOffset(suite.source.Path)
+	suite.Equal(int64(42), offset)
+	suite.Equal(os.SEEK_CUR, whence)
+	_, err := os.Stat(suite.testPath)
+	suite.True(os.IsNotExist(err))
+	suite.Equal(0, len(a.registryStore.Recover()))
+}
+
+func (suite *AuditorTestSuite) TestShardedRegistryStoreAssignsShards() {
+	s := NewShardedRegistryStore(suite.testPath, 4)
+	other := NewShardedRegistryStore(suite.testPath, 4)
+	suite.Equal(fmt.Sprintf("%s/auditor-0.json", suite.testDir), s.shards[0].path)
+	shards := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		identifier := fmt.Sprintf("file:/var/log/%d.log", i)
+		shard := s.shardOf(identifier)
+		suite.Equal(shard, s.shardOf(identifier))
+		suite.Equal(shard, other.shardOf(identifier))
+		shards[shard] = true
+	}
+	suite.Equal(4, len(shards))
+}
+
+func (suite *AuditorTestSuite) TestShardedRegistryStoreFlushesAndRecoversShards() {
+	s := NewShardedRegistryStore(suite.testPath, 4)
+	for _, shard := range s.shards {
+		defer os.Remove(shard.path)
+	}
+	registry := make(map[string]RegistryEntry)
+	for i := 0; i < 20; i++ {
+		registry[fmt.Sprintf("file:%d.log", i)] = RegistryEntry{Offset: int64(i), Kind: OFFSET_ENTRY}
+	}
+	suite.Nil(s.Flush(registry))
+
+	// only the shard of the updated entry is rewritten
+	for _, shard := range s.shards {
+		suite.Nil(os.Remove(shard.path))
+	}
+	registry["file:3.log"] = RegistryEntry{Offset: 42, Kind: OFFSET_ENTRY}
+	suite.Nil(s.Flush(registry))
+	for i, shard := range s.shards {
+		_, err := os.Stat(shard.path)
+		suite.Equal(i == s.shardOf("file:3.log"), err == nil)
+	}
+
+	// recovery merges all the shards
+	suite.Nil(NewShardedRegistryStore(suite.testPath, 4).Flush(registry))
+	r := NewShardedRegistryStore(suite.testPath, 4).Recover()
+	suite.Equal(20, len(r))
+	suite.Equal(int64(42), r["file:3.log"].Offset)
+	suite.Equal(int64(7), r["file:7.log"].Offset)
+}
+
+func (suite *AuditorTestSuite) TestMirroredRegistryStoreFallsBackToSecondaryWhenPrimaryIsCorrupt() {
+	primary := filepath.Join(suite.testDir, "primary.json")
+	secondary := filepath.Join(suite.testDir, "secondary.json")
+	defer os.Remove(secondary)
+	defer os.Remove(primary + ".corrupted")
+	s := NewMirroredRegistryStore([]string{primary, secondary})
+	registry := map[string]RegistryEntry{
+		"file:a.log": {Offset: 42, Kind: OFFSET_ENTRY, LastUpdated: time.Now().UTC()},
+	}
+	suite.Nil(s.Flush(registry))
+	for _, path := range []string{primary, secondary} {
+		mr, err := ioutil.ReadFile(path)
+		suite.Nil(err)
+		r, err := unmarshalRegistry(mr)
+		suite.Nil(err)
+		suite.Equal(int64(42), r["file:a.log"].Offset)
+	}
+
+	// the primary is corrupted by a flaky disk
+	suite.Nil(ioutil.WriteFile(primary, []byte(`{"Version":2,"Registry":{"file:a.log":{"Offset":1`), 0644))
+	r := NewMirroredRegistryStore([]string{primary, secondary}).Recover()
+	suite.Equal(int64(42), r["file:a.log"].Offset)
+	_, err := os.Stat(primary + ".corrupted")
+	suite.Nil(err)
+}
+
+func (suite *AuditorTestSuite) TestMirroredRegistryStoreRecoversNewestMirror() {
+	primary := filepath.Join(suite.testDir, "primary.json")
+	secondary := filepath.Join(suite.testDir, "secondary.json")
+	defer os.Remove(primary)
+	defer os.Remove(secondary)
+	now := time.Now().UTC()
+	suite.Nil(NewFileRegistryStore(primary).Flush(map[string]RegistryEntry{
+		"file:a.log": {Offset: 10, Kind: OFFSET_ENTRY, LastUpdated: now.Add(-time.Minute)},
+	}))
+	// the primary was not writable for a while, only the secondary kept up
+	suite.Nil(NewFileRegistryStore(secondary).Flush(map[string]RegistryEntry{
+		"file:a.log": {Offset: 20, Kind: OFFSET_ENTRY, LastUpdated: now},
+	}))
+	r := NewMirroredRegistryStore([]string{primary, secondary}).Recover()
+	suite.Equal(int64(20), r["file:a.log"].Offset)
+
+	// a missing mirror is ignored
+	r = NewMirroredRegistryStore([]string{filepath.Join(suite.testDir, "missing.json"), primary}).Recover()
+	suite.Equal(int64(10), r["file:a.log"].Offset)
+}
+
 func TestScannerTestSuite(t *testing.T) {
 	suite.Run(t, new(AuditorTestSuite))
 }
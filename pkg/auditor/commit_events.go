@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// A CommitEvent reports an offset that was saved in the registry store
+type CommitEvent struct {
+	Identifier string
+	Offset     int64
+	Timestamp  string
+	// LastUpdated is when the offset was commited
+	LastUpdated time.Time
+}
+
+// Subscribe returns a channel receiving an event for each offset commited, once it is
+// saved in the registry store. A flush doesn't wait for the subscribers: the events
+// are dropped while the channel is full, the next flush reports the identifiers
+// commited since. The channel is closed once the auditor is stopped
+func (a *Auditor) Subscribe() <-chan CommitEvent {
+	a.subscribersMutex.Lock()
+	defer a.subscribersMutex.Unlock()
+	events := make(chan CommitEvent, a.commitEventsSize)
+	if a.subscribersClosed {
+		close(events)
+		return events
+	}
+	a.subscribers = append(a.subscribers, events)
+	return events
+}
+
+// publishCommits sends the events of the entries commited since the previous flush
+func (a *Auditor) publishCommits(flushed map[string]RegistryEntry) {
+	a.subscribersMutex.Lock()
+	defer a.subscribersMutex.Unlock()
+	if len(a.subscribers) == 0 {
+		return
+	}
+	identifiers := []string{}
+	for identifier, entry := range flushed {
+		if entry.dirty && entry.Kind != META_ENTRY {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	sort.Strings(identifiers)
+	for _, identifier := range identifiers {
+		entry := flushed[identifier]
+		event := CommitEvent{
+			Identifier:  identifier,
+			Offset:      entry.Offset,
+			Timestamp:   entry.Timestamp,
+			LastUpdated: entry.LastUpdated,
+		}
+		for _, events := range a.subscribers {
+			select {
+			case events <- event:
+			default:
+				metrics.CommitEventsDropped.Add(1)
+			}
+		}
+	}
+}
+
+// closeSubscribers closes the channels of the subscribers, no event is sent afterwards
+func (a *Auditor) closeSubscribers() {
+	a.subscribersMutex.Lock()
+	defer a.subscribersMutex.Unlock()
+	for _, events := range a.subscribers {
+		close(events)
+	}
+	a.subscribers = nil
+	a.subscribersClosed = true
+}
@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+const defaultKeyDateLayout = "2006-01-02"
+const defaultKeyMaxAge = 24 * time.Hour
+
+// newKeyDatePattern returns the pattern of the dates embedded in the registry keys,
+// or nil when the entries are only expired by their time to live
+func newKeyDatePattern() *regexp.Regexp {
+	pattern := config.LogsAgent.GetString("registry_key_date_pattern")
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println("Can't compile registry_key_date_pattern", pattern, ":", err)
+		return nil
+	}
+	return re
+}
+
+// keyDate returns the date embedded in a registry key, the first group of the
+// pattern when it has one, the whole match otherwise. It returns false when
+// the key has no date, its entry is then expired by its time to live
+func (a *Auditor) keyDate(key string) (time.Time, bool) {
+	if a.keyDatePattern == nil {
+		return time.Time{}, false
+	}
+	match := a.keyDatePattern.FindStringSubmatch(key)
+	if match == nil {
+		return time.Time{}, false
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	date, err := time.ParseInLocation(a.keyDateLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// isExpired returns true if the entry at key can be removed from the registry.
+// An entry whose key embeds a date is kept until the date is older than keyMaxAge,
+// however long ago it was updated: the file of the current day can go quiet,
+// while the files of the previous days are never written again
+func (a *Auditor) isExpired(key string, entry *RegistryEntry, now time.Time) bool {
+	if date, ok := a.keyDate(key); ok {
+		return now.Sub(date) > a.keyMaxAge
+	}
+	return entry.age(now) > a.entryTTL(entry)
+}
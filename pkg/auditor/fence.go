@@ -0,0 +1,168 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"log"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// A fence gives up on the messages of a gap once it held back maxFencedMessages
+// messages, or once it held them back for fenceTimeout: the messages of the gap
+// were lost, and the offsets of the stream would never move again otherwise
+const (
+	maxFencedMessages = 10000
+	fenceTimeout      = 5 * time.Minute
+)
+
+// A fence holds back the messages of a stream received before the ones
+// forwarded ahead of them, for instance when a destination acknowledges
+// them out of order: an offset is only commited once all the lines before
+// it are, so that a crash never leaves a gap of lines that were not sent
+type fence struct {
+	// next is the sequence number of the next message to commit
+	next    uint64
+	pending map[uint64]message.Message
+	// heldSince is when the first message held back behind the current gap was received
+	heldSince time.Time
+	// updated is when a message of the stream was last received, or when it ended
+	updated time.Time
+	// skipped is true once the fence gave up on a gap, the messages of the gap
+	// may still be received, they are then dropped instead of commited
+	skipped bool
+	// last is the sequence number of the last message of the stream once it ended
+	last  uint64
+	ended bool
+}
+
+// isDone returns true once all the messages of an ended stream were released,
+// and no message of a skipped gap can still be received
+func (f *fence) isDone() bool {
+	return f.ended && f.next > f.last && !f.skipped
+}
+
+// isAbandoned returns true when no message of the stream is expected anymore:
+// it ended, or it never received its first message, fenceTimeout ago
+func (f *fence) isAbandoned(now time.Time) bool {
+	return (f.ended || f.next == 1) && now.Sub(f.updated) >= fenceTimeout
+}
+
+// isStuck returns true when the fence must give up on the messages of its gap
+func (f *fence) isStuck(now time.Time) bool {
+	return len(f.pending) >= maxFencedMessages || now.Sub(f.heldSince) >= fenceTimeout
+}
+
+// firstPending returns the lowest sequence number held back
+func (f *fence) firstPending() uint64 {
+	var first uint64
+	for seq := range f.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+// getFence returns the fence of a stream, it must be called with fencesMutex held
+func (a *Auditor) getFence(stream uint64) *fence {
+	f, ok := a.fences[stream]
+	if !ok {
+		f = &fence{next: 1, pending: make(map[uint64]message.Message), updated: a.clock.Now()}
+		a.fences[stream] = f
+	}
+	return f
+}
+
+// release returns the messages that can be commited now that msg was received,
+// in the order of their stream. Messages that are not part of a stream are never held back
+func (a *Auditor) release(msg message.Message) []message.Message {
+	origin := msg.GetOrigin()
+	if origin.Stream == 0 || origin.Seq == 0 {
+		return []message.Message{msg}
+	}
+	a.fencesMutex.Lock()
+	defer a.fencesMutex.Unlock()
+	f := a.getFence(origin.Stream)
+	now := a.clock.Now()
+	f.updated = now
+	if origin.Seq < f.next {
+		// the message is part of a gap that was skipped, its offset
+		// is before the ones commited since and must not replace them
+		a.freeMessage(msg)
+		return nil
+	}
+	var released []message.Message
+	if origin.Seq == f.next {
+		released = append(released, msg)
+		f.next++
+	} else {
+		if len(f.pending) == 0 {
+			f.heldSince = now
+		}
+		f.pending[origin.Seq] = msg
+		metrics.FencedMessages.Add(1)
+		if !f.isStuck(now) {
+			return nil
+		}
+		first := f.firstPending()
+		log.Println("Can't commit the messages", f.next, "to", first-1, "of stream", origin.Stream, ", skipping them")
+		f.next = first
+		f.skipped = true
+	}
+	for {
+		next, ok := f.pending[f.next]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.next)
+		metrics.FencedMessages.Add(-1)
+		released = append(released, next)
+		f.next++
+	}
+	if len(f.pending) > 0 {
+		// a new gap starts
+		f.heldSince = now
+	}
+	if f.isDone() {
+		delete(a.fences, origin.Stream)
+	}
+	return released
+}
+
+// EndStream tells that last is the sequence number of the last message of stream,
+// its fence is forgotten once all the messages up to it were commited
+func (a *Auditor) EndStream(stream, last uint64) {
+	a.fencesMutex.Lock()
+	defer a.fencesMutex.Unlock()
+	f := a.getFence(stream)
+	f.last = last
+	f.ended = true
+	f.updated = a.clock.Now()
+	if f.isDone() {
+		delete(a.fences, stream)
+	}
+}
+
+// cleanupFences forgets the fences of the streams no message is expected from anymore,
+// the messages they still hold back are never commited, they are read again after a restart
+func (a *Auditor) cleanupFences() {
+	a.fencesMutex.Lock()
+	defer a.fencesMutex.Unlock()
+	now := a.clock.Now()
+	for stream, f := range a.fences {
+		if !f.isAbandoned(now) {
+			continue
+		}
+		for _, msg := range f.pending {
+			metrics.FencedMessages.Add(-1)
+			a.freeMessage(msg)
+		}
+		delete(a.fences, stream)
+	}
+}
@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"time"
+)
+
+// recordHeartbeat records that the source of identifier notified it is still healthy,
+// nothing is commited
+func (a *Auditor) recordHeartbeat(identifier string) {
+	if identifier == "" {
+		return
+	}
+	a.heartbeatsMutex.Lock()
+	defer a.heartbeatsMutex.Unlock()
+	a.heartbeats[identifier] = a.clock.Now()
+}
+
+// GetLastHeartbeat returns when the source of identifier last notified it was still
+// healthy while idle, the zero time when it didn't
+func (a *Auditor) GetLastHeartbeat(identifier string) time.Time {
+	a.heartbeatsMutex.Lock()
+	defer a.heartbeatsMutex.Unlock()
+	return a.heartbeats[identifier]
+}
+
+// cleanupHeartbeats forgets the heartbeats older than the time to live of the offsets
+func (a *Auditor) cleanupHeartbeats() {
+	now := a.clock.Now()
+	a.heartbeatsMutex.Lock()
+	defer a.heartbeatsMutex.Unlock()
+	for identifier, heartbeat := range a.heartbeats {
+		if now.Sub(heartbeat) >= a.entryTTLs[OFFSET_ENTRY] {
+			delete(a.heartbeats, identifier)
+		}
+	}
+}
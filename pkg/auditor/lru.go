@@ -0,0 +1,64 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"container/list"
+	"sort"
+)
+
+// An lru orders the identifiers of the registry from the least to the most
+// recently updated, so that the entries to evict are found without scanning
+// the registry
+type lru struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+// newLRU returns an lru of the entries of registry, ordered by their last update
+func newLRU(registry map[string]*RegistryEntry) *lru {
+	l := &lru{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+	identifiers := make([]string, 0, len(registry))
+	for identifier := range registry {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Slice(identifiers, func(i, j int) bool {
+		return registry[identifiers[i]].LastUpdated.Before(registry[identifiers[j]].LastUpdated)
+	})
+	for _, identifier := range identifiers {
+		l.touch(identifier)
+	}
+	return l
+}
+
+// touch makes identifier the most recently updated
+func (l *lru) touch(identifier string) {
+	if element, ok := l.elements[identifier]; ok {
+		l.order.MoveToBack(element)
+		return
+	}
+	l.elements[identifier] = l.order.PushBack(identifier)
+}
+
+// remove forgets identifier
+func (l *lru) remove(identifier string) {
+	if element, ok := l.elements[identifier]; ok {
+		l.order.Remove(element)
+		delete(l.elements, identifier)
+	}
+}
+
+// oldest returns the least recently updated identifier, false when there is none
+func (l *lru) oldest() (string, bool) {
+	element := l.order.Front()
+	if element == nil {
+		return "", false
+	}
+	return element.Value.(string), true
+}
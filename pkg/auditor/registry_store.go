@@ -0,0 +1,427 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package auditor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+const (
+	FILE_REGISTRY    = "file"
+	MEMORY_REGISTRY  = "memory"
+	SHARDED_REGISTRY = "sharded"
+)
+
+// A RegistryStore keeps the registry between two runs of the agent
+type RegistryStore interface {
+	// Recover returns the registry saved by a previous run
+	Recover() map[string]*RegistryEntry
+	// Flush saves the registry in its current state
+	Flush(registry map[string]RegistryEntry) error
+}
+
+// A checkedRegistryStore can tell upfront whether it will be able to save the registry
+type checkedRegistryStore interface {
+	CheckWritable() error
+}
+
+// A sizedRegistryStore tells how many bytes the registry takes once saved
+type sizedRegistryStore interface {
+	Size() int64
+}
+
+// NewRegistryStore returns the store for registryType,
+// the registry is written at path unless it is kept in memory,
+// or at every registry path when several are configured
+func NewRegistryStore(registryType, path string) RegistryStore {
+	switch registryType {
+	case MEMORY_REGISTRY:
+		return NewMemoryRegistryStore()
+	case SHARDED_REGISTRY:
+		return NewShardedRegistryStore(path, config.LogsAgent.GetInt("registry_shards"))
+	default:
+		if paths := config.LogsAgent.GetStringSlice("registry_paths"); len(paths) > 0 {
+			return NewMirroredRegistryStore(paths)
+		}
+		return NewFileRegistryStore(path)
+	}
+}
+
+// defaultRecoveryTimeout bounds each attempt to read the state file on recovery,
+// defaultRecoveryBackoff is the time to wait before the first retry, doubled afterwards
+const (
+	defaultRecoveryTimeout = 5 * time.Second
+	defaultRecoveryBackoff = 500 * time.Millisecond
+)
+
+// FileRegistryStore writes the registry on disk
+type FileRegistryStore struct {
+	path string
+	// size is the size of the state file last written
+	size int64
+
+	// the state file is read again up to recoveryRetries times on recovery,
+	// for a run_path on a network mount that is not available yet
+	recoveryRetries int
+	recoveryTimeout time.Duration
+	recoveryBackoff time.Duration
+	readFile        func(path string) ([]byte, error)
+}
+
+// NewFileRegistryStore returns a FileRegistryStore writing at path
+func NewFileRegistryStore(path string) *FileRegistryStore {
+	recoveryTimeout := time.Duration(config.LogsAgent.GetInt("registry_recovery_timeout")) * time.Millisecond
+	if recoveryTimeout <= 0 {
+		recoveryTimeout = defaultRecoveryTimeout
+	}
+	return &FileRegistryStore{
+		path:            path,
+		recoveryRetries: config.LogsAgent.GetInt("registry_recovery_retries"),
+		recoveryTimeout: recoveryTimeout,
+		recoveryBackoff: defaultRecoveryBackoff,
+		readFile:        ioutil.ReadFile,
+	}
+}
+
+// readWithTimeout reads the state file, a read that doesn't
+// complete within recoveryTimeout fails
+func (s *FileRegistryStore) readWithTimeout() ([]byte, error) {
+	type result struct {
+		content []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		content, err := s.readFile(s.path)
+		done <- result{content, err}
+	}()
+	select {
+	case r := <-done:
+		return r.content, r.err
+	case <-time.After(s.recoveryTimeout):
+		return nil, fmt.Errorf("reading %s took more than %v", s.path, s.recoveryTimeout)
+	}
+}
+
+// readOnRecovery reads the state file, and retries with a backoff when it fails
+func (s *FileRegistryStore) readOnRecovery() ([]byte, error) {
+	backoff := s.recoveryBackoff
+	for retry := 0; ; retry++ {
+		mr, err := s.readWithTimeout()
+		if err == nil || retry >= s.recoveryRetries {
+			return mr, err
+		}
+		log.Println("Can't read the registry, retrying in", backoff, ":", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Recover rebuilds the registry from the state file
+func (s *FileRegistryStore) Recover() map[string]*RegistryEntry {
+	mr, err := s.readOnRecovery()
+	if err != nil {
+		log.Println(err)
+		return make(map[string]*RegistryEntry)
+	}
+	r, err := decodeRegistry(mr)
+	if err != nil {
+		log.Println("Registry is corrupted, starting from an empty one:", err)
+		s.backup()
+		return make(map[string]*RegistryEntry)
+	}
+	s.size = int64(len(mr))
+	return r
+}
+
+// Flush writes the registry in the state file, a crash during
+// the flush leaves the previous state file untouched
+func (s *FileRegistryStore) Flush(registry map[string]RegistryEntry) error {
+	mr, err := marshalRegistry(registry)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(mr)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.size = int64(len(mr))
+	return nil
+}
+
+// Size returns the size of the state file last written or recovered
+func (s *FileRegistryStore) Size() int64 {
+	return s.size
+}
+
+// CheckWritable writes and removes a file next to the registry,
+// to find out whether the registry can be saved
+func (s *FileRegistryStore) CheckWritable() error {
+	probe := filepath.Join(filepath.Dir(s.path), ".registry-probe")
+	err := ioutil.WriteFile(probe, nil, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Remove(probe)
+}
+
+// backup moves aside a corrupted registry so that it can be investigated
+func (s *FileRegistryStore) backup() {
+	err := os.Rename(s.path, fmt.Sprintf("%s.corrupted", s.path))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// decodeRegistry returns the registry of a state file, an empty state file holds an empty registry
+func decodeRegistry(mr []byte) (map[string]*RegistryEntry, error) {
+	if len(mr) == 0 {
+		return make(map[string]*RegistryEntry), nil
+	}
+	return unmarshalRegistry(mr)
+}
+
+// MirroredRegistryStore writes the registry in several files, for instance on
+// a tmpfs and on a persistent disk, so that it survives the loss of one of them
+type MirroredRegistryStore struct {
+	mirrors []*FileRegistryStore
+}
+
+// NewMirroredRegistryStore returns a MirroredRegistryStore writing at every path
+func NewMirroredRegistryStore(paths []string) *MirroredRegistryStore {
+	s := &MirroredRegistryStore{
+		mirrors: make([]*FileRegistryStore, len(paths)),
+	}
+	for i, path := range paths {
+		s.mirrors[i] = NewFileRegistryStore(path)
+	}
+	return s
+}
+
+// Recover returns the newest valid registry among the mirrors,
+// the corrupted ones are moved aside
+func (s *MirroredRegistryStore) Recover() map[string]*RegistryEntry {
+	var newest map[string]*RegistryEntry
+	var newestUpdate time.Time
+	for _, mirror := range s.mirrors {
+		mr, err := mirror.readOnRecovery()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		r, err := decodeRegistry(mr)
+		if err != nil {
+			log.Println("Registry", mirror.path, "is corrupted, ignoring it:", err)
+			mirror.backup()
+			continue
+		}
+		if update := lastUpdate(r); newest == nil || update.After(newestUpdate) {
+			newest = r
+			newestUpdate = update
+		}
+	}
+	if newest == nil {
+		return make(map[string]*RegistryEntry)
+	}
+	return newest
+}
+
+// Flush writes the registry in every mirror, it only fails if none could be written
+func (s *MirroredRegistryStore) Flush(registry map[string]RegistryEntry) error {
+	var err error
+	flushed := false
+	for _, mirror := range s.mirrors {
+		if mirrorErr := mirror.Flush(registry); mirrorErr != nil {
+			log.Println("Can't flush the registry in", mirror.path, ":", mirrorErr)
+			err = mirrorErr
+			continue
+		}
+		flushed = true
+	}
+	if flushed {
+		return nil
+	}
+	return err
+}
+
+// Size returns the size of the registry last written or recovered in a mirror,
+// they all hold the same registry
+func (s *MirroredRegistryStore) Size() int64 {
+	for _, mirror := range s.mirrors {
+		if mirror.size > 0 {
+			return mirror.size
+		}
+	}
+	return 0
+}
+
+// CheckWritable checks that at least one of the mirrors can be written
+func (s *MirroredRegistryStore) CheckWritable() error {
+	var err error
+	for _, mirror := range s.mirrors {
+		if err = mirror.CheckWritable(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// lastUpdate returns when the most recent entry of a registry was updated
+func lastUpdate(registry map[string]*RegistryEntry) time.Time {
+	var last time.Time
+	for _, entry := range registry {
+		if entry.LastUpdated.After(last) {
+			last = entry.LastUpdated
+		}
+	}
+	return last
+}
+
+// MemoryRegistryStore does not persist the registry, for environments
+// without a persistent disk: offsets are only kept while the agent runs
+type MemoryRegistryStore struct{}
+
+// NewMemoryRegistryStore returns a MemoryRegistryStore
+func NewMemoryRegistryStore() *MemoryRegistryStore {
+	return &MemoryRegistryStore{}
+}
+
+// Recover returns an empty registry
+func (s *MemoryRegistryStore) Recover() map[string]*RegistryEntry {
+	return make(map[string]*RegistryEntry)
+}
+
+// Flush does nothing, the auditor already holds the registry
+func (s *MemoryRegistryStore) Flush(registry map[string]RegistryEntry) error {
+	return nil
+}
+
+// ShardedRegistryStore splits the registry across several files,
+// and only rewrites the files whose entries changed since the last flush
+type ShardedRegistryStore struct {
+	shards []*FileRegistryStore
+	// flushed holds the entries last written in each shard
+	flushed []map[string]RegistryEntry
+}
+
+// NewShardedRegistryStore returns a ShardedRegistryStore writing n files next to path,
+// path registry.json is split into registry-0.json, registry-1.json...
+func NewShardedRegistryStore(path string, n int) *ShardedRegistryStore {
+	if n <= 0 {
+		n = 1
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	s := &ShardedRegistryStore{
+		shards:  make([]*FileRegistryStore, n),
+		flushed: make([]map[string]RegistryEntry, n),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewFileRegistryStore(fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+	return s
+}
+
+// shardOf returns the index of the shard holding the entry of identifier
+func (s *ShardedRegistryStore) shardOf(identifier string) int {
+	h := fnv.New32a()
+	h.Write([]byte(identifier))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// CheckWritable checks that the shards can be written, they are all in the same directory
+func (s *ShardedRegistryStore) CheckWritable() error {
+	return s.shards[0].CheckWritable()
+}
+
+// Recover merges the registries of all the shards
+func (s *ShardedRegistryStore) Recover() map[string]*RegistryEntry {
+	registry := make(map[string]*RegistryEntry)
+	for i, shard := range s.shards {
+		if _, err := os.Stat(shard.path); os.IsNotExist(err) {
+			continue
+		}
+		s.flushed[i] = make(map[string]RegistryEntry)
+		for identifier, entry := range shard.Recover() {
+			registry[identifier] = entry
+			s.flushed[i][identifier] = entry.copy()
+		}
+	}
+	return registry
+}
+
+// Flush writes the shards whose entries changed since the last flush
+func (s *ShardedRegistryStore) Flush(registry map[string]RegistryEntry) error {
+	shards := make([]map[string]RegistryEntry, len(s.shards))
+	for i := range shards {
+		shards[i] = make(map[string]RegistryEntry)
+	}
+	for identifier, entry := range registry {
+		shards[s.shardOf(identifier)][identifier] = entry
+	}
+	for i, entries := range shards {
+		if s.flushed[i] != nil && isSameRegistry(s.flushed[i], entries) {
+			continue
+		}
+		if err := s.shards[i].Flush(entries); err != nil {
+			return err
+		}
+		s.flushed[i] = entries
+	}
+	return nil
+}
+
+// Size returns the total size of the shards last written or recovered
+func (s *ShardedRegistryStore) Size() int64 {
+	var size int64
+	for _, shard := range s.shards {
+		size += shard.size
+	}
+	return size
+}
+
+// isSameRegistry returns true if both registries have the same entries
+func isSameRegistry(a, b map[string]RegistryEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for identifier, entry := range a {
+		other, ok := b[identifier]
+		if !ok || entry.Offset != other.Offset || entry.Timestamp != other.Timestamp ||
+			entry.Kind != other.Kind || entry.Line != other.Line || !entry.LastUpdated.Equal(other.LastUpdated) ||
+			!reflect.DeepEqual(entry.Meta, other.Meta) {
+			return false
+		}
+	}
+	return true
+}
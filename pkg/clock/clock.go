@@ -0,0 +1,98 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package clock
+
+import "time"
+
+// Clock tells the time and waits, so that time can be controlled in tests
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker delivers ticks at intervals
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer delivers the time once its duration elapsed, it can be reset
+// to wait again without allocating a new timer
+type Timer interface {
+	C() <-chan time.Time
+	// Reset makes the timer fire after d, a time it delivered that was not received is dropped
+	Reset(d time.Duration)
+	Stop()
+}
+
+// New returns a clock using the time of the system
+func New() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Reset(d time.Duration) {
+	t.Stop()
+	t.timer.Reset(d)
+}
+
+func (t *realTimer) Stop() {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+}
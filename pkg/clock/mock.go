@@ -0,0 +1,191 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Mock is a clock whose time only moves when it is told to,
+// sleepers, timers and tickers are woken up as the time goes by
+type Mock struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*mockWaiter
+	tickers []*mockTicker
+}
+
+type mockWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewMock returns a mock clock set at now
+func NewMock(now time.Time) *Mock {
+	m := &Mock{now: now}
+	m.cond = sync.NewCond(&m.mutex)
+	return m
+}
+
+// Now returns the time of the mock
+func (m *Mock) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+// Since returns the time elapsed since t according to the mock
+func (m *Mock) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
+// Sleep blocks until the mock is advanced by d
+func (m *Mock) Sleep(d time.Duration) {
+	<-m.After(d)
+}
+
+// After returns a channel receiving the time once the mock is advanced by d
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- m.now
+		return c
+	}
+	m.waiters = append(m.waiters, &mockWaiter{deadline: m.now.Add(d), c: c})
+	m.cond.Broadcast()
+	return c
+}
+
+// NewTicker returns a ticker ticking each time the mock is advanced by d
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t := &mockTicker{
+		mock:   m,
+		period: d,
+		next:   m.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// NewTimer returns a timer firing once the mock is advanced by d
+func (m *Mock) NewTimer(d time.Duration) Timer {
+	t := &mockTimer{mock: m, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Add advances the mock by d, and wakes up the sleepers and tickers
+// whose deadline is reached. A negative d steps the time backward
+func (m *Mock) Add(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set sets the time of the mock, and wakes up the sleepers and tickers
+// whose deadline is reached
+func (m *Mock) Set(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = now
+	waiters := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.deadline.After(now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- now
+	}
+	m.waiters = waiters
+	for _, t := range m.tickers {
+		if t.next.After(now) {
+			continue
+		}
+		// like time.Ticker, ticks are dropped for slow receivers
+		select {
+		case t.c <- now:
+		default:
+		}
+		for !t.next.After(now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// BlockUntil blocks until n goroutines sleep or wait on the mock
+func (m *Mock) BlockUntil(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for len(m.waiters) < n {
+		m.cond.Wait()
+	}
+}
+
+type mockTicker struct {
+	mock   *Mock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *mockTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTicker) Stop() {
+	t.mock.mutex.Lock()
+	defer t.mock.mutex.Unlock()
+	for i, other := range t.mock.tickers {
+		if other == t {
+			t.mock.tickers = append(t.mock.tickers[:i], t.mock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type mockTimer struct {
+	mock   *Mock
+	waiter *mockWaiter
+	c      chan time.Time
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTimer) Reset(d time.Duration) {
+	t.Stop()
+	t.mock.mutex.Lock()
+	defer t.mock.mutex.Unlock()
+	if d <= 0 {
+		t.c <- t.mock.now
+		return
+	}
+	t.waiter = &mockWaiter{deadline: t.mock.now.Add(d), c: t.c}
+	t.mock.waiters = append(t.mock.waiters, t.waiter)
+	t.mock.cond.Broadcast()
+}
+
+func (t *mockTimer) Stop() {
+	t.mock.mutex.Lock()
+	defer t.mock.mutex.Unlock()
+	for i, w := range t.mock.waiters {
+		if w == t.waiter {
+			t.mock.waiters = append(t.mock.waiters[:i], t.mock.waiters[i+1:]...)
+			break
+		}
+	}
+	t.waiter = nil
+	select {
+	case <-t.c:
+	default:
+	}
+}
@@ -0,0 +1,76 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockWakesUpSleepers(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMock(start)
+	done := make(chan struct{})
+	go func() {
+		m.Sleep(time.Minute)
+		close(done)
+	}()
+
+	m.BlockUntil(1)
+	m.Add(30 * time.Second)
+	select {
+	case <-done:
+		assert.Fail(t, "the sleeper woke up too early")
+	default:
+	}
+	m.Add(30 * time.Second)
+	<-done
+	assert.Equal(t, time.Minute, m.Since(start))
+}
+
+func TestMockTicks(t *testing.T) {
+	m := NewMock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	ticker := m.NewTicker(time.Second)
+
+	m.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, len(ticker.C()))
+	m.Add(500 * time.Millisecond)
+	assert.Equal(t, m.Now(), <-ticker.C())
+
+	// ticks are dropped when nobody receives them
+	m.Add(3 * time.Second)
+	assert.Equal(t, 1, len(ticker.C()))
+	<-ticker.C()
+
+	ticker.Stop()
+	m.Add(time.Second)
+	assert.Equal(t, 0, len(ticker.C()))
+}
+
+func TestMockTimers(t *testing.T) {
+	m := NewMock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	timer := m.NewTimer(time.Second)
+
+	m.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, len(timer.C()))
+	m.Add(500 * time.Millisecond)
+	assert.Equal(t, m.Now(), <-timer.C())
+
+	// a timer fires once, until it is reset
+	m.Add(time.Second)
+	assert.Equal(t, 0, len(timer.C()))
+	timer.Reset(time.Second)
+	m.Add(time.Second)
+	assert.Equal(t, m.Now(), <-timer.C())
+
+	// a stopped timer never fires
+	timer.Reset(time.Second)
+	timer.Stop()
+	m.Add(time.Second)
+	assert.Equal(t, 0, len(timer.C()))
+}
@@ -6,9 +6,12 @@
 package config
 
 import (
+	"crypto/rand"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -54,6 +57,59 @@ func buildMainConfig(config *viper.Viper, ddconfigPath, ddconfdPath string) erro
 	config.SetDefault("log_dd_port", 10516)
 	config.SetDefault("skip_ssl_validation", false)
 	config.SetDefault("run_path", "/opt/datadog-agent/run")
+	config.SetDefault("shutdown_timeout", 10)
+	config.SetDefault("shutdown_drain_timeout", 5000)
+	config.SetDefault("max_open_files", 500)
+	config.SetDefault("glob_scan_interval", 10)
+	config.SetDefault("use_file_events", false)
+	config.SetDefault("status_addr", "")
+	config.SetDefault("registry_type", "file")
+	config.SetDefault("registry_shards", 16)
+	config.SetDefault("max_registry_entries", 0)
+	config.SetDefault("registry_paths", []string{})
+	config.SetDefault("reject_offset_regressions", false)
+	config.SetDefault("destination", "intake")
+	config.SetDefault("destination_path", "")
+	config.SetDefault("destination_format", "raw")
+	config.SetDefault("outputs", []interface{}{})
+	config.SetDefault("destination_compress", false)
+	config.SetDefault("destination_ack_on_sync", false)
+	config.SetDefault("destination_max_file_bytes", 100*1024*1024)
+	config.SetDefault("max_mem_bytes", 0)
+	config.SetDefault("retry_buffer_size", 1000)
+	config.SetDefault("retry_min_backoff", 1000)
+	config.SetDefault("retry_max_backoff", 30000)
+	config.SetDefault("dead_letter_path", "")
+	config.SetDefault("ack_timeout", 30000)
+	config.SetDefault("max_payload_size", MaxMessageLen)
+	config.SetDefault("oversize_policy", "truncate")
+	config.SetDefault("use_compression", false)
+	config.SetDefault("compression_level", 6)
+	config.SetDefault("content_hash", "fnv")
+	config.SetDefault("dedup_window", 0)
+	config.SetDefault("dedup_max_entries", 10000)
+	config.SetDefault("batch_max_count", 0)
+	config.SetDefault("batch_max_size", 0)
+	config.SetDefault("batch_flush_interval", 0)
+	config.SetDefault("reorder_window", 0)
+	config.SetDefault("reorder_max_messages", 1000)
+	config.SetDefault("wal_max_bytes", 64*1024*1024)
+	config.SetDefault("max_reads_per_interval", 0)
+	config.SetDefault("read_interval", 1000)
+	config.SetDefault("decoder_chan_size", ChanSizes)
+	config.SetDefault("decoder_overflow_policy", "block")
+	config.SetDefault("commit_events_size", 1000)
+	config.SetDefault("delete_grace_period", 1000)
+	config.SetDefault("registry_key_date_pattern", "")
+	config.SetDefault("registry_key_date_layout", "2006-01-02")
+	config.SetDefault("registry_key_max_age", 24)
+	config.SetDefault("registry_flush_max_duration", 1000)
+	config.SetDefault("registry_recovery_retries", 0)
+	config.SetDefault("registry_recovery_timeout", 5000)
+	config.SetDefault("tag_agent_run", false)
+	config.SetDefault("report_source_errors", false)
+	config.SetDefault("log_level", "info")
+	config.SetDefault("log_repeat_interval", 60)
 
 	if isAgent5 {
 		// for agent5, we don't want people to have to set log_enabled in the config
@@ -62,16 +118,266 @@ func buildMainConfig(config *viper.Viper, ddconfigPath, ddconfdPath string) erro
 		config.SetDefault("log_enabled", false)
 	}
 
+	switch config.GetString("log_level") {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level must be debug, info, warn or error (got %s)", config.GetString("log_level"))
+	}
+
+	if config.GetInt("log_repeat_interval") < 0 {
+		return fmt.Errorf("log_repeat_interval must be positive (got %d)", config.GetInt("log_repeat_interval"))
+	}
+
+	if config.GetInt("glob_scan_interval") <= 0 {
+		return fmt.Errorf("glob_scan_interval must be positive (got %d)", config.GetInt("glob_scan_interval"))
+	}
+
+	// the messages are batched as soon as one of the batch settings is set
+	for _, key := range []string{"batch_max_count", "batch_max_size", "batch_flush_interval"} {
+		if config.GetInt(key) < 0 {
+			return fmt.Errorf("%s must be positive (got %d)", key, config.GetInt(key))
+		}
+	}
+
+	if config.GetInt("reorder_window") < 0 {
+		return fmt.Errorf("reorder_window must be positive (got %d)", config.GetInt("reorder_window"))
+	}
+
+	if config.GetInt("reorder_window") > 0 && config.GetInt("reorder_max_messages") <= 0 {
+		return fmt.Errorf("reorder_max_messages must be positive (got %d)", config.GetInt("reorder_max_messages"))
+	}
+
+	if config.GetInt("wal_max_bytes") <= 0 {
+		return fmt.Errorf("wal_max_bytes must be positive (got %d)", config.GetInt("wal_max_bytes"))
+	}
+
+	if config.GetInt("max_reads_per_interval") < 0 {
+		return fmt.Errorf("max_reads_per_interval must be positive (got %d)", config.GetInt("max_reads_per_interval"))
+	}
+
+	if config.GetInt("max_reads_per_interval") > 0 && config.GetInt("read_interval") <= 0 {
+		return fmt.Errorf("read_interval must be positive (got %d)", config.GetInt("read_interval"))
+	}
+
+	if config.GetInt("decoder_chan_size") <= 0 {
+		return fmt.Errorf("decoder_chan_size must be positive (got %d)", config.GetInt("decoder_chan_size"))
+	}
+
+	switch config.GetString("decoder_overflow_policy") {
+	case "block", "drop_newest", "drop_oldest":
+	default:
+		return fmt.Errorf("decoder_overflow_policy must be block, drop_newest or drop_oldest (got %s)", config.GetString("decoder_overflow_policy"))
+	}
+
+	switch config.GetString("destination") {
+	case "intake", "stdout":
+	case "file":
+		if config.GetString("destination_path") == "" {
+			return fmt.Errorf("destination_path must be set for a file destination")
+		}
+	default:
+		return fmt.Errorf("destination must be intake, stdout or file (got %s)", config.GetString("destination"))
+	}
+
+	if config.GetBool("destination_compress") && config.GetString("destination") != "file" {
+		return fmt.Errorf("destination_compress can only be set for a file destination (got %s)", config.GetString("destination"))
+	}
+
+	if config.GetBool("destination_ack_on_sync") && config.GetString("destination") != "file" {
+		return fmt.Errorf("destination_ack_on_sync can only be set for a file destination (got %s)", config.GetString("destination"))
+	}
+
+	if config.GetInt("ack_timeout") <= 0 {
+		return fmt.Errorf("ack_timeout must be positive (got %d)", config.GetInt("ack_timeout"))
+	}
+
+	if config.GetInt("destination_max_file_bytes") <= 0 {
+		return fmt.Errorf("destination_max_file_bytes must be positive (got %d)", config.GetInt("destination_max_file_bytes"))
+	}
+
+	switch config.GetString("destination_format") {
+	case "raw", "json":
+	default:
+		return fmt.Errorf("destination_format must be raw or json (got %s)", config.GetString("destination_format"))
+	}
+
+	// the sources can only send their lines to the outputs that are not tees
+	outputs := make(map[string]bool)
+	names := make(map[string]bool)
+	var outputConfigs []OutputConfig
+	if err := config.UnmarshalKey("outputs", &outputConfigs); err != nil {
+		return fmt.Errorf("outputs must be a list of outputs: %v", err)
+	}
+	for _, output := range outputConfigs {
+		if err := validateOutput(output); err != nil {
+			return err
+		}
+		if names[output.Name] {
+			return fmt.Errorf("outputs must have different names (got %s twice)", output.Name)
+		}
+		names[output.Name] = true
+		outputs[output.Name] = !output.Tee
+	}
+
+	if config.GetInt("max_payload_size") <= 0 {
+		return fmt.Errorf("max_payload_size must be positive (got %d)", config.GetInt("max_payload_size"))
+	}
+
+	switch config.GetString("oversize_policy") {
+	case "truncate", "split", "drop":
+	default:
+		return fmt.Errorf("oversize_policy must be truncate, split or drop (got %s)", config.GetString("oversize_policy"))
+	}
+
+	if level := config.GetInt("compression_level"); level < -1 || level > 9 {
+		return fmt.Errorf("compression_level must be between -1 and 9 (got %d)", level)
+	}
+
+	switch config.GetString("registry_type") {
+	case "file", "memory", "sharded":
+	default:
+		return fmt.Errorf("registry_type must be file, memory or sharded (got %s)", config.GetString("registry_type"))
+	}
+
+	if config.GetInt("max_registry_entries") < 0 {
+		return fmt.Errorf("max_registry_entries must be positive (got %d)", config.GetInt("max_registry_entries"))
+	}
+
+	for _, root := range config.GetStringSlice("allowed_roots") {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("allowed_roots must be absolute paths (got %s)", root)
+		}
+	}
+
+	if len(config.GetStringSlice("registry_paths")) > 0 && config.GetString("registry_type") != "file" {
+		return fmt.Errorf("registry_paths can only be set for a file registry (got %s)", config.GetString("registry_type"))
+	}
+
+	if _, err := regexp.Compile(config.GetString("registry_key_date_pattern")); err != nil {
+		return fmt.Errorf("registry_key_date_pattern must be a valid regular expression (got %s): %v", config.GetString("registry_key_date_pattern"), err)
+	}
+
+	if config.GetInt("registry_key_max_age") <= 0 {
+		return fmt.Errorf("registry_key_max_age must be positive (got %d)", config.GetInt("registry_key_max_age"))
+	}
+
+	if config.GetInt("delete_grace_period") < 0 {
+		return fmt.Errorf("delete_grace_period must be positive (got %d)", config.GetInt("delete_grace_period"))
+	}
+
+	if config.GetInt("commit_events_size") <= 0 {
+		return fmt.Errorf("commit_events_size must be positive (got %d)", config.GetInt("commit_events_size"))
+	}
+
+	if config.GetInt("registry_flush_max_duration") <= 0 {
+		return fmt.Errorf("registry_flush_max_duration must be positive (got %d)", config.GetInt("registry_flush_max_duration"))
+	}
+
+	if config.GetInt("registry_recovery_retries") < 0 {
+		return fmt.Errorf("registry_recovery_retries must be positive (got %d)", config.GetInt("registry_recovery_retries"))
+	}
+
+	if config.GetInt("registry_recovery_timeout") <= 0 {
+		return fmt.Errorf("registry_recovery_timeout must be positive (got %d)", config.GetInt("registry_recovery_timeout"))
+	}
+
+	switch config.GetString("content_hash") {
+	case "crc32", "fnv", "sha256":
+	default:
+		return fmt.Errorf("content_hash must be crc32, fnv or sha256 (got %s)", config.GetString("content_hash"))
+	}
+
+	if config.GetInt("shutdown_drain_timeout") <= 0 {
+		return fmt.Errorf("shutdown_drain_timeout must be positive (got %d)", config.GetInt("shutdown_drain_timeout"))
+	}
+
+	if config.GetInt("shutdown_drain_timeout") >= config.GetInt("shutdown_timeout")*1000 {
+		return fmt.Errorf("shutdown_drain_timeout must be shorter than shutdown_timeout (got %d)", config.GetInt("shutdown_drain_timeout"))
+	}
+
+	if config.GetInt("registry_shards") <= 0 {
+		return fmt.Errorf("registry_shards must be positive (got %d)", config.GetInt("registry_shards"))
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Println(err)
 		hostname = "unknown"
 	}
 	config.SetDefault("hostname", hostname)
+	// the run identifier tells apart the lines shipped by agents running side by side,
+	// during an upgrade for instance
+	config.SetDefault("agent_run_id", newRunID())
 
 	err = BuildLogsAgentIntegrationsConfigs(ddconfdPath)
 	if err != nil {
 		return err
 	}
+	for _, source := range GetLogsSources() {
+		if source.Output != "" && !outputs[source.Output] {
+			return fmt.Errorf("A source must have the name of one of the outputs as output (got %s)", source.Output)
+		}
+	}
+	return nil
+}
+
+// An OutputConfig is a destination the sources send their lines to when they have its name
+// as output, instead of the main destination. A tee output gets a copy of all the lines instead
+type OutputConfig struct {
+	Name        string
+	Destination string
+	Path        string
+	Format      string
+	Tee         bool
+	MustAck     bool `mapstructure:"must_ack"` // tee, the lines are only commited once handed to the sender of the output
+}
+
+// GetOutputs returns the outputs of the main config, they are validated when it is built
+func GetOutputs() []OutputConfig {
+	var outputs []OutputConfig
+	LogsAgent.UnmarshalKey("outputs", &outputs)
+	for i := range outputs {
+		if outputs[i].Format == "" {
+			outputs[i].Format = "raw"
+		}
+	}
+	return outputs
+}
+
+// validateOutput returns an error if an output can't be used
+func validateOutput(output OutputConfig) error {
+	if output.Name == "" {
+		return fmt.Errorf("An output must have a name")
+	}
+	switch output.Destination {
+	case "intake", "stdout":
+	case "file":
+		if output.Path == "" {
+			return fmt.Errorf("An output must have a path for a file destination (got none for %s)", output.Name)
+		}
+	default:
+		return fmt.Errorf("An output must have an intake, stdout or file destination (got %s for %s)", output.Destination, output.Name)
+	}
+	switch output.Format {
+	case "", "raw", "json":
+	default:
+		return fmt.Errorf("An output must have a raw or json format (got %s for %s)", output.Format, output.Name)
+	}
+	if output.MustAck && !output.Tee {
+		return fmt.Errorf("Only a tee output can have must_ack (got %s)", output.Name)
+	}
 	return nil
 }
+
+// newRunID returns a random UUID identifying the current run of the agent
+func newRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("Can't generate the agent run id:", err)
+		return "unknown"
+	}
+	// version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
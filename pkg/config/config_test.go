@@ -45,6 +45,18 @@ func TestBuildConfigWithCompleteFileAgent5(t *testing.T) {
 	assert.Equal(t, true, testConfig.GetBool("log_enabled"))
 }
 
+func TestBuildConfigGeneratesARunID(t *testing.T) {
+	var testConfig = viper.New()
+	buildMainConfig(testConfig, filepath.Join(testsPath, "complete", "datadog.yaml"), filepath.Join(testsPath, "complete", "conf.d"))
+	runID := testConfig.GetString("agent_run_id")
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", runID)
+	assert.Equal(t, runID, testConfig.GetString("agent_run_id"))
+
+	otherConfig := viper.New()
+	buildMainConfig(otherConfig, filepath.Join(testsPath, "complete", "datadog.yaml"), filepath.Join(testsPath, "complete", "conf.d"))
+	assert.NotEqual(t, runID, otherConfig.GetString("agent_run_id"))
+}
+
 func TestBuildConfigWithIncompleteFile(t *testing.T) {
 	var testConfig = viper.New()
 	ddconfigPath := filepath.Join(testsPath, "incomplete", "datadog.yaml")
@@ -85,4 +97,9 @@ func TestComputeConfigWithMisconfiguredFile(t *testing.T) {
 	ddconfdPath = filepath.Join(testsPath, "misconfigured_5", "conf.d")
 	err = buildMainConfig(testConfig, ddconfigPath, ddconfdPath)
 	assert.NotNil(t, err)
+
+	ddconfigPath = filepath.Join(testsPath, "misconfigured_6", "datadog.yaml")
+	ddconfdPath = filepath.Join(testsPath, "complete", "conf.d")
+	err = buildMainConfig(viper.New(), ddconfigPath, ddconfdPath)
+	assert.NotNil(t, err)
 }
@@ -6,10 +6,17 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/spf13/viper"
 )
@@ -19,9 +26,22 @@ const (
 	TCP_TYPE         = "tcp"
 	UDP_TYPE         = "udp"
 	FILE_TYPE        = "file"
+	DIRECTORY_TYPE   = "directory"
 	DOCKER_TYPE      = "docker"
 	EXCLUDE_AT_MATCH = "exclude_at_match"
 	MASK_SEQUENCES   = "mask_sequences"
+	JSON_FORMAT      = "json"
+	CRI_FORMAT       = "cri"
+	CSV_FORMAT       = "csv"
+	NOATIME_FLAG     = "noatime"
+	SCRUB_PROCESSOR  = "scrub"
+	FILTER_PROCESSOR = "filter"
+	SAMPLE_PROCESSOR = "sample"
+	PREFIX_PROCESSOR = "prefix"
+	DEDUP_PROCESSOR  = "dedup"
+
+	INODE_IDENTITY       = "inode"
+	FINGERPRINT_IDENTITY = "fingerprint"
 )
 
 // LogsProcessingRule defines an exclusion or a masking rule to
@@ -40,8 +60,50 @@ type LogsProcessingRule struct {
 type IntegrationConfigLogSource struct {
 	Type string
 
-	Port int    // Network
-	Path string // File
+	Port       int    // Network
+	Path       string // File, or Directory whose files are all tailed
+	Identifier string // File, key of the file in the registry instead of its path. Network, the time of the messages is commited under it for the file source taking over
+
+	HeartbeatInterval int `mapstructure:"heartbeat_interval"` // File, in seconds
+
+	Format          string   // json, cri for the logs of a container runtime, or csv for files whose first line is a header
+	CSVDelimiter    string   `mapstructure:"csv_delimiter"`    // File, separator of the fields of a csv file, a comma when unset
+	TimestampFormat string   `mapstructure:"timestamp_format"` // File, Go layout of the timestamp starting each line, or of the timestamp_field of a json source, RFC3339 when unset
+	TimestampField  string   `mapstructure:"timestamp_field"`  // json, dot-separated path of the field holding the time of the event
+	Timezone        string   `mapstructure:"timezone"`         // File, IANA name of the zone of the timestamps without an offset, UTC when unset
+	StartAt         string   `mapstructure:"start_at"`         // File, RFC3339
+	TailLines       int      `mapstructure:"tail_lines"`       // File, number of lines to read before the end of a new file
+	FollowSymlinks  bool     `mapstructure:"follow_symlinks"`  // File, tail the targets of symlinks matched by a glob
+	ExcludePaths    []string `mapstructure:"exclude_paths"`    // File, globs of the files matched by path that must not be tailed
+	TrackOffset     *bool    `mapstructure:"track_offset"`     // File, when false the file is always tailed from its end and its offset is never commited
+	Nonblock        bool     `mapstructure:"nonblock"`         // File, for virtual files that can't be seeked, their offset is never commited
+	OpenFlags       []string `mapstructure:"open_flags"`       // File, noatime to not update the access time of the file on Linux
+	WAL             bool     `mapstructure:"wal"`              // Nonblocking file or network, messages are kept in the WAL until they are commited
+
+	CatchUpRotations bool   `mapstructure:"catch_up_rotations"` // File, read the .gz rotations written since the file was last tailed before the file
+	OrderedRotations bool   `mapstructure:"ordered_rotations"`  // File, a glob matching files and their numbered rotations, like app.log.1 or app.log.2.gz, read oldest first before the files
+	FileIdentity     string `mapstructure:"file_identity"`      // File, inode, or fingerprint to tell files apart by their first bytes when inodes are not stable
+
+	SamplingRate      *float64 `mapstructure:"sampling_rate"`        // fraction of the lines to forward, all of them when unset, none when 0
+	MaxLinesPerSecond int      `mapstructure:"max_lines_per_second"` // File, lines over the limit are dropped
+	DecoderWorkers    int      `mapstructure:"decoder_workers"`      // File, number of payloads decoded concurrently
+	RecentLines       int      `mapstructure:"recent_lines"`         // File, number of the last lines read kept for the status server
+
+	PartialLineTimeout int  `mapstructure:"partial_line_timeout"` // File, in milliseconds, the beginning of a line is sent when its end doesn't come in time
+	KeepLineEnding     bool `mapstructure:"keep_line_ending"`     // File or directory, the lines are forwarded with their `\n` or `\r\n` as read
+	SkipFirstLines     int  `mapstructure:"skip_first_lines"`     // File or directory, lines of a banner discarded when a file is read from its beginning, before the header of a csv file
+	DetectGzip         bool `mapstructure:"detect_gzip"`          // File or directory, files starting with the gzip magic number are decompressed whatever their name
+
+	ResetOnChange bool `mapstructure:"reset_on_change"` // File, the file is tailed from its end again when the source changes
+
+	Follow *bool `mapstructure:"follow"` // File or directory, when false the files are read until their end once, and are not followed
+
+	LineNumbers   bool `mapstructure:"line_numbers"`    // File or directory, number the lines and commit their number with their offset
+	TagSourceFile bool `mapstructure:"tag_source_file"` // File or directory, tag the lines with the path of their file and its number of rotations
+
+	Output string // name of one of the outputs the lines are sent to, instead of the destination
+
+	Sharded bool // File, the files matched by path are the shards of one stream, forwarded together and commited per file under the identifier
 
 	Image string // Docker
 	Label string // Docker
@@ -51,8 +113,15 @@ type IntegrationConfigLogSource struct {
 	Source          string
 	SourceCategory  string
 	Tags            string
+	LinePrefix      string `mapstructure:"line_prefix"` // prepended to each line, ${hostname}, ${service}, ${source} and ${path} are replaced
 	TagsPayload     []byte
 	ProcessingRules []LogsProcessingRule `mapstructure:"log_processing_rules"`
+	// Processors are the names of the processors the lines go through, in order:
+	// scrub applies the mask_sequences rules, filter the exclude_at_match rules,
+	// sample the sampling_rate, prefix the line_prefix, and dedup drops duplicated lines.
+	// When unset, lines are sampled, deduplicated, go through all the rules and are prefixed.
+	// The rules whose processor is not declared are applied before the declared processors
+	Processors []string
 }
 
 // IntegrationConfig represents a dd agent config, which includes infra and logs parts
@@ -96,6 +165,18 @@ func buildLogsAgentIntegrationsConfig(config *viper.Viper, ddconfdPath string) e
 
 		for _, logSourceConfigIterator := range integrationConfig.Logs {
 			logSourceConfig := logSourceConfigIterator
+			// paths are resolved once, so that they don't change while the agent runs
+			logSourceConfig.Path, err = expandPath(logSourceConfig.Path)
+			if err != nil {
+				return err
+			}
+			for i, pattern := range logSourceConfig.ExcludePaths {
+				logSourceConfig.ExcludePaths[i], err = expandPath(pattern)
+				if err != nil {
+					return err
+				}
+			}
+
 			err = validateSource(logSourceConfig)
 			if err != nil {
 				return err
@@ -107,7 +188,7 @@ func buildLogsAgentIntegrationsConfig(config *viper.Viper, ddconfdPath string) e
 			}
 			logSourceConfig.ProcessingRules = rules
 
-			logSourceConfig.TagsPayload = buildTagsPayload(logSourceConfig.Tags, logSourceConfig.Source, logSourceConfig.SourceCategory)
+			logSourceConfig.TagsPayload = BuildTagsPayload(logSourceConfig.Tags, logSourceConfig.Source, logSourceConfig.SourceCategory)
 
 			logsSourceConfigs = append(logsSourceConfigs, &logSourceConfig)
 		}
@@ -116,6 +197,30 @@ func buildLogsAgentIntegrationsConfig(config *viper.Viper, ddconfdPath string) e
 	return nil
 }
 
+// expandPath replaces the environment variables of path, and a leading ~ by the home directory.
+// It fails when a variable is not set, rather than tailing a wrong path
+func expandPath(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("A source must have a path whose ~ can be expanded (got %s): %v", path, err)
+		}
+		path = home + path[1:]
+	}
+	var unset []string
+	expanded := os.Expand(path, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("A source must have a path whose environment variables are set (%s unset in %s)", strings.Join(unset, ", "), path)
+	}
+	return expanded, nil
+}
+
 // availableIntegrationConfigs lists yaml files in ddconfdPath
 func availableIntegrationConfigs(ddconfdPath string) []string {
 	var integrationConfigFiles []string
@@ -135,6 +240,7 @@ func validateSource(config IntegrationConfigLogSource) error {
 
 	switch config.Type {
 	case FILE_TYPE,
+		DIRECTORY_TYPE,
 		DOCKER_TYPE,
 		TCP_TYPE,
 		UDP_TYPE:
@@ -146,6 +252,158 @@ func validateSource(config IntegrationConfigLogSource) error {
 		return fmt.Errorf("A file source must have a path")
 	}
 
+	if config.Type == DIRECTORY_TYPE && config.Path == "" {
+		return fmt.Errorf("A directory source must have a path")
+	}
+
+	for _, pattern := range config.ExcludePaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("A source must have valid exclude_paths (got %s): %v", pattern, err)
+		}
+	}
+
+	switch config.Format {
+	case "", JSON_FORMAT, CRI_FORMAT, CSV_FORMAT:
+	default:
+		return fmt.Errorf("A source must have a valid format (got %s)", config.Format)
+	}
+
+	for _, flag := range config.OpenFlags {
+		if flag != NOATIME_FLAG {
+			return fmt.Errorf("A source must have valid open_flags (got %s)", flag)
+		}
+	}
+
+	for _, processor := range config.Processors {
+		switch processor {
+		case SCRUB_PROCESSOR, FILTER_PROCESSOR, SAMPLE_PROCESSOR, PREFIX_PROCESSOR, DEDUP_PROCESSOR:
+		default:
+			return fmt.Errorf("A source must have valid processors (got %s)", processor)
+		}
+	}
+
+	if config.Format == CSV_FORMAT && config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE {
+		return fmt.Errorf("Only a file or directory source can have a csv format")
+	}
+
+	if config.WAL && !(config.Type == FILE_TYPE && config.Nonblock) && config.Type != TCP_TYPE && config.Type != UDP_TYPE {
+		return fmt.Errorf("Only a nonblocking file or a network source can have a wal")
+	}
+
+	if config.CatchUpRotations && (config.Type != FILE_TYPE || config.Nonblock) {
+		return fmt.Errorf("Only a file source that can be seeked can have catch_up_rotations")
+	}
+
+	if config.OrderedRotations && (config.Type != FILE_TYPE || config.Nonblock || !strings.ContainsAny(config.Path, "*?[")) {
+		return fmt.Errorf("Only a file source with a glob path that can be seeked can have ordered_rotations")
+	}
+
+	switch config.FileIdentity {
+	case "", INODE_IDENTITY, FINGERPRINT_IDENTITY:
+	default:
+		return fmt.Errorf("A source must have a valid file_identity (got %s)", config.FileIdentity)
+	}
+
+	if config.Follow != nil && !*config.Follow && ((config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE) || config.Nonblock) {
+		return fmt.Errorf("Only a file or directory source that can be seeked can have follow set to false")
+	}
+
+	if config.LineNumbers && ((config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE) || config.Nonblock) {
+		return fmt.Errorf("Only a file or directory source that can be seeked can have line_numbers")
+	}
+
+	if config.TagSourceFile && config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE {
+		return fmt.Errorf("Only a file or directory source can have tag_source_file")
+	}
+
+	if config.Sharded && (config.Type != FILE_TYPE || config.Identifier == "") {
+		return fmt.Errorf("Only a file source with an identifier can be sharded")
+	}
+
+	if config.FileIdentity == FINGERPRINT_IDENTITY && config.Nonblock {
+		return fmt.Errorf("Only a file source that can be seeked can have a fingerprint file_identity")
+	}
+
+	if config.TimestampField != "" && config.Format != JSON_FORMAT {
+		return fmt.Errorf("Only a json source can have a timestamp_field")
+	}
+
+	if config.CSVDelimiter != "" && utf8.RuneCountInString(config.CSVDelimiter) != 1 {
+		return fmt.Errorf("A source must have a single character csv_delimiter (got %s)", config.CSVDelimiter)
+	}
+
+	if config.Timezone != "" {
+		if _, err := time.LoadLocation(config.Timezone); err != nil {
+			return fmt.Errorf("A source must have a valid timezone (got %s): %v", config.Timezone, err)
+		}
+	}
+
+	if config.StartAt != "" {
+		if config.TimestampFormat == "" {
+			return fmt.Errorf("A source with a start_at must have a timestamp_format")
+		}
+		_, err := time.Parse(time.RFC3339, config.StartAt)
+		if err != nil {
+			return fmt.Errorf("A source must have a valid start_at (got %s): %v", config.StartAt, err)
+		}
+	}
+
+	if config.TailLines < 0 {
+		return fmt.Errorf("A source must have a positive tail_lines (got %d)", config.TailLines)
+	}
+
+	if config.TailLines > 0 && config.StartAt != "" {
+		return fmt.Errorf("A source can't have both a tail_lines and a start_at")
+	}
+
+	if config.SamplingRate != nil && (*config.SamplingRate < 0 || *config.SamplingRate > 1) {
+		return fmt.Errorf("A source must have a sampling_rate between 0 and 1 (got %v)", *config.SamplingRate)
+	}
+
+	if config.MaxLinesPerSecond < 0 {
+		return fmt.Errorf("A source must have a positive max_lines_per_second (got %d)", config.MaxLinesPerSecond)
+	}
+
+	if config.RecentLines < 0 {
+		return fmt.Errorf("A source must have a positive recent_lines (got %d)", config.RecentLines)
+	}
+
+	if config.PartialLineTimeout < 0 {
+		return fmt.Errorf("A source must have a positive partial_line_timeout (got %d)", config.PartialLineTimeout)
+	}
+
+	if config.PartialLineTimeout > 0 && (config.Format == CRI_FORMAT || config.Format == CSV_FORMAT) {
+		return fmt.Errorf("A source can't have a partial_line_timeout with the %s format", config.Format)
+	}
+
+	if config.KeepLineEnding && config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE {
+		return fmt.Errorf("Only a file or directory source can have keep_line_ending")
+	}
+
+	if config.KeepLineEnding && (config.Format == CRI_FORMAT || config.Format == CSV_FORMAT) {
+		return fmt.Errorf("A source can't have keep_line_ending with the %s format", config.Format)
+	}
+
+	if config.DetectGzip && (config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE || config.Nonblock) {
+		return fmt.Errorf("Only a file or directory source that can be seeked can have detect_gzip")
+	}
+
+	if config.DetectGzip && config.Format == CSV_FORMAT {
+		return fmt.Errorf("A source can't have detect_gzip with the %s format", config.Format)
+	}
+
+	if config.SkipFirstLines < 0 {
+		return fmt.Errorf("A source must have a positive skip_first_lines (got %d)", config.SkipFirstLines)
+	}
+
+	if config.SkipFirstLines > 0 && config.Type != FILE_TYPE && config.Type != DIRECTORY_TYPE {
+		return fmt.Errorf("Only a file or directory source can have skip_first_lines")
+	}
+
+	if config.DecoderWorkers < 0 {
+		return fmt.Errorf("A source must have a positive decoder_workers (got %d)", config.DecoderWorkers)
+	}
+
 	if config.Type == TCP_TYPE && config.Port == 0 {
 		return fmt.Errorf("A tcp source must have a port")
 	}
@@ -180,9 +438,55 @@ func validateProcessingRules(rules []LogsProcessingRule) ([]LogsProcessingRule,
 	return rules, nil
 }
 
-// Given a list of tags, buildTagsPayload generates the bytes array that will be inserted
+// Hash returns a hash of the configuration of the source, it changes when the source does.
+// Only the options that are set are hashed, by their name in the configuration,
+// so that the options added to the agent don't change the hash of existing sources
+func (config *IntegrationConfigLogSource) Hash() string {
+	options := make(map[string]interface{})
+	value := reflect.ValueOf(*config)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		option := value.Field(i)
+		// the tags payload is built from the other options
+		if field.Name == "TagsPayload" || isUnset(option) {
+			continue
+		}
+		name := field.Tag.Get("mapstructure")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		options[name] = option.Interface()
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// isUnset returns true for the zero value of an option, and for an empty list
+func isUnset(option reflect.Value) bool {
+	switch option.Kind() {
+	case reflect.Slice, reflect.Map:
+		return option.Len() == 0
+	}
+	return option.IsZero()
+}
+
+// Location returns the zone of the timestamps of the source without an offset
+func (config *IntegrationConfigLogSource) Location() *time.Location {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// Given a list of tags, BuildTagsPayload generates the bytes array that will be inserted
 // into messages
-func buildTagsPayload(configTags, source, sourceCategory string) []byte {
+func BuildTagsPayload(configTags, source, sourceCategory string) []byte {
 
 	tagsPayload := []byte{}
 	if source != "" {
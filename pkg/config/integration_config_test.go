@@ -6,6 +6,7 @@
 package config
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -58,7 +59,53 @@ func TestBuildLogsAgentIntegrationsConfigs(t *testing.T) {
 }
 
 func TestBuildTagsPayload(t *testing.T) {
-	assert.Equal(t, "-", string(buildTagsPayload("", "", "")))
-	assert.Equal(t, "[dd ddtags=\"hello:world\"]", string(buildTagsPayload("hello:world", "", "")))
-	assert.Equal(t, "[dd ddsource=\"nginx\"][dd ddsourcecategory=\"http_access\"][dd ddtags=\"hello:world, hi\"]", string(buildTagsPayload("hello:world, hi", "nginx", "http_access")))
+	assert.Equal(t, "-", string(BuildTagsPayload("", "", "")))
+	assert.Equal(t, "[dd ddtags=\"hello:world\"]", string(BuildTagsPayload("hello:world", "", "")))
+	assert.Equal(t, "[dd ddsource=\"nginx\"][dd ddsourcecategory=\"http_access\"][dd ddtags=\"hello:world, hi\"]", string(BuildTagsPayload("hello:world, hi", "nginx", "http_access")))
+}
+
+func TestExpandPath(t *testing.T) {
+	os.Setenv("TEST_LOG_DIR", "/var/log/app")
+	defer os.Unsetenv("TEST_LOG_DIR")
+	os.Unsetenv("TEST_UNSET_DIR")
+
+	path, err := expandPath("$TEST_LOG_DIR/app.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/log/app/app.log", path)
+	path, err = expandPath("${TEST_LOG_DIR}/*.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/log/app/*.log", path)
+
+	_, err = expandPath("$TEST_UNSET_DIR/app.log")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "TEST_UNSET_DIR")
+
+	home, err := os.UserHomeDir()
+	assert.Nil(t, err)
+	path, err = expandPath("~/logs/app.log")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(home, "logs", "app.log"), path)
+	path, err = expandPath("/var/log/~app.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/log/~app.log", path)
+}
+
+func TestHashOnlyDependsOnTheOptionsSet(t *testing.T) {
+	source := &IntegrationConfigLogSource{Type: FILE_TYPE, Path: "/var/log/app.log", Service: "app"}
+	// the hash of a source is the same across versions of the agent
+	assert.Equal(t, "2e9cbb54bb8a7913", source.Hash())
+
+	// unset options, including empty lists, don't change the hash
+	unset := *source
+	unset.ExcludePaths = []string{}
+	unset.TagsPayload = BuildTagsPayload("", "", "")
+	assert.Equal(t, source.Hash(), unset.Hash())
+
+	changed := *source
+	changed.Format = JSON_FORMAT
+	assert.NotEqual(t, source.Hash(), changed.Hash())
+	follow := false
+	changed = *source
+	changed.Follow = &follow
+	assert.NotEqual(t, source.Hash(), changed.Hash())
 }
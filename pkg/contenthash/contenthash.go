@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package contenthash
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// The algorithms content_hash can be set to
+const (
+	CRC32  = "crc32"
+	FNV    = "fnv"
+	SHA256 = "sha256"
+)
+
+// A Hasher hashes the content of lines and files for the features that compare them:
+// deduplication, sampling and the fingerprints of files
+type Hasher interface {
+	// Name returns the name of the algorithm, as set in content_hash
+	Name() string
+	// Sum returns the hash of the concatenation of data
+	Sum(data ...[]byte) uint64
+}
+
+// hasher hashes content with a standard library hash,
+// its sum is made of the first 8 bytes of the digest
+type hasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+var hashers = map[string]Hasher{
+	CRC32:  &hasher{name: CRC32, newHash: func() hash.Hash { return crc32.NewIEEE() }},
+	FNV:    &hasher{name: FNV, newHash: func() hash.Hash { return fnv.New64a() }},
+	SHA256: &hasher{name: SHA256, newHash: sha256.New},
+}
+
+func (h *hasher) Name() string {
+	return h.name
+}
+
+func (h *hasher) Sum(data ...[]byte) uint64 {
+	digest := h.newHash()
+	for _, d := range data {
+		digest.Write(d)
+	}
+	sum := digest.Sum(nil)
+	if len(sum) > 8 {
+		sum = sum[:8]
+	}
+	var value uint64
+	for _, b := range sum {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// New returns the Hasher of an algorithm
+func New(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown content hash %s", name)
+	}
+	return h, nil
+}
+
+// Configured returns the Hasher of content_hash, fnv when it is unset
+func Configured() Hasher {
+	h, err := New(config.LogsAgent.GetString("content_hash"))
+	if err != nil {
+		return hashers[FNV]
+	}
+	return h
+}
@@ -0,0 +1,50 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package contenthash
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"testing"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumsOfTheAlgorithms(t *testing.T) {
+	content := []byte("hello world")
+
+	h, err := New(CRC32)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(crc32.ChecksumIEEE(content)), h.Sum(content))
+
+	h, err = New(FNV)
+	assert.Nil(t, err)
+	f := fnv.New64a()
+	f.Write(content)
+	assert.Equal(t, f.Sum64(), h.Sum(content))
+
+	h, err = New(SHA256)
+	assert.Nil(t, err)
+	digest := sha256.Sum256(content)
+	assert.Equal(t, binary.BigEndian.Uint64(digest[:8]), h.Sum(content))
+	// the content is hashed as if it was concatenated
+	assert.Equal(t, h.Sum(content), h.Sum([]byte("hello"), []byte(" world")))
+
+	_, err = New("md5")
+	assert.NotNil(t, err)
+}
+
+func TestConfiguredFollowsContentHash(t *testing.T) {
+	defer config.LogsAgent.Set("content_hash", FNV)
+	assert.Equal(t, FNV, Configured().Name())
+	config.LogsAgent.Set("content_hash", SHA256)
+	assert.Equal(t, SHA256, Configured().Name())
+	config.LogsAgent.Set("content_hash", "")
+	assert.Equal(t, FNV, Configured().Name())
+}
@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package decoder
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+const (
+	criPartial = "P"
+	criFull    = "F"
+)
+
+// criLine is a line written by a container runtime:
+// `<timestamp> <stream> <P|F> <content>`
+type criLine struct {
+	timestamp time.Time
+	stream    string
+	partial   bool
+	content   []byte
+}
+
+// parseCRILine parses a line written by a container runtime
+func parseCRILine(line []byte) (*criLine, error) {
+	parts := bytes.SplitN(line, []byte{' '}, 4)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("invalid cri line: %q", line)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, string(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	stream := string(parts[1])
+	if stream != "stdout" && stream != "stderr" {
+		return nil, fmt.Errorf("invalid cri stream: %s", stream)
+	}
+	flag := string(parts[2])
+	if flag != criPartial && flag != criFull {
+		return nil, fmt.Errorf("invalid cri flag: %s", flag)
+	}
+	var content []byte
+	if len(parts) == 4 {
+		content = parts[3]
+	}
+	return &criLine{
+		timestamp: timestamp,
+		stream:    stream,
+		partial:   flag == criPartial,
+		content:   content,
+	}, nil
+}
+
+// criPending holds the content of the partial lines of a stream
+type criPending struct {
+	content bytes.Buffer
+	// start is the offset of the first partial line
+	start int64
+}
+
+// newCRIMessage returns a message for a line written by a container runtime,
+// or nil when the line is partial and its content is kept until the full one.
+// Partial lines are joined per stream, as the runtime interleaves them.
+// A line that can't be parsed falls back to a plain message
+func (d *Decoder) newCRIMessage(content []byte) message.Message {
+	line, err := parseCRILine(content)
+	if err != nil {
+		return message.NewMessage(content)
+	}
+	pending, ok := d.criPending[line.stream]
+	if !ok {
+		pending = &criPending{start: d.lineStart}
+		d.criPending[line.stream] = pending
+	}
+	pending.content.Write(line.content)
+	if line.partial && pending.content.Len() < maxMessageLen {
+		return nil
+	}
+	delete(d.criPending, line.stream)
+	msg := make([]byte, pending.content.Len())
+	copy(msg, pending.content.Bytes())
+	return message.NewCRIMessage(msg, line.timestamp, line.stream)
+}
+
+// commitableOffset returns offset, or the offset of the earliest partial line
+// that is still pending: a restart must read it again, so that the message
+// it belongs to is not split or lost
+func (d *Decoder) commitableOffset(offset int64) int64 {
+	for _, pending := range d.criPending {
+		if pending.start < offset {
+			offset = pending.start
+		}
+	}
+	return offset
+}
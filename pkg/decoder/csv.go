@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package decoder
+
+import (
+	"bytes"
+	"encoding/csv"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// parseCSVRow parses a line of a csv file, a row that doesn't
+// have fieldCount fields is an error unless fieldCount is negative
+func parseCSVRow(line []byte, delimiter rune, fieldCount int) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(line))
+	r.Comma = delimiter
+	r.FieldsPerRecord = fieldCount
+	return r.Read()
+}
+
+// SetCSVHeader sets the header of a csv file, for a file that
+// is not read from its first line. It must be called before the
+// rows of the file are sent to the decoder
+func (d *Decoder) SetCSVHeader(line []byte) error {
+	header, err := parseCSVRow(line, d.csvDelimiter, -1)
+	if err != nil {
+		return err
+	}
+	d.csvHeader = header
+	return nil
+}
+
+// SetCSVHeaderOffset sets the offset of the header of a csv file, for a file
+// that is not read from its first line and whose first lines are skipped
+func (d *Decoder) SetCSVHeaderOffset(offset int64) {
+	d.csvHeaderOffset = offset
+}
+
+// newCSVMessage returns a message for a line of a csv file. The first line
+// of the file, after the skipped ones, is its header, it is read again when the
+// file is truncated and only its offset is sent. A row that can't be parsed,
+// or whose fields don't match the header, falls back to a plain message
+func (d *Decoder) newCSVMessage(content []byte) message.Message {
+	if d.lineStart == d.csvHeaderOffset {
+		if err := d.SetCSVHeader(content); err != nil {
+			return message.NewMessage(content)
+		}
+		return message.NewMessage(nil)
+	}
+	if d.csvHeader == nil {
+		return message.NewMessage(content)
+	}
+	values, err := parseCSVRow(content, d.csvDelimiter, len(d.csvHeader))
+	if err != nil {
+		return message.NewMessage(content)
+	}
+	fields := make(map[string]string, len(values))
+	for i, value := range values {
+		fields[d.csvHeader[i]] = value
+	}
+	return message.NewCSVMessage(content, fields)
+}
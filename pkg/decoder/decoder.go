@@ -7,20 +7,33 @@ package decoder
 
 import (
 	"bytes"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
 )
 
-// Payload represents a list of bytes and an optional reference to its origin
+// Payload represents a list of bytes and an optional reference to its origin,
+// offset is the offset in the file of the first byte of content
 type Payload struct {
 	content []byte
 	offset  int64
+	// msg is forwarded as is once the previous payloads are decoded
+	msg message.Message
 }
 
 // NewPayload returns a new decoder payload
 func NewPayload(content []byte, offset int64) *Payload {
-	return &Payload{content, offset}
+	return &Payload{content: content, offset: offset}
+}
+
+// NewMessagePayload returns a payload forwarding msg after the lines of the previous payloads
+func NewMessagePayload(msg message.Message) *Payload {
+	return &Payload{msg: msg}
 }
 
 // Decoder splits raw data based on `\n`, and sends those messages to a channel
@@ -28,43 +41,191 @@ type Decoder struct {
 	InputChan  chan *Payload
 	OutputChan chan message.Message
 	msgBuffer  *bytes.Buffer
+	format     string
+	// workers is the number of payloads decoded concurrently
+	workers int
+	// criPending holds the partial lines of a container runtime, per stream
+	criPending map[string]*criPending
+	// csvHeader names the fields of the rows of a csv file
+	csvHeader    []string
+	csvDelimiter rune
+	// timestampField is the path of the field holding the time of the
+	// event of a json line, timestampFormat its layout, and
+	// timestampLocation the zone of the timestamps without an offset
+	timestampField    []string
+	timestampFormat   string
+	timestampLocation *time.Location
+	// parse returns the message of a line according to the format
+	parse func(content []byte) message.Message
+
+	// lineOffset is the offset of the end of the last complete line,
+	// it is the only offset that is safe to commit
+	lineOffset int64
+	// lineStart is the offset of the beginning of the line being sent
+	lineStart int64
+	// bufferOffset is the offset of the end of the bytes buffered
+	bufferOffset int64
+	// partialLineTimeout is how long the beginning of a line waits for its end
+	// before being sent on its own, lines always wait for their end when it is zero
+	partialLineTimeout time.Duration
+	// keepLineEnding is true when the lines are sent with their `\n` or `\r\n`
+	keepLineEnding bool
+	// skipLines is the number of lines left to skip at the beginning of the file,
+	// csvHeaderOffset is the offset of the header of a csv file, after them
+	skipLines       int
+	csvHeaderOffset int64
 }
 
 // InitializeDecoder returns a properly initialized Decoder
 func InitializedDecoder() *Decoder {
-	inputChan := make(chan *Payload)
+	inputChan := make(chan *Payload, config.ChanSizes)
 	outputChan := make(chan message.Message)
 	return New(inputChan, outputChan)
 }
 
+// InitializedDecoderFromSource returns a properly initialized Decoder,
+// decoding lines with the format of source. Its input channel holds
+// decoder_chan_size payloads
+func InitializedDecoderFromSource(source *config.IntegrationConfigLogSource) *Decoder {
+	inputChanSize := config.LogsAgent.GetInt("decoder_chan_size")
+	if inputChanSize <= 0 {
+		inputChanSize = config.ChanSizes
+	}
+	d := New(make(chan *Payload, inputChanSize), make(chan message.Message))
+	d.format = source.Format
+	d.workers = source.DecoderWorkers
+	d.partialLineTimeout = time.Duration(source.PartialLineTimeout) * time.Millisecond
+	d.keepLineEnding = source.KeepLineEnding
+	d.csvDelimiter = ','
+	if source.CSVDelimiter != "" {
+		d.csvDelimiter, _ = utf8.DecodeRuneInString(source.CSVDelimiter)
+	}
+	if source.TimestampField != "" {
+		d.timestampField = strings.Split(source.TimestampField, ".")
+		d.timestampFormat = source.TimestampFormat
+		if d.timestampFormat == "" {
+			d.timestampFormat = time.RFC3339Nano
+		}
+		d.timestampLocation = source.Location()
+	}
+	return d
+}
+
 // New returns an initialized Decoder
 func New(InputChan chan *Payload, OutputChan chan message.Message) *Decoder {
 	var msgBuf bytes.Buffer
-	return &Decoder{
+	d := &Decoder{
 		InputChan:  InputChan,
 		OutputChan: OutputChan,
 		msgBuffer:  &msgBuf,
+		criPending: make(map[string]*criPending),
 	}
+	d.parse = d.parseLine
+	return d
 }
 
-// Start starts the Decoder
+// Start starts the Decoder, partial cri lines and csv headers
+// depend on the previous lines so they are never decoded concurrently,
+// nor are the lines that can be sent before their end or skipped
 func (d *Decoder) Start() {
+	if d.workers > 1 && d.format != config.CRI_FORMAT && d.format != config.CSV_FORMAT && d.partialLineTimeout == 0 && d.skipLines == 0 {
+		go d.runWorkers()
+		return
+	}
 	go d.run()
 }
 
 // run lets the Decoder handle data coming from the InputChan
 func (d *Decoder) run() {
+	if d.partialLineTimeout > 0 {
+		d.runWithPartialLines()
+		return
+	}
 	for data := range d.InputChan {
+		if data.msg != nil {
+			d.OutputChan <- data.msg
+			continue
+		}
 		d.decodeIncomingData(data.content, data.offset)
 	}
 	d.OutputChan <- message.NewStopMessage()
 }
 
+// runWithPartialLines lets the Decoder handle data coming from the InputChan,
+// the beginning of a line is sent when its end doesn't come in time
+func (d *Decoder) runWithPartialLines() {
+	timer := time.NewTimer(d.partialLineTimeout)
+	waiting := true
+	stopTimer := func() {
+		if waiting && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		waiting = false
+	}
+	stopTimer()
+	for {
+		select {
+		case data, ok := <-d.InputChan:
+			if !ok {
+				stopTimer()
+				d.OutputChan <- message.NewStopMessage()
+				return
+			}
+			if data.msg != nil {
+				d.OutputChan <- data.msg
+				continue
+			}
+			lineOffset := d.lineOffset
+			d.decodeIncomingData(data.content, data.offset)
+			switch {
+			case d.msgBuffer.Len() == 0:
+				stopTimer()
+			case !waiting || d.lineOffset != lineOffset:
+				// a new line started, it waits for its end from now on
+				stopTimer()
+				timer.Reset(d.partialLineTimeout)
+				waiting = true
+			}
+		case <-timer.C:
+			waiting = false
+			d.sendPartialLine()
+		}
+	}
+}
+
+// SkipLines lets the decoder skip the first n lines of a file read from its beginning,
+// only their offset is sent. It must be called before the decoder is started
+func (d *Decoder) SkipLines(n int) {
+	d.skipLines = n
+}
+
+// skipLine discards the line in the buffer, and sends its offset
+func (d *Decoder) skipLine() {
+	d.msgBuffer.Reset()
+	d.skipLines--
+	if d.skipLines == 0 {
+		d.csvHeaderOffset = d.lineOffset
+	}
+	m := message.NewMessage(nil)
+	o := message.NewOrigin()
+	o.Offset = d.commitableOffset(d.lineOffset)
+	m.SetOrigin(o)
+	d.OutputChan <- m
+}
+
 // Stop stops the Decoder
 func (d *Decoder) Stop() {
 	close(d.InputChan)
 }
 
+// InputQueueDepth returns the number of payloads waiting to be decoded
+func (d *Decoder) InputQueueDepth() int {
+	return len(d.InputChan)
+}
+
 var truncatedMsg = []byte("...TRUNCATED...")
 var truncatedLen = len(truncatedMsg)
 var maxMessageLen = config.MaxMessageLen - truncatedLen
@@ -75,34 +236,115 @@ func (d *Decoder) sendBuffuredMessage(offset int64) {
 	// d.msgBuffer.Bytes() returns a slice to the []byte, we thus need to copy it
 	copy(msg, d.msgBuffer.Bytes())
 	if len(msg) > 0 {
-		m := message.NewMessage(msg)
+		m := d.newMessage(msg)
+		if m == nil {
+			// the line is partial, it will be sent with the next ones
+			d.msgBuffer.Reset()
+			return
+		}
 		o := message.NewOrigin()
-		o.Offset = offset
+		o.Offset = d.commitableOffset(offset)
 		m.SetOrigin(o)
 		d.OutputChan <- m
 	}
 	d.msgBuffer.Reset()
 }
 
-// decodeIncomingData splits raw data based on `\n`, creates and sends messages to a channel
+// sendPartialLine sends the beginning of the line being read, flagged as partial.
+// Its offset is commited, the rest of the line is sent once read
+func (d *Decoder) sendPartialLine() {
+	if d.msgBuffer.Len() == 0 {
+		return
+	}
+	content := make([]byte, d.msgBuffer.Len())
+	copy(content, d.msgBuffer.Bytes())
+	d.msgBuffer.Reset()
+	d.lineOffset = d.bufferOffset
+	m := message.NewMessage(content)
+	o := message.NewOrigin()
+	o.Offset = d.lineOffset
+	o.Partial = true
+	m.SetOrigin(o)
+	d.OutputChan <- m
+}
+
+// maxLoggedLineLen is the number of bytes logged of a line that can't be decoded
+const maxLoggedLineLen = 256
+
+// newMessage returns a message for a line, parsed according to the decoder format.
+// A line whose parsing panics is logged and falls back to a plain message,
+// so that the lines after it are still decoded
+func (d *Decoder) newMessage(content []byte) (msg message.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logged := content
+			if len(logged) > maxLoggedLineLen {
+				logged = logged[:maxLoggedLineLen]
+			}
+			log.Println("Can't decode the line", string(logged), ":", r)
+			metrics.DecoderPanics.Add(1)
+			msg = message.NewMessage(content)
+		}
+	}()
+	return d.parse(content)
+}
+
+// parseLine returns a message for a line, parsed according to the decoder format.
+// A line that can't be parsed falls back to a plain message
+func (d *Decoder) parseLine(content []byte) message.Message {
+	switch d.format {
+	case config.JSON_FORMAT:
+		if jsonMsg := d.newJSONMessage(content); jsonMsg != nil {
+			return jsonMsg
+		}
+	case config.CRI_FORMAT:
+		return d.newCRIMessage(content)
+	case config.CSV_FORMAT:
+		return d.newCSVMessage(content)
+	}
+	return message.NewMessage(content)
+}
+
+// decodeIncomingData splits raw data based on `\n`, creates and sends messages to a channel.
+// Messages carry the offset of the last complete line, so that an offset is never
+// commited in the middle of a line. The `\n` is stripped unless the decoder keeps line endings
 func (d *Decoder) decodeIncomingData(inBuf []byte, offset int64) {
+	if d.msgBuffer.Len() == 0 {
+		// nothing is pending, inBuf starts at the beginning of a line
+		d.lineOffset = offset
+	}
 	var i, j = 0, 0
 	var maxj = maxMessageLen - d.msgBuffer.Len()
 	// Note: we will truncate messages of length MaxLen - truncatedLen
 	// instead of MaxLen. We'll live with it for now
 	for ; j < len(inBuf); j++ {
 		if inBuf[j] == '\n' {
-			d.msgBuffer.Write(inBuf[i:j])
-			d.sendBuffuredMessage(offset + int64(j+1))
+			d.msgBuffer.Write(inBuf[i:d.lineEnd(j)])
+			d.lineStart = d.lineOffset
+			d.lineOffset = offset + int64(j+1)
+			if d.skipLines > 0 {
+				d.skipLine()
+			} else {
+				d.sendBuffuredMessage(d.lineOffset)
+			}
 			i = j + 1 // +1 as we skip the `\n`
 			maxj = maxMessageLen - d.msgBuffer.Len()
 		} else if j == maxj {
 			d.msgBuffer.Write(inBuf[i:j])
 			d.msgBuffer.Write(truncatedMsg)
-			d.sendBuffuredMessage(offset + int64(j))
+			d.sendBuffuredMessage(d.lineOffset)
 			d.msgBuffer.Write(truncatedMsg)
 			i = j
 		}
 	}
 	d.msgBuffer.Write(inBuf[i:j])
+	d.bufferOffset = offset + int64(len(inBuf))
+}
+
+// lineEnd returns the end of the content of a line whose `\n` is at index j
+func (d *Decoder) lineEnd(j int) int {
+	if d.keepLineEnding {
+		return j + 1
+	}
+	return j
 }
@@ -6,12 +6,15 @@
 package decoder
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -91,6 +94,356 @@ func TestDecodeIncomingData(t *testing.T) {
 	assert.Equal(t, int64(30), out.GetOrigin().Offset)
 }
 
+func TestDecoderOffsetsStayOnLineBoundaries(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := New(nil, outChan)
+
+	var out message.Message
+
+	// a truncated line keeps the offset of the previous complete line
+	d.decodeIncomingData([]byte("hello\n"), 10)
+	out = <-outChan
+	assert.Equal(t, int64(16), out.GetOrigin().Offset)
+	d.decodeIncomingData([]byte(strings.Repeat("a", config.MaxMessageLen)), 16)
+	out = <-outChan
+	assert.Equal(t, config.MaxMessageLen, len(out.Content()))
+	assert.Equal(t, int64(16), out.GetOrigin().Offset)
+	d.decodeIncomingData([]byte("\n"), int64(16+config.MaxMessageLen))
+	out = <-outChan
+	assert.Equal(t, int64(17+config.MaxMessageLen), out.GetOrigin().Offset)
+
+	// a partial line is not sent
+	d.decodeIncomingData([]byte("world"), 100)
+	assert.Equal(t, 0, len(outChan))
+	d.decodeIncomingData([]byte("!\n"), 105)
+	out = <-outChan
+	assert.Equal(t, "world!", string(out.Content()))
+	assert.Equal(t, int64(107), out.GetOrigin().Offset)
+}
+
+func TestDecoderComputesOffsetPerLine(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := New(nil, outChan)
+
+	// several lines in one payload each get the offset of their own end
+	d.decodeIncomingData([]byte("a\nbb\n\nccc\ndd"), 100)
+	out := <-outChan
+	assert.Equal(t, "a", string(out.Content()))
+	assert.Equal(t, int64(102), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "bb", string(out.Content()))
+	assert.Equal(t, int64(105), out.GetOrigin().Offset)
+	// the empty line is not sent, the next line carries its offset
+	out = <-outChan
+	assert.Equal(t, "ccc", string(out.Content()))
+	assert.Equal(t, int64(110), out.GetOrigin().Offset)
+	assert.Equal(t, 0, len(outChan))
+
+	d.decodeIncomingData([]byte("d\n"), 112)
+	out = <-outChan
+	assert.Equal(t, "ddd", string(out.Content()))
+	assert.Equal(t, int64(114), out.GetOrigin().Offset)
+}
+
+func TestDecoderStripsOrKeepsLineEndings(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		outChan := make(chan message.Message, 10)
+		d := New(nil, outChan)
+		d.keepLineEnding = keep
+
+		d.decodeIncomingData([]byte("unix\nwindows\r\n"), 0)
+		unix, windows := <-outChan, <-outChan
+		if keep {
+			assert.Equal(t, "unix\n", string(unix.Content()))
+			assert.Equal(t, "windows\r\n", string(windows.Content()))
+		} else {
+			assert.Equal(t, "unix", string(unix.Content()))
+			// only the `\n` is stripped
+			assert.Equal(t, "windows\r", string(windows.Content()))
+		}
+		// offsets don't depend on the content
+		assert.Equal(t, int64(5), unix.GetOrigin().Offset)
+		assert.Equal(t, int64(14), windows.GetOrigin().Offset)
+	}
+}
+
+func TestDecoderWorkersKeepLineEndings(t *testing.T) {
+	inChan := make(chan *Payload, 10)
+	outChan := make(chan message.Message, 10)
+	d := New(inChan, outChan)
+	d.workers = 2
+	d.keepLineEnding = true
+	d.Start()
+	defer d.Stop()
+
+	inChan <- NewPayload([]byte("first\nsecond\r\nthi"), 0)
+	inChan <- NewPayload([]byte("rd\r\n"), 19)
+	for _, expected := range []string{"first\n", "second\r\n", "third\r\n"} {
+		out := <-outChan
+		assert.Equal(t, expected, string(out.Content()))
+	}
+}
+
+func TestDecoderParsesJSON(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.JSON_FORMAT})
+	d.OutputChan = outChan
+
+	d.decodeIncomingData([]byte("{\"status\":\"error\",\"count\":2}\n"), 0)
+	out := <-outChan
+	jsonMsg, ok := out.(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, "{\"status\":\"error\",\"count\":2}", string(jsonMsg.Content()))
+	assert.Equal(t, "error", jsonMsg.Fields()["status"])
+	assert.Equal(t, float64(2), jsonMsg.Fields()["count"])
+	assert.Equal(t, int64(29), jsonMsg.GetOrigin().Offset)
+
+	d.decodeIncomingData([]byte("{\"status\":\n"), 29)
+	out = <-outChan
+	_, ok = out.(*message.JSONMessage)
+	assert.False(t, ok)
+	assert.Equal(t, "{\"status\":", string(out.Content()))
+	assert.Equal(t, int64(40), out.GetOrigin().Offset)
+}
+
+func TestDecoderReadsTheTimestampOfJSONLines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, TimestampField: "ts"})
+	d.OutputChan = outChan
+
+	d.decodeIncomingData([]byte("{\"ts\":\"2024-06-01T12:00:00.5Z\",\"msg\":\"hello\"}\n"), 0)
+	jsonMsg, ok := (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 500000000, time.UTC), jsonMsg.Timestamp)
+
+	d.decodeIncomingData([]byte("{\"ts\":1717243200,\"msg\":\"hello\"}\n"), 0)
+	jsonMsg, ok = (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), jsonMsg.Timestamp)
+}
+
+func TestDecoderReadsTheTimestampOfJSONLinesInNestedFields(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	source := &config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, TimestampField: "meta.time", TimestampFormat: "2006-01-02 15:04:05"}
+	d := InitializedDecoderFromSource(source)
+	d.OutputChan = outChan
+
+	d.decodeIncomingData([]byte("{\"meta\":{\"time\":\"2024-06-01 12:00:00\"},\"msg\":\"hello\"}\n"), 0)
+	jsonMsg, ok := (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), jsonMsg.Timestamp)
+	assert.Equal(t, jsonMsg.Timestamp, message.EventTimestamp(jsonMsg))
+}
+
+func TestDecoderParsesTheTimestampsWithoutOffsetInTheTimezoneOfTheSource(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	source := &config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, TimestampField: "ts", TimestampFormat: "2006-01-02 15:04:05", Timezone: "America/New_York"}
+	d := InitializedDecoderFromSource(source)
+	d.OutputChan = outChan
+
+	// EDT in summer, EST in winter
+	d.decodeIncomingData([]byte("{\"ts\":\"2024-06-01 12:00:00\"}\n"), 0)
+	jsonMsg, ok := (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 1, 16, 0, 0, 0, time.UTC), jsonMsg.Timestamp)
+
+	d.decodeIncomingData([]byte("{\"ts\":\"2024-01-15 12:00:00\"}\n"), 0)
+	jsonMsg, ok = (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 15, 17, 0, 0, 0, time.UTC), jsonMsg.Timestamp)
+}
+
+func TestDecoderKeepsTheOffsetOfTimestampsInTheTimezoneOfTheSource(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	source := &config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, TimestampField: "ts", Timezone: "America/New_York"}
+	d := InitializedDecoderFromSource(source)
+	d.OutputChan = outChan
+
+	d.decodeIncomingData([]byte("{\"ts\":\"2024-06-01T12:00:00+02:00\"}\n"), 0)
+	jsonMsg, ok := (<-outChan).(*message.JSONMessage)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), jsonMsg.Timestamp)
+}
+
+func TestDecoderCountsJSONLinesWithoutTimestamp(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, TimestampField: "meta.time"})
+	d.OutputChan = outChan
+
+	errors := metrics.TimestampFieldErrors.Value()
+	for _, line := range []string{"{\"msg\":\"hello\"}\n", "{\"meta\":\"time\"}\n", "{\"meta\":{\"time\":\"yesterday\"}}\n"} {
+		d.decodeIncomingData([]byte(line), 0)
+		jsonMsg, ok := (<-outChan).(*message.JSONMessage)
+		assert.True(t, ok)
+		assert.True(t, jsonMsg.Timestamp.IsZero())
+	}
+	assert.Equal(t, errors+3, metrics.TimestampFieldErrors.Value())
+}
+
+func TestDecoderParsesCRILines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CRI_FORMAT})
+	d.OutputChan = outChan
+
+	line := "2024-06-01T12:00:00.000Z stdout F the message\n"
+	d.decodeIncomingData([]byte(line), 0)
+	out := <-outChan
+	criMsg, ok := out.(*message.CRIMessage)
+	assert.True(t, ok)
+	assert.Equal(t, "the message", string(criMsg.Content()))
+	assert.Equal(t, "stdout", criMsg.Stream)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), criMsg.Timestamp)
+	assert.Equal(t, int64(len(line)), criMsg.GetOrigin().Offset)
+}
+
+func TestDecoderJoinsPartialCRILines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CRI_FORMAT})
+	d.OutputChan = outChan
+
+	content := "2024-06-01T12:00:00.000Z stderr P a long \n" +
+		"2024-06-01T12:00:00.001Z stderr P message \n" +
+		"2024-06-01T12:00:00.002Z stderr F split in three\n"
+	d.decodeIncomingData([]byte(content), 0)
+	out := <-outChan
+	criMsg, ok := out.(*message.CRIMessage)
+	assert.True(t, ok)
+	assert.Equal(t, "a long message split in three", string(criMsg.Content()))
+	assert.Equal(t, "stderr", criMsg.Stream)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 2000000, time.UTC), criMsg.Timestamp)
+	// the offset is only commited once the line is complete
+	assert.Equal(t, int64(len(content)), criMsg.GetOrigin().Offset)
+	assert.Equal(t, 0, len(outChan))
+}
+
+func TestDecoderNeverCommitsPastPendingCRILines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CRI_FORMAT})
+	d.OutputChan = outChan
+
+	first := "2024-06-01T12:00:00.000Z stdout F first\n"
+	partial := "2024-06-01T12:00:00.001Z stdout P hello \n"
+	interleaved := "2024-06-01T12:00:00.002Z stderr F boom\n"
+	full := "2024-06-01T12:00:00.003Z stdout F world\n"
+	d.decodeIncomingData([]byte(first+partial+interleaved+"malformed\n"+full), 0)
+
+	out := <-outChan
+	assert.Equal(t, int64(len(first)), out.GetOrigin().Offset)
+	// the lines read while a message is pending don't move the offset past it
+	out = <-outChan
+	assert.Equal(t, "boom", string(out.Content()))
+	assert.Equal(t, int64(len(first)), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "malformed", string(out.Content()))
+	assert.Equal(t, int64(len(first)), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "hello world", string(out.Content()))
+	assert.Equal(t, int64(len(first+partial+interleaved+"malformed\n"+full)), out.GetOrigin().Offset)
+}
+
+func TestDecoderFallsBackToRawForMalformedCRILines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CRI_FORMAT})
+	d.OutputChan = outChan
+
+	d.decodeIncomingData([]byte("not a cri line\n"), 0)
+	out := <-outChan
+	_, ok := out.(*message.CRIMessage)
+	assert.False(t, ok)
+	assert.Equal(t, "not a cri line", string(out.Content()))
+	assert.Equal(t, int64(15), out.GetOrigin().Offset)
+}
+
+func TestDecoderParsesCSVRows(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CSV_FORMAT, CSVDelimiter: "\t"})
+	d.OutputChan = outChan
+
+	content := "time\tlevel\tmessage\n2024-06-01\tinfo\thello world\n"
+	d.decodeIncomingData([]byte(content), 0)
+	// the header is not a log line, only its offset is sent
+	out := <-outChan
+	assert.Equal(t, 0, len(out.Content()))
+	assert.Equal(t, int64(19), out.GetOrigin().Offset)
+	out = <-outChan
+	csvMsg, ok := out.(*message.CSVMessage)
+	assert.True(t, ok)
+	assert.Equal(t, "2024-06-01\tinfo\thello world", string(csvMsg.Content()))
+	assert.Equal(t, map[string]string{"time": "2024-06-01", "level": "info", "message": "hello world"}, csvMsg.Fields())
+	assert.Equal(t, int64(len(content)), csvMsg.GetOrigin().Offset)
+
+	// the file is truncated, its header is read again
+	d.decodeIncomingData([]byte("level\tmessage\nerror\tboom\n"), 0)
+	<-outChan
+	out = <-outChan
+	assert.Equal(t, map[string]string{"level": "error", "message": "boom"}, out.(*message.CSVMessage).Fields())
+}
+
+func TestDecoderFallsBackToRawForRaggedCSVRows(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CSV_FORMAT})
+	d.OutputChan = outChan
+	assert.Nil(t, d.SetCSVHeader([]byte("time,level,message")))
+
+	d.decodeIncomingData([]byte("2024-06-01,info\n"), 100)
+	out := <-outChan
+	_, ok := out.(*message.CSVMessage)
+	assert.False(t, ok)
+	assert.Equal(t, "2024-06-01,info", string(out.Content()))
+	assert.Equal(t, int64(116), out.GetOrigin().Offset)
+
+	d.decodeIncomingData([]byte("2024-06-01,info,\"hello, world\"\n"), 116)
+	out = <-outChan
+	assert.Equal(t, "hello, world", out.(*message.CSVMessage).Fields()["message"])
+}
+
+func TestDecoderSkipsTheFirstLines(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := New(nil, outChan)
+	d.SkipLines(1)
+
+	d.decodeIncomingData([]byte("banner\nfirst\n"), 0)
+	// the banner is not forwarded, only its offset is sent
+	out := <-outChan
+	assert.Equal(t, 0, len(out.Content()))
+	assert.Equal(t, int64(7), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "first", string(out.Content()))
+	assert.Equal(t, int64(13), out.GetOrigin().Offset)
+}
+
+func TestDecoderSkipsMoreLinesThanTheFileHas(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := New(nil, outChan)
+	d.SkipLines(3)
+
+	d.decodeIncomingData([]byte("one\ntwo\n"), 0)
+	assert.Equal(t, int64(4), (<-outChan).GetOrigin().Offset)
+	assert.Equal(t, int64(8), (<-outChan).GetOrigin().Offset)
+	// the lines written afterwards are skipped until there are enough of them
+	d.decodeIncomingData([]byte("three\nfour\n"), 8)
+	out := <-outChan
+	assert.Equal(t, 0, len(out.Content()))
+	assert.Equal(t, int64(14), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "four", string(out.Content()))
+	assert.Equal(t, int64(19), out.GetOrigin().Offset)
+}
+
+func TestDecoderSkipsTheFirstLinesBeforeTheCSVHeader(t *testing.T) {
+	outChan := make(chan message.Message, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.CSV_FORMAT})
+	d.OutputChan = outChan
+	d.SkipLines(1)
+
+	d.decodeIncomingData([]byte("# exported logs\nlevel,message\ninfo,hello\n"), 0)
+	// the banner and the header are not log lines
+	assert.Equal(t, int64(16), (<-outChan).GetOrigin().Offset)
+	assert.Equal(t, int64(30), (<-outChan).GetOrigin().Offset)
+	out := <-outChan
+	assert.Equal(t, map[string]string{"level": "info", "message": "hello"}, out.(*message.CSVMessage).Fields())
+}
+
 func TestDecoderLifecycle(t *testing.T) {
 	inChan := make(chan *Payload, 10)
 	outChan := make(chan message.Message, 10)
@@ -102,7 +455,119 @@ func TestDecoderLifecycle(t *testing.T) {
 	out = <-outChan
 	assert.Equal(t, "helloworld", string(out.Content()))
 
+	// a message payload is forwarded after the lines of the previous payloads
+	statusMsg := message.NewStatusMessage(message.CAUGHT_UP_STATUS, nil)
+	inChan <- NewPayload([]byte(("hello")), 11)
+	inChan <- NewPayload([]byte(("world\n")), 16)
+	inChan <- NewMessagePayload(statusMsg)
+	out = <-outChan
+	assert.Equal(t, "helloworld", string(out.Content()))
+	out = <-outChan
+	assert.Equal(t, statusMsg, out)
+
 	d.Stop()
 	out = <-outChan
 	assert.Equal(t, reflect.TypeOf(out), reflect.TypeOf(message.NewStopMessage()))
 }
+
+func TestDecoderWorkersKeepFileOrder(t *testing.T) {
+	var content []byte
+	for i := 0; i < 500; i++ {
+		content = append(content, []byte(fmt.Sprintf("{\"line\":%d}\n", i))...)
+	}
+	inChan := make(chan *Payload, 10)
+	d := InitializedDecoderFromSource(&config.IntegrationConfigLogSource{Format: config.JSON_FORMAT, DecoderWorkers: 4})
+	d.InputChan = inChan
+	d.Start()
+
+	// payloads cut lines at arbitrary places
+	go func() {
+		for offset := 0; offset < len(content); offset += 37 {
+			end := offset + 37
+			if end > len(content) {
+				end = len(content)
+			}
+			inChan <- NewPayload(content[offset:end], int64(offset))
+		}
+		d.Stop()
+	}()
+
+	var offset int64
+	for i := 0; i < 500; i++ {
+		out := <-d.OutputChan
+		line := fmt.Sprintf("{\"line\":%d}", i)
+		assert.Equal(t, line, string(out.Content()))
+		_, ok := out.(*message.JSONMessage)
+		assert.True(t, ok)
+		offset += int64(len(line) + 1)
+		assert.Equal(t, offset, out.GetOrigin().Offset)
+	}
+	out := <-d.OutputChan
+	assert.Equal(t, reflect.TypeOf(out), reflect.TypeOf(message.NewStopMessage()))
+}
+
+func TestDecoderSendsPartialLinesAfterTimeout(t *testing.T) {
+	inChan := make(chan *Payload, 10)
+	outChan := make(chan message.Message, 10)
+	d := New(inChan, outChan)
+	d.partialLineTimeout = 50 * time.Millisecond
+	d.Start()
+	defer d.Stop()
+
+	inChan <- NewPayload([]byte("hello\nDownloading... 10%"), 0)
+	out := <-outChan
+	assert.Equal(t, "hello", string(out.Content()))
+	assert.False(t, out.GetOrigin().Partial)
+
+	// the end of the line doesn't come in time
+	start := time.Now()
+	out = <-outChan
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+	assert.Equal(t, "Downloading... 10%", string(out.Content()))
+	assert.True(t, out.GetOrigin().Partial)
+	assert.Equal(t, int64(24), out.GetOrigin().Offset)
+
+	// the line continues where it was sent
+	inChan <- NewPayload([]byte(" done\nbye\n"), 24)
+	out = <-outChan
+	assert.Equal(t, " done", string(out.Content()))
+	assert.False(t, out.GetOrigin().Partial)
+	assert.Equal(t, int64(30), out.GetOrigin().Offset)
+	out = <-outChan
+	assert.Equal(t, "bye", string(out.Content()))
+	assert.Equal(t, int64(34), out.GetOrigin().Offset)
+
+	// complete lines are not delayed
+	select {
+	case out = <-outChan:
+		assert.Fail(t, "unexpected message", string(out.Content()))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDecoderKeepsDecodingAfterAPanic(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		inChan := make(chan *Payload, 10)
+		outChan := make(chan message.Message, 10)
+		d := New(inChan, outChan)
+		d.workers = workers
+		d.parse = func(content []byte) message.Message {
+			if string(content) == "boom" {
+				panic("can't parse boom")
+			}
+			return d.parseLine(content)
+		}
+		panics := metrics.DecoderPanics.Value()
+		d.Start()
+
+		inChan <- NewPayload([]byte("hello\nboom\nworld\n"), 0)
+		d.Stop()
+		for _, expected := range []string{"hello", "boom", "world"} {
+			out := <-outChan
+			assert.Equal(t, expected, string(out.Content()))
+		}
+		out := <-outChan
+		assert.Equal(t, reflect.TypeOf(out), reflect.TypeOf(message.NewStopMessage()))
+		assert.Equal(t, panics+1, metrics.DecoderPanics.Value())
+	}
+}
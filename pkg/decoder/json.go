@@ -0,0 +1,69 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package decoder
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// newJSONMessage returns a message for a line of a json source, or nil when it
+// is not a JSON object. The time of the event is read from the timestamp field,
+// a line without a valid one is timestamped when it is processed
+func (d *Decoder) newJSONMessage(content []byte) message.Message {
+	jsonMsg, err := message.NewJSONMessage(content)
+	if err != nil {
+		return nil
+	}
+	if d.timestampField == nil {
+		return jsonMsg
+	}
+	timestamp, err := parseJSONTimestamp(lookupJSONField(jsonMsg.Fields(), d.timestampField), d.timestampFormat, d.timestampLocation)
+	if err != nil {
+		metrics.TimestampFieldErrors.Add(1)
+		return jsonMsg
+	}
+	jsonMsg.Timestamp = timestamp
+	return jsonMsg
+}
+
+// lookupJSONField returns the value at path in fields, the
+// keys of the nested objects, or nil when it is missing
+func lookupJSONField(fields map[string]interface{}, path []string) interface{} {
+	var value interface{} = fields
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// parseJSONTimestamp parses the value of a timestamp field, a string
+// with layout, in location when it has no offset, or a number of seconds since the epoch
+func parseJSONTimestamp(value interface{}, layout string, location *time.Location) (time.Time, error) {
+	switch v := value.(type) {
+	case string:
+		timestamp, err := time.ParseInLocation(layout, v, location)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return timestamp.UTC(), nil
+	case float64:
+		seconds, fraction := math.Modf(v)
+		return time.Unix(int64(seconds), int64(fraction*1e9)).UTC(), nil
+	case nil:
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp: %v", v)
+	}
+}
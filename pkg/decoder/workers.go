@@ -0,0 +1,109 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package decoder
+
+import (
+	"bytes"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// decodedPayload is a payload split by a worker: head and tail are the
+// bytes before the first and after the last `\n`, they belong to lines
+// spanning several payloads and are decoded in order by the decoder
+type decodedPayload struct {
+	payload  *Payload
+	head     []byte
+	messages []message.Message
+	tail     []byte
+	// raw is true when the payload has to be decoded in order entirely
+	raw bool
+}
+
+// job is a payload to decode, its result is sent on done
+type job struct {
+	payload *Payload
+	done    chan *decodedPayload
+}
+
+// runWorkers lets workers decode the payloads of the InputChan concurrently,
+// messages are still sent in the order of the payloads in the file
+func (d *Decoder) runWorkers() {
+	jobs := make(chan *job, d.workers)
+	pending := make(chan *job, d.workers)
+	for i := 0; i < d.workers; i++ {
+		go func() {
+			for j := range jobs {
+				j.done <- d.splitPayload(j.payload)
+			}
+		}()
+	}
+	go func() {
+		for data := range d.InputChan {
+			j := &job{data, make(chan *decodedPayload, 1)}
+			// pending is filled first, so that results are read in order
+			pending <- j
+			jobs <- j
+		}
+		close(jobs)
+		close(pending)
+	}()
+	for j := range pending {
+		d.sendDecodedPayload(<-j.done)
+	}
+	d.OutputChan <- message.NewStopMessage()
+}
+
+// splitPayload parses the complete lines of a payload,
+// messages carry the offset of the end of their line
+func (d *Decoder) splitPayload(p *Payload) *decodedPayload {
+	first := bytes.IndexByte(p.content, '\n')
+	last := bytes.LastIndexByte(p.content, '\n')
+	if first == -1 {
+		return &decodedPayload{payload: p, raw: true}
+	}
+	decoded := &decodedPayload{
+		payload: p,
+		head:    p.content[:first+1],
+		tail:    p.content[last+1:],
+	}
+	for i := first + 1; i <= last; {
+		j := i + bytes.IndexByte(p.content[i:], '\n')
+		if j-i > maxMessageLen {
+			// the line has to be truncated
+			return &decodedPayload{payload: p, raw: true}
+		}
+		if end := d.lineEnd(j); end > i {
+			m := d.newMessage(append([]byte{}, p.content[i:end]...))
+			o := message.NewOrigin()
+			o.Offset = p.offset + int64(j+1)
+			m.SetOrigin(o)
+			decoded.messages = append(decoded.messages, m)
+		}
+		i = j + 1
+	}
+	return decoded
+}
+
+// sendDecodedPayload sends the messages of a payload split by a worker
+func (d *Decoder) sendDecodedPayload(decoded *decodedPayload) {
+	p := decoded.payload
+	if p.msg != nil {
+		d.OutputChan <- p.msg
+		return
+	}
+	if decoded.raw {
+		d.decodeIncomingData(p.content, p.offset)
+		return
+	}
+	d.decodeIncomingData(decoded.head, p.offset)
+	for _, m := range decoded.messages {
+		d.OutputChan <- m
+	}
+	tailOffset := p.offset + int64(len(p.content)-len(decoded.tail))
+	d.lineOffset = tailOffset
+	d.decodeIncomingData(decoded.tail, tailOffset)
+}
@@ -6,21 +6,27 @@
 package listener
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/decoder"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
+	"github.com/DataDog/datadog-log-agent/pkg/wal"
 )
 
-// A NetworkListener implements the methods run and readMessages,
+// A NetworkListener implements the methods run, readMessages and stop,
 // required by the AbstractNetworkListener to run properly
 type NetworkListener interface {
 	run()
 	readMessage(net.Conn, []byte) (int, error)
+	// stop stops accepting data, and closes the connections being read
+	stop()
 }
 
 // AbstractNetworkListener is an abstracted network listener.
@@ -29,13 +35,60 @@ type AbstractNetworkListener struct {
 	listener NetworkListener
 	pp       *pipeline.PipelineProvider
 	source   *config.IntegrationConfigLogSource
+	// wal keeps the messages until they are commited, as they can't be received again
+	wal *wal.WAL
+
+	// connections are the connections being read, they are waited for on stop
+	connections sync.WaitGroup
+	stopped     chan struct{}
+	stopOnce    sync.Once
 }
 
-// Start starts the AbstractNetworkListener
+// Start starts the AbstractNetworkListener, the messages of the previous run
+// that were never commited are forwarded before the new ones
 func (anl *AbstractNetworkListener) Start() {
+	anl.replayWAL()
 	go anl.listener.run()
 }
 
+// Stop stops the AbstractNetworkListener once the messages
+// already received are forwarded to the pipeline
+func (anl *AbstractNetworkListener) Stop() {
+	anl.stopOnce.Do(func() {
+		close(anl.stopped)
+		anl.listener.stop()
+	})
+	anl.connections.Wait()
+}
+
+// isStopped returns true once the AbstractNetworkListener is stopped
+func (anl *AbstractNetworkListener) isStopped() bool {
+	select {
+	case <-anl.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// walSource returns the key of the messages of the listener in the WAL
+func (anl *AbstractNetworkListener) walSource() string {
+	return fmt.Sprintf("%s:%d", anl.source.Type, anl.source.Port)
+}
+
+// replayWAL forwards the messages of the previous run that were never commited
+func (anl *AbstractNetworkListener) replayWAL() {
+	if anl.wal == nil {
+		return
+	}
+	outputChan := anl.pp.NextPipelineChan()
+	for _, entry := range anl.wal.Recovered(anl.walSource()) {
+		netMsg := message.NewNetworkMessage(entry.Content)
+		netMsg.SetOrigin(message.NewOriginBuilder().LogSource(anl.source).WALSeq(entry.Seq).Build())
+		outputChan <- netMsg
+	}
+}
+
 // forwardMessages lets the AbstractNetworkListener forward log messages to the output channel
 func (anl *AbstractNetworkListener) forwardMessages(d *decoder.Decoder, outputChan chan message.Message) {
 	for msg := range d.OutputChan {
@@ -48,27 +101,49 @@ func (anl *AbstractNetworkListener) forwardMessages(d *decoder.Decoder, outputCh
 		netMsg := message.NewNetworkMessage(msg.Content())
 		o := message.NewOrigin()
 		o.LogSource = anl.source
+		if anl.source.Identifier != "" {
+			// a file source with the same identifier resumes at the time of the last message commited
+			o.Identifier = fmt.Sprintf("file:%s", anl.source.Identifier)
+			o.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		if anl.wal != nil {
+			seq, err := anl.wal.Append(anl.walSource(), netMsg.Content())
+			if err != nil && err != wal.ErrFull {
+				log.Println("Can't append a message to the WAL:", err)
+			}
+			o.WALSeq = seq
+		}
 		netMsg.SetOrigin(o)
 		outputChan <- netMsg
 	}
 }
 
 // handleConnection listens to messages sent on a given connection
-// and forwards them to an outputChan
+// and forwards them to an outputChan, it must be called after connections.Add(1)
 func (anl *AbstractNetworkListener) handleConnection(conn net.Conn) {
+	defer anl.connections.Done()
 	d := decoder.InitializedDecoder()
 	d.Start()
-	go anl.forwardMessages(d, anl.pp.NextPipelineChan())
+	forwarded := make(chan struct{})
+	go func() {
+		anl.forwardMessages(d, anl.pp.NextPipelineChan())
+		close(forwarded)
+	}()
+	defer func() {
+		// the messages decoded so far are forwarded before the connection is done
+		d.Stop()
+		<-forwarded
+	}()
 	for {
 		inBuf := make([]byte, 4096)
 		n, err := anl.listener.readMessage(conn, inBuf)
 		if err == io.EOF {
-			d.Stop()
 			return
 		}
 		if err != nil {
-			log.Println("Couldn't read message from connection:", err)
-			d.Stop()
+			if !anl.isStopped() {
+				log.Println("Couldn't read message from connection:", err)
+			}
 			return
 		}
 		d.InputChan <- decoder.NewPayload(inBuf[:n], 0) // we don't pass an offset for a network message
@@ -8,6 +8,7 @@ package listener
 import (
 	"log"
 
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
 )
@@ -16,13 +17,17 @@ import (
 type Listener struct {
 	pp      *pipeline.PipelineProvider
 	sources []*config.IntegrationConfigLogSource
+	auditor *auditor.Auditor
+	// listeners are the listeners started, they are stopped with the Listener
+	listeners []*AbstractNetworkListener
 }
 
 // New returns an initialized Listener
-func New(sources []*config.IntegrationConfigLogSource, pp *pipeline.PipelineProvider) *Listener {
+func New(sources []*config.IntegrationConfigLogSource, pp *pipeline.PipelineProvider, auditor *auditor.Auditor) *Listener {
 	return &Listener{
 		pp:      pp,
 		sources: sources,
+		auditor: auditor,
 	}
 }
 
@@ -35,16 +40,31 @@ func (l *Listener) Start() {
 			if err != nil {
 				log.Println("Can't start tcp source:", err)
 			} else {
+				if source.WAL {
+					tcpl.wal = l.auditor.WAL()
+				}
 				tcpl.Start()
+				l.listeners = append(l.listeners, tcpl)
 			}
 		case config.UDP_TYPE:
 			udpl, err := NewUdpListener(l.pp, source)
 			if err != nil {
 				log.Println("Can't start udp source:", err)
 			} else {
+				if source.WAL {
+					udpl.wal = l.auditor.WAL()
+				}
 				udpl.Start()
+				l.listeners = append(l.listeners, udpl)
 			}
 		default:
 		}
 	}
 }
+
+// Stop stops the Listener once the messages already received are forwarded
+func (l *Listener) Stop() {
+	for _, listener := range l.listeners {
+		listener.Stop()
+	}
+}
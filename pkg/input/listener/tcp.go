@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
@@ -19,6 +20,9 @@ import (
 type TcpListener struct {
 	listener net.Listener
 	anl      *AbstractNetworkListener
+	// conns are the connections being read, they are closed on stop
+	conns      map[net.Conn]bool
+	connsMutex sync.Mutex
 }
 
 // NewTcpListener returns an initialized NewTcpListener
@@ -31,11 +35,13 @@ func NewTcpListener(pp *pipeline.PipelineProvider, source *config.IntegrationCon
 	}
 	tcpListener := &TcpListener{
 		listener: listener,
+		conns:    make(map[net.Conn]bool),
 	}
 	anl := &AbstractNetworkListener{
 		listener: tcpListener,
 		pp:       pp,
 		source:   source,
+		stopped:  make(chan struct{}),
 	}
 	tcpListener.anl = anl
 	return anl, nil
@@ -46,10 +52,51 @@ func (tcpListener *TcpListener) run() {
 	for {
 		conn, err := tcpListener.listener.Accept()
 		if err != nil {
-			log.Println("Can't listen:", err)
+			if !tcpListener.anl.isStopped() {
+				log.Println("Can't listen:", err)
+			}
 			return
 		}
-		go tcpListener.anl.handleConnection(conn)
+		if !tcpListener.track(conn) {
+			// the listener was stopped while the connection was accepted
+			conn.Close()
+			return
+		}
+		go func() {
+			tcpListener.anl.handleConnection(conn)
+			tcpListener.untrack(conn)
+		}()
+	}
+}
+
+// track adds a connection to the ones closed on stop, and counts it as being read.
+// It returns false once the listener is stopped
+func (tcpListener *TcpListener) track(conn net.Conn) bool {
+	tcpListener.connsMutex.Lock()
+	defer tcpListener.connsMutex.Unlock()
+	if tcpListener.anl.isStopped() {
+		return false
+	}
+	tcpListener.conns[conn] = true
+	tcpListener.anl.connections.Add(1)
+	return true
+}
+
+// untrack closes a connection that is no longer read
+func (tcpListener *TcpListener) untrack(conn net.Conn) {
+	tcpListener.connsMutex.Lock()
+	defer tcpListener.connsMutex.Unlock()
+	delete(tcpListener.conns, conn)
+	conn.Close()
+}
+
+// stop stops accepting connections, and closes the ones being read
+func (tcpListener *TcpListener) stop() {
+	tcpListener.listener.Close()
+	tcpListener.connsMutex.Lock()
+	defer tcpListener.connsMutex.Unlock()
+	for conn := range tcpListener.conns {
+		conn.Close()
 	}
 }
 
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
@@ -38,6 +39,10 @@ func (suite *TCPTestSuite) SetupTest() {
 	suite.tcpl.Start()
 }
 
+func (suite *TCPTestSuite) TearDownTest() {
+	suite.tcpl.Stop()
+}
+
 func (suite *TCPTestSuite) TestTCPReceivesMessages() {
 	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", TCP_TEST_PORT))
 	suite.Nil(err)
@@ -46,6 +51,29 @@ func (suite *TCPTestSuite) TestTCPReceivesMessages() {
 	suite.Equal("hello world", string(msg.Content()))
 }
 
+func (suite *TCPTestSuite) TestTCPClosesItsConnectionsOnStop() {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", TCP_TEST_PORT))
+	suite.Nil(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "hello world\n")
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+
+	// the open connection is closed, and no new one is accepted
+	stopped := make(chan struct{})
+	go func() {
+		suite.tcpl.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		suite.FailNow("the listener was not stopped")
+	}
+	_, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", TCP_TEST_PORT))
+	suite.NotNil(err)
+}
+
 func TestTCPTestSuite(t *testing.T) {
 	suite.Run(t, new(TCPTestSuite))
 }
@@ -42,6 +42,7 @@ func NewUdpListener(pp *pipeline.PipelineProvider, source *config.IntegrationCon
 		listener: udpListener,
 		pp:       pp,
 		source:   source,
+		stopped:  make(chan struct{}),
 	}
 	udpListener.anl = anl
 	return anl, nil
@@ -49,9 +50,15 @@ func NewUdpListener(pp *pipeline.PipelineProvider, source *config.IntegrationCon
 
 // run lets the listener handle incoming udp messages
 func (udpListener *UdpListener) run() {
+	udpListener.anl.connections.Add(1)
 	go udpListener.anl.handleConnection(udpListener.conn)
 }
 
+// stop closes the udp port
+func (udpListener *UdpListener) stop() {
+	udpListener.conn.Close()
+}
+
 func (udpListener *UdpListener) readMessage(conn net.Conn, inBuf []byte) (int, error) {
 	n, _, err := udpListener.conn.ReadFromUDP(inBuf)
 	return n, err
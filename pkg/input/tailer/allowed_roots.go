@@ -0,0 +1,54 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// allowedRoots returns the directories files can be tailed from, with their
+// symlinks resolved. Files can be tailed from anywhere when there is none
+func allowedRoots() []string {
+	roots := []string{}
+	for _, root := range config.LogsAgent.GetStringSlice("allowed_roots") {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		roots = append(roots, filepath.Clean(root))
+	}
+	return roots
+}
+
+// isUnder returns true if path is root or in one of its subdirectories
+func isUnder(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveAllowedPath returns the path of the file to open, with its symlinks resolved
+// when there are allowed roots. It fails when the file is outside of all of them,
+// so that neither the configuration nor a symlink can get a file outside tailed
+func (t *Tailer) resolveAllowedPath() (string, error) {
+	if len(t.allowedRoots) == 0 {
+		return t.path, nil
+	}
+	resolved, err := filepath.EvalSymlinks(t.path)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range t.allowedRoots {
+		if isUnder(resolved, root) {
+			return resolved, nil
+		}
+	}
+	metrics.PathsOutsideAllowedRoots.Add(1)
+	return "", fmt.Errorf("%s resolves to %s, outside of the allowed_roots %v", t.path, resolved, t.allowedRoots)
+}
@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// newAllowedRoot returns a directory that is the only allowed root,
+// and a directory outside of it
+func newAllowedRoot(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "allowed-roots")
+	assert.Nil(t, err)
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	assert.Nil(t, os.Mkdir(root, 0755))
+	assert.Nil(t, os.Mkdir(outside, 0755))
+	config.LogsAgent.Set("allowed_roots", []string{root})
+	return root, outside, func() {
+		config.LogsAgent.Set("allowed_roots", []string{})
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTailerOnlyOpensFilesUnderAllowedRoots(t *testing.T) {
+	root, outside, cleanup := newAllowedRoot(t)
+	defer cleanup()
+	metrics.PathsOutsideAllowedRoots.Set(0)
+	inRoot := filepath.Join(root, "app.log")
+	outOfRoot := filepath.Join(outside, "secret.log")
+	escaping := filepath.Join(root, "escaping.log")
+	assert.Nil(t, ioutil.WriteFile(inRoot, []byte("hello\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(outOfRoot, []byte("secret\n"), 0644))
+	assert.Nil(t, os.Symlink(outOfRoot, escaping))
+
+	outputChan := make(chan message.Message, chanSize)
+	tl := NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: inRoot})
+	assert.Nil(t, tl.tailFromBegining())
+	msg := <-outputChan
+	assert.Equal(t, "hello", string(msg.Content()))
+	tl.Stop(false)
+
+	for _, path := range []string{outOfRoot, escaping, filepath.Join(root, "..", "outside", "secret.log")} {
+		tl := NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path})
+		err := tl.tailFromBegining()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "outside of the allowed_roots")
+	}
+	assert.Equal(t, int64(3), metrics.PathsOutsideAllowedRoots.Value())
+	assert.Equal(t, 0, len(outputChan))
+}
+
+func TestScannerValidatesSymlinkTargetsOnRotation(t *testing.T) {
+	root, outside, cleanup := newAllowedRoot(t)
+	defer cleanup()
+	target := filepath.Join(root, "app.log.1")
+	outOfRoot := filepath.Join(outside, "secret.log")
+	link := filepath.Join(root, "app.log")
+	assert.Nil(t, ioutil.WriteFile(target, nil, 0644))
+	assert.Nil(t, ioutil.WriteFile(outOfRoot, []byte("secret\n"), 0644))
+	assert.Nil(t, os.Symlink(target, link))
+
+	pp := pipeline.NewPipelineProvider()
+	pp.MockPipelineChans()
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: link}}
+	s := New(sources, pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	assert.Nil(t, s.tailers[link].Stats().Err)
+
+	// the link is turned to a file outside of the root
+	assert.Nil(t, os.Remove(link))
+	assert.Nil(t, os.Symlink(outOfRoot, link))
+	rejected := metrics.PathsOutsideAllowedRoots.Value()
+	s.scan()
+	assert.Equal(t, rejected+1, metrics.PathsOutsideAllowedRoots.Value())
+	// the new file is not tailed, it is tried again from its begining at the next scans
+	assert.Nil(t, s.tailers[link])
+	assert.True(t, s.failedSources[link])
+}
@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// readLine returns the line n of the file at path, counted from 0, without its newline,
+// and the offset it starts at
+func readLine(path string, n int) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	for ; n > 0; n-- {
+		skipped, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		offset += int64(len(skipped))
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return bytes.TrimRight(line, "\r\n"), offset, nil
+}
+
+// setCSVHeader lets the decoder parse the rows of a csv file
+// that is not read from its first line. The header is the first
+// line after the skip_first_lines of the file
+func (t *Tailer) setCSVHeader() error {
+	header, offset, err := readLine(t.path, t.source.SkipFirstLines)
+	if err != nil {
+		return err
+	}
+	if err := t.d.SetCSVHeader(header); err != nil {
+		return err
+	}
+	t.d.SetCSVHeaderOffset(offset)
+	return nil
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// cursorVersion is the version of the cursors returned by the tailers
+const cursorVersion = 1
+
+// A cursor is the position of a tailer, for the integrations that keep it on their own:
+// the offset of the last line forwarded in the file the tailer has open,
+// identified by its inode or by its fingerprint, and the number of times
+// the file was rotated or truncated. It is opaque to them
+type cursor struct {
+	Version     int    `json:"v"`
+	Offset      int64  `json:"offset"`
+	Inode       uint64 `json:"inode,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Generation  int64  `json:"generation"`
+}
+
+// parseCursor parses a cursor returned by Cursor
+func parseCursor(token []byte) (cursor, error) {
+	var c cursor
+	if err := json.Unmarshal(token, &c); err != nil {
+		return c, err
+	}
+	if c.Version != cursorVersion {
+		return c, fmt.Errorf("unknown cursor version %d", c.Version)
+	}
+	if c.Offset < 0 {
+		return c, fmt.Errorf("negative cursor offset %d", c.Offset)
+	}
+	return c, nil
+}
+
+// setCursorPosition records the position of the last line forwarded
+func (t *Tailer) setCursorPosition(offset, generation int64) {
+	t.cursorMutex.Lock()
+	defer t.cursorMutex.Unlock()
+	t.cursorOffset = offset
+	t.cursorGeneration = generation
+}
+
+// Cursor returns the position of the tailer, to resume it with ResumeFromCursor
+func (t *Tailer) Cursor() []byte {
+	t.cursorMutex.Lock()
+	c := cursor{Version: cursorVersion, Offset: t.cursorOffset, Generation: t.cursorGeneration}
+	t.cursorMutex.Unlock()
+	if t.source.FileIdentity == config.FINGERPRINT_IDENTITY {
+		c.Fingerprint = t.getFingerprint().String()
+	} else {
+		t.stopMutex.Lock()
+		if t.file != nil {
+			if info, err := t.file.Stat(); err == nil {
+				c.Inode = inode(info)
+			}
+		}
+		t.stopMutex.Unlock()
+	}
+	token, _ := json.Marshal(c)
+	return token
+}
+
+// ResumeFromCursor starts the tailer at the position of a cursor returned by Cursor.
+// When the cursor can't be parsed, or no longer matches the file at the path
+// of the tailer, the tailer starts from the end of the file
+func (t *Tailer) ResumeFromCursor(token []byte) error {
+	c, err := parseCursor(token)
+	if err == nil {
+		err = t.checkCursor(c)
+	}
+	if err != nil {
+		log.Println("Can't resume", t.path, "from its cursor, tailing it from its end:", err)
+		return t.tailFromEnd()
+	}
+	t.generation = c.Generation
+	return t.tailFrom(c.Offset, os.SEEK_SET)
+}
+
+// checkCursor returns an error when the file at the path of the tailer
+// is not the file of the cursor anymore, or when it was truncated
+func (t *Tailer) checkCursor(c cursor) error {
+	info, err := t.fs.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() < c.Offset {
+		return fmt.Errorf("the file is smaller than the offset of the cursor (%d < %d)", info.Size(), c.Offset)
+	}
+	if c.Fingerprint != "" {
+		fp, err := parseFingerprint(c.Fingerprint)
+		if err != nil {
+			return err
+		}
+		start, err := t.readPathStart()
+		if err != nil {
+			return err
+		}
+		if !fp.matches(start) {
+			return fmt.Errorf("the file was replaced, its fingerprint changed")
+		}
+	}
+	if current := inode(info); c.Inode != 0 && current != 0 && current != c.Inode {
+		return fmt.Errorf("the file was replaced, its inode changed from %d to %d", c.Inode, current)
+	}
+	return nil
+}
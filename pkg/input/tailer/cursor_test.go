@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailerResumesFromItsCursor(t *testing.T) {
+	for _, fileIdentity := range []string{config.INODE_IDENTITY, config.FINGERPRINT_IDENTITY} {
+		fs := newFakeFS()
+		path := "/var/log/cursor.log"
+		fs.create(path, "first\nsecond\n")
+		outputChan := make(chan message.Message, chanSize)
+		tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: fileIdentity}, outputChan)
+		tl.generation = 3
+		assert.Nil(t, tl.tailFromBegining())
+		<-outputChan
+		<-outputChan
+		var token []byte
+		assert.Eventually(t, func() bool {
+			token = tl.Cursor()
+			c, err := parseCursor(token)
+			return err == nil && c.Offset == 13
+		}, time.Second, 10*time.Millisecond)
+		tl.Stop(false)
+		<-tl.done
+
+		fs.append(path, "third\n")
+		tl = newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: fileIdentity}, outputChan)
+		assert.Nil(t, tl.ResumeFromCursor(token))
+		msg := <-outputChan
+		assert.Equal(t, "third", string(msg.Content()))
+		assert.Equal(t, int64(19), msg.GetOrigin().Offset)
+		assert.Equal(t, int64(3), tl.generation)
+		tl.Stop(false)
+		<-tl.done
+	}
+}
+
+func TestTailerResumesFromTheEndWithAStaleCursor(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/cursor.log"
+	fs.create(path, "first\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: config.INODE_IDENTITY}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	<-outputChan
+	token := tl.Cursor()
+	tl.Stop(false)
+	<-tl.done
+
+	for _, stale := range []struct {
+		name   string
+		token  []byte
+		change func()
+	}{
+		{"replaced file", token, func() { fs.create(path, "other first\nother second\n") }},
+		{"truncated file", []byte(`{"v":1,"offset":1000}`), func() {}},
+		{"unknown version", []byte(`{"v":42,"offset":0}`), func() {}},
+		{"garbage", []byte("garbage"), func() {}},
+	} {
+		stale.change()
+		tl = newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: config.INODE_IDENTITY}, outputChan)
+		assert.Nil(t, tl.ResumeFromCursor(stale.token), stale.name)
+		// only the lines written afterwards are read
+		fs.append(path, stale.name+"\n")
+		msg := <-outputChan
+		assert.Equal(t, stale.name, string(msg.Content()))
+		tl.Stop(false)
+		<-tl.done
+	}
+}
@@ -0,0 +1,73 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+const (
+	// DISCOVERED_STATUS is emitted when a file of a directory is found
+	DISCOVERED_STATUS = "discovered"
+	// STARTED_STATUS is emitted when a file of a directory is tailed
+	STARTED_STATUS = "started"
+	// STOPPED_STATUS is emitted when a file of a directory is no longer tailed
+	STOPPED_STATUS = "stopped"
+	// ERRORED_STATUS is emitted when a file of a directory can't be tailed
+	ERRORED_STATUS = "errored"
+)
+
+const discoveryEventsSize = 100
+
+// DiscoveryEvent reports a change in the files tailed for a directory source
+type DiscoveryEvent struct {
+	Path   string
+	Status string
+	// Err is set for an errored file
+	Err error
+}
+
+// DiscoveryEvents returns the channel receiving the discovery events
+// of the directory sources. Events are only emitted once it was called,
+// and are dropped when it is full
+func (s *Scanner) DiscoveryEvents() <-chan DiscoveryEvent {
+	atomic.StoreInt32(&s.discoverySubscribed, 1)
+	return s.discoveryEvents
+}
+
+// sendDiscoveryEvent emits an event for a file of a directory source,
+// it never blocks the scanner
+func (s *Scanner) sendDiscoveryEvent(source *config.IntegrationConfigLogSource, status string, err error) {
+	if source.Type != config.DIRECTORY_TYPE || atomic.LoadInt32(&s.discoverySubscribed) == 0 {
+		return
+	}
+	select {
+	case s.discoveryEvents <- DiscoveryEvent{Path: source.Path, Status: status, Err: err}:
+	default:
+		log.Println("Dropping discovery event for", source.Path, "nobody is reading them")
+	}
+}
+
+// listFiles returns the files of a directory, its subdirectories are ignored
+func listFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, filepath.Join(dir, info.Name()))
+	}
+	return files, nil
+}
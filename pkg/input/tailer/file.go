@@ -0,0 +1,48 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// A file is a file opened by a tailer, an *os.File
+// unless the tailer reads a fake filesystem
+type file interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// A fileOpener gives a tailer access to a filesystem
+type fileOpener interface {
+	OpenFile(path string, flag int) (file, error)
+	Stat(path string) (os.FileInfo, error)
+}
+
+// osOpener gives access to the filesystem of the host
+type osOpener struct{}
+
+// OpenFile opens the file at path with flag
+func (osOpener) OpenFile(path string, flag int) (file, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat returns the info of the file at path
+func (osOpener) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// deadliner is implemented by the files whose reads can be interrupted
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
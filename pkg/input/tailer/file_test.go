@@ -0,0 +1,202 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeContent is the content of a file of a fakeFS
+type fakeContent struct {
+	data  []byte
+	inode uint64
+}
+
+// fakeFS is an in-memory filesystem, the files opened keep
+// reading their content after it is replaced at their path
+type fakeFS struct {
+	mutex     sync.Mutex
+	files     map[string]*fakeContent
+	lastInode uint64
+}
+
+func newFakeFS() *fakeFS {
+	return &fakeFS{files: make(map[string]*fakeContent)}
+}
+
+// create replaces the file at path by a new one, as a rotation does
+func (fs *fakeFS) create(path, data string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.lastInode++
+	fs.files[path] = &fakeContent{data: []byte(data), inode: fs.lastInode}
+}
+
+func (fs *fakeFS) append(path, data string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.files[path].data = append(fs.files[path].data, data...)
+}
+
+func (fs *fakeFS) truncate(path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.files[path].data = nil
+}
+
+func (fs *fakeFS) OpenFile(path string, flag int) (file, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	content, ok := fs.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &fakeFile{fs: fs, path: path, content: content}, nil
+}
+
+func (fs *fakeFS) Stat(path string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	content, ok := fs.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return fakeFileInfo{path: path, size: int64(len(content.data)), inode: content.inode}, nil
+}
+
+type fakeFile struct {
+	fs      *fakeFS
+	path    string
+	content *fakeContent
+	offset  int64
+}
+
+func (f *fakeFile) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.offset >= int64(len(f.content.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.content.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *fakeFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.content.data))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *fakeFile) Close() error {
+	return nil
+}
+
+func (f *fakeFile) Stat() (os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return fakeFileInfo{path: f.path, size: int64(len(f.content.data)), inode: f.content.inode}, nil
+}
+
+type fakeFileInfo struct {
+	path  string
+	size  int64
+	inode uint64
+}
+
+func (i fakeFileInfo) Name() string       { return i.path }
+func (i fakeFileInfo) Size() int64        { return i.size }
+func (i fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (i fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeFileInfo) IsDir() bool        { return false }
+func (i fakeFileInfo) Sys() interface{}   { return &syscall.Stat_t{Ino: i.inode} }
+
+// newFakeTailer returns a tailer of source reading its file from fs, polling it often
+func newFakeTailer(fs *fakeFS, source *config.IntegrationConfigLogSource, outputChan chan message.Message) *Tailer {
+	tl := NewTailer(outputChan, source)
+	tl.fs = fs
+	tl.sleepDuration = 10 * time.Millisecond
+	return tl
+}
+
+func TestTailerDetectsRotationsOnFakeFilesystem(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/fake.log"
+	fs.create(path, "hello\n")
+
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+
+	msg := <-outputChan
+	assert.Equal(t, "hello", string(msg.Content()))
+	fs.append(path, "world\n")
+	msg = <-outputChan
+	assert.Equal(t, "world", string(msg.Content()))
+	assert.Equal(t, int64(12), msg.GetOrigin().Offset)
+	action, err := tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, continueReading, action)
+
+	fs.truncate(path)
+	action, err = tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, seekToBeginning, action)
+
+	fs.create(path, "rotated\n")
+	action, err = tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, reopenFromBeginning, action)
+
+	_, err = NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "/var/log/missing.log"}).open()
+	assert.NotNil(t, err)
+}
+
+func TestTailerFlagsOffsetResetAfterTruncation(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/fake.log"
+	fs.create(path, "hello\n")
+
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+
+	// the file is tailed from the beginning, its commited offset may be higher
+	msg := <-outputChan
+	assert.True(t, msg.GetOrigin().OffsetReset)
+	fs.append(path, "world\n")
+	msg = <-outputChan
+	assert.False(t, msg.GetOrigin().OffsetReset)
+
+	fs.truncate(path)
+	action, err := tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, seekToBeginning, action)
+	tl.reset()
+	fs.append(path, "again\n")
+	msg = <-outputChan
+	assert.Equal(t, "again", string(msg.Content()))
+	assert.Equal(t, int64(6), msg.GetOrigin().Offset)
+	assert.True(t, msg.GetOrigin().OffsetReset)
+}
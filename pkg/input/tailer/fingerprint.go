@@ -0,0 +1,160 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
+)
+
+// fingerprintSize is the number of bytes at the beginning
+// of a file that identify it
+const fingerprintSize = 1024
+
+// fingerprintMeta is the key of the fingerprint of a file in its metadata
+const fingerprintMeta = "fingerprint"
+
+// A fingerprint identifies a file by the hash of its first bytes, on filesystems
+// whose inodes are not stable. A file shorter than fingerprintSize has a shorter
+// fingerprint, that is completed once the file grows. A fingerprint keeps the
+// algorithm it was computed with, so that changing content_hash doesn't make
+// the commited files look replaced
+type fingerprint struct {
+	hasher contenthash.Hasher
+	size   int
+	sum    uint64
+}
+
+// newFingerprint returns the fingerprint of the first bytes of a file
+func newFingerprint(hasher contenthash.Hasher, start []byte) fingerprint {
+	return fingerprint{hasher: hasher, size: len(start), sum: hasher.Sum(start)}
+}
+
+// parseFingerprint parses a fingerprint stored in the registry,
+// the ones stored without their algorithm are crc32 checksums
+func parseFingerprint(s string) (fingerprint, error) {
+	name := contenthash.CRC32
+	if strings.Count(s, ":") == 2 {
+		i := strings.Index(s, ":")
+		name, s = s[:i], s[i+1:]
+	}
+	hasher, err := contenthash.New(name)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	fp := fingerprint{hasher: hasher}
+	_, err = fmt.Sscanf(s, "%d:%x", &fp.size, &fp.sum)
+	return fp, err
+}
+
+func (fp fingerprint) String() string {
+	if fp.hasher == nil {
+		// the file was not fingerprinted yet
+		return fmt.Sprintf("%d:%08x", fp.size, fp.sum)
+	}
+	return fmt.Sprintf("%s:%d:%016x", fp.hasher.Name(), fp.size, fp.sum)
+}
+
+// matches returns true if a file starting with start can be the file of the fingerprint.
+// An empty fingerprint matches any file
+func (fp fingerprint) matches(start []byte) bool {
+	if fp.size == 0 {
+		return true
+	}
+	return len(start) >= fp.size && fp.hasher.Sum(start[:fp.size]) == fp.sum
+}
+
+// readStart returns the first bytes of a file, fewer than
+// fingerprintSize when the file is shorter
+func readStart(r io.Reader) ([]byte, error) {
+	start := make([]byte, fingerprintSize)
+	n, err := io.ReadFull(r, start)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return start[:n], err
+}
+
+// readPathStart returns the first bytes of the file currently at the path of the tailer
+func (t *Tailer) readPathStart() ([]byte, error) {
+	f, err := t.fs.OpenFile(t.path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readStart(f)
+}
+
+// getFingerprint returns the fingerprint of the open file
+func (t *Tailer) getFingerprint() fingerprint {
+	t.fingerprintMutex.Lock()
+	defer t.fingerprintMutex.Unlock()
+	return t.fingerprint
+}
+
+// setFingerprint updates the fingerprint of the open file, and saves it in the registry
+func (t *Tailer) setFingerprint(fp fingerprint) {
+	t.fingerprintMutex.Lock()
+	t.fingerprint = fp
+	t.fingerprintMutex.Unlock()
+	if t.auditor != nil && t.shouldTrackOffset {
+		t.auditor.SetMeta(t.Identifier(), fingerprintMeta, fp.String())
+	}
+}
+
+// fingerprintOpenFile computes the fingerprint of a file that was just opened,
+// it is read again from its beginning afterwards
+func (t *Tailer) fingerprintOpenFile(f file) error {
+	start, err := readStart(f)
+	if err != nil {
+		return err
+	}
+	t.setFingerprint(newFingerprint(t.hasher, start))
+	_, err = f.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// isCommitedFile returns false when the file at the path of the tailer is not
+// the one whose offset was commited, according to the fingerprint commited with it
+func (t *Tailer) isCommitedFile(a *auditor.Auditor) (bool, error) {
+	commited, err := parseFingerprint(a.GetMeta(t.Identifier(), fingerprintMeta))
+	if err != nil {
+		// the file was never fingerprinted
+		return true, nil
+	}
+	start, err := t.readPathStart()
+	if err != nil {
+		return false, err
+	}
+	return commited.matches(start), nil
+}
+
+// fingerprintAction returns the action to take given the first bytes of the file
+// currently at the path of the tailer: the open file was replaced when they don't
+// match its fingerprint, and truncated when the file is smaller than our offset
+func (t *Tailer) fingerprintAction(currentSize int64) (fileAction, error) {
+	start, err := t.readPathStart()
+	if err != nil {
+		return continueReading, err
+	}
+	fp := t.getFingerprint()
+	if !fp.matches(start) {
+		return reopenFromBeginning, nil
+	}
+	if currentSize < t.openOffset() {
+		return seekToBeginning, nil
+	}
+	if len(start) > fp.size {
+		// the file grew, its fingerprint is completed
+		t.setFingerprint(newFingerprint(t.hasher, start))
+	}
+	return continueReading, nil
+}
@@ -0,0 +1,153 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// changeInode gives a new inode to the file at path, as some overlay filesystems do
+func (fs *fakeFS) changeInode(path string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.lastInode++
+	fs.files[path].inode = fs.lastInode
+}
+
+func TestFingerprintTellsFilesApartWhenInodesAreNotStable(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/overlay.log"
+	header := strings.Repeat("h", fingerprintSize)
+	fs.create(path, header+"\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: config.FINGERPRINT_IDENTITY}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+	<-outputChan
+
+	// the same file gets a new inode
+	fs.changeInode(path)
+	action, err := tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, continueReading, action)
+
+	// a new file gets the same inode
+	fs.mutex.Lock()
+	fs.files[path].data = []byte("new file\n")
+	fs.mutex.Unlock()
+	action, err = tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, reopenFromBeginning, action)
+}
+
+func TestFingerprintOfFilesShorterThanItsSize(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/short.log"
+	fs.create(path, "ab\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: config.FINGERPRINT_IDENTITY}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+	<-outputChan
+	assert.Equal(t, 3, tl.getFingerprint().size)
+
+	// the file grows, its fingerprint is completed
+	fs.append(path, "cd\n")
+	<-outputChan
+	action, err := tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, continueReading, action)
+	assert.Equal(t, 6, tl.getFingerprint().size)
+
+	// a new file shorter than the fingerprint
+	fs.create(path, "ab\n")
+	action, err = tl.checkRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, reopenFromBeginning, action)
+}
+
+func TestFingerprintIsCommitedWithTheOffset(t *testing.T) {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	fs := newFakeFS()
+	path := "/var/log/overlay.log"
+	fs.create(path, "first\n")
+	outputChan := make(chan message.Message, chanSize)
+	newTailer := func() *Tailer {
+		tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FileIdentity: config.FINGERPRINT_IDENTITY}, outputChan)
+		tl.auditor = a
+		assert.Nil(t, tl.recoverTailing(a))
+		return tl
+	}
+	// commitAndStop commits the next line and returns it
+	commitAndStop := func(tl *Tailer) string {
+		msg := <-outputChan
+		auditorChan <- msg
+		assert.Eventually(t, func() bool {
+			offset, _ := a.GetLastCommitedOffset(tl.Identifier())
+			return offset == msg.GetOrigin().Offset
+		}, time.Second, 10*time.Millisecond)
+		tl.Stop(true)
+		<-tl.done
+		return string(msg.Content())
+	}
+
+	tl := newTailer()
+	fs.append(path, "second\n")
+	assert.Equal(t, "second", commitAndStop(tl))
+
+	// the same file, with a new inode, resumes at its offset
+	fs.changeInode(path)
+	fs.append(path, "third\n")
+	assert.Equal(t, "third", commitAndStop(newTailer()))
+
+	// a new file is read from its beginning
+	fs.create(path, "other\n")
+	tl = newTailer()
+	defer tl.Stop(false)
+	msg := <-outputChan
+	assert.Equal(t, "other", string(msg.Content()))
+}
+
+func TestFingerprintKeepsTheAlgorithmItWasComputedWith(t *testing.T) {
+	start := []byte("the first bytes of the file\n")
+	crc32Hasher, _ := contenthash.New(contenthash.CRC32)
+	sha256Hasher, _ := contenthash.New(contenthash.SHA256)
+
+	// the fingerprints commited without their algorithm are crc32 checksums
+	legacy, err := parseFingerprint(fmt.Sprintf("%d:%08x", len(start), crc32.ChecksumIEEE(start)))
+	assert.Nil(t, err)
+	assert.Equal(t, contenthash.CRC32, legacy.hasher.Name())
+	assert.True(t, legacy.matches(start))
+	assert.Equal(t, newFingerprint(crc32Hasher, start), legacy)
+
+	fp := newFingerprint(sha256Hasher, start)
+	assert.True(t, strings.HasPrefix(fp.String(), "sha256:"))
+	parsed, err := parseFingerprint(fp.String())
+	assert.Nil(t, err)
+	assert.Equal(t, fp, parsed)
+	assert.True(t, parsed.matches(start))
+	assert.False(t, parsed.matches([]byte("the first bytes of another file\n")))
+	assert.NotEqual(t, legacy.sum, fp.sum)
+
+	_, err = parseFingerprint("md5:28:0123456789abcdef")
+	assert.NotNil(t, err)
+}
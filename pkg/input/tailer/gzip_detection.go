@@ -0,0 +1,85 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"sync"
+)
+
+// gzipMagic are the first bytes of gzip content
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipped returns true when a file starts with the gzip magic number,
+// whatever its name. The file is read again from its beginning afterwards
+func isGzipped(f file) (bool, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return false, err
+	}
+	return n == len(gzipMagic) && bytes.Equal(magic, gzipMagic), nil
+}
+
+// A gzipFileReader reads the decompressed content of a gzipped file from its beginning.
+// The header is read once it is written, and again when the file is truncated
+type gzipFileReader struct {
+	mutex sync.Mutex
+	f     file
+	r     *gzip.Reader
+}
+
+func newGzipFileReader(f file) *gzipFileReader {
+	return &gzipFileReader{f: f}
+}
+
+func (g *gzipFileReader) Read(p []byte) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.r == nil {
+		r, err := gzip.NewReader(g.f)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the header is not written yet
+			if _, err := g.f.Seek(0, os.SEEK_SET); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		g.r = r
+	}
+	return g.r.Read(p)
+}
+
+// reset lets the reader decompress the file from its beginning again
+func (g *gzipFileReader) reset() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.r = nil
+	_, err := g.f.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// openOffset returns the offset reached in the open file: the offset
+// in its compressed content when it is gzipped, as its size is compared to it
+func (t *Tailer) openOffset() int64 {
+	if _, ok := t.reader.(*gzipFileReader); !ok {
+		return t.GetLastOffset()
+	}
+	offset, err := t.file.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return t.GetLastOffset()
+	}
+	return offset
+}
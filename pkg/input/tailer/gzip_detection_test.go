@@ -0,0 +1,84 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, content string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(content))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.String()
+}
+
+func TestTailerDecompressesGzipFilesWithoutExtension(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/app.log"
+	fs.create(path, gzipped(t, "first\nsecond\n"))
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, DetectGzip: true}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+
+	// offsets are in the decompressed content
+	msg := <-outputChan
+	assert.Equal(t, "first", string(msg.Content()))
+	assert.Equal(t, int64(6), msg.GetOrigin().Offset)
+	msg = <-outputChan
+	assert.Equal(t, "second", string(msg.Content()))
+	assert.Equal(t, int64(13), msg.GetOrigin().Offset)
+
+	// the file is truncated and rewritten, its decompressed
+	// content is still longer than the new compressed file
+	fs.mutex.Lock()
+	fs.files[path].data = []byte(gzipped(t, "third\n"))
+	fs.mutex.Unlock()
+	msg = <-outputChan
+	assert.Equal(t, "third", string(msg.Content()))
+	assert.Equal(t, int64(6), msg.GetOrigin().Offset)
+}
+
+func TestTailerResumesGzipFilesInTheirDecompressedContent(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/app.log"
+	fs.create(path, gzipped(t, "first\nsecond\n"))
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, DetectGzip: true}, outputChan)
+	assert.Nil(t, tl.tailFrom(6, os.SEEK_SET))
+	defer tl.Stop(false)
+
+	msg := <-outputChan
+	assert.Equal(t, "second", string(msg.Content()))
+	assert.Equal(t, int64(13), msg.GetOrigin().Offset)
+}
+
+func TestTailerDoesNotDecompressPlainFiles(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/app.log"
+	// the first byte is the first byte of the gzip magic number
+	fs.create(path, "\x1fplain\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, DetectGzip: true}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+
+	msg := <-outputChan
+	assert.Equal(t, "\x1fplain", string(msg.Content()))
+	assert.Equal(t, int64(7), msg.GetOrigin().Offset)
+	_, ok := tl.reader.(*gzipFileReader)
+	assert.False(t, ok)
+}
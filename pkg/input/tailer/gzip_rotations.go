@@ -0,0 +1,204 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+)
+
+// A rotatedFile is a rotation of the file of a tailer, compressed unless it is
+// a numbered rotation of a source with ordered_rotations. Its lines are commited
+// under the catch-up identifier of the tailer, with the modification time
+// of the rotation as timestamp: the registry holds the rotation being read and
+// the offset in its decompressed content
+type rotatedFile struct {
+	path    string
+	modTime time.Time
+	// index is the number of the rotation in its name, the higher the older
+	index int
+	// offset is where to start reading the decompressed content
+	offset     int64
+	identifier string
+}
+
+// catchUpIdentifier returns the identifier under which the lines
+// of the compressed rotations of the file are commited
+func (t *Tailer) catchUpIdentifier() string {
+	return t.Identifier() + ":rotations"
+}
+
+// rotationPattern matches the numbered rotations of a file, like app.log.1 or app.log.2.gz
+var rotationPattern = regexp.MustCompile(`^(.+)\.(\d+)(\.gz)?$`)
+
+// rotationOf returns the path of the file that path is a numbered rotation of,
+// and the number of the rotation. It returns false when path is not a rotation
+func rotationOf(path string) (string, int, bool) {
+	match := rotationPattern.FindStringSubmatch(path)
+	if match == nil {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return match[1], index, true
+}
+
+// rotationPaths returns the paths of the rotations of the file, its .gz rotations,
+// or its numbered rotations for a source with ordered_rotations
+func (t *Tailer) rotationPaths() ([]string, error) {
+	if !t.source.OrderedRotations {
+		return filepath.Glob(t.path + "*.gz")
+	}
+	matches, err := filepath.Glob(t.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, match := range matches {
+		if live, _, ok := rotationOf(match); ok && live == t.path {
+			paths = append(paths, match)
+		}
+	}
+	return paths, nil
+}
+
+// rotationsToCatchUp returns the rotations written since the file was last
+// tailed and not read yet, oldest first. The oldest one was the live file
+// when its offset was commited, it is read from this offset.
+// A file that was never tailed has nothing to catch up, unless its source
+// has ordered_rotations: all its rotations are read then
+func (t *Tailer) rotationsToCatchUp(a *auditor.Auditor) ([]rotatedFile, error) {
+	registry := a.GetRegistrySnapshot()
+	live, ok := registry[t.Identifier()]
+	if !ok || live.Kind != auditor.OFFSET_ENTRY {
+		if !t.source.OrderedRotations {
+			return nil, nil
+		}
+		live = auditor.RegistryEntry{}
+	}
+	paths, err := t.rotationPaths()
+	if err != nil {
+		return nil, err
+	}
+	rotations := []rotatedFile{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().After(live.LastUpdated) {
+			continue
+		}
+		_, index, _ := rotationOf(path)
+		rotations = append(rotations, rotatedFile{path: path, modTime: info.ModTime(), index: index, identifier: t.catchUpIdentifier()})
+	}
+	sort.Slice(rotations, func(i, j int) bool {
+		if rotations[i].modTime.Equal(rotations[j].modTime) {
+			return rotations[i].index > rotations[j].index
+		}
+		return rotations[i].modTime.Before(rotations[j].modTime)
+	})
+
+	position, ok := registry[t.catchUpIdentifier()]
+	var positionTime time.Time
+	if ok && position.Kind == auditor.TIMESTAMP_ENTRY {
+		positionTime, _ = time.Parse(time.RFC3339Nano, position.Timestamp)
+	}
+	if positionTime.IsZero() || !positionTime.After(live.LastUpdated) {
+		// the previous catch-up completed, the live file was tailed since
+		if len(rotations) > 0 {
+			rotations[0].offset = live.Offset
+		}
+		return rotations, nil
+	}
+	// a catch-up was interrupted, it resumes in the rotation being read
+	pending := []rotatedFile{}
+	for _, rotation := range rotations {
+		if rotation.modTime.Before(positionTime) {
+			continue
+		}
+		if rotation.modTime.Equal(positionTime) {
+			rotation.offset = position.Offset
+		}
+		pending = append(pending, rotation)
+	}
+	return pending, nil
+}
+
+// newRotationTailer returns a tailer reading the content of a rotation
+// until its end, decompressed when it is a .gz file
+func (t *Tailer) newRotationTailer(rotation rotatedFile) *Tailer {
+	rt := NewTailer(t.outputChan, t.source)
+	rt.path = rotation.path
+	rt.rotation = &rotation
+	rt.sleepDuration = t.sleepDuration
+	rt.auditor = t.auditor
+	if strings.HasSuffix(rotation.path, ".gz") {
+		rt.newReader = func(f file) io.Reader {
+			r, err := gzip.NewReader(f)
+			if err != nil {
+				return &errReader{err: err}
+			}
+			return r
+		}
+	}
+	rt.shouldStop = true
+	return rt
+}
+
+// catchUpRotations reads the compressed rotations of the file one after the other,
+// before the live file. It returns false when the tailer is stopped meanwhile
+func (t *Tailer) catchUpRotations() bool {
+	for _, rotation := range t.rotations {
+		rt := t.newRotationTailer(rotation)
+		if err := rt.tailFrom(rotation.offset, os.SEEK_SET); err != nil {
+			log.Println("Can't read the rotation", rotation.path, ":", err)
+			continue
+		}
+		select {
+		case <-rt.done:
+		case <-t.softStop:
+			// the catch-up resumes from the last line commited on restart
+			rt.hardStopOnce.Do(func() { close(rt.hardStop) })
+			<-rt.done
+			return false
+		}
+		if err := rt.Stats().Err; err != nil {
+			log.Println("Can't read the rotation", rotation.path, ":", err)
+		}
+	}
+	t.rotations = nil
+	return true
+}
+
+// skipDecompressed discards the first offset bytes of the decompressed
+// content of a rotation or of a gzipped file, it can't be seeked, or all of it
+// when offset is negative. A rotation that is not compressed is read the same way
+func (t *Tailer) skipDecompressed(offset int64) (int64, error) {
+	if offset < 0 {
+		return io.Copy(ioutil.Discard, t.reader)
+	}
+	return io.CopyN(ioutil.Discard, t.reader, offset)
+}
+
+// errReader is a reader that always fails
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
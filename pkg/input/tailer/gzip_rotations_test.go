@@ -0,0 +1,143 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeGzipFile(t *testing.T, path, content string) {
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	_, err = w.Write([]byte(content))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+}
+
+func TestTailerCatchesUpGzipRotationsBeforeLiveFile(t *testing.T) {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	testDir, err := ioutil.TempDir("", "rotations")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "app.log")
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, CatchUpRotations: true}
+	outputChan := make(chan message.Message, chanSize)
+	newTailer := func() *Tailer {
+		tl := NewTailer(outputChan, source)
+		tl.sleepDuration = 10 * time.Millisecond
+		return tl
+	}
+	commit := func(msg message.Message) {
+		auditorChan <- msg
+		assert.Eventually(t, func() bool {
+			return a.GetRegistrySnapshot()[msg.GetOrigin().Identifier].Offset == msg.GetOrigin().Offset
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// the first two lines were sent before the agent stopped
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old1\nold2\n"), 0644))
+	var msg message.Message = message.NewFileMessage(nil)
+	msg.SetOrigin(&message.MessageOrigin{Identifier: newTailer().Identifier(), Offset: 10})
+	commit(msg)
+	time.Sleep(10 * time.Millisecond)
+	// meanwhile, the file was rotated and compressed
+	writeGzipFile(t, path+".1.gz", "old1\nold2\nnew1\n")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("live1\n"), 0644))
+
+	tl := newTailer()
+	assert.Nil(t, tl.recoverTailing(a))
+	msg = <-outputChan
+	assert.Equal(t, "new1", string(msg.Content()))
+	assert.Equal(t, tl.catchUpIdentifier(), msg.GetOrigin().Identifier)
+	assert.Equal(t, int64(15), msg.GetOrigin().Offset)
+	assert.NotEqual(t, "", msg.GetOrigin().Timestamp)
+	commit(msg)
+	msg = <-outputChan
+	assert.Equal(t, "live1", string(msg.Content()))
+	assert.Equal(t, tl.Identifier(), msg.GetOrigin().Identifier)
+	assert.Equal(t, int64(6), msg.GetOrigin().Offset)
+	// the agent stops before the live line is commited
+	tl.Stop(true)
+	<-tl.done
+
+	// the rotation is not read again, the live file is
+	tl = newTailer()
+	assert.Nil(t, tl.recoverTailing(a))
+	msg = <-outputChan
+	assert.Equal(t, "live1", string(msg.Content()))
+	commit(msg)
+	tl.Stop(true)
+	<-tl.done
+
+	tl = newTailer()
+	defer tl.Stop(false)
+	assert.Nil(t, tl.recoverTailing(a))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString("live2\n")
+	assert.Nil(t, err)
+	msg = <-outputChan
+	assert.Equal(t, "live2", string(msg.Content()))
+}
+
+func TestScannerReadsOrderedRotationsOldestFirst(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "rotations")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "app.log")
+	writeGzipFile(t, path+".3.gz", "one\ntwo\n")
+	writeGzipFile(t, path+".2.gz", "three\n")
+	assert.Nil(t, ioutil.WriteFile(path+".1", []byte("four\nfive\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("six\n"), 0644))
+	// the two oldest rotations were compressed at the same time
+	now := time.Now()
+	for i, rotation := range []string{path + ".3.gz", path + ".2.gz", path + ".1"} {
+		modTime := now.Add(-time.Duration(3-i/2) * time.Hour)
+		assert.Nil(t, os.Chtimes(rotation, modTime, modTime))
+	}
+
+	pp := pipeline.NewPipelineProvider()
+	pp.MockPipelineChans()
+	outputChan := pp.NextPipelineChan()
+	sources := []*config.IntegrationConfigLogSource{{Type: config.FILE_TYPE, Path: path + "*", OrderedRotations: true}}
+	s := New(sources, pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	// only the live file is followed
+	assert.Equal(t, 1, len(s.tailers))
+
+	for _, line := range []string{"one", "two", "three", "four", "five", "six"} {
+		msg := <-outputChan
+		assert.Equal(t, line, string(msg.Content()))
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString("seven\n")
+	assert.Nil(t, err)
+	msg := <-outputChan
+	assert.Equal(t, "seven", string(msg.Content()))
+}
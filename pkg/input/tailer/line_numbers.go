@@ -0,0 +1,48 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// countLines returns the number of lines of f before offset, f is left at offset.
+// A line that doesn't end before offset is not counted
+func countLines(f file, offset int64) (int64, error) {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	var lines int64
+	r := io.LimitReader(f, offset)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := f.Seek(offset, os.SEEK_SET)
+	return lines, err
+}
+
+// numberLine returns the number of the line forwarded, the lines are
+// numbered again from the begining of the file when it was truncated
+func (t *Tailer) numberLine(truncated, partial bool) int64 {
+	if truncated {
+		t.lines = 0
+	}
+	line := t.lines + 1
+	if !partial {
+		t.lines++
+	}
+	return line
+}
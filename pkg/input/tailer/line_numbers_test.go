@@ -0,0 +1,87 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountLines(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/count.log"
+	fs.create(path, "a\nbb\nccc")
+	f, err := fs.OpenFile(path, os.O_RDONLY)
+	assert.Nil(t, err)
+
+	for offset, expected := range map[int64]int64{0: 0, 1: 0, 2: 1, 4: 1, 5: 2, 8: 2} {
+		lines, err := countLines(f, offset)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, lines, "offset %d", offset)
+		position, _ := f.Seek(0, os.SEEK_CUR)
+		assert.Equal(t, offset, position)
+	}
+}
+
+func TestTailerNumbersLinesAcrossRestarts(t *testing.T) {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	fs := newFakeFS()
+	path := "/var/log/numbered.log"
+	fs.create(path, "a\nb\nc\n")
+	outputChan := make(chan message.Message, chanSize)
+	newTailer := func() *Tailer {
+		source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, LineNumbers: true}
+		tl := newFakeTailer(fs, source, outputChan)
+		assert.Nil(t, tl.recoverTailing(a))
+		return tl
+	}
+	// nextLine commits the next line and returns its content and number
+	nextLine := func() (string, int64) {
+		msg := <-outputChan
+		auditorChan <- msg
+		return string(msg.Content()), msg.GetOrigin().Line
+	}
+
+	// a new file is tailed from its end, the lines before it are counted
+	tl := newTailer()
+	fs.append(path, "d\ne\n")
+	for _, expected := range []int64{4, 5} {
+		_, line := nextLine()
+		assert.Equal(t, expected, line)
+	}
+	assert.Eventually(t, func() bool {
+		return a.GetLastCommitedLine(tl.Identifier()) == 5
+	}, time.Second, 10*time.Millisecond)
+	tl.Stop(true)
+	<-tl.done
+
+	// the numbering resumes at the commited line
+	fs.append(path, "f\n")
+	tl = newTailer()
+	defer tl.Stop(false)
+	content, line := nextLine()
+	assert.Equal(t, "f", content)
+	assert.Equal(t, int64(6), line)
+
+	// a truncated file is numbered from its begining again
+	fs.truncate(path)
+	fs.append(path, "g\n")
+	content, line = nextLine()
+	assert.Equal(t, "g", content)
+	assert.Equal(t, int64(1), line)
+}
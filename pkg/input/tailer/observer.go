@@ -0,0 +1,32 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+// A TailerObserver is notified of the lifecycle of the tailers of a scanner.
+// Its hooks are called from the goroutines of the tailers and of the scanner,
+// while no lock of the tailer is held: they can call back into the tailer,
+// but must return quickly as the tailer waits for them
+type TailerObserver interface {
+	// OnOpen is called once a file is opened, with the offset it is read from
+	OnOpen(path string, offset int64)
+	// OnRotate is called when a file is rotated or truncated,
+	// with the offset read in the previous file
+	OnRotate(path string, offset int64)
+	// OnCaughtUp is called when the end of a file is reached,
+	// and again each time it is reached after more data is read
+	OnCaughtUp(path string, offset int64)
+	// OnError is called when a file can't be read
+	OnError(path string, err error)
+	// OnStop is called once a file is closed, with the offset it was read up to
+	OnStop(path string, offset int64)
+}
+
+// SetObserver sets the observer of the tailers started from now on
+func (s *Scanner) SetObserver(observer TailerObserver) {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	s.observer = observer
+}
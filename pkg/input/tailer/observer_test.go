@@ -0,0 +1,105 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingObserver records the hooks called, it calls back
+// into the tailer to check that no lock of the tailer is held
+type recordingObserver struct {
+	mutex  sync.Mutex
+	events []string
+	tailer *Tailer
+}
+
+func (o *recordingObserver) record(event string) {
+	if o.tailer != nil {
+		o.tailer.Stats()
+		o.tailer.RecentLines()
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) getEvents() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]string{}, o.events...)
+}
+
+func (o *recordingObserver) OnOpen(path string, offset int64) {
+	o.record(fmt.Sprintf("open %s %d", path, offset))
+}
+
+func (o *recordingObserver) OnRotate(path string, offset int64) {
+	o.record(fmt.Sprintf("rotate %s %d", path, offset))
+}
+
+func (o *recordingObserver) OnCaughtUp(path string, offset int64) {
+	o.record(fmt.Sprintf("caught up %s %d", path, offset))
+}
+
+func (o *recordingObserver) OnError(path string, err error) {
+	o.record(fmt.Sprintf("error %s", path))
+}
+
+func (o *recordingObserver) OnStop(path string, offset int64) {
+	o.record(fmt.Sprintf("stop %s %d", path, offset))
+}
+
+func TestTailerNotifiesItsObserver(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/observed.log"
+	fs.create(path, "hello\n")
+
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}, outputChan)
+	observer := &recordingObserver{tailer: tl}
+	tl.observer = observer
+	waitFor := func(events ...string) {
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(events, observer.getEvents())
+		}, time.Second, 10*time.Millisecond, "%v", observer.getEvents())
+	}
+
+	assert.Nil(t, tl.tailFromBegining())
+	<-outputChan
+	waitFor("open /var/log/observed.log 0", "caught up /var/log/observed.log 6")
+
+	// the file is truncated, then written again
+	fs.truncate(path)
+	waitFor("open /var/log/observed.log 0", "caught up /var/log/observed.log 6", "rotate /var/log/observed.log 6")
+	fs.append(path, "hi\n")
+	<-outputChan
+	waitFor("open /var/log/observed.log 0", "caught up /var/log/observed.log 6", "rotate /var/log/observed.log 6",
+		"caught up /var/log/observed.log 3")
+
+	tl.Stop(false)
+	<-tl.done
+	waitFor("open /var/log/observed.log 0", "caught up /var/log/observed.log 6", "rotate /var/log/observed.log 6",
+		"caught up /var/log/observed.log 3", "stop /var/log/observed.log 3")
+}
+
+func TestTailerNotifiesItsObserverOfErrors(t *testing.T) {
+	outputChan := make(chan message.Message, chanSize)
+	tl := NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "/var/log/missing.log"})
+	tl.fs = newFakeFS()
+	observer := &recordingObserver{tailer: tl}
+	tl.observer = observer
+
+	assert.NotNil(t, tl.tailFromBegining())
+	assert.Equal(t, []string{"error /var/log/missing.log"}, observer.getEvents())
+}
@@ -0,0 +1,131 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// An idleFile is a file closed to stay under max_open_files, it is reopened
+// once it gets new data. cursor is the position of its tailer when it was closed,
+// it is nil for a file that was never opened, which is tailed from offset
+type idleFile struct {
+	cursor []byte
+	offset int64
+}
+
+// startTailers starts the tailers of sources, the most recently modified files first.
+// When maxOpenFiles is set and the open files reach it, a file is only opened in place
+// of an open file modified less recently, which is closed. The files left closed
+// are opened once they get new data, from where they were left
+func (s *Scanner) startTailers(sources []*config.IntegrationConfigLogSource, fromBegining map[string]bool) {
+	if s.maxOpenFiles <= 0 {
+		for _, source := range sources {
+			s.startTailer(source, fromBegining[source.Path])
+		}
+		return
+	}
+	candidates := []*config.IntegrationConfigLogSource{}
+	truncated := make(map[string]bool)
+	sizes := make(map[string]int64)
+	modTimes := make(map[string]time.Time)
+	for _, source := range sources {
+		info, err := os.Stat(source.Path)
+		if err != nil {
+			// the tailer fails without opening the file, and reports why
+			s.startTailer(source, fromBegining[source.Path])
+			continue
+		}
+		if idle, ok := s.idleFiles[source.Path]; ok {
+			if info.Size() == idle.offset {
+				// the file has no new data
+				continue
+			}
+			truncated[source.Path] = info.Size() < idle.offset
+		}
+		candidates = append(candidates, source)
+		sizes[source.Path] = info.Size()
+		modTimes[source.Path] = info.ModTime()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return modTimes[candidates[i].Path].After(modTimes[candidates[j].Path])
+	})
+	for _, source := range candidates {
+		if len(s.tailers) >= s.maxOpenFiles && !s.closeIdlestTailer(modTimes[source.Path]) {
+			if _, ok := s.idleFiles[source.Path]; !ok {
+				// only what is written after the file was found is tailed
+				s.idleFiles[source.Path] = &idleFile{offset: sizes[source.Path]}
+			}
+			continue
+		}
+		s.startTailer(source, fromBegining[source.Path] || truncated[source.Path])
+	}
+}
+
+// closeIdlestTailer closes the file modified least recently, when it was modified
+// before newModTime, that of the file to open. It returns false when no file is closed
+func (s *Scanner) closeIdlestTailer(newModTime time.Time) bool {
+	var idlest *Tailer
+	var idlestModTime time.Time
+	for path, t := range s.tailers {
+		if _, deleted := s.deletedAt[path]; deleted || !t.follow {
+			continue
+		}
+		if m := modTime(t.path); idlest == nil || m.Before(idlestModTime) {
+			idlest, idlestModTime = t, m
+		}
+	}
+	if idlest == nil || !idlestModTime.Before(newModTime) {
+		return false
+	}
+	s.closeIdleTailer(idlest)
+	return true
+}
+
+// closeIdleTailer stops a tailer and waits for it to close its file, its offset
+// is commited and it is reopened where it stopped once the file gets new data
+func (s *Scanner) closeIdleTailer(t *Tailer) {
+	// the file is identified while it is open
+	c, _ := parseCursor(t.Cursor())
+	shouldTrackOffset := true
+	t.Stop(shouldTrackOffset)
+	select {
+	case <-t.done:
+	case <-time.After(s.shutdownTimeout):
+		log.Println("Closing", t.path, "before it forwarded the lines it read")
+	}
+	position, _ := parseCursor(t.Cursor())
+	c.Offset, c.Generation = position.Offset, position.Generation
+	token, _ := json.Marshal(c)
+	delete(s.tailers, t.source.Path)
+	s.idleFiles[t.source.Path] = &idleFile{cursor: token, offset: c.Offset}
+	s.sendDiscoveryEvent(t.source, STOPPED_STATUS, nil)
+}
+
+// reopenIdleTailer starts the tailer of an idle file where it was left,
+// a file replaced or truncated since it was closed is tailed from its begining
+func (s *Scanner) reopenIdleTailer(t *Tailer, idle *idleFile) error {
+	if idle.cursor == nil {
+		t.foundSize = idle.offset
+		return t.recoverTailing(s.auditor)
+	}
+	c, err := parseCursor(idle.cursor)
+	if err == nil {
+		err = t.checkCursor(c)
+	}
+	if err != nil {
+		log.Println("Tailing", t.path, "from its begining:", err)
+		return t.tailFromBegining()
+	}
+	t.generation = c.Generation
+	return t.tailFrom(c.Offset, os.SEEK_SET)
+}
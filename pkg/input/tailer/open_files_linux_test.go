@@ -0,0 +1,110 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// openFiles returns the number of files in dir the process has open
+func openFiles(dir string) int {
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	open := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, dir+"/") {
+			open++
+		}
+	}
+	return open
+}
+
+// readContent returns the content of the next log line sent to outputChan
+func readContent(t *testing.T, outputChan chan message.Message) string {
+	for {
+		select {
+		case msg := <-outputChan:
+			if _, ok := msg.(*message.StatusMessage); !ok {
+				return string(msg.Content())
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "no line was sent")
+			return ""
+		}
+	}
+}
+
+func TestScannerCapsOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capped")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.Nil(t, err)
+	path := func(i int) string { return fmt.Sprintf("%s/%d.log", dir, i) }
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		f, err := os.Create(path(i))
+		assert.Nil(t, err)
+		f.Close()
+		modTime := now.Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(path(i), modTime, modTime)
+	}
+	write := func(i int, line string) {
+		f, err := os.OpenFile(path(i), os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+		assert.Nil(t, err)
+		defer f.Close()
+		_, err = f.WriteString(line)
+		assert.Nil(t, err)
+	}
+
+	pp := pipeline.NewPipelineProvider()
+	pp.MockPipelineChans()
+	outputChan := pp.NextPipelineChan()
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: fmt.Sprintf("%s/*.log", dir)}}
+	s := New(sources, pp, auditor.New(nil))
+	s.maxOpenFiles = 2
+	s.setup()
+	defer s.Stop()
+
+	// the most recently modified files are opened first
+	assert.Equal(t, 2, openFiles(dir))
+	assert.NotNil(t, s.tailers[path(4)])
+	assert.NotNil(t, s.tailers[path(3)])
+
+	// a file that gets new data is opened in place of the idlest one,
+	// and tailed from its size when it was found
+	write(0, "hello world\n")
+	s.scan()
+	assert.Equal(t, 2, openFiles(dir))
+	assert.NotNil(t, s.tailers[path(0)])
+	assert.NotNil(t, s.tailers[path(4)])
+	assert.Equal(t, "hello world", readContent(t, outputChan))
+
+	// a closed file is reopened where it was left
+	write(3, "hello again\n")
+	s.scan()
+	assert.Equal(t, 2, openFiles(dir))
+	assert.NotNil(t, s.tailers[path(3)])
+	assert.NotNil(t, s.tailers[path(0)])
+	assert.Equal(t, "hello again", readContent(t, outputChan))
+
+	// the files with no new data stay closed
+	s.scan()
+	assert.Equal(t, 2, openFiles(dir))
+	assert.Equal(t, 2, len(s.tailers))
+}
@@ -0,0 +1,24 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"syscall"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// openFlags returns the flags to open the files of a source with
+func openFlags(names []string) int {
+	flags := 0
+	for _, name := range names {
+		switch name {
+		case config.NOATIME_FLAG:
+			flags |= syscall.O_NOATIME
+		}
+	}
+	return flags
+}
@@ -0,0 +1,44 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fileFlags returns the status flags of an open file
+func fileFlags(t *testing.T, f file) int {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.(*os.File).Fd(), syscall.F_GETFL, 0)
+	assert.Equal(t, syscall.Errno(0), errno)
+	return int(flags)
+}
+
+func TestTailerOpensFileWithNoatime(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "open_flags")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	testPath := filepath.Join(testDir, "noatime.log")
+	assert.Nil(t, ioutil.WriteFile(testPath, []byte("hello world\n"), 0644))
+
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: testPath, OpenFlags: []string{config.NOATIME_FLAG}}
+	f, err := NewTailer(nil, source).open()
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.NotEqual(t, 0, fileFlags(t, f)&syscall.O_NOATIME)
+
+	source = &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: testPath}
+	f, err = NewTailer(nil, source).open()
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, 0, fileFlags(t, f)&syscall.O_NOATIME)
+}
@@ -0,0 +1,66 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-log-agent/pkg/decoder"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// The overflow policies tell what a tailer does with the payloads it reads
+// when the input channel of its decoder is full
+const (
+	// BLOCK_OVERFLOW waits for the decoder, no line is lost
+	BLOCK_OVERFLOW = "block"
+	// DROP_NEWEST_OVERFLOW drops the payload just read
+	DROP_NEWEST_OVERFLOW = "drop_newest"
+	// DROP_OLDEST_OVERFLOW drops the oldest payload waiting for the decoder
+	DROP_OLDEST_OVERFLOW = "drop_oldest"
+)
+
+// sendPayload hands a payload read from the file to the decoder, following
+// the overflow policy when the decoder can't keep up. A dropped payload loses
+// the lines it holds, and the lines around it may be merged.
+// It returns false when the tailer has to stop before the payload is sent
+func (t *Tailer) sendPayload(payload *decoder.Payload) bool {
+	switch t.overflowPolicy {
+	case DROP_NEWEST_OVERFLOW:
+		select {
+		case t.d.InputChan <- payload:
+		default:
+			t.onPayloadDropped()
+		}
+		return true
+	case DROP_OLDEST_OVERFLOW:
+		for {
+			select {
+			case t.d.InputChan <- payload:
+				return true
+			default:
+			}
+			select {
+			case <-t.d.InputChan:
+				t.onPayloadDropped()
+			default:
+				// the decoder took a payload meanwhile
+			}
+		}
+	default:
+		select {
+		case t.d.InputChan <- payload:
+			return true
+		case <-t.hardStop:
+			return false
+		}
+	}
+}
+
+func (t *Tailer) onPayloadDropped() {
+	atomic.AddInt64(&t.payloadsDropped, 1)
+	metrics.PayloadsDropped.Add(1)
+}
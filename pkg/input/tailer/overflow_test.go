@@ -0,0 +1,87 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/decoder"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOverflowTailer returns a tailer whose decoder is not started, with its
+// input channel of two payloads filled with the first payloads given
+func newOverflowTailer(t *testing.T, policy string, payloads []*decoder.Payload) *Tailer {
+	config.LogsAgent.Set("decoder_chan_size", 2)
+	config.LogsAgent.Set("decoder_overflow_policy", policy)
+	defer config.LogsAgent.Set("decoder_chan_size", config.ChanSizes)
+	defer config.LogsAgent.Set("decoder_overflow_policy", BLOCK_OVERFLOW)
+	tl := NewTailer(make(chan message.Message, chanSize), &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "/var/log/overflow.log"})
+	assert.Equal(t, 2, cap(tl.d.InputChan))
+	assert.True(t, tl.sendPayload(payloads[0]))
+	assert.True(t, tl.sendPayload(payloads[1]))
+	return tl
+}
+
+func newOverflowPayloads() []*decoder.Payload {
+	payloads := []*decoder.Payload{}
+	for i := 0; i < 4; i++ {
+		payloads = append(payloads, decoder.NewPayload([]byte("line\n"), int64(5*i)))
+	}
+	return payloads
+}
+
+// queuedPayloads returns the payloads waiting for the decoder
+func queuedPayloads(tl *Tailer) []*decoder.Payload {
+	queued := []*decoder.Payload{}
+	for len(tl.d.InputChan) > 0 {
+		queued = append(queued, <-tl.d.InputChan)
+	}
+	return queued
+}
+
+func TestBlockOverflowPolicyWaitsForTheDecoder(t *testing.T) {
+	payloads := newOverflowPayloads()
+	tl := newOverflowTailer(t, BLOCK_OVERFLOW, payloads)
+	sent := make(chan bool)
+	go func() {
+		sent <- tl.sendPayload(payloads[2])
+	}()
+	select {
+	case <-sent:
+		assert.Fail(t, "the payload was sent to a full channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-tl.d.InputChan
+	assert.True(t, <-sent)
+	assert.Equal(t, []*decoder.Payload{payloads[1], payloads[2]}, queuedPayloads(tl))
+	assert.Equal(t, int64(0), tl.Stats().PayloadsDropped)
+
+	// a hard stop gives up on the payload
+	tl = newOverflowTailer(t, BLOCK_OVERFLOW, payloads)
+	close(tl.hardStop)
+	assert.False(t, tl.sendPayload(payloads[2]))
+}
+
+func TestDropNewestOverflowPolicyDropsThePayloadRead(t *testing.T) {
+	payloads := newOverflowPayloads()
+	tl := newOverflowTailer(t, DROP_NEWEST_OVERFLOW, payloads)
+	assert.True(t, tl.sendPayload(payloads[2]))
+	assert.Equal(t, []*decoder.Payload{payloads[0], payloads[1]}, queuedPayloads(tl))
+	assert.Equal(t, int64(1), tl.Stats().PayloadsDropped)
+}
+
+func TestDropOldestOverflowPolicyDropsTheOldestPayload(t *testing.T) {
+	payloads := newOverflowPayloads()
+	tl := newOverflowTailer(t, DROP_OLDEST_OVERFLOW, payloads)
+	assert.True(t, tl.sendPayload(payloads[2]))
+	assert.True(t, tl.sendPayload(payloads[3]))
+	assert.Equal(t, []*decoder.Payload{payloads[2], payloads[3]}, queuedPayloads(tl))
+	assert.Equal(t, int64(2), tl.Stats().PayloadsDropped)
+}
@@ -0,0 +1,53 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+// Pause stops the tailer from reading its file, to hold back a noisy source
+// for a while. The file stays open, and the tailer resumes reading at the
+// same offset once resumed. A paused tailer can still be stopped
+func (t *Tailer) Pause() {
+	t.pauseMutex.Lock()
+	defer t.pauseMutex.Unlock()
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets a paused tailer read its file again
+func (t *Tailer) Resume() {
+	t.pauseMutex.Lock()
+	defer t.pauseMutex.Unlock()
+	if t.resumed != nil {
+		close(t.resumed)
+		t.resumed = nil
+	}
+}
+
+// IsPaused returns true while the tailer is paused
+func (t *Tailer) IsPaused() bool {
+	return t.resumedChan() != nil
+}
+
+// resumedChan returns a channel closed when the tailer is resumed,
+// or nil when it is not paused
+func (t *Tailer) resumedChan() chan struct{} {
+	t.pauseMutex.Lock()
+	defer t.pauseMutex.Unlock()
+	return t.resumed
+}
+
+// waitUntilResumed blocks while the tailer is paused. It returns
+// false when the tailer was stopped meanwhile
+func (t *Tailer) waitUntilResumed(resumed chan struct{}) bool {
+	select {
+	case <-resumed:
+		return true
+	case <-t.softStop:
+		return false
+	case <-t.hardStop:
+		return false
+	}
+}
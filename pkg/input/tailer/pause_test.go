@@ -0,0 +1,64 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPausedTailerResumesAtTheSameOffset(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/noisy.log"
+	fs.create(path, "first\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	defer tl.Stop(false)
+	msg := <-outputChan
+	assert.Equal(t, "first", string(msg.Content()))
+
+	tl.Pause()
+	assert.True(t, tl.Stats().Paused)
+	// let the tailer notice it is paused
+	time.Sleep(50 * time.Millisecond)
+	fs.append(path, "second\n")
+	select {
+	case msg := <-outputChan:
+		assert.Fail(t, "a paused tailer forwarded a line", string(msg.Content()))
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, int64(6), tl.GetLastOffset())
+
+	tl.Resume()
+	assert.False(t, tl.Stats().Paused)
+	msg = <-outputChan
+	assert.Equal(t, "second", string(msg.Content()))
+	assert.Equal(t, int64(13), msg.GetOrigin().Offset)
+}
+
+func TestPausedTailerCanBeStopped(t *testing.T) {
+	fs := newFakeFS()
+	path := "/var/log/noisy.log"
+	fs.create(path, "first\n")
+	outputChan := make(chan message.Message, chanSize)
+	tl := newFakeTailer(fs, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}, outputChan)
+	assert.Nil(t, tl.tailFromBegining())
+	<-outputChan
+
+	tl.Pause()
+	time.Sleep(50 * time.Millisecond)
+	tl.Stop(false)
+	select {
+	case <-tl.done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the paused tailer didn't stop")
+	}
+}
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+)
+
+// A readScheduler shares the read cycles between the tailers of a scanner:
+// while several files are read, a file can't be read more than maxReads times
+// per interval, so that a flooding file doesn't delay the lines of the others.
+// A file read alone is never throttled
+type readScheduler struct {
+	mutex    sync.Mutex
+	clock    clock.Clock
+	interval time.Duration
+	maxReads int
+
+	start time.Time
+	// reads counts the read cycles of each tailer during the current interval
+	reads map[*Tailer]int
+	// previous holds the tailers that read during the previous interval
+	previous map[*Tailer]int
+}
+
+// newReadScheduler returns a readScheduler letting each file be read
+// maxReads times per interval while other files are read too
+func newReadScheduler(maxReads int, interval time.Duration, clock clock.Clock) *readScheduler {
+	return &readScheduler{
+		clock:    clock,
+		interval: interval,
+		maxReads: maxReads,
+		start:    clock.Now(),
+		reads:    make(map[*Tailer]int),
+		previous: make(map[*Tailer]int),
+	}
+}
+
+// allow returns false when t used its share of the read cycles
+// of the current interval, while other files are read
+func (s *readScheduler) allow(t *Tailer) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextInterval()
+	return s.reads[t] < s.maxReads || !s.isShared(t)
+}
+
+// record counts a read cycle of t that returned data
+func (s *readScheduler) record(t *Tailer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextInterval()
+	s.reads[t]++
+}
+
+// nextInterval starts a new interval once the current one is over
+func (s *readScheduler) nextInterval() {
+	now := s.clock.Now()
+	if now.Sub(s.start) < s.interval {
+		return
+	}
+	s.previous = s.reads
+	s.reads = make(map[*Tailer]int)
+	s.start = now
+}
+
+// isShared returns true if other tailers than t read recently
+func (s *readScheduler) isShared(t *Tailer) bool {
+	for _, reads := range []map[*Tailer]int{s.reads, s.previous} {
+		for other := range reads {
+			if other != t {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSchedulerOnlyThrottlesFilesReadTogether(t *testing.T) {
+	mock := clock.NewMock(time.Now())
+	s := newReadScheduler(2, time.Second, mock)
+	flood, trickle := &Tailer{}, &Tailer{}
+
+	// a file read alone is never throttled
+	for i := 0; i < 5; i++ {
+		assert.True(t, s.allow(flood))
+		s.record(flood)
+	}
+	s.record(trickle)
+	assert.False(t, s.allow(flood))
+	assert.True(t, s.allow(trickle))
+
+	// the trickle file was read during the previous interval
+	mock.Add(time.Second)
+	assert.True(t, s.allow(flood))
+	s.record(flood)
+	s.record(flood)
+	assert.False(t, s.allow(flood))
+
+	// it is not read anymore
+	mock.Add(time.Second)
+	s.record(flood)
+	s.record(flood)
+	assert.True(t, s.allow(flood))
+}
+
+func TestReadSchedulerForwardsTrickleFileWhileAnotherFloods(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "read_scheduler")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	floodPath := filepath.Join(testDir, "flood.log")
+	tricklePath := filepath.Join(testDir, "trickle.log")
+	line := strings.Repeat("f", 63) + "\n"
+	assert.Nil(t, ioutil.WriteFile(floodPath, []byte(strings.Repeat(line, 100000)), 0644))
+	assert.Nil(t, ioutil.WriteFile(tricklePath, nil, 0644))
+
+	outputChan := make(chan message.Message, chanSize)
+	scheduler := newReadScheduler(4, time.Second, clock.New())
+	newTailer := func(path string) *Tailer {
+		tl := NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path})
+		tl.scheduler = scheduler
+		tl.sleepDuration = 10 * time.Millisecond
+		assert.Nil(t, tl.tailFromBegining())
+		return tl
+	}
+	flood := newTailer(floodPath)
+	trickle := newTailer(tricklePath)
+	defer func() {
+		// the flooding file is not read until its end
+		for _, tl := range []*Tailer{flood, trickle} {
+			tl.Stop(false)
+			tl.hardStopOnce.Do(func() { close(tl.hardStop) })
+		}
+		for {
+			select {
+			case <-outputChan:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}()
+
+	// alone, the flooding file is read as fast as possible
+	for i := 0; i < 1000; i++ {
+		<-outputChan
+	}
+
+	f, err := os.OpenFile(tricklePath, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString("trickle\n")
+	assert.Nil(t, err)
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case msg := <-outputChan:
+			done = string(msg.Content()) == "trickle"
+		case <-timeout:
+			assert.Fail(t, "the trickle line was not forwarded")
+			return
+		}
+	}
+
+	// meanwhile, the flooding file is held to its share of the read cycles
+	read := flood.Stats().BytesRead
+	drained := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case <-outputChan:
+		case <-drained:
+			done = true
+		}
+	}
+	assert.True(t, flood.Stats().BytesRead-read <= 2*4*4096)
+}
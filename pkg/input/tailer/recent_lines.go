@@ -0,0 +1,56 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"sync"
+)
+
+// A lineRing keeps the last lines added to it, it is safe to use concurrently
+type lineRing struct {
+	mutex sync.Mutex
+	lines []string
+	// next is where the next line is written, the oldest line once the ring is full
+	next int
+	full bool
+}
+
+// newLineRing returns a ring keeping the last size lines
+func newLineRing(size int) *lineRing {
+	return &lineRing{
+		lines: make([]string, size),
+	}
+}
+
+// add adds a line to the ring, replacing the oldest one when it is full
+func (r *lineRing) add(line []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lines[r.next] = string(line)
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// get returns the lines of the ring, oldest first
+func (r *lineRing) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.full {
+		return append([]string{}, r.lines[:r.next]...)
+	}
+	return append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// RecentLines returns the last lines read by the tailer, oldest first,
+// or nil when its source doesn't keep them
+func (t *Tailer) RecentLines() []string {
+	if t.recentLines == nil {
+		return nil
+	}
+	return t.recentLines.get()
+}
@@ -0,0 +1,43 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineRingKeepsLastLines(t *testing.T) {
+	r := newLineRing(3)
+	assert.Equal(t, []string{}, r.get())
+	r.add([]byte("line 1"))
+	r.add([]byte("line 2"))
+	assert.Equal(t, []string{"line 1", "line 2"}, r.get())
+	for i := 3; i <= 7; i++ {
+		r.add([]byte(fmt.Sprintf("line %d", i)))
+	}
+	assert.Equal(t, []string{"line 5", "line 6", "line 7"}, r.get())
+}
+
+func TestLineRingIsSafeToUseConcurrently(t *testing.T) {
+	r := newLineRing(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.add([]byte("hello"))
+				assert.True(t, len(r.get()) <= 10)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, len(r.get()))
+}
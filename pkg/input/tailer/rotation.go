@@ -0,0 +1,85 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// fileAction is what a tailer must do with its open file
+// after comparing it to the file currently at its path
+type fileAction int
+
+const (
+	// continueReading keeps reading the open file from the current offset
+	continueReading fileAction = iota
+	// reopenFromBeginning closes the open file and tails the file
+	// at the same path from its first byte, the file has been rotated
+	reopenFromBeginning
+	// seekToBeginning keeps the open file and reads it again from
+	// its first byte, the file has been truncated
+	seekToBeginning
+)
+
+func (a fileAction) String() string {
+	switch a {
+	case continueReading:
+		return "continue"
+	case reopenFromBeginning:
+		return "reopen-from-0"
+	case seekToBeginning:
+		return "seek-to-0"
+	default:
+		return "unknown"
+	}
+}
+
+// rotationAction decides how to keep tailing a file.
+// A different inode always means a rotation, even if the new file is smaller
+// than our offset: the open file is kept until it is replaced, and the new one
+// must be read entirely. A smaller file with the same inode has been truncated.
+// An inode of 0 is unknown, in which case only the size is compared
+func rotationAction(openInode uint64, openOffset int64, currentInode uint64, currentSize int64) fileAction {
+	if openInode != 0 && currentInode != 0 && openInode != currentInode {
+		return reopenFromBeginning
+	}
+	if currentSize < openOffset {
+		return seekToBeginning
+	}
+	return continueReading
+}
+
+// checkRotation returns the action to take given the file
+// currently at the path of the tailer. The size of a nonblocking
+// file is meaningless, it is never considered rotated.
+// With a fingerprint file_identity, files are told apart by their first bytes
+// instead of their inodes. The size of a gzipped file is compared to
+// the offset in its compressed content. A file that couldn't be opened is left as is
+func (t *Tailer) checkRotation() (fileAction, error) {
+	if t.source.Nonblock {
+		return continueReading, nil
+	}
+	current, err := t.fs.Stat(t.path)
+	if err != nil {
+		return continueReading, err
+	}
+	t.stopMutex.Lock()
+	f := t.file
+	t.stopMutex.Unlock()
+	if f == nil {
+		return continueReading, fmt.Errorf("%s was never opened", t.path)
+	}
+	if t.source.FileIdentity == config.FINGERPRINT_IDENTITY {
+		return t.fingerprintAction(current.Size())
+	}
+	open, err := f.Stat()
+	if err != nil {
+		return reopenFromBeginning, nil
+	}
+	return rotationAction(inode(open), t.openOffset(), inode(current), current.Size()), nil
+}
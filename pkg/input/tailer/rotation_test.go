@@ -0,0 +1,40 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotationAction(t *testing.T) {
+	tests := []struct {
+		name         string
+		openInode    uint64
+		openOffset   int64
+		currentInode uint64
+		currentSize  int64
+		action       fileAction
+	}{
+		{"same file, no new data", 1, 10, 1, 10, continueReading},
+		{"same file, new data", 1, 10, 1, 20, continueReading},
+		{"same file, truncated", 1, 10, 1, 5, seekToBeginning},
+		{"same file, truncated to empty", 1, 10, 1, 0, seekToBeginning},
+		{"new file, bigger", 1, 10, 2, 20, reopenFromBeginning},
+		{"new file, same size", 1, 10, 2, 10, reopenFromBeginning},
+		{"new file, smaller", 1, 10, 2, 5, reopenFromBeginning},
+		{"new file, empty", 1, 10, 2, 0, reopenFromBeginning},
+		{"unknown inodes, new data", 0, 10, 0, 20, continueReading},
+		{"unknown inodes, truncated", 0, 10, 0, 5, seekToBeginning},
+		{"unknown open inode, smaller", 0, 10, 2, 5, seekToBeginning},
+		{"unknown current inode, bigger", 1, 10, 0, 20, continueReading},
+	}
+	for _, test := range tests {
+		action := rotationAction(test.openInode, test.openOffset, test.currentInode, test.currentSize)
+		assert.Equal(t, test.action, action, test.name)
+	}
+}
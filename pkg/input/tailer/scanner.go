@@ -6,24 +6,75 @@
 package tailer
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
 )
 
-const scanPeriod = 10 * time.Second
+const defaultScanPeriod = 10 * time.Second
+const defaultShutdownTimeout = 10 * time.Second
+
+// deletedFileTTL is how long a file closed once deleted is remembered, a file recreated
+// within it is tailed from its begining, after it is tailed as a new file
+const deletedFileTTL = 24 * time.Hour
 
 type Scanner struct {
-	sources []*config.IntegrationConfigLogSource
-	pp      *pipeline.PipelineProvider
-	tailers map[string]*Tailer
-	auditor *auditor.Auditor
+	sources      []*config.IntegrationConfigLogSource
+	pp           *pipeline.PipelineProvider
+	tailers      map[string]*Tailer
+	auditor      *auditor.Auditor
+	maxOpenFiles int
+	scanPeriod   time.Duration
+	// scheduler shares the read cycles between the tailers, when the reads are limited
+	scheduler *readScheduler
+	observer  TailerObserver
+	// generations counts the rotations of the files since they are tailed
+	generations map[string]int64
+	// shardChans are the pipelines of the sharded sources by identifier,
+	// the shards of a source are forwarded through the same pipeline
+	shardChans map[string]chan message.Message
+	// deletedAt is when the files tailed were found deleted, they are tailed
+	// from their begining when they are recreated, by their tailer within
+	// deleteGracePeriod, and by a new tailer within deletedFileTTL after it
+	deletedAt         map[string]time.Time
+	deleteGracePeriod time.Duration
+	clock             clock.Clock
+	// failedSources are the files whose tailer couldn't start, they are tailed
+	// from their commited offset once they can be, or from their begining when
+	// they failed after a rotation
+	failedSources map[string]bool
+	// idleFiles are the files matched but closed to stay under maxOpenFiles
+	idleFiles map[string]*idleFile
+
+	// replays are the tailers sending again the lines of a file, until they reach its end
+	replays []*Tailer
+
+	// tailersMutex protects tailers and replays, that can be read while the scanner is running
+	tailersMutex sync.Mutex
+
+	discoveryEvents chan DiscoveryEvent
+	// discoverySubscribed is set once the discovery events are read
+	discoverySubscribed int32
+
+	// reportSourceErrors makes the sources that can't be tailed emit an error
+	// into the pipeline, once until they are tailed again
+	reportSourceErrors bool
+	reportedErrors     map[string]bool
+
+	// shutdownTimeout bounds the wait for the tailers to forward their lines on stop
+	shutdownTimeout time.Duration
 }
 
 // New returns an initialized Scanner
@@ -31,44 +82,189 @@ func New(sources []*config.IntegrationConfigLogSource, pp *pipeline.PipelineProv
 	tailSources := []*config.IntegrationConfigLogSource{}
 	for _, source := range sources {
 		switch source.Type {
-		case config.FILE_TYPE:
+		case config.FILE_TYPE, config.DIRECTORY_TYPE:
 			tailSources = append(tailSources, source)
 		default:
 		}
 	}
+	scanPeriod := time.Duration(config.LogsAgent.GetInt("glob_scan_interval")) * time.Second
+	if scanPeriod <= 0 {
+		scanPeriod = defaultScanPeriod
+	}
+	shutdownTimeout := time.Duration(config.LogsAgent.GetInt("shutdown_timeout")) * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	var scheduler *readScheduler
+	if maxReads := config.LogsAgent.GetInt("max_reads_per_interval"); maxReads > 0 {
+		interval := time.Duration(config.LogsAgent.GetInt("read_interval")) * time.Millisecond
+		scheduler = newReadScheduler(maxReads, interval, clock.New())
+	}
 	return &Scanner{
 		sources: tailSources,
 		pp:      pp,
 		tailers: make(map[string]*Tailer),
 		auditor: auditor,
+
+		maxOpenFiles: config.LogsAgent.GetInt("max_open_files"),
+		scanPeriod:   scanPeriod,
+		scheduler:    scheduler,
+		generations:  make(map[string]int64),
+		shardChans:   make(map[string]chan message.Message),
+
+		deletedAt:         make(map[string]time.Time),
+		deleteGracePeriod: time.Duration(config.LogsAgent.GetInt("delete_grace_period")) * time.Millisecond,
+		clock:             clock.New(),
+		failedSources:     make(map[string]bool),
+		idleFiles:         make(map[string]*idleFile),
+
+		discoveryEvents: make(chan DiscoveryEvent, discoveryEventsSize),
+
+		reportSourceErrors: config.LogsAgent.GetBool("report_source_errors"),
+		reportedErrors:     make(map[string]bool),
+
+		shutdownTimeout: shutdownTimeout,
 	}
 }
 
 // setup sets all tailers
 func (s *Scanner) setup() {
-	for _, source := range s.sources {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	sources := []*config.IntegrationConfigLogSource{}
+	for _, source := range s.filesToTail() {
 		if _, ok := s.tailers[source.Path]; ok {
 			log.Println("Can't tail file twice:", source.Path)
 		} else {
-			s.setupTailer(source, false, s.pp.NextPipelineChan())
+			sources = append(sources, source)
+		}
+	}
+	s.startTailers(sources, nil)
+}
+
+// filesToTail returns a source for each file the scanner should tail.
+// Sources whose path is a glob pattern, or a directory for directory sources,
+// are expanded to one source per match that isn't excluded
+func (s *Scanner) filesToTail() []*config.IntegrationConfigLogSource {
+	files := []*config.IntegrationConfigLogSource{}
+	for _, source := range s.sources {
+		var matches []string
+		var err error
+		switch {
+		case source.Type == config.DIRECTORY_TYPE:
+			matches, err = listFiles(source.Path)
+			if err != nil {
+				log.Println("Can't list directory:", source.Path, err)
+				continue
+			}
+		case isGlob(source.Path):
+			matches, err = filepath.Glob(source.Path)
+		default:
+			files = append(files, source)
+			continue
+		}
+		if err != nil {
+			log.Println("Invalid path pattern:", source.Path, err)
+			continue
+		}
+		var isMatch map[string]bool
+		if source.OrderedRotations {
+			isMatch = make(map[string]bool)
+			for _, match := range matches {
+				isMatch[match] = true
+			}
+		}
+		for _, match := range matches {
+			if !source.FollowSymlinks && isSymlink(match) {
+				continue
+			}
+			if live, _, ok := rotationOf(match); ok && isMatch[live] {
+				// the rotation is read by the tailer of its file, before it
+				continue
+			}
+			if isExcluded(match, source.ExcludePaths) {
+				continue
+			}
+			fileSource := *source
+			fileSource.Path = match
+			files = append(files, &fileSource)
 		}
 	}
+	return files
 }
 
 // setupTailer sets one tailer, making it tail from the begining or the end
-func (s *Scanner) setupTailer(source *config.IntegrationConfigLogSource, tailFromBegining bool, outputChan chan message.Message) {
+func (s *Scanner) setupTailer(source *config.IntegrationConfigLogSource, tailFromBegining bool, outputChan chan message.Message) error {
 	t := NewTailer(outputChan, source)
+	t.scheduler = s.scheduler
+	t.auditor = s.auditor
+	t.observer = s.observer
+	t.reportErrors = s.reportSourceErrors
+	t.generation = s.generations[source.Path]
+	_, t.retried = s.failedSources[source.Path]
+	if source.WAL {
+		t.wal = s.auditor.WAL()
+	}
+	idle, isIdle := s.idleFiles[source.Path]
+	delete(s.idleFiles, source.Path)
 	var err error
-	if tailFromBegining {
+	switch {
+	case tailFromBegining:
 		err = t.tailFromBegining()
-	} else {
+	case isIdle:
+		err = s.reopenIdleTailer(t, idle)
+	default:
 		// resume tailing from last commited offset
 		err = t.recoverTailing(s.auditor)
 	}
 	if err != nil {
-		log.Println(err)
+		// the tailer is not kept, the file is tried again at the next scans
+		logger.Error(err)
+		s.reportSourceError(source, err, outputChan)
+		delete(s.tailers, source.Path)
+		s.failedSources[source.Path] = s.failedSources[source.Path] || tailFromBegining
+		return err
 	}
+	delete(s.reportedErrors, source.Path)
+	delete(s.failedSources, source.Path)
 	s.tailers[source.Path] = t
+	return nil
+}
+
+// reportSourceError emits an error describing why a file can't be tailed
+// into its pipeline, when report_source_errors is set. It is emitted once,
+// until the file is tailed again. It is a status, not a log line, and it is never commited
+func (s *Scanner) reportSourceError(source *config.IntegrationConfigLogSource, err error, outputChan chan message.Message) {
+	if !s.reportSourceErrors || s.reportedErrors[source.Path] {
+		return
+	}
+	s.reportedErrors[source.Path] = true
+	outputChan <- newSourceErrorMessage(source, err)
+}
+
+// startTailer sets a tailer for a file that is not tailed yet,
+// reporting it for a directory source
+func (s *Scanner) startTailer(source *config.IntegrationConfigLogSource, tailFromBegining bool) {
+	s.sendDiscoveryEvent(source, DISCOVERED_STATUS, nil)
+	if err := s.setupTailer(source, tailFromBegining, s.outputChan(source)); err != nil {
+		s.sendDiscoveryEvent(source, ERRORED_STATUS, err)
+		return
+	}
+	s.sendDiscoveryEvent(source, STARTED_STATUS, nil)
+}
+
+// outputChan returns the pipeline of a new tailer, that of the other shards
+// of its source when it is sharded
+func (s *Scanner) outputChan(source *config.IntegrationConfigLogSource) chan message.Message {
+	if !source.Sharded {
+		return s.pp.NextPipelineChan()
+	}
+	outputChan, ok := s.shardChans[source.Identifier]
+	if !ok {
+		outputChan = s.pp.NextPipelineChan()
+		s.shardChans[source.Identifier] = outputChan
+	}
+	return outputChan
 }
 
 // Start starts the Scanner
@@ -79,7 +275,7 @@ func (s *Scanner) Start() {
 
 // run lets the Scanner tail its file
 func (s *Scanner) run() {
-	ticker := time.NewTicker(scanPeriod)
+	ticker := time.NewTicker(s.scanPeriod)
 	for _ = range ticker.C {
 		s.scan()
 	}
@@ -92,45 +288,262 @@ func (s *Scanner) run() {
 // its tailer will keep tailing the rotated file.
 // The Scanner needs to stop that previous tailer,
 // and start a new one for the new file.
+// A followed symlink that points to a new target is handled the same way.
 func (s *Scanner) scan() {
-	for _, source := range s.sources {
-		tailer := s.tailers[source.Path]
-		f, err := os.Open(source.Path)
-		if err != nil {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	files := s.filesToTail()
+
+	// close the files that are no longer matched or that have been idle
+	// for too long, their offsets are kept in the registry.
+	// A deleted file is closed once it was not recreated within the grace period
+	shouldTail := make(map[string]bool)
+	for _, source := range files {
+		shouldTail[source.Path] = true
+	}
+	for path := range s.idleFiles {
+		if !shouldTail[path] {
+			delete(s.idleFiles, path)
+		}
+	}
+	recreated := make(map[string]bool)
+	now := s.clock.Now()
+	for path, tailer := range s.tailers {
+		_, err := tailer.fs.Stat(tailer.path)
+		deleted := os.IsNotExist(err)
+		if _, ok := s.deletedAt[path]; ok && !deleted {
+			recreated[path] = true
+			delete(s.deletedAt, path)
+		}
+		if shouldTail[path] && !deleted {
 			continue
 		}
-		stat1, err := f.Stat()
-		if err != nil {
+		if deleted {
+			if _, ok := s.deletedAt[path]; !ok {
+				s.deletedAt[path] = now
+			}
+			if now.Sub(s.deletedAt[path]) < s.deleteGracePeriod {
+				// the file may be recreated
+				continue
+			}
+		}
+		tailer.Stop(!deleted)
+		delete(s.tailers, path)
+		delete(s.generations, path)
+		s.sendDiscoveryEvent(tailer.source, STOPPED_STATUS, nil)
+	}
+
+	for path, deletedAt := range s.deletedAt {
+		if _, ok := s.tailers[path]; !ok && now.Sub(deletedAt) >= s.deleteGracePeriod+deletedFileTTL {
+			delete(s.deletedAt, path)
+		}
+	}
+
+	starts := []*config.IntegrationConfigLogSource{}
+	fromBegining := make(map[string]bool)
+	for _, source := range files {
+		tailer, ok := s.tailers[source.Path]
+		if !ok {
+			if _, err := os.Lstat(source.Path); os.IsNotExist(err) {
+				// the file was deleted, it is tailed again once recreated
+				continue
+			}
+			_, recreated := s.deletedAt[source.Path]
+			delete(s.deletedAt, source.Path)
+			// resume tailing a new file, or a file that has new data,
+			// a file recreated after it was closed is read from its begining
+			starts = append(starts, source)
+			fromBegining[source.Path] = recreated || s.failedSources[source.Path]
 			continue
 		}
-		stat2, err := tailer.file.Stat()
-		if err != nil {
-			s.onFileRotation(tailer, source)
+		if !tailer.follow {
+			// the file is read once, it is not read again after a rotation
 			continue
 		}
-		if inode(stat1) != inode(stat2) {
-			s.onFileRotation(tailer, source)
+		if recreated[source.Path] {
+			// the file was deleted, the new one is read from its begining
+			s.onFileRotation(tailer, tailer.source)
 			continue
 		}
-
-		if stat1.Size() < tailer.GetLastOffset() {
+		action, err := tailer.checkRotation()
+		if err != nil {
+			continue
+		}
+		switch action {
+		case reopenFromBeginning:
+			s.onFileRotation(tailer, tailer.source)
+		case seekToBeginning:
 			tailer.reset()
 		}
 	}
+	s.startTailers(starts, fromBegining)
 }
 
 func (s *Scanner) onFileRotation(tailer *Tailer, source *config.IntegrationConfigLogSource) {
+	if tailer.observer != nil {
+		tailer.observer.OnRotate(tailer.path, tailer.GetLastOffset())
+	}
 	shouldTrackOffset := false
 	tailer.Stop(shouldTrackOffset)
+	s.generations[source.Path]++
 	s.setupTailer(source, true, tailer.outputChan)
 }
 
-// Stop stops the Scanner and its tailers
+// Stop stops the Scanner and its tailers. It returns once the tailers forwarded
+// the lines they read to the pipeline, so that their offsets can be commited,
+// or once shutdown_timeout is over
 func (s *Scanner) Stop() {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
 	shouldTrackOffset := true
+	stopped := make([]*Tailer, 0, len(s.tailers)+len(s.replays))
 	for _, t := range s.tailers {
 		t.Stop(shouldTrackOffset)
+		stopped = append(stopped, t)
+		s.sendDiscoveryEvent(t.source, STOPPED_STATUS, nil)
+	}
+	for _, t := range s.replays {
+		t.Stop(false)
+		stopped = append(stopped, t)
+	}
+	s.replays = nil
+	deadline := time.After(s.shutdownTimeout)
+	for _, t := range stopped {
+		select {
+		case <-t.done:
+		case <-deadline:
+			log.Println("Stopping the scanner before all its tailers forwarded the lines they read")
+			return
+		}
+	}
+}
+
+// Replay sends again the lines of the file at path, from fromOffset to its end.
+// path is the path of the file in its source, or the absolute path its stats report.
+// It doesn't change the offset commited for the file, and the lines are flagged
+// as replayed so that they can be deduplicated
+func (s *Scanner) Replay(path string, fromOffset int64) error {
+	if fromOffset < 0 {
+		return fmt.Errorf("can't replay %s from a negative offset (got %d)", path, fromOffset)
+	}
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	abs := absPath(path)
+	for _, source := range s.filesToTail() {
+		if source.Path == path || absPath(source.Path) == abs {
+			t := NewTailer(s.pp.NextPipelineChan(), source)
+			err := t.replayFrom(fromOffset)
+			if err != nil {
+				return err
+			}
+			s.replays = append(s.pendingReplays(), t)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not tailed", path)
+}
+
+// pendingReplays returns the replays that didn't reach the end of their file yet
+func (s *Scanner) pendingReplays() []*Tailer {
+	pending := s.replays[:0]
+	for _, t := range s.replays {
+		select {
+		case <-t.done:
+		default:
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+// Stats returns the stats of all the tailers
+func (s *Scanner) Stats() []TailerStats {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	stats := []TailerStats{}
+	for _, t := range s.tailers {
+		stats = append(stats, t.Stats())
+	}
+	return stats
+}
+
+// RecentLines returns the last lines read from the file at path, oldest first.
+// It fails when the file is not tailed or when its source doesn't keep its last lines
+func (s *Scanner) RecentLines(path string) ([]string, error) {
+	s.tailersMutex.Lock()
+	defer s.tailersMutex.Unlock()
+	t, ok := s.tailerOf(path)
+	if !ok {
+		return nil, fmt.Errorf("%s is not tailed", path)
+	}
+	if t.recentLines == nil {
+		return nil, fmt.Errorf("%s doesn't keep its recent lines, set recent_lines on its source", path)
+	}
+	return t.RecentLines(), nil
+}
+
+// tailerOf returns the tailer of the file at path, a relative path is resolved
+// like the paths of the tailers, so that the path reported in their stats finds them
+func (s *Scanner) tailerOf(path string) (*Tailer, bool) {
+	if t, ok := s.tailers[path]; ok {
+		return t, true
+	}
+	path = absPath(path)
+	for _, t := range s.tailers {
+		if t.path == path {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// absPath resolves path against the working directory,
+// it returns path when it can't be resolved
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// isGlob returns true if path is a pattern that can match several files
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// isExcluded returns true if path matches one of the exclude globs,
+// a glob without a separator is matched against the name of the file
+func isExcluded(path string, excludePaths []string) bool {
+	for _, pattern := range excludePaths {
+		name := path
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			name = filepath.Base(path)
+		}
+		if excluded, _ := filepath.Match(pattern, name); excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// isSymlink returns true if path is a symbolic link
+func isSymlink(path string) bool {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeSymlink != 0
+}
+
+// modTime returns the last modification time of a file,
+// or the zero time if it can't be found
+func modTime(path string) time.Time {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
 	}
+	return stat.ModTime()
 }
 
 // inode uniquely identifies a file on a filesystem
@@ -6,13 +6,20 @@
 package tailer
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
 	"github.com/stretchr/testify/suite"
@@ -75,6 +82,21 @@ func (suite *ScannerTestSuite) TestScannerStartsTailers() {
 	suite.Equal("hello world", string(msg.Content()))
 }
 
+func (suite *ScannerTestSuite) TestScannerStopsOnceItsTailersForwardedTheirLines() {
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+
+	tailer := suite.s.tailers[suite.testPath]
+	suite.s.Stop()
+	select {
+	case <-tailer.done:
+	default:
+		suite.Fail("the scanner stopped before its tailer")
+	}
+}
+
 func (suite *ScannerTestSuite) TestScannerScanWithoutLogRotation() {
 	s := suite.s
 	sources := suite.sources
@@ -95,7 +117,7 @@ func (suite *ScannerTestSuite) TestScannerScanWithoutLogRotation() {
 
 	s.scan()
 	newTailer = s.tailers[sources[0].Path]
-	suite.Equal(tailer, newTailer)
+	suite.True(tailer == newTailer)
 
 	_, err = suite.testFile.WriteString("hello again\n")
 	suite.Nil(err)
@@ -124,7 +146,7 @@ func (suite *ScannerTestSuite) TestScannerScanWithLogRotation() {
 	suite.Nil(err)
 	s.scan()
 	newTailer = s.tailers[sources[0].Path]
-	suite.NotEqual(tailer, newTailer)
+	suite.False(tailer == newTailer)
 
 	_, err = f.WriteString("hello again\n")
 	suite.Nil(err)
@@ -132,6 +154,114 @@ func (suite *ScannerTestSuite) TestScannerScanWithLogRotation() {
 	suite.Equal("hello again", string(msg.Content()))
 }
 
+func (suite *ScannerTestSuite) TestScannerTagsLinesWithTheirRotationGeneration() {
+	path := fmt.Sprintf("%s/tagged.log", suite.testDir)
+	rotatedPath := fmt.Sprintf("%s.1", path)
+	f, err := os.Create(path)
+	suite.Nil(err)
+	defer os.Remove(path)
+	defer os.Remove(rotatedPath)
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, TagSourceFile: true}
+	s := New([]*config.IntegrationConfigLogSource{source}, suite.pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	absPath, err := filepath.Abs(path)
+	suite.Nil(err)
+
+	_, err = f.WriteString("hello world\n")
+	suite.Nil(err)
+	f.Close()
+	msg := <-suite.outputChan
+	suite.Equal([]string{"source_file:" + absPath, "rotation_generation:0"}, msg.GetOrigin().Tags)
+
+	// the file is rotated
+	suite.Nil(os.Rename(path, rotatedPath))
+	f, err = os.Create(path)
+	suite.Nil(err)
+	defer f.Close()
+	s.scan()
+	_, err = f.WriteString("hello again\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+	suite.Equal([]string{"source_file:" + absPath, "rotation_generation:1"}, msg.GetOrigin().Tags)
+
+	// the file is truncated
+	suite.Nil(f.Truncate(0))
+	_, err = f.Seek(0, os.SEEK_SET)
+	suite.Nil(err)
+	_, err = f.WriteString("bye\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("bye", string(msg.Content()))
+	suite.Equal([]string{"source_file:" + absPath, "rotation_generation:2"}, msg.GetOrigin().Tags)
+}
+
+func (suite *ScannerTestSuite) TestScannerRecoversTheOffsetsOfEachShard() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, 10)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	paths := []string{fmt.Sprintf("%s/app.0.log", suite.testDir), fmt.Sprintf("%s/app.1.log", suite.testDir)}
+	shards := []*os.File{}
+	for _, path := range paths {
+		f, err := os.Create(path)
+		suite.Nil(err)
+		defer os.Remove(path)
+		defer f.Close()
+		shards = append(shards, f)
+	}
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: fmt.Sprintf("%s/app.*.log", suite.testDir), Identifier: "app", Sharded: true}
+	newScanner := func() *Scanner {
+		s := New([]*config.IntegrationConfigLogSource{source}, suite.pp, a)
+		s.setup()
+		suite.Equal(2, len(s.tailers))
+		suite.Equal(s.tailers[paths[0]].outputChan, s.tailers[paths[1]].outputChan)
+		return s
+	}
+	// receive returns the lines forwarded by the shards once they are commited
+	receive := func(count int) []string {
+		lines := []string{}
+		for i := 0; i < count; i++ {
+			msg := <-suite.outputChan
+			auditorChan <- msg
+			lines = append(lines, string(msg.Content()))
+		}
+		return lines
+	}
+
+	s := newScanner()
+	_, err := shards[0].WriteString("shard 0\n")
+	suite.Nil(err)
+	_, err = shards[1].WriteString("shard 1 line 1\n")
+	suite.Nil(err)
+	suite.ElementsMatch([]string{"shard 0", "shard 1 line 1"}, receive(2))
+	for i, path := range paths {
+		identifier := s.tailers[path].Identifier()
+		suite.True(strings.HasPrefix(identifier, "file:app:"))
+		suite.Eventually(func() bool {
+			offset, _ := a.GetLastCommitedOffset(identifier)
+			return offset == []int64{8, 15}[i]
+		}, time.Second, 10*time.Millisecond)
+	}
+	s.Stop()
+	for _, tl := range s.tailers {
+		<-tl.done
+	}
+
+	// each shard resumes at its own offset
+	_, err = shards[0].WriteString("shard 0 again\n")
+	suite.Nil(err)
+	_, err = shards[1].WriteString("shard 1 line 2\n")
+	suite.Nil(err)
+	s = newScanner()
+	defer s.Stop()
+	suite.ElementsMatch([]string{"shard 0 again", "shard 1 line 2"}, receive(2))
+}
+
 func (suite *ScannerTestSuite) TestScannerScanWithLogRotationCopyTruncate() {
 	s := suite.s
 	sources := suite.sources
@@ -155,13 +285,462 @@ func (suite *ScannerTestSuite) TestScannerScanWithLogRotationCopyTruncate() {
 	suite.Nil(err)
 	s.scan()
 	newTailer = s.tailers[sources[0].Path]
-	suite.Equal(tailer, newTailer)
+	suite.True(tailer == newTailer)
 	suite.Equal(tailer.GetLastOffset(), int64(0))
 
 	msg = <-suite.outputChan
 	suite.Equal("third", string(msg.Content()))
 }
 
+func (suite *ScannerTestSuite) TestScannerReplaysFile() {
+	_, err := suite.testFile.WriteString("first\nsecond\nthird\n")
+	suite.Nil(err)
+
+	suite.NotNil(suite.s.Replay("/does/not/exist.log", 0))
+	suite.Nil(suite.s.Replay(suite.testPath, int64(len("first\n"))))
+
+	// the live tailer also reads the new lines, only the replayed ones are kept
+	replayed := []string{}
+	for len(replayed) < 2 {
+		msg := <-suite.outputChan
+		if msg.GetOrigin().Replay {
+			suite.Equal("", msg.GetOrigin().Identifier)
+			replayed = append(replayed, string(msg.Content()))
+		}
+	}
+	suite.Equal([]string{"second", "third"}, replayed)
+
+	// the replays that reached the end of the file are forgotten, the others stop with the scanner
+	suite.Equal(1, len(suite.s.replays))
+	<-suite.s.replays[0].done
+	suite.Nil(suite.s.Replay(suite.testPath, 0))
+	suite.Equal(1, len(suite.s.replays))
+	replay := suite.s.replays[0]
+	go func() {
+		for range suite.outputChan {
+		}
+	}()
+	suite.s.Stop()
+	suite.Nil(suite.s.replays)
+	<-replay.done
+}
+
+func (suite *ScannerTestSuite) TestScannerFindsTheRecentLinesOfARelativePath() {
+	suite.s.Stop()
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: suite.testPath, RecentLines: 2}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+
+	// the stats report the absolute path of the file, that finds it as its relative path does
+	stats := s.Stats()
+	suite.Equal(1, len(stats))
+	suite.True(filepath.IsAbs(stats[0].Path))
+	for _, path := range []string{stats[0].Path, suite.testPath} {
+		lines, err := s.RecentLines(path)
+		suite.Nil(err)
+		suite.Equal([]string{"hello world"}, lines)
+	}
+}
+
+func (suite *ScannerTestSuite) TestScannerReplaysARelativePathByItsAbsolutePath() {
+	_, err := suite.testFile.WriteString("first\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	suite.Equal("first", string(msg.Content()))
+
+	stats := suite.s.Stats()
+	suite.Equal(1, len(stats))
+	suite.Nil(suite.s.Replay(stats[0].Path, 0))
+	msg = <-suite.outputChan
+	suite.True(msg.GetOrigin().Replay)
+	suite.Equal("first", string(msg.Content()))
+	<-suite.s.replays[0].done
+}
+
+// newDeletionScanner returns a scanner tailing a single file, with a grace period of a minute
+// before closing it once deleted, and the mock clock of the grace period
+func (suite *ScannerTestSuite) newDeletionScanner(path string, a *auditor.Auditor) (*Scanner, *clock.Mock) {
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}}
+	s := New(sources, suite.pp, a)
+	mockClock := clock.NewMock(time.Now())
+	s.clock = mockClock
+	s.deleteGracePeriod = time.Minute
+	s.setup()
+	return s, mockClock
+}
+
+func (suite *ScannerTestSuite) TestScannerTailsAFileRecreatedWithinTheGracePeriodFromItsBegining() {
+	path := fmt.Sprintf("%s/recreated.log", suite.testDir)
+	suite.Nil(ioutil.WriteFile(path, nil, 0644))
+	defer os.Remove(path)
+	s, mockClock := suite.newDeletionScanner(path, auditor.New(nil))
+	defer s.Stop()
+
+	suite.Nil(os.Remove(path))
+	s.scan()
+	suite.NotNil(s.tailers[path])
+
+	mockClock.Add(30 * time.Second)
+	suite.Nil(ioutil.WriteFile(path, []byte("hello world\n"), 0644))
+	s.scan()
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	suite.Equal(0, len(s.deletedAt))
+}
+
+func (suite *ScannerTestSuite) TestScannerClosesAFileDeletedForGood() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, 10)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	path := fmt.Sprintf("%s/deleted.log", suite.testDir)
+	f, err := os.Create(path)
+	suite.Nil(err)
+	defer f.Close()
+	defer os.Remove(path)
+	s, mockClock := suite.newDeletionScanner(path, a)
+	defer s.Stop()
+	tailer := s.tailers[path]
+	_, err = f.WriteString("hello world\n")
+	suite.Nil(err)
+	auditorChan <- <-suite.outputChan
+	suite.Eventually(func() bool {
+		_, whence := a.GetLastCommitedOffset(tailer.Identifier())
+		return whence == os.SEEK_CUR
+	}, time.Second, 10*time.Millisecond)
+
+	suite.Nil(os.Remove(path))
+	s.scan()
+	suite.NotNil(s.tailers[path])
+	mockClock.Add(2 * time.Minute)
+	s.scan()
+	suite.Nil(s.tailers[path])
+	<-tailer.done
+	// the offset of the deleted file is kept
+	offset, _ := a.GetLastCommitedOffset(tailer.Identifier())
+	suite.Equal(int64(12), offset)
+
+	// the recreated file is read from its begining
+	suite.Nil(ioutil.WriteFile(path, []byte("first\nsecond\n"), 0644))
+	s.scan()
+	msg := <-suite.outputChan
+	suite.Equal("first", string(msg.Content()))
+	suite.True(msg.GetOrigin().OffsetReset)
+	msg = <-suite.outputChan
+	suite.Equal("second", string(msg.Content()))
+	suite.Equal(0, len(s.deletedAt))
+}
+
+func (suite *ScannerTestSuite) TestScannerForgetsTheFilesDeletedForLong() {
+	path := fmt.Sprintf("%s/forgotten.log", suite.testDir)
+	suite.Nil(ioutil.WriteFile(path, nil, 0644))
+	defer os.Remove(path)
+	s, mockClock := suite.newDeletionScanner(path, auditor.New(nil))
+	defer s.Stop()
+
+	suite.Nil(os.Remove(path))
+	s.scan()
+	mockClock.Add(2 * time.Minute)
+	s.scan()
+	suite.Nil(s.tailers[path])
+	suite.Equal(1, len(s.deletedAt))
+
+	mockClock.Add(deletedFileTTL)
+	s.scan()
+	suite.Equal(0, len(s.deletedAt))
+}
+
+func (suite *ScannerTestSuite) TestScannerPicksUpNewFilesBetweenScans() {
+	suite.s.Stop()
+
+	dir := fmt.Sprintf("%s/globbed", suite.testDir)
+	os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	defer os.RemoveAll(dir)
+	f, err := os.Create(fmt.Sprintf("%s/1.log", dir))
+	suite.Nil(err)
+	f.Close()
+
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: fmt.Sprintf("%s/*.log", dir)}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	suite.Equal(1, len(s.tailers))
+
+	newPath := fmt.Sprintf("%s/2.log", dir)
+	f, err = os.Create(newPath)
+	suite.Nil(err)
+	defer f.Close()
+	s.scan()
+	suite.Equal(2, len(s.tailers))
+	suite.NotNil(s.tailers[newPath])
+}
+
+func (suite *ScannerTestSuite) TestScannerSkipsExcludedPaths() {
+	suite.s.Stop()
+
+	dir := fmt.Sprintf("%s/excluded", suite.testDir)
+	os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"app.log", "access.log", "debug.log"} {
+		f, err := os.Create(fmt.Sprintf("%s/%s", dir, name))
+		suite.Nil(err)
+		f.Close()
+	}
+
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: fmt.Sprintf("%s/*.log", dir), ExcludePaths: []string{"debug.log"}}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	defer s.Stop()
+	suite.Equal(2, len(s.tailers))
+	suite.NotNil(s.tailers[fmt.Sprintf("%s/app.log", dir)])
+	suite.NotNil(s.tailers[fmt.Sprintf("%s/access.log", dir)])
+
+	// a tailed file that becomes excluded is stopped
+	accessLog := fmt.Sprintf("%s/access.log", dir)
+	tailer := s.tailers[accessLog]
+	sources[0].ExcludePaths = append(sources[0].ExcludePaths, fmt.Sprintf("%s/acc*.log", dir))
+	s.scan()
+	suite.Equal(1, len(s.tailers))
+	suite.Nil(s.tailers[accessLog])
+	suite.True(tailer.shouldSoftStop())
+}
+
+func (suite *ScannerTestSuite) TestScannerFollowsSymlinks() {
+	suite.s.Stop()
+
+	dir := fmt.Sprintf("%s/symlinked", suite.testDir)
+	os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	defer os.RemoveAll(dir)
+	target1, err := filepath.Abs(fmt.Sprintf("%s/target1", dir))
+	suite.Nil(err)
+	target2, err := filepath.Abs(fmt.Sprintf("%s/target2", dir))
+	suite.Nil(err)
+	for _, target := range []string{target1, target2} {
+		f, err := os.Create(target)
+		suite.Nil(err)
+		f.Close()
+	}
+	link := fmt.Sprintf("%s/app.log", dir)
+	suite.Nil(os.Symlink(target1, link))
+
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: fmt.Sprintf("%s/*.log", dir)}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	suite.Equal(0, len(s.tailers))
+
+	sources[0].FollowSymlinks = true
+	s.scan()
+	defer s.Stop()
+	suite.Equal(1, len(s.tailers))
+	tailer := s.tailers[link]
+
+	// the link points to a new target, it is handled like a rotation
+	suite.Nil(os.Remove(link))
+	suite.Nil(os.Symlink(target2, link))
+	s.scan()
+	suite.False(tailer == s.tailers[link])
+
+	f, err := os.OpenFile(target2, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	suite.Nil(err)
+	defer f.Close()
+	_, err = f.WriteString("hello world\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	suite.Equal(link, msg.GetOrigin().LogSource.Path)
+}
+
+func (suite *ScannerTestSuite) TestScannerLogsOpenedFilesAtDebugAndFailuresAtError() {
+	suite.s.Stop()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	suite.Nil(logger.SetLevel(logger.DEBUG_LEVEL))
+	defer logger.SetLevel(logger.INFO_LEVEL)
+	// the error of a previous run of the test must not suppress this one
+	logger.SetRepeatInterval(0)
+	defer logger.SetRepeatInterval(time.Minute)
+
+	missingPath := fmt.Sprintf("%s/missing.log", suite.testDir)
+	sources := []*config.IntegrationConfigLogSource{
+		&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: suite.testPath},
+		&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: missingPath},
+	}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	s.Stop()
+	<-s.tailers[suite.testPath].done
+	log.SetOutput(os.Stderr)
+
+	path := s.tailers[suite.testPath].path
+	suite.Contains(logs.String(), "DEBUG: Opening "+path)
+	suite.Contains(logs.String(), "DEBUG: Closing "+path)
+	missingPath, err := filepath.Abs(missingPath)
+	suite.Nil(err)
+	suite.Contains(logs.String(), "ERROR: open "+missingPath)
+	// the tailer of the missing file is not kept, the file is tried again at the next scans
+	suite.Nil(s.tailers[missingPath])
+}
+
+func (suite *ScannerTestSuite) TestScannerReportsDirectoryDiscoveryEvents() {
+	suite.s.Stop()
+
+	dir := fmt.Sprintf("%s/directory", suite.testDir)
+	os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	defer os.RemoveAll(dir)
+	// subdirectories are not tailed
+	os.MkdirAll(fmt.Sprintf("%s/archive", dir), os.ModeDir|os.ModePerm)
+
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.DIRECTORY_TYPE, Path: dir}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	s.setup()
+	suite.Equal(0, len(s.tailers))
+
+	// without a subscriber, no event is emitted
+	path := fmt.Sprintf("%s/unwatched.log", dir)
+	f, err := os.Create(path)
+	suite.Nil(err)
+	f.Close()
+	s.scan()
+	suite.Nil(os.Remove(path))
+	s.scan()
+	suite.Equal(0, len(s.discoveryEvents))
+
+	suite.Equal(0, len(s.DiscoveryEvents()))
+	path = fmt.Sprintf("%s/app.log", dir)
+	f, err = os.Create(path)
+	suite.Nil(err)
+	f.Close()
+	s.scan()
+	suite.Equal(DiscoveryEvent{Path: path, Status: DISCOVERED_STATUS}, <-s.DiscoveryEvents())
+	suite.Equal(DiscoveryEvent{Path: path, Status: STARTED_STATUS}, <-s.DiscoveryEvents())
+
+	suite.Nil(os.Remove(path))
+	s.scan()
+	suite.Equal(DiscoveryEvent{Path: path, Status: STOPPED_STATUS}, <-s.DiscoveryEvents())
+	suite.Equal(0, len(s.tailers))
+
+	// a file that can't be opened is reported as errored,
+	// its target is outside of the directory so that it is not discovered too
+	path = fmt.Sprintf("%s/dangling.log", dir)
+	target, err := filepath.Abs(fmt.Sprintf("%s/missing", suite.testDir))
+	suite.Nil(err)
+	defer os.Remove(target)
+	suite.Nil(os.Symlink(target, path))
+	sources[0].FollowSymlinks = true
+	s.scan()
+	suite.Equal(DiscoveryEvent{Path: path, Status: DISCOVERED_STATUS}, <-s.DiscoveryEvents())
+	event := <-s.DiscoveryEvents()
+	suite.Equal(ERRORED_STATUS, event.Status)
+	suite.NotNil(event.Err)
+	suite.Equal(0, len(s.tailers))
+
+	// the file is tried again at the next scan, and started once it can be opened
+	f, err = os.Create(target)
+	suite.Nil(err)
+	f.Close()
+	s.scan()
+	suite.Equal(DiscoveryEvent{Path: path, Status: DISCOVERED_STATUS}, <-s.DiscoveryEvents())
+	suite.Equal(DiscoveryEvent{Path: path, Status: STARTED_STATUS}, <-s.DiscoveryEvents())
+
+	s.Stop()
+	suite.Equal(DiscoveryEvent{Path: path, Status: STOPPED_STATUS}, <-s.DiscoveryEvents())
+}
+
+func (suite *ScannerTestSuite) TestScannerReportsAFailingSourceOnce() {
+	suite.s.Stop()
+	_, outside, cleanup := newAllowedRoot(suite.T())
+	defer cleanup()
+	config.LogsAgent.Set("report_source_errors", true)
+	defer config.LogsAgent.Set("report_source_errors", false)
+
+	path := filepath.Join(outside, "secret.log")
+	suite.Nil(ioutil.WriteFile(path, []byte("secret\n"), 0644))
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	scanned := make(chan struct{})
+	go func() {
+		s.setup()
+		s.scan()
+		s.scan()
+		close(scanned)
+	}()
+
+	msg := <-suite.outputChan
+	statusMsg, ok := msg.(*message.StatusMessage)
+	suite.True(ok)
+	suite.Equal(message.SOURCE_ERROR_STATUS, statusMsg.Status)
+	suite.Contains(string(statusMsg.Content()), path)
+	suite.Contains(string(statusMsg.Content()), "outside of the allowed_roots")
+	suite.Equal(sources[0], statusMsg.GetOrigin().LogSource)
+	suite.Equal("", statusMsg.GetOrigin().Identifier)
+
+	// the source keeps failing at each scan, it is not reported again
+	select {
+	case <-scanned:
+	case msg := <-suite.outputChan:
+		suite.Fail("the source was reported twice", string(msg.Content()))
+	case <-time.After(time.Second):
+		suite.Fail("the scans didn't complete")
+	}
+	s.Stop()
+}
+
+func (suite *ScannerTestSuite) TestScannerTailsAFailingSourceOnceItCanBeOpened() {
+	suite.s.Stop()
+	config.LogsAgent.Set("report_source_errors", true)
+	defer config.LogsAgent.Set("report_source_errors", false)
+
+	path := fmt.Sprintf("%s/dangling.log", suite.testDir)
+	target, err := filepath.Abs(fmt.Sprintf("%s/target.log", suite.testDir))
+	suite.Nil(err)
+	suite.Nil(os.Symlink(target, path))
+	defer os.Remove(path)
+	defer os.Remove(target)
+	sources := []*config.IntegrationConfigLogSource{&config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, FollowSymlinks: true}}
+	s := New(sources, suite.pp, auditor.New(nil))
+	go s.setup()
+	select {
+	case msg := <-suite.outputChan:
+		suite.Equal(message.SOURCE_ERROR_STATUS, msg.(*message.StatusMessage).Status)
+	case <-time.After(time.Second):
+		suite.FailNow("the source was not reported")
+	}
+
+	// the file is tailed from its begining once it can be opened,
+	// it would be reported again if it failed again
+	suite.Nil(ioutil.WriteFile(target, []byte("hello\n"), 0644))
+	scanned := make(chan struct{})
+	go func() {
+		s.scan()
+		close(scanned)
+	}()
+	select {
+	case msg := <-suite.outputChan:
+		suite.Equal("hello", string(msg.Content()))
+	case <-time.After(time.Second):
+		suite.FailNow("the file was not tailed from its begining")
+	}
+	select {
+	case msg := <-suite.outputChan:
+		suite.Equal(message.CAUGHT_UP_STATUS, msg.(*message.StatusMessage).Status)
+	case <-time.After(time.Second):
+		suite.FailNow("the tailer didn't catch up")
+	}
+	<-scanned
+	suite.NotNil(s.tailers[path])
+	suite.False(s.reportedErrors[path])
+	s.Stop()
+}
+
 func TestScannerTestSuite(t *testing.T) {
 	suite.Run(t, new(ScannerTestSuite))
 }
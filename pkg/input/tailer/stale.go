@@ -0,0 +1,62 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
+)
+
+// maxStaleAttempts is the number of times in a row a stale file is reopened
+// before the tailer gives up on it
+const maxStaleAttempts = 5
+
+// isStale returns true when err is a stale file handle error,
+// which happens on NFS when the file handle is invalidated by the server
+func isStale(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ESTALE
+}
+
+// reopen closes the file and opens it again by name to refresh its handle,
+// the reading resumes at the last offset
+func (t *Tailer) reopen() error {
+	t.staleAttempts++
+	if t.staleAttempts > maxStaleAttempts {
+		return fmt.Errorf("%s: stale file handle after %d reopens", t.path, maxStaleAttempts)
+	}
+	logger.Debug("Reopening stale file", t.path)
+	f, err := t.open()
+	if err != nil {
+		return err
+	}
+	_, gzipped := t.reader.(*gzipFileReader)
+	if !gzipped {
+		_, err = f.Seek(t.GetLastOffset(), os.SEEK_SET)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	t.stopMutex.Lock()
+	t.file.Close()
+	t.file = f
+	t.stopMutex.Unlock()
+	t.reader = t.newReader(f)
+	if gzipped {
+		// the decompressed content is read again until the last offset
+		t.reader = newGzipFileReader(f)
+		if _, err := t.skipDecompressed(t.GetLastOffset()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
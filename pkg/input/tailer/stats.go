@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TailerStats is a snapshot of the state of a tailer
+type TailerStats struct {
+	// Path is the absolute path of the file
+	Path       string
+	Identifier string
+	// Offset is the offset up to which the file has been read
+	Offset    int64
+	BytesRead int64
+	LinesRead int64
+	// LinesOverLimit is the number of lines dropped by max_lines_per_second
+	LinesOverLimit int64
+	// LastReadTime is the zero time if nothing was read yet
+	LastReadTime time.Time
+	// QueueDepth is the number of payloads read but not decoded yet
+	QueueDepth int
+	// BlockedTime is the total time spent waiting for the decoder to accept payloads
+	BlockedTime time.Duration
+	// PayloadsDropped is the number of payloads dropped by decoder_overflow_policy
+	PayloadsDropped int64
+	// Paused is true while the tailer doesn't read its file
+	Paused bool
+	// Err is the last error that stopped the tailer, if any
+	Err error
+}
+
+// Stats returns the current stats of the tailer, it is safe to call it
+// while the tailer is running
+func (t *Tailer) Stats() TailerStats {
+	var lastReadTime time.Time
+	if nanos := atomic.LoadInt64(&t.lastReadTime); nanos > 0 {
+		lastReadTime = time.Unix(0, nanos)
+	}
+	t.errMutex.Lock()
+	err := t.err
+	t.errMutex.Unlock()
+	return TailerStats{
+		Path:            t.path,
+		Identifier:      t.Identifier(),
+		Offset:          t.GetLastOffset(),
+		BytesRead:       atomic.LoadInt64(&t.bytesRead),
+		LinesRead:       atomic.LoadInt64(&t.linesRead),
+		LinesOverLimit:  atomic.LoadInt64(&t.linesOverLimit),
+		LastReadTime:    lastReadTime,
+		QueueDepth:      t.d.InputQueueDepth(),
+		BlockedTime:     time.Duration(atomic.LoadInt64(&t.blockedTime)),
+		PayloadsDropped: atomic.LoadInt64(&t.payloadsDropped),
+		Paused:          t.IsPaused(),
+		Err:             err,
+	}
+}
+
+// setError records the error that stopped the tailer
+func (t *Tailer) setError(err error) {
+	t.errMutex.Lock()
+	t.err = err
+	t.errMutex.Unlock()
+	if t.observer != nil {
+		t.observer.OnError(t.path, err)
+	}
+}
@@ -0,0 +1,67 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"os"
+)
+
+const tailLinesChunkSize = 4096
+
+// findTailLinesOffset returns the offset of the begining of the n-th line
+// before the end of the file at path, scanning it backward from its end.
+// A last line that is not terminated yet counts as a line.
+// The whole file is read when it has less than n lines
+func findTailLinesOffset(path string, n int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := stat.Size()
+	if end == 0 || n <= 0 {
+		return end, nil
+	}
+	lastByte := make([]byte, 1)
+	_, err = f.ReadAt(lastByte, end-1)
+	if err != nil {
+		return 0, err
+	}
+	if lastByte[0] == '\n' {
+		// the newline terminating the last line does not start a new one
+		end--
+	}
+
+	newlines := 0
+	chunk := make([]byte, tailLinesChunkSize)
+	for end > 0 {
+		start := end - tailLinesChunkSize
+		if start < 0 {
+			start = 0
+		}
+		buf := chunk[:end-start]
+		_, err := f.ReadAt(buf, start)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(buf) - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindTailLinesOffset(t *testing.T) {
+	f, err := ioutil.TempFile("", "tail_lines")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("first\nsecond\nthird\nfourth\n")
+	assert.Nil(t, err)
+	f.Close()
+
+	offset, err := findTailLinesOffset(f.Name(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("first\nsecond\n")), offset)
+
+	offset, err = findTailLinesOffset(f.Name(), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	// the file is shorter than the lines to read
+	offset, err = findTailLinesOffset(f.Name(), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestFindTailLinesOffsetOverSeveralChunks(t *testing.T) {
+	f, err := ioutil.TempFile("", "tail_lines")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	line := strings.Repeat("a", 999) + "\n"
+	_, err = f.WriteString(strings.Repeat(line, 10) + "not terminated")
+	assert.Nil(t, err)
+	f.Close()
+
+	// the unterminated line counts as the last one
+	offset, err := findTailLinesOffset(f.Name(), 6)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5*len(line)), offset)
+}
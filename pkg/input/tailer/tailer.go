@@ -6,96 +6,419 @@
 package tailer
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
 	"github.com/DataDog/datadog-log-agent/pkg/decoder"
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/DataDog/datadog-log-agent/pkg/ratelimit"
+	"github.com/DataDog/datadog-log-agent/pkg/wal"
 )
 
 const defaultSleepDuration = 1 * time.Second
 const defaultCloseTimeout = 60 * time.Second
 
+// configHashMeta is the key of the hash of its source in the metadata of a file
+const configHashMeta = "config_hash"
+
+// lastStream is the stream of the last tailer created, each tailer has its own
+var lastStream uint64
+
 // Tailer tails one file and sends messages to an output channel
 type Tailer struct {
+	// path is the absolute path of the file, source.Path is kept as configured
 	path string
-	file *os.File
+	file file
+	// fs opens the file, the filesystem of the host unless a test fakes it
+	fs fileOpener
+	// openFlags are added to the flags the file is opened with
+	openFlags int
+	// allowedRoots are the directories the file must be in once its symlinks are resolved
+	allowedRoots []string
+
+	// reader reads the open file, newReader builds it each time the file is opened
+	reader        io.Reader
+	newReader     func(f file) io.Reader
+	staleAttempts int
 
 	lastOffset        int64
 	shouldTrackOffset bool
+	isReplay          bool
+	// follow is false when the file is read until its end once
+	follow bool
+	// lines is the number of lines before the offset the tailer starts at, and then
+	// before the last line forwarded, when the source numbers its lines
+	lines int64
+	// generation is the number of times the file was rotated or truncated
+	// since it is tailed, it is only updated by forwardMessages once started
+	generation int64
+	// cursorOffset is the offset of the last line forwarded, and cursorGeneration
+	// the generation of the file then, for the cursor of the tailer
+	cursorOffset     int64
+	cursorGeneration int64
+	cursorMutex      sync.Mutex
+	// startedOver is true until the first line is forwarded when the tailer starts
+	// from a position that may be before the commited offset, after a rotation
+	startedOver bool
+	// wal keeps the lines of a nonblocking file until they are commited,
+	// as they can't be read again
+	wal *wal.WAL
+
+	// scheduler shares the read cycles with the other tailers of the scanner
+	scheduler *readScheduler
+	// auditor keeps the fingerprint of the file, when the file is identified by it,
+	// and commits the messages of the stream of the tailer in order
+	auditor          *auditor.Auditor
+	stream           uint64
+	fingerprint      fingerprint
+	fingerprintMutex sync.Mutex
+	hasher           contenthash.Hasher
+	// observer is notified of the lifecycle of the tailer, caughtUp is true
+	// once the end of the file is reached, until more data is read
+	observer TailerObserver
+	caughtUp bool
+	// reportErrors makes the tailer emit the error that stopped it into its pipeline
+	reportErrors bool
+	// retried is set when a previous tailer of the file couldn't start,
+	// none of its lines were read so it isn't tailed from its end
+	retried bool
+	// foundSize is the size of a file that wasn't opened when it was found, because
+	// of max_open_files, it is tailed from there rather than from its end. It is -1 otherwise
+	foundSize int64
+
+	// resumed is closed when a paused tailer is resumed, it is nil when the tailer is not paused
+	resumed    chan struct{}
+	pauseMutex sync.Mutex
+
+	// rotations are the rotations to read before the file
+	rotations []rotatedFile
+	// rotation is the rotation read by a catch-up tailer
+	rotation *rotatedFile
+
+	// counters exposed in the tailer stats, updated atomically
+	bytesRead    int64
+	linesRead    int64
+	lastReadTime int64 // unix nanoseconds
+	blockedTime  int64 // time spent waiting for the decoder, in nanoseconds
+
+	// overflowPolicy tells what to do with the payloads read when the decoder can't keep up
+	overflowPolicy  string
+	payloadsDropped int64
+
+	err      error
+	errMutex sync.Mutex
 
 	outputChan chan message.Message
 	d          *decoder.Decoder
 	source     *config.IntegrationConfigLogSource
 
+	clock         clock.Clock
 	sleepDuration time.Duration
 	sleepMutex    sync.Mutex
 
+	// an idle tailer with useFileEvents waits for watcher events instead of polling
+	useFileEvents bool
+	watcher       fileWatcher
+	// eventTimer bounds the waits for watcher events, it is reused by all the waits
+	eventTimer clock.Timer
+
+	heartbeatInterval time.Duration
+	lastActivity      time.Time
+
+	// shouldSendCaughtUp is true until a tailer that started reading the existing
+	// content of its file reaches EOF
+	shouldSendCaughtUp bool
+
+	// maxInFlightBytes pauses reads while too many bytes wait to be commited
+	maxInFlightBytes int64
+
+	// lineLimiter drops the lines over max_lines_per_second
+	lineLimiter    *ratelimit.TokenBucket
+	linesOverLimit int64
+
+	// recentLines keeps the last lines read for debugging, when the source asks for it
+	recentLines *lineRing
+
 	closeTimeout time.Duration
 	shouldStop   bool
+	softStop     chan struct{}
 	stopTimer    *time.Timer
 	stopMutex    sync.Mutex
+	hardStop     chan struct{}
+	hardStopOnce sync.Once
+	done         chan struct{}
 }
 
 // NewTailer returns an initialized Tailer
 func NewTailer(outputChan chan message.Message, source *config.IntegrationConfigLogSource) *Tailer {
+	// a nonblocking file can't be seeked, its offset is meaningless between two runs
+	shouldTrackOffset := (source.TrackOffset == nil || *source.TrackOffset) && !source.Nonblock
+	// a file that is not followed is stopped once its end is reached
+	follow := source.Follow == nil || *source.Follow
+	var lineLimiter *ratelimit.TokenBucket
+	if source.MaxLinesPerSecond > 0 {
+		lineLimiter = ratelimit.NewTokenBucket(float64(source.MaxLinesPerSecond), float64(source.MaxLinesPerSecond))
+	}
+	var recentLines *lineRing
+	if source.RecentLines > 0 {
+		recentLines = newLineRing(source.RecentLines)
+	}
 	return &Tailer{
-		path:       source.Path,
-		outputChan: outputChan,
-		d:          decoder.InitializedDecoder(),
-		source:     source,
+		// the path is resolved once, so that the registry key doesn't depend
+		// on the working directory of the agent
+		path:         absPath(source.Path),
+		openFlags:    openFlags(source.OpenFlags),
+		allowedRoots: allowedRoots(),
+		stream:       atomic.AddUint64(&lastStream, 1),
+		outputChan:   outputChan,
+		d:            decoder.InitializedDecoderFromSource(source),
+		source:       source,
+		hasher:       contenthash.Configured(),
+		fs:           osOpener{},
+		newReader:    func(f file) io.Reader { return f },
 
 		lastOffset:        0,
-		shouldTrackOffset: true,
+		shouldTrackOffset: shouldTrackOffset,
+		follow:            follow,
+		foundSize:         -1,
 
+		clock:         clock.New(),
 		sleepDuration: defaultSleepDuration,
 		sleepMutex:    sync.Mutex{},
-		shouldStop:    false,
-		stopMutex:     sync.Mutex{},
-		closeTimeout:  defaultCloseTimeout,
+		useFileEvents: config.LogsAgent.GetBool("use_file_events"),
+
+		overflowPolicy: config.LogsAgent.GetString("decoder_overflow_policy"),
+
+		heartbeatInterval: time.Duration(source.HeartbeatInterval) * time.Second,
+		maxInFlightBytes:  int64(config.LogsAgent.GetInt("max_mem_bytes")),
+		lineLimiter:       lineLimiter,
+		recentLines:       recentLines,
+
+		shouldStop:   !follow,
+		stopMutex:    sync.Mutex{},
+		closeTimeout: defaultCloseTimeout,
+		softStop:     make(chan struct{}),
+		hardStop:     make(chan struct{}),
+		done:         make(chan struct{}),
 	}
 }
 
-// Identifier returns a string that uniquely identifies a source
+// Identifier returns a string that uniquely identifies a source,
+// sources with an identifier share their offset whatever their path,
+// and the shards of a sharded source have their own offset under it
 func (t *Tailer) Identifier() string {
-	return fmt.Sprintf("file:%s", t.source.Path)
+	if t.rotation != nil {
+		return t.rotation.identifier
+	}
+	if t.source.Sharded {
+		return fmt.Sprintf("file:%s:%s", t.source.Identifier, t.path)
+	}
+	if t.source.Identifier != "" {
+		return fmt.Sprintf("file:%s", t.source.Identifier)
+	}
+	return fmt.Sprintf("file:%s", t.path)
 }
 
 // recoverTailing starts the tailing from the last log line processed, or now
-// if we tail this file for the first time
+// if we tail this file for the first time.
+// When the source has a start_at, a file tailed for the first time
+// is tailed from its first line at or after start_at, and when it has
+// a tail_lines, from its last tail_lines lines. In both cases, the tailer
+// notifies once when it has caught up with the existing content.
+// A source that only has a commited timestamp, for instance because it
+// was a network source before, resumes at the first line at or after it
+// when it has a timestamp_format.
+// A tailer that doesn't track its offset always starts from the end of the file.
+// With catch_up_rotations, the compressed rotations written since the file was
+// last tailed are read first, and the file is then read from its begining.
+// With ordered_rotations, so are its numbered rotations, all of them when it is new.
+// With reset_on_change, the offset is forgotten when the source changed since it was commited.
+// A file that is not followed is read from its begining instead of its end
 func (t *Tailer) recoverTailing(a *auditor.Auditor) error {
-	return t.tailFrom(a.GetLastCommitedOffset(t.Identifier()))
+	if !t.shouldTrackOffset {
+		if !t.follow {
+			return t.tailFromBegining()
+		}
+		return t.tailFromEnd()
+	}
+	if t.source.ResetOnChange {
+		t.resetOffsetOnChange(a)
+	}
+	if t.source.FileIdentity == config.FINGERPRINT_IDENTITY {
+		isCommitedFile, err := t.isCommitedFile(a)
+		if err != nil {
+			return err
+		}
+		if !isCommitedFile {
+			// the file was replaced while it was not tailed
+			t.startedOver = true
+			return t.tailFrom(0, os.SEEK_SET)
+		}
+	}
+	if t.source.CatchUpRotations || t.source.OrderedRotations {
+		rotations, err := t.rotationsToCatchUp(a)
+		if err != nil {
+			return err
+		}
+		if len(rotations) > 0 {
+			// the live file is new since its offset was commited
+			t.rotations = rotations
+			t.startedOver = true
+			return t.tailFrom(0, os.SEEK_SET)
+		}
+	}
+	offset, whence := a.GetLastCommitedOffset(t.Identifier())
+	if whence == os.SEEK_END && t.source.Identifier == "" && t.source.Path != t.path {
+		// the offset may have been commited under the relative path
+		offset, whence = a.GetLastCommitedOffset(fmt.Sprintf("file:%s", t.source.Path))
+	}
+	if timestamp := a.GetLastCommitedTimestamp(t.Identifier()); timestamp != "" && t.source.TimestampFormat != "" {
+		var err error
+		offset, err = t.findCommitedTimestampOffset(timestamp)
+		if err != nil {
+			return err
+		}
+		whence = os.SEEK_SET
+		t.startedOver = true
+	}
+	if whence == os.SEEK_END && t.source.TailLines > 0 {
+		var err error
+		offset, err = findTailLinesOffset(t.path, t.source.TailLines)
+		if err != nil {
+			return err
+		}
+		whence = os.SEEK_SET
+	}
+	if whence == os.SEEK_END && t.source.StartAt != "" {
+		startAt, err := time.Parse(time.RFC3339, t.source.StartAt)
+		if err != nil {
+			return err
+		}
+		offset, err = findTimestampOffset(t.path, t.source.TimestampFormat, t.source.Location(), startAt)
+		if err != nil {
+			return err
+		}
+		whence = os.SEEK_SET
+	}
+	if whence == os.SEEK_END && t.foundSize >= 0 {
+		offset, whence = t.foundSize, os.SEEK_SET
+	}
+	if whence == os.SEEK_END && (!t.follow || t.retried) {
+		offset, whence = 0, os.SEEK_SET
+	}
+	if whence == os.SEEK_CUR {
+		// the numbering resumes at the commited line, the lines before an offset
+		// commited without their number are counted when the file is opened
+		t.lines = a.GetLastCommitedLine(t.Identifier())
+	}
+	t.shouldSendCaughtUp = whence == os.SEEK_SET
+	return t.tailFrom(offset, whence)
 }
 
-// Stop lets  the tailer stop
+// resetOffsetOnChange forgets the commited offset of the file
+// when its source changed since it was last tailed
+func (t *Tailer) resetOffsetOnChange(a *auditor.Auditor) {
+	hash := t.source.Hash()
+	previous := a.GetMeta(t.Identifier(), configHashMeta)
+	if previous != "" && previous != hash {
+		log.Println("The source of", t.path, "changed, tailing it from its end")
+		a.ResetOffset(t.Identifier())
+	}
+	a.SetMeta(t.Identifier(), configHashMeta, hash)
+}
+
+// findCommitedTimestampOffset returns the offset of the first line of the file
+// at or after a timestamp commited in the registry
+func (t *Tailer) findCommitedTimestampOffset(timestamp string) (int64, error) {
+	from, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return findTimestampOffset(t.path, t.source.TimestampFormat, t.source.Location(), from)
+}
+
+// Stop lets  the tailer stop: it reads its file until EOF,
+// or until closeTimeout when it can't keep up.
+// A tailer that doesn't track its offset never starts tracking it
 func (t *Tailer) Stop(shouldTrackOffset bool) {
 	t.stopMutex.Lock()
 	t.shouldStop = true
-	t.shouldTrackOffset = shouldTrackOffset
-	t.stopTimer = time.NewTimer(t.closeTimeout)
+	t.shouldTrackOffset = t.shouldTrackOffset && shouldTrackOffset
+	if t.stopTimer == nil {
+		// wakes a tailer waiting for file events
+		close(t.softStop)
+		if f, ok := t.file.(deadliner); ok && t.source.Nonblock {
+			// a fifo is read in the runtime poller, wakes a tailer waiting for data
+			f.SetReadDeadline(time.Now())
+		}
+		t.stopTimer = time.AfterFunc(t.closeTimeout, func() {
+			t.hardStopOnce.Do(func() { close(t.hardStop) })
+		})
+	}
 	t.stopMutex.Unlock()
 }
 
-// onStop handles the housekeeping when we stop the tailer
-func (t *Tailer) onStop() {
+// onStop handles the housekeeping when we stop reading the file.
+// The decoder is drained before the file is closed, unless the tailer
+// had to be stopped before reaching EOF
+func (t *Tailer) onStop(hardStop bool) {
 	t.stopMutex.Lock()
 	t.d.Stop()
-	log.Println("Closing", t.path)
-	t.file.Close()
-	t.stopTimer.Stop()
+	closed := hardStop && t.closeFile()
+	if t.stopTimer != nil {
+		t.stopTimer.Stop()
+	}
 	t.stopMutex.Unlock()
+	if closed {
+		t.notifyStop()
+	}
 }
 
-// tailFrom let's the tailer open a file and tail from whence
+// closeFile closes the file, the tailer is stopped.
+// It returns false when the file was already closed
+func (t *Tailer) closeFile() bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	logger.Debug("Closing", t.path)
+	if err := t.file.Close(); err != nil {
+		logger.Error("Can't close", t.path, ":", err)
+	}
+	if t.watcher != nil {
+		t.watcher.Close()
+	}
+	close(t.done)
+	return true
+}
+
+// notifyStop notifies the observer that the file is closed
+func (t *Tailer) notifyStop() {
+	if t.observer != nil {
+		t.observer.OnStop(t.path, t.GetLastOffset())
+	}
+}
+
+// tailFrom let's the tailer open a file and tail from whence.
+// The skip_first_lines of a file read from its beginning are not forwarded
 func (t *Tailer) tailFrom(offset int64, whence int) error {
+	if t.source.SkipFirstLines > 0 && offset == 0 && whence == os.SEEK_SET {
+		t.d.SkipLines(t.source.SkipFirstLines)
+	}
 	t.d.Start()
 	err := t.startReading(offset, whence)
 	if err == nil {
@@ -105,26 +428,124 @@ func (t *Tailer) tailFrom(offset int64, whence int) error {
 }
 
 func (t *Tailer) startReading(offset int64, whence int) error {
-	fullpath, err := filepath.Abs(t.path)
+	logger.Debug("Opening", t.path)
+	f, err := t.open()
 	if err != nil {
+		t.setError(err)
 		return err
 	}
-	log.Println("Opening", t.path)
-	f, err := os.Open(fullpath)
-	if err != nil {
-		return err
+	if t.source.FileIdentity == config.FINGERPRINT_IDENTITY && t.rotation == nil {
+		if err := t.fingerprintOpenFile(f); err != nil {
+			f.Close()
+			t.setError(err)
+			return err
+		}
+	}
+	gzipped := false
+	if t.source.DetectGzip && t.rotation == nil {
+		if gzipped, err = isGzipped(f); err != nil {
+			f.Close()
+			t.setError(err)
+			return err
+		}
+	}
+	// a nonblocking file is read from where it is opened,
+	// and a compressed file is skipped once decompressed
+	var ret int64
+	if !t.source.Nonblock && t.rotation == nil && !gzipped {
+		ret, _ = f.Seek(offset, whence)
+	}
+	if t.source.Format == config.CSV_FORMAT && ret > 0 {
+		// the header is before the offset, the decoder won't read it
+		if err := t.setCSVHeader(); err != nil {
+			log.Println("Can't read the csv header of", t.path, err)
+		}
+	}
+	if t.source.LineNumbers && t.rotation == nil && ret > 0 && t.lines == 0 {
+		if t.lines, err = countLines(f, ret); err != nil {
+			f.Close()
+			t.setError(err)
+			return err
+		}
 	}
-	ret, _ := f.Seek(offset, whence)
 	t.file = f
+	t.reader = t.newReader(f)
+	if gzipped {
+		t.reader = newGzipFileReader(f)
+		if whence == os.SEEK_END {
+			// the end of the decompressed content is only known once it is read
+			offset = -1
+		}
+	}
+	if (t.rotation != nil || gzipped) && offset != 0 {
+		ret, _ = t.skipDecompressed(offset)
+	}
 	t.lastOffset = ret
+	t.setCursorPosition(ret, t.generation)
+	t.lastActivity = t.clock.Now()
+	if t.useFileEvents && t.rotation == nil {
+		t.watcher, err = newFileWatcher(t.path)
+		if err != nil && err != errWatchUnsupported {
+			log.Println("Can't watch", t.path, "for events, polling instead:", err)
+		}
+	}
+	if t.observer != nil {
+		t.observer.OnOpen(t.path, ret)
+	}
 
 	go t.readForever()
 	return nil
 }
 
+// open opens the file of the tailer with the flags of its source, and in nonblocking
+// mode if its source requires it. The flags the file can't be opened with
+// are ignored, noatime is only allowed to the owner of the file. When there are
+// allowed roots, the file is opened at the path its symlinks resolve to, once checked
+func (t *Tailer) open() (file, error) {
+	path, err := t.resolveAllowedPath()
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_RDONLY
+	if t.source.Nonblock {
+		flags |= syscall.O_NONBLOCK
+	}
+	if t.openFlags != 0 {
+		f, err := t.fs.OpenFile(path, flags|t.openFlags)
+		if !os.IsPermission(err) {
+			return f, err
+		}
+	}
+	return t.fs.OpenFile(path, flags)
+}
+
+// isWouldBlock returns true when a nonblocking read has no data available yet,
+// or when a read waiting for data was interrupted to stop the tailer
+func isWouldBlock(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.EAGAIN
+}
+
+// replayFrom lets the tailer read its file from offset until EOF, and stop.
+// The lines are flagged as replayed, and their offsets are not commited
+func (t *Tailer) replayFrom(offset int64) error {
+	t.stopMutex.Lock()
+	t.shouldStop = true
+	t.shouldTrackOffset = false
+	t.stopMutex.Unlock()
+	t.isReplay = true
+	return t.tailFrom(offset, os.SEEK_SET)
+}
+
 // tailFromBegining lets the tailer start tailing its file
 // from the begining
 func (t *Tailer) tailFromBegining() error {
+	t.startedOver = true
 	return t.tailFrom(0, os.SEEK_SET)
 }
 
@@ -136,23 +557,75 @@ func (t *Tailer) tailFromEnd() error {
 
 // reset makes the tailer seek the begining of its file
 func (t *Tailer) reset() {
-	t.file.Seek(0, os.SEEK_SET)
+	if t.observer != nil {
+		t.observer.OnRotate(t.path, t.GetLastOffset())
+	}
+	if g, ok := t.reader.(*gzipFileReader); ok {
+		g.reset()
+	} else {
+		t.file.Seek(0, os.SEEK_SET)
+	}
 	t.setLastOffset(0)
 }
 
 // forwardMessages lets the Tailer forward log messages to the output channel
 func (t *Tailer) forwardMessages() {
+	t.replayWAL()
+	// forwardedOffset is the offset of the last line forwarded
+	var forwardedOffset int64
+	// seq is the number of the last message forwarded in the stream of the tailer
+	var seq uint64
 	for msg := range t.d.OutputChan {
 
 		_, ok := msg.(*message.StopMessage)
 		if ok {
+			// all the lines read have been forwarded
+			if t.auditor != nil {
+				t.auditor.EndStream(t.stream, seq)
+			}
+			t.stopMutex.Lock()
+			closed := t.closeFile()
+			t.stopMutex.Unlock()
+			if closed {
+				t.notifyStop()
+			}
 			return
 		}
+		if statusMsg, ok := msg.(*message.StatusMessage); ok {
+			t.outputChan <- statusMsg
+			continue
+		}
 
-		fileMsg := message.NewFileMessage(msg.Content())
-		msgOffset := msg.GetOrigin().Offset
+		if t.recentLines != nil {
+			t.recentLines.add(msg.Content())
+		}
+		var fileMsg message.Message
+		if t.lineLimiter != nil && !t.lineLimiter.Allow(1) {
+			// the line is dropped, but its offset still has to be commited
+			atomic.AddInt64(&t.linesOverLimit, 1)
+			metrics.LinesOverLimit.Add(1)
+			fileMsg = message.NewFileMessage(nil)
+		} else if jsonMsg, ok := msg.(*message.JSONMessage); ok {
+			// keep the fields parsed by the decoder
+			fileMsg = jsonMsg
+		} else if csvMsg, ok := msg.(*message.CSVMessage); ok {
+			// keep the fields parsed by the decoder
+			fileMsg = csvMsg
+		} else if criMsg, ok := msg.(*message.CRIMessage); ok {
+			// keep the timestamp and the stream parsed by the decoder
+			fileMsg = criMsg
+		} else {
+			fileMsg = message.NewFileMessage(msg.Content())
+		}
+		var msgOffset int64
 		identifier := t.Identifier()
-		if !t.shouldTrackOffset {
+		if msg.GetOrigin() != nil {
+			msgOffset = msg.GetOrigin().Offset
+		} else {
+			// without an offset, the message must not reset the commited one
+			identifier = ""
+		}
+		if !t.tracksOffset() {
 			msgOffset = 0
 			identifier = ""
 		}
@@ -160,54 +633,270 @@ func (t *Tailer) forwardMessages() {
 		msgOrigin.LogSource = t.source
 		msgOrigin.Identifier = identifier
 		msgOrigin.Offset = msgOffset
+		if t.rotation != nil && identifier != "" {
+			// the position is the rotation along with the offset in its content
+			msgOrigin.Timestamp = t.rotation.modTime.UTC().Format(time.RFC3339Nano)
+		}
+		// the offset only goes back when the file was truncated and read again
+		truncated := false
+		if msg.GetOrigin() != nil && t.rotation == nil {
+			truncated = msg.GetOrigin().Offset < forwardedOffset
+			forwardedOffset = msg.GetOrigin().Offset
+		}
+		if truncated {
+			t.generation++
+		}
+		if identifier != "" && t.rotation == nil {
+			if t.source.LineNumbers {
+				msgOrigin.Line = t.numberLine(truncated, msg.GetOrigin().Partial)
+			}
+			msgOrigin.OffsetReset = t.startedOver || truncated
+			t.startedOver = false
+		}
+		if t.source.TagSourceFile {
+			msgOrigin.Tags = append(msgOrigin.Tags, "source_file:"+t.path, fmt.Sprintf("rotation_generation:%d", t.generation))
+		}
+		if msg.GetOrigin() != nil {
+			msgOrigin.Partial = msg.GetOrigin().Partial
+		}
+		msgOrigin.Replay = t.isReplay
+		if t.auditor != nil {
+			seq++
+			msgOrigin.Stream = t.stream
+			msgOrigin.Seq = seq
+		}
+		msgOrigin.InFlightBytes = int64(len(fileMsg.Content()))
+		if t.wal != nil && len(fileMsg.Content()) > 0 {
+			msgOrigin.WALSeq = t.appendToWAL(fileMsg.Content())
+		}
 		fileMsg.SetOrigin(msgOrigin)
+		metrics.InFlightBytes.Add(msgOrigin.InFlightBytes)
 		t.outputChan <- fileMsg
+		if msg.GetOrigin() != nil && t.rotation == nil {
+			t.setCursorPosition(forwardedOffset, t.generation)
+		}
+		atomic.AddInt64(&t.linesRead, 1)
 	}
 }
 
+// replayWAL forwards the lines of the previous run that were never commited,
+// before the lines read from the file. They are forwarded as raw lines
+func (t *Tailer) replayWAL() {
+	if t.wal == nil {
+		return
+	}
+	for _, entry := range t.wal.Recovered(t.Identifier()) {
+		fileMsg := message.NewFileMessage(entry.Content)
+		msgOrigin := message.NewOriginBuilder().
+			LogSource(t.source).
+			WALSeq(entry.Seq).
+			InFlightBytes(int64(len(entry.Content))).
+			Build()
+		fileMsg.SetOrigin(msgOrigin)
+		metrics.InFlightBytes.Add(msgOrigin.InFlightBytes)
+		t.outputChan <- fileMsg
+	}
+}
+
+// appendToWAL appends a line to the WAL and returns its sequence number,
+// or zero when the line could not be appended
+func (t *Tailer) appendToWAL(content []byte) uint64 {
+	seq, err := t.wal.Append(t.Identifier(), content)
+	if err != nil && err != wal.ErrFull {
+		log.Println("Can't append a line of", t.path, "to the WAL:", err)
+	}
+	return seq
+}
+
 // readForever lets the tailer tail the content of a file
 // until it is closed.
 func (t *Tailer) readForever() {
+	if len(t.rotations) > 0 && !t.catchUpRotations() {
+		t.onStop(false)
+		return
+	}
 	for {
 		if t.shouldHardStop() {
-			t.onStop()
+			t.onStop(true)
 			return
 		}
 
+		// an idle tailer notifies it is healthy whatever keeps it from reading
+		t.sendHeartbeatIfIdle()
+
+		if resumed := t.resumedChan(); resumed != nil {
+			// the file stays open, nothing is read until the tailer is resumed
+			if !t.waitUntilResumed(resumed) && !t.shouldHardStop() {
+				t.onStop(false)
+				return
+			}
+			continue
+		}
+
+		if t.isBackpressured() {
+			// stop pulling from the file until the pipeline drains
+			t.wait()
+			continue
+		}
+
+		if t.scheduler != nil && !t.scheduler.allow(t) {
+			// the file used its share of the read cycles, the other files go first
+			t.wait()
+			continue
+		}
+
 		inBuf := make([]byte, 4096)
-		n, err := t.file.Read(inBuf)
+		n, err := t.reader.Read(inBuf)
+		if n > 0 && err == io.EOF {
+			// a decompressing reader returns its last bytes along with EOF,
+			// the next read returns EOF again
+			err = nil
+		}
+		if isWouldBlock(err) {
+			// nothing to read yet, wait like at EOF
+			err = io.EOF
+		}
+		if isStale(err) {
+			// the file handle has to be refreshed, the file is still there
+			if err := t.reopen(); err != nil {
+				logger.Error(err)
+				t.setError(err)
+				t.reportError(err)
+				// the lines read so far are forwarded, and the stream of the tailer ends
+				t.onStop(false)
+				return
+			}
+			continue
+		}
+		t.staleAttempts = 0
 		if err == io.EOF {
 			if t.shouldSoftStop() {
-				t.onStop()
+				t.onStop(false)
 				return
 			}
-			t.wait()
+			// a rotated file is replaced by the scanner, a truncated one
+			// is read again from the begining
+			if action, err := t.checkRotation(); err == nil && action == seekToBeginning {
+				t.reset()
+				continue
+			}
+			if t.shouldSendCaughtUp {
+				// sent through the decoder, so that it follows the lines read so far
+				select {
+				case t.d.InputChan <- decoder.NewMessagePayload(t.newStatusMessage(message.CAUGHT_UP_STATUS, "tailer caught up at offset %d")):
+				case <-t.hardStop:
+					t.onStop(true)
+					return
+				}
+				t.shouldSendCaughtUp = false
+			}
+			if !t.caughtUp && t.observer != nil {
+				t.observer.OnCaughtUp(t.path, t.GetLastOffset())
+			}
+			t.caughtUp = true
+			t.waitForData()
 			continue
 		}
 		if err != nil {
-			log.Println("Err:", err)
+			logger.Error(err)
+			t.setError(err)
+			t.reportError(err)
+			// the lines read so far are forwarded, and the stream of the tailer ends,
+			// a corrupted rotation is given up
+			t.onStop(false)
 			return
 		}
 		if n == 0 {
 			t.wait()
 			continue
 		}
-		t.d.InputChan <- decoder.NewPayload(inBuf[:n], t.GetLastOffset())
+		if t.scheduler != nil {
+			t.scheduler.record(t)
+		}
+		sendStart := t.clock.Now()
+		if !t.sendPayload(decoder.NewPayload(inBuf[:n], t.GetLastOffset())) {
+			// the decoder can't keep up, give up on the payload
+			t.onStop(true)
+			return
+		}
+		atomic.AddInt64(&t.blockedTime, int64(t.clock.Since(sendStart)))
 		t.incrementLastOffset(n)
+		t.caughtUp = false
+		atomic.AddInt64(&t.bytesRead, int64(n))
+		atomic.StoreInt64(&t.lastReadTime, t.clock.Now().UnixNano())
+		t.lastActivity = t.clock.Now()
 	}
 }
 
+// sendHeartbeatIfIdle lets the tailer notify that it is still healthy
+// when its file has not produced any data for heartbeatInterval
+func (t *Tailer) sendHeartbeatIfIdle() {
+	if t.heartbeatInterval <= 0 || t.clock.Since(t.lastActivity) < t.heartbeatInterval {
+		return
+	}
+	offset := t.GetLastOffset()
+	heartbeat := message.NewHeartbeatMessage([]byte(fmt.Sprintf("tailer healthy at offset %d", offset)))
+	// the identifier lets the auditor record the heartbeat, it is not commited
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = t.Identifier()
+	msgOrigin.LogSource = t.source
+	msgOrigin.Offset = offset
+	heartbeat.SetOrigin(msgOrigin)
+	select {
+	case t.outputChan <- heartbeat:
+	case <-t.softStop:
+		// the tailer is stopping, it is not idle anymore
+	}
+	t.lastActivity = t.clock.Now()
+}
+
+// newStatusMessage returns a status message for the current offset,
+// format is the content of the message given the offset
+func (t *Tailer) newStatusMessage(status, format string) *message.StatusMessage {
+	offset := t.GetLastOffset()
+	statusMsg := message.NewStatusMessage(status, []byte(fmt.Sprintf(format, offset)))
+	// the identifier is left empty, a status must not be commited by the auditor
+	msgOrigin := message.NewOrigin()
+	msgOrigin.LogSource = t.source
+	msgOrigin.Offset = offset
+	statusMsg.SetOrigin(msgOrigin)
+	return statusMsg
+}
+
+// newSourceErrorMessage returns the status describing why the file of source can't be tailed
+func newSourceErrorMessage(source *config.IntegrationConfigLogSource, err error) *message.StatusMessage {
+	statusMsg := message.NewStatusMessage(message.SOURCE_ERROR_STATUS, []byte(fmt.Sprintf("can't tail %s: %v", source.Path, err)))
+	// the identifier is left empty, a status must not be commited by the auditor
+	msgOrigin := message.NewOrigin()
+	msgOrigin.LogSource = source
+	statusMsg.SetOrigin(msgOrigin)
+	return statusMsg
+}
+
+// reportError emits the error that stopped the tailer after it started into its pipeline,
+// when report_source_errors is set. It is sent through the decoder, after the lines read so far
+func (t *Tailer) reportError(err error) {
+	if !t.reportErrors {
+		return
+	}
+	select {
+	case t.d.InputChan <- decoder.NewMessagePayload(newSourceErrorMessage(t.source, err)):
+	case <-t.hardStop:
+	}
+}
+
+// isBackpressured returns true when too many bytes wait to be commited
+func (t *Tailer) isBackpressured() bool {
+	return t.maxInFlightBytes > 0 && metrics.InFlightBytes.Value() >= t.maxInFlightBytes
+}
+
 func (t *Tailer) shouldHardStop() bool {
-	t.stopMutex.Lock()
-	defer t.stopMutex.Unlock()
-	if t.stopTimer != nil {
-		select {
-		case <-t.stopTimer.C:
-			return true
-		default:
-		}
+	select {
+	case <-t.hardStop:
+		return true
+	default:
+		return false
 	}
-	return false
 }
 
 func (t *Tailer) shouldSoftStop() bool {
@@ -216,6 +905,14 @@ func (t *Tailer) shouldSoftStop() bool {
 	return t.shouldStop
 }
 
+// tracksOffset returns true while the offsets of the lines forwarded are to be commited,
+// stopping the tailer can turn it off
+func (t *Tailer) tracksOffset() bool {
+	t.stopMutex.Lock()
+	defer t.stopMutex.Unlock()
+	return t.shouldTrackOffset
+}
+
 func (t *Tailer) incrementLastOffset(n int) {
 	atomic.AddInt64(&t.lastOffset, int64(n))
 }
@@ -228,9 +925,40 @@ func (t *Tailer) GetLastOffset() int64 {
 	return atomic.LoadInt64(&t.lastOffset)
 }
 
-// wait lets the tailer sleep for a bit
+// wait lets the tailer sleep for a bit, a tailer stopped meanwhile wakes up
 func (t *Tailer) wait() {
 	t.sleepMutex.Lock()
 	defer t.sleepMutex.Unlock()
-	time.Sleep(t.sleepDuration)
+	select {
+	case <-t.clock.After(t.sleepDuration):
+	case <-t.softStop:
+	case <-t.hardStop:
+	}
+}
+
+// waitForData lets an idle tailer wait until its file changes,
+// it sleeps for a bit when the file is not watched.
+// The wait is bounded so that rotations, heartbeats and
+// missed events are still handled
+func (t *Tailer) waitForData() {
+	if t.watcher == nil {
+		t.wait()
+		return
+	}
+	timeout := eventPollPeriod
+	if t.heartbeatInterval > 0 && t.heartbeatInterval < timeout {
+		timeout = t.heartbeatInterval
+	}
+	if t.eventTimer == nil {
+		t.eventTimer = t.clock.NewTimer(timeout)
+	} else {
+		t.eventTimer.Reset(timeout)
+	}
+	select {
+	case <-t.watcher.Events():
+	case <-t.softStop:
+	case <-t.hardStop:
+	case <-t.eventTimer.C():
+	}
+	t.eventTimer.Stop()
 }
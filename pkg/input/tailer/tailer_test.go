@@ -6,15 +6,29 @@
 package tailer
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/decoder"
+	"github.com/DataDog/datadog-log-agent/pkg/input/listener"
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -67,11 +81,123 @@ func (suite *TailerTestSuite) TestTailerTails() {
 	msg = <-suite.outputChan
 	suite.Equal("hello again", string(msg.Content()))
 
-	suite.Equal("file:tests/tailer/tailer.log", suite.tl.Identifier())
+	absPath, err := filepath.Abs(suite.testPath)
+	suite.Nil(err)
+	suite.Equal(fmt.Sprintf("file:%s", absPath), suite.tl.Identifier())
+	stats := suite.tl.Stats()
+	suite.Equal(int64(24), stats.BytesRead)
+	suite.Equal(int64(2), stats.LinesRead)
+	suite.False(stats.LastReadTime.IsZero())
+	suite.Nil(stats.Err)
+}
+
+func (suite *TailerTestSuite) TestTailerSendsEndOfLineOffsets() {
+	suite.tl.tailFromBegining()
+
+	_, err := suite.testFile.WriteString("a\nbb\nccc\n")
+	suite.Nil(err)
+
+	for _, offset := range []int64{2, 5, 9} {
+		msg := <-suite.outputChan
+		suite.Equal(offset, msg.GetOrigin().Offset)
+	}
 }
 
 func (suite *TailerTestSuite) TestTailerIdentifier() {
-	suite.Equal("file:tests/tailer/tailer.log", suite.tl.Identifier())
+	// a relative path is keyed by its absolute path, whatever the working directory later becomes
+	absPath, err := filepath.Abs(suite.testPath)
+	suite.Nil(err)
+	suite.Equal(fmt.Sprintf("file:%s", absPath), suite.tl.Identifier())
+	wd, err := os.Getwd()
+	suite.Nil(err)
+	suite.Nil(os.Chdir(suite.testDir))
+	defer os.Chdir(wd)
+	suite.Equal(fmt.Sprintf("file:%s", absPath), suite.tl.Identifier())
+	absSource := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: absPath}
+	suite.Equal(suite.tl.Identifier(), NewTailer(suite.outputChan, absSource).Identifier())
+	suite.Equal(suite.testPath, suite.tl.source.Path)
+
+	suite.source.Identifier = "app"
+	suite.Equal("file:app", suite.tl.Identifier())
+}
+
+func (suite *TailerTestSuite) TestTailersWithTheSameIdentifierShareOffsets() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	suite.source.Identifier = "app"
+	suite.tl.tailFromBegining()
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	auditorChan <- msg
+	suite.tl.Stop(true)
+
+	// a file with a new name but the same identifier resumes at the commited offset
+	newPath := fmt.Sprintf("%s/tailer-2.log", suite.testDir)
+	err = ioutil.WriteFile(newPath, []byte("hello world\nhello again\n"), 0644)
+	suite.Nil(err)
+	defer os.Remove(newPath)
+	newSource := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: newPath, Identifier: "app"}
+	newTailer := NewTailer(suite.outputChan, newSource)
+	newTailer.sleepDuration = 10 * time.Millisecond
+	defer newTailer.Stop(false)
+
+	suite.Eventually(func() bool {
+		offset, _ := a.GetLastCommitedOffset("file:app")
+		return offset == 12
+	}, time.Second, 10*time.Millisecond)
+	suite.Nil(newTailer.recoverTailing(a))
+	msg = <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+}
+
+func (suite *TailerTestSuite) TestTailerWithoutOffsetTrackingIsNotCommited() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	trackOffset := false
+	suite.source.TrackOffset = &trackOffset
+	suite.source.TailLines = 1
+	suite.tl = NewTailer(suite.outputChan, suite.source)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	suite.Nil(suite.tl.recoverTailing(a))
+
+	// the file is tailed from its end
+	_, err = suite.testFile.WriteString("hello again\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+	suite.Equal(int64(0), msg.GetOrigin().Offset)
+	suite.Equal("", msg.GetOrigin().Identifier)
+	auditorChan <- msg
+	a.Stop()
+
+	_, whence := a.GetLastCommitedOffset(suite.tl.Identifier())
+	suite.Equal(os.SEEK_END, whence)
+	suite.tl.Stop(true)
+	suite.False(suite.tl.shouldTrackOffset)
+}
+
+func (suite *TailerTestSuite) TestTailerForwardsMessagesWithoutOrigin() {
+	suite.tl.d.OutputChan = make(chan message.Message, 2)
+	suite.tl.d.OutputChan <- message.NewMessage([]byte("hello world"))
+	close(suite.tl.d.OutputChan)
+	suite.NotPanics(suite.tl.forwardMessages)
+
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	suite.Equal(int64(0), msg.GetOrigin().Offset)
+	suite.Equal("", msg.GetOrigin().Identifier)
 }
 
 func (suite *TailerTestSuite) TestTailerLifecycle() {
@@ -81,6 +207,613 @@ func (suite *TailerTestSuite) TestTailerLifecycle() {
 	// this will be fixed when we implement stop pills
 }
 
+func (suite *TailerTestSuite) TestTailerSendsHeartbeatsWhenIdle() {
+	mock := clock.NewMock(time.Now())
+	suite.tl.clock = mock
+	suite.tl.sleepDuration = time.Second
+	suite.tl.heartbeatInterval = time.Minute
+	suite.tl.tailFromEnd()
+
+	start := mock.Now()
+	for i := 0; i < 3; i++ {
+		// the tailer sleeps at EOF until the file has been idle for long enough
+		mock.BlockUntil(1)
+		mock.Add(time.Minute)
+		msg := <-suite.outputChan
+		_, ok := msg.(*message.HeartbeatMessage)
+		suite.True(ok)
+		suite.Equal(suite.tl.Identifier(), msg.GetOrigin().Identifier)
+		suite.Equal(int64(0), msg.GetOrigin().Offset)
+	}
+	suite.Equal(3*time.Minute, mock.Since(start))
+
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	mock.BlockUntil(1)
+	mock.Add(time.Second)
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+
+	mock.BlockUntil(1)
+	mock.Add(time.Minute)
+	msg = <-suite.outputChan
+	suite.Equal("tailer healthy at offset 12", string(msg.Content()))
+}
+
+// chanWatcher is a fileWatcher whose events are sent by the test
+type chanWatcher struct {
+	events chan struct{}
+}
+
+func (w *chanWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *chanWatcher) Close() error {
+	return nil
+}
+
+func (suite *TailerTestSuite) TestTailerReusesItsEventTimer() {
+	mock := clock.NewMock(time.Now())
+	suite.tl.clock = mock
+	watcher := &chanWatcher{events: make(chan struct{}, 1)}
+	suite.tl.watcher = watcher
+
+	waited := make(chan struct{})
+	wait := func() {
+		suite.tl.waitForData()
+		waited <- struct{}{}
+	}
+
+	// the wait is bounded by the timer
+	go wait()
+	mock.BlockUntil(1)
+	mock.Add(eventPollPeriod)
+	<-waited
+	timer := suite.tl.eventTimer
+	suite.NotNil(timer)
+
+	// an event ends the wait before the timer fires
+	watcher.events <- struct{}{}
+	go wait()
+	<-waited
+	suite.Equal(timer, suite.tl.eventTimer)
+
+	// the timer was stopped, and is reset for the next wait
+	go wait()
+	mock.BlockUntil(1)
+	mock.Add(eventPollPeriod)
+	<-waited
+	suite.Equal(timer, suite.tl.eventTimer)
+}
+
+func (suite *TailerTestSuite) TestTailerReadsCSVHeaderBeforeItsOffset() {
+	_, err := suite.testFile.WriteString("level,message\ninfo,hello\n")
+	suite.Nil(err)
+	suite.source.Format = config.CSV_FORMAT
+	tl := NewTailer(suite.outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	suite.Nil(tl.tailFromEnd())
+	defer tl.Stop(false)
+
+	_, err = suite.testFile.WriteString("error,boom\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	csvMsg, ok := msg.(*message.CSVMessage)
+	suite.True(ok)
+	suite.Equal(map[string]string{"level": "error", "message": "boom"}, csvMsg.Fields())
+	suite.Equal(int64(36), csvMsg.GetOrigin().Offset)
+}
+
+func (suite *TailerTestSuite) TestTailerReadsCSVHeaderAfterTheSkippedLines() {
+	_, err := suite.testFile.WriteString("# exported logs\nlevel,message\ninfo,hello\n")
+	suite.Nil(err)
+	suite.source.Format = config.CSV_FORMAT
+	suite.source.SkipFirstLines = 1
+	tl := NewTailer(suite.outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	// the agent restarts in the middle of the file
+	suite.Nil(tl.tailFrom(41, os.SEEK_SET))
+	defer tl.Stop(false)
+
+	_, err = suite.testFile.WriteString("error,boom\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	csvMsg, ok := msg.(*message.CSVMessage)
+	suite.True(ok)
+	suite.Equal(map[string]string{"level": "error", "message": "boom"}, csvMsg.Fields())
+	suite.Equal(int64(52), csvMsg.GetOrigin().Offset)
+}
+
+// staleReader fails with a stale file handle error once its file has been read
+type staleReader struct {
+	r     io.Reader
+	stale bool
+}
+
+func (r *staleReader) Read(p []byte) (int, error) {
+	if r.stale {
+		return 0, &os.PathError{Op: "read", Path: "tailer.log", Err: syscall.ESTALE}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.stale = true
+	}
+	return n, err
+}
+
+func (suite *TailerTestSuite) TestTailerReopensStaleFile() {
+	var opens int32
+	suite.tl.newReader = func(f file) io.Reader {
+		if atomic.AddInt32(&opens, 1) == 1 {
+			return &staleReader{r: f}
+		}
+		return f
+	}
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	suite.tl.tailFromBegining()
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+
+	_, err = suite.testFile.WriteString("hello again\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+	suite.Equal(int64(24), msg.GetOrigin().Offset)
+	suite.Equal(int32(2), atomic.LoadInt32(&opens))
+	suite.Nil(suite.tl.Stats().Err)
+}
+
+// brokenReader fails once its file has been read
+type brokenReader struct {
+	r      io.Reader
+	broken bool
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.broken {
+		return 0, &os.PathError{Op: "read", Path: "tailer.log", Err: syscall.EIO}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.broken = true
+	}
+	return n, err
+}
+
+func (suite *TailerTestSuite) TestTailerReportsTheErrorThatStoppedIt() {
+	suite.tl.reportErrors = true
+	suite.tl.newReader = func(f file) io.Reader {
+		return &brokenReader{r: f}
+	}
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	suite.Nil(suite.tl.tailFromBegining())
+
+	// the error follows the lines read before it
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	msg = <-suite.outputChan
+	statusMsg, ok := msg.(*message.StatusMessage)
+	suite.True(ok)
+	suite.Equal(message.SOURCE_ERROR_STATUS, statusMsg.Status)
+	suite.Contains(string(statusMsg.Content()), "input/output error")
+	suite.Equal("", statusMsg.GetOrigin().Identifier)
+	suite.NotNil(suite.tl.Stats().Err)
+
+	// the tailer stops once the lines read were forwarded, so that its stream ends
+	select {
+	case <-suite.tl.done:
+	case <-time.After(time.Second):
+		suite.Fail("the tailer was not stopped")
+	}
+}
+
+func (suite *TailerTestSuite) TestTailerLogsReadFailuresAtError() {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	// the error of a previous run of the test must not suppress this one
+	logger.SetRepeatInterval(0)
+	defer logger.SetRepeatInterval(time.Minute)
+
+	suite.tl.newReader = func(f file) io.Reader {
+		return &brokenReader{r: f}
+	}
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	suite.Nil(suite.tl.tailFromBegining())
+	<-suite.outputChan
+	suite.Eventually(func() bool { return suite.tl.Stats().Err != nil }, time.Second, time.Millisecond)
+	log.SetOutput(os.Stderr)
+	suite.Contains(logs.String(), "ERROR: read tailer.log: input/output error")
+}
+
+// wouldBlockReader has no data available on every other read
+type wouldBlockReader struct {
+	r     io.Reader
+	reads int32
+}
+
+func (r *wouldBlockReader) Read(p []byte) (int, error) {
+	if atomic.AddInt32(&r.reads, 1)%2 == 1 {
+		return 0, &os.PathError{Op: "read", Path: "tailer.log", Err: syscall.EAGAIN}
+	}
+	return r.r.Read(p)
+}
+
+func (suite *TailerTestSuite) TestTailerReadsNonblockingFile() {
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	suite.source.Nonblock = true
+	suite.tl = NewTailer(suite.outputChan, suite.source)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	reader := &wouldBlockReader{}
+	suite.tl.newReader = func(f file) io.Reader {
+		reader.r = f
+		return reader
+	}
+	// the file is read from where it is opened, the registry is not used
+	suite.Nil(suite.tl.recoverTailing(auditor.New(nil)))
+
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	suite.Equal(int64(0), msg.GetOrigin().Offset)
+	suite.Equal("", msg.GetOrigin().Identifier)
+	_, err = suite.testFile.WriteString("hello again\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+	suite.True(atomic.LoadInt32(&reader.reads) > 2)
+	suite.Nil(suite.tl.Stats().Err)
+
+	action, err := suite.tl.checkRotation()
+	suite.Nil(err)
+	suite.Equal(continueReading, action)
+}
+
+func (suite *TailerTestSuite) TestTailerGivesUpOnStaleFile() {
+	suite.tl.newReader = func(f file) io.Reader {
+		return &staleReader{r: f, stale: true}
+	}
+	suite.tl.tailFromBegining()
+	for suite.tl.Stats().Err == nil {
+		tick()
+	}
+	suite.Equal(maxStaleAttempts+1, suite.tl.staleAttempts)
+}
+
+func (suite *TailerTestSuite) TestTailerResumesPartialLineWithoutDuplication() {
+	_, err := suite.testFile.WriteString("first\nhel")
+	suite.Nil(err)
+	suite.tl.tailFromBegining()
+
+	msg := <-suite.outputChan
+	suite.Equal("first", string(msg.Content()))
+	commitedOffset := msg.GetOrigin().Offset
+	suite.Equal(int64(6), commitedOffset)
+
+	// wait for the partial line to be read, then restart
+	for suite.tl.GetLastOffset() != 9 {
+		tick()
+	}
+	suite.tl.Stop(true)
+	// the previous tailer must not read the end of the line
+	<-suite.tl.done
+	suite.tl = NewTailer(suite.outputChan, suite.source)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	suite.tl.tailFrom(commitedOffset, os.SEEK_SET)
+
+	_, err = suite.testFile.WriteString("lo\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("hello", string(msg.Content()))
+	suite.Equal(int64(12), msg.GetOrigin().Offset)
+
+	tick()
+	suite.Equal(0, len(suite.outputChan))
+}
+
+func (suite *TailerTestSuite) TestTailerResumesPartialCRIMessageOnce() {
+	suite.source.Format = config.CRI_FORMAT
+	content := "2024-06-01T12:00:00Z stdout F first\n2024-06-01T12:00:01Z stdout P hel\n"
+	_, err := suite.testFile.WriteString(content)
+	suite.Nil(err)
+	tl := NewTailer(suite.outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	tl.tailFromBegining()
+
+	msg := <-suite.outputChan
+	suite.Equal("first", string(msg.Content()))
+	commitedOffset := msg.GetOrigin().Offset
+	suite.Equal(int64(36), commitedOffset)
+
+	// restart while the message is pending, its partial line is read again
+	for tl.GetLastOffset() != int64(len(content)) {
+		tick()
+	}
+	tl.Stop(true)
+	<-tl.done
+	tl = NewTailer(suite.outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	tl.tailFrom(commitedOffset, os.SEEK_SET)
+	defer tl.Stop(false)
+
+	_, err = suite.testFile.WriteString("2024-06-01T12:00:02Z stdout F lo\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("hello", string(msg.Content()))
+	suite.Equal(int64(len(content)+33), msg.GetOrigin().Offset)
+
+	tick()
+	suite.Equal(0, len(suite.outputChan))
+}
+
+func (suite *TailerTestSuite) TestTailerStartsAtTimestamp() {
+	_, err := suite.testFile.WriteString("2024-06-01 12:00:00 first\n2024-06-01 12:00:01 second\nno timestamp\n2024-06-01 12:00:02 third\n2024-06-01 12:00:03 fourth\n")
+	suite.Nil(err)
+	suite.source.TimestampFormat = "2006-01-02 15:04:05"
+	suite.source.StartAt = "2024-06-01T12:00:02Z"
+
+	err = suite.tl.recoverTailing(auditor.New(nil))
+	suite.Nil(err)
+
+	msg := <-suite.outputChan
+	suite.Equal("2024-06-01 12:00:02 third", string(msg.Content()))
+	suite.Equal(int64(92), msg.GetOrigin().Offset)
+	msg = <-suite.outputChan
+	suite.Equal("2024-06-01 12:00:03 fourth", string(msg.Content()))
+}
+
+func (suite *TailerTestSuite) TestTailerResumesAtCommitedTimestamp() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+
+	// the source used to be a network source tracked by timestamp
+	networkMsg := message.NewNetworkMessage([]byte("2024-06-01 12:00:01 second"))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = suite.tl.Identifier()
+	msgOrigin.Timestamp = "2024-06-01T12:00:01.5Z"
+	networkMsg.SetOrigin(msgOrigin)
+	auditorChan <- networkMsg
+	a.Stop()
+
+	_, err := suite.testFile.WriteString("2024-06-01 12:00:00 first\n2024-06-01 12:00:01 second\n2024-06-01 12:00:02 third\n")
+	suite.Nil(err)
+	suite.source.TimestampFormat = "2006-01-02 15:04:05"
+	suite.Nil(suite.tl.recoverTailing(a))
+
+	msg := <-suite.outputChan
+	suite.Equal("2024-06-01 12:00:02 third", string(msg.Content()))
+	suite.Equal(int64(79), msg.GetOrigin().Offset)
+}
+
+func (suite *TailerTestSuite) TestTailerTakesOverFromANetworkSource() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+
+	// the lines received by the network source are commited as the sender would
+	free, err := net.Listen("tcp", "localhost:0")
+	suite.Nil(err)
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	pp := pipeline.NewPipelineProvider()
+	pp.MockPipelineChans()
+	networkSource := &config.IntegrationConfigLogSource{Type: config.TCP_TYPE, Port: port, Identifier: "app"}
+	tcpl, err := listener.NewTcpListener(pp, networkSource)
+	suite.Nil(err)
+	tcpl.Start()
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	suite.Nil(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "received\n")
+	received := <-pp.NextPipelineChan()
+	suite.Equal("file:app", received.GetOrigin().Identifier)
+	auditorChan <- received
+	a.Stop()
+
+	// the same lines are now written to a file, along with the ones the network source didn't get
+	layout := "2006-01-02 15:04:05"
+	before := time.Now().UTC().Add(-time.Hour).Format(layout)
+	after := time.Now().UTC().Add(time.Hour).Format(layout)
+	_, err = suite.testFile.WriteString(fmt.Sprintf("%s received\n%s missed\n", before, after))
+	suite.Nil(err)
+	suite.source.Identifier = "app"
+	suite.source.TimestampFormat = layout
+	suite.Nil(suite.tl.recoverTailing(a))
+
+	msg := <-suite.outputChan
+	suite.Equal(after+" missed", string(msg.Content()))
+}
+
+func (suite *TailerTestSuite) TestTailerStartsAtTailLines() {
+	_, err := suite.testFile.WriteString("first\nsecond\nthird\n")
+	suite.Nil(err)
+	suite.source.TailLines = 2
+
+	err = suite.tl.recoverTailing(auditor.New(nil))
+	suite.Nil(err)
+
+	msg := <-suite.outputChan
+	suite.Equal("second", string(msg.Content()))
+	msg = <-suite.outputChan
+	suite.Equal("third", string(msg.Content()))
+	msg = <-suite.outputChan
+	_, ok := msg.(*message.StatusMessage)
+	suite.True(ok)
+
+	_, err = suite.testFile.WriteString("fourth\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("fourth", string(msg.Content()))
+}
+
+func (suite *TailerTestSuite) TestTailerSendsCaughtUpOnce() {
+	_, err := suite.testFile.WriteString("first\nsecond\n")
+	suite.Nil(err)
+	// the whole file is read from its begining
+	suite.source.TailLines = 10
+	suite.Nil(suite.tl.recoverTailing(auditor.New(nil)))
+
+	suite.Equal("first", string((<-suite.outputChan).Content()))
+	suite.Equal("second", string((<-suite.outputChan).Content()))
+	msg := <-suite.outputChan
+	statusMsg, ok := msg.(*message.StatusMessage)
+	suite.True(ok)
+	suite.Equal(message.CAUGHT_UP_STATUS, statusMsg.Status)
+	suite.Equal("tailer caught up at offset 13", string(statusMsg.Content()))
+	suite.Equal(int64(13), statusMsg.GetOrigin().Offset)
+	suite.Equal("", statusMsg.GetOrigin().Identifier)
+
+	// later EOFs don't notify again
+	_, err = suite.testFile.WriteString("third\n")
+	suite.Nil(err)
+	suite.Equal("third", string((<-suite.outputChan).Content()))
+	tick()
+	tick()
+	suite.Equal(0, len(suite.outputChan))
+}
+
+func (suite *TailerTestSuite) TestTailerReportsDecoderBacklog() {
+	suite.tl.sleepDuration = time.Millisecond
+	// the decoder is never started, payloads pile up
+	suite.tl.d.InputChan = make(chan *decoder.Payload, 3)
+	suite.tl.startReading(0, os.SEEK_END)
+	suite.Equal(0, suite.tl.Stats().QueueDepth)
+
+	for i := 0; i < 5; i++ {
+		writeMessage(suite.testFile)
+		tick()
+	}
+	stats := suite.tl.Stats()
+	suite.Equal(3, stats.QueueDepth)
+	suite.Equal(absPath(suite.testPath), stats.Path)
+	suite.True(stats.BlockedTime > 0)
+	suite.Equal(int64(36), stats.Offset)
+}
+
+func (suite *TailerTestSuite) TestTailerSoftStopDrainsTheDecoder() {
+	outputChan := make(chan message.Message)
+	tl := NewTailer(outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		_, err := suite.testFile.WriteString(fmt.Sprintf("line %d\n", i))
+		suite.Nil(err)
+	}
+	suite.Nil(tl.tailFromBegining())
+
+	// nothing is consumed yet, the lines are buffered in the decoder
+	time.Sleep(50 * time.Millisecond)
+	tl.Stop(true)
+
+	for i := 0; i < 5; i++ {
+		msg := <-outputChan
+		suite.Equal(fmt.Sprintf("line %d", i), string(msg.Content()))
+	}
+	select {
+	case <-tl.done:
+	case <-time.After(time.Second):
+		suite.Fail("the tailer did not stop")
+	}
+	suite.Equal(0, len(outputChan))
+}
+
+func (suite *TailerTestSuite) TestTailerPausesWhenTooManyBytesAreInFlight() {
+	metrics.InFlightBytes.Set(0)
+	defer metrics.InFlightBytes.Set(0)
+	// the pipeline is stuck, nothing is ever commited
+	outputChan := make(chan message.Message, 1000)
+	testPath := fmt.Sprintf("%s/backpressure.log", suite.testDir)
+	line := "0123456789012345678\n"
+	err := ioutil.WriteFile(testPath, []byte(strings.Repeat(line, 1000)), 0644)
+	suite.Nil(err)
+	defer os.Remove(testPath)
+	tl := NewTailer(outputChan, &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: testPath})
+	tl.sleepDuration = time.Millisecond
+	tl.maxInFlightBytes = 100
+	tl.d.InputChan = make(chan *decoder.Payload)
+	defer tl.Stop(false)
+
+	suite.Nil(tl.tailFromBegining())
+
+	time.Sleep(100 * time.Millisecond)
+	// reads are paused after a few chunks instead of the whole file
+	bytesRead := tl.Stats().BytesRead
+	suite.True(bytesRead > 0)
+	suite.True(bytesRead < int64(1000*len(line)))
+	suite.True(metrics.InFlightBytes.Value() >= 100)
+
+	// committing the messages resumes reads
+	go func() {
+		for msg := range outputChan {
+			metrics.InFlightBytes.Add(-msg.GetOrigin().InFlightBytes)
+		}
+	}()
+	suite.Eventually(func() bool {
+		return tl.Stats().BytesRead == int64(1000*len(line))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *TailerTestSuite) TestTailerSendsHeartbeatsWhileItCantRead() {
+	// the pipeline is stuck, the file is not read
+	metrics.InFlightBytes.Set(100)
+	defer metrics.InFlightBytes.Set(0)
+	_, err := suite.testFile.WriteString("hello world\n")
+	suite.Nil(err)
+	outputChan := make(chan message.Message, 10)
+	tl := NewTailer(outputChan, suite.source)
+	tl.sleepDuration = time.Millisecond
+	tl.maxInFlightBytes = 100
+	tl.heartbeatInterval = 10 * time.Millisecond
+	defer tl.Stop(false)
+
+	suite.Nil(tl.tailFromBegining())
+	select {
+	case msg := <-outputChan:
+		_, ok := msg.(*message.HeartbeatMessage)
+		suite.True(ok)
+		suite.Equal(int64(0), msg.GetOrigin().Offset)
+	case <-time.After(time.Second):
+		suite.Fail("the tailer didn't send a heartbeat")
+	}
+}
+
+func (suite *TailerTestSuite) TestTailerLimitsLineRate() {
+	line := "hello world\n"
+	_, err := suite.testFile.WriteString(strings.Repeat(line, 1000))
+	suite.Nil(err)
+	outputChan := make(chan message.Message, 1000)
+	suite.source.MaxLinesPerSecond = 100
+	tl := NewTailer(outputChan, suite.source)
+	tl.sleepDuration = 10 * time.Millisecond
+	defer tl.Stop(false)
+
+	start := time.Now()
+	suite.Nil(tl.tailFromBegining())
+	forwarded := 0
+	for i := 1; i <= 1000; i++ {
+		msg := <-outputChan
+		// offsets keep advancing for the dropped lines
+		suite.Equal(int64(i*len(line)), msg.GetOrigin().Offset)
+		if len(msg.Content()) > 0 {
+			forwarded++
+		}
+	}
+	elapsed := time.Since(start)
+
+	maxForwarded := 100 + int(elapsed.Seconds()*100) + 1
+	suite.True(forwarded >= 100)
+	suite.True(forwarded <= maxForwarded)
+	suite.Equal(int64(1000-forwarded), tl.Stats().LinesOverLimit)
+}
+
 func writeMessage(file *os.File) {
 	time.Sleep(time.Millisecond)
 	file.WriteString("hello world\n")
@@ -178,6 +911,82 @@ func (suite *TailerTestSuite) TestTailerIsTooSlowAndClosed() {
 	suite.Equal(int(atomic.LoadUint64(&messagesReceived)), int(received))
 }
 
+func (suite *TailerTestSuite) TestTailerResetsOffsetWhenSourceChanges() {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, chanSize)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	suite.source.ResetOnChange = true
+	suite.Nil(suite.tl.recoverTailing(a))
+	_, err := suite.testFile.WriteString("hello\n")
+	suite.Nil(err)
+	msg := <-suite.outputChan
+	auditorChan <- msg
+	suite.Eventually(func() bool {
+		offset, _ := a.GetLastCommitedOffset(suite.tl.Identifier())
+		return offset == 6
+	}, time.Second, 10*time.Millisecond)
+	suite.tl.Stop(true)
+	<-suite.tl.done
+	_, err = suite.testFile.WriteString("garbage\n")
+	suite.Nil(err)
+
+	// the same source resumes at its offset
+	suite.tl = NewTailer(suite.outputChan, suite.source)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	suite.Nil(suite.tl.recoverTailing(a))
+	msg = <-suite.outputChan
+	suite.Equal("garbage", string(msg.Content()))
+	suite.tl.Stop(true)
+	<-suite.tl.done
+
+	// once it is fixed, the file is tailed from its end
+	fixed := *suite.source
+	fixed.Format = config.JSON_FORMAT
+	suite.tl = NewTailer(suite.outputChan, &fixed)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	suite.Nil(suite.tl.recoverTailing(a))
+	_, err = suite.testFile.WriteString("{\"fixed\":true}\n")
+	suite.Nil(err)
+	msg = <-suite.outputChan
+	suite.Equal("{\"fixed\":true}", string(msg.Content()))
+	suite.Equal(fixed.Hash(), a.GetMeta(suite.tl.Identifier(), configHashMeta))
+}
+
+func (suite *TailerTestSuite) TestTailerExitsAfterReadingAFileThatIsNotFollowed() {
+	_, err := suite.testFile.WriteString("hello world\nhello again\n")
+	suite.Nil(err)
+	follow := false
+	suite.source.Follow = &follow
+	suite.tl = NewTailer(suite.outputChan, suite.source)
+	suite.tl.sleepDuration = 10 * time.Millisecond
+	// a new file is read from its begining
+	suite.Nil(suite.tl.recoverTailing(auditor.New(nil)))
+
+	msg := <-suite.outputChan
+	suite.Equal("hello world", string(msg.Content()))
+	msg = <-suite.outputChan
+	suite.Equal("hello again", string(msg.Content()))
+	suite.Equal(int64(24), msg.GetOrigin().Offset)
+	select {
+	case <-suite.tl.done:
+	case <-time.After(time.Second):
+		suite.Fail("the tailer didn't stop at the end of the file")
+	}
+
+	// the lines written afterwards are not read
+	_, err = suite.testFile.WriteString("too late\n")
+	suite.Nil(err)
+	select {
+	case msg := <-suite.outputChan:
+		suite.Fail("unexpected line", string(msg.Content()))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func TestTailerTestSuite(t *testing.T) {
 	suite.Run(t, new(TailerTestSuite))
 }
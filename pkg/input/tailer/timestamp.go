@@ -0,0 +1,55 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseTimestamp parses the timestamp found at the beginning of a line,
+// made of as many space separated fields as layout, in location when it has no offset
+func parseTimestamp(line []byte, layout string, location *time.Location) (time.Time, error) {
+	numFields := strings.Count(layout, " ") + 1
+	fields := strings.SplitN(string(line), " ", numFields+1)
+	if len(fields) < numFields {
+		return time.Time{}, fmt.Errorf("no timestamp found in line")
+	}
+	return time.ParseInLocation(layout, strings.Join(fields[:numFields], " "), location)
+}
+
+// findTimestampOffset returns the offset of the first line of the file at path
+// whose timestamp is at or after from. Lines without a valid timestamp are skipped.
+// If no line qualifies, the offset of the end of the last complete line is returned
+func findTimestampOffset(path, layout string, location *time.Location, from time.Time) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		ts, err := parseTimestamp(bytes.TrimRight(line, "\r\n"), layout, location)
+		if err == nil && !ts.Before(from) {
+			return offset, nil
+		}
+		offset += int64(len(line))
+	}
+}
@@ -0,0 +1,28 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := parseTimestamp([]byte("2024-06-01 12:00:00 hello world"), "2006-01-02 15:04:05", time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC), ts)
+
+	ts, err = parseTimestamp([]byte("2024-06-01T12:00:00Z hello"), time.RFC3339, time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC), ts)
+
+	_, err = parseTimestamp([]byte("hello world"), "2006-01-02 15:04:05", time.UTC)
+	assert.NotNil(t, err)
+	_, err = parseTimestamp([]byte("hello"), "2006-01-02 15:04:05", time.UTC)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,80 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// startFIFOTailer starts a tailer reading the fifo at path, keeping its lines in w
+func startFIFOTailer(t *testing.T, path string, w *wal.WAL, outputChan chan message.Message) *Tailer {
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: path, Nonblock: true, WAL: true}
+	tl := NewTailer(outputChan, source)
+	tl.sleepDuration = 10 * time.Millisecond
+	tl.wal = w
+	assert.Nil(t, tl.tailFromEnd())
+	return tl
+}
+
+func TestTailerRecoversFIFOLinesFromWALAfterCrash(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	fifoPath := filepath.Join(testDir, "fifo")
+	walPath := filepath.Join(testDir, "wal.log")
+	assert.Nil(t, syscall.Mkfifo(fifoPath, 0644))
+	// the writer keeps the fifo open while the tailers come and go
+	writer, err := os.OpenFile(fifoPath, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	defer writer.Close()
+
+	w, err := wal.Open(walPath, 1024)
+	assert.Nil(t, err)
+	outputChan := make(chan message.Message, chanSize)
+	tl := startFIFOTailer(t, fifoPath, w, outputChan)
+	_, err = writer.WriteString("first\nsecond\n")
+	assert.Nil(t, err)
+	first := <-outputChan
+	assert.Equal(t, "first", string(first.Content()))
+	second := <-outputChan
+	assert.Equal(t, "second", string(second.Content()))
+	assert.NotEqual(t, uint64(0), second.GetOrigin().WALSeq)
+	// only the first line was commited when the agent crashed,
+	// the WAL is never closed
+	assert.Nil(t, w.Ack(first.GetOrigin().WALSeq))
+	tl.Stop(false)
+	<-tl.done
+
+	w, err = wal.Open(walPath, 1024)
+	assert.Nil(t, err)
+	defer w.Close()
+	tl = startFIFOTailer(t, fifoPath, w, outputChan)
+	defer tl.Stop(false)
+	_, err = writer.WriteString("third\n")
+	assert.Nil(t, err)
+	// the line that was never commited is replayed before the live ones
+	msg := <-outputChan
+	assert.Equal(t, "second", string(msg.Content()))
+	assert.Equal(t, second.GetOrigin().WALSeq, msg.GetOrigin().WALSeq)
+	msg = <-outputChan
+	assert.Equal(t, "third", string(msg.Content()))
+	assert.True(t, msg.GetOrigin().WALSeq > second.GetOrigin().WALSeq)
+	select {
+	case msg = <-outputChan:
+		assert.Fail(t, "unexpected message", string(msg.Content()))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,24 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"errors"
+	"time"
+)
+
+// eventPollPeriod is how often a tailer waiting for file events still checks
+// its file, in case an event was missed
+const eventPollPeriod = 10 * time.Second
+
+var errWatchUnsupported = errors.New("file events are not supported on this platform")
+
+// A fileWatcher notifies when a file is written, truncated, moved or removed
+type fileWatcher interface {
+	// Events receives a value when the file changed, events are coalesced
+	Events() <-chan struct{}
+	Close() error
+}
@@ -0,0 +1,66 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"os"
+	"syscall"
+)
+
+// inotifyWatcher watches a file with inotify
+type inotifyWatcher struct {
+	file   *os.File
+	events chan struct{}
+}
+
+// newFileWatcher returns a watcher for the file at path
+func newFileWatcher(path string) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF)
+	if _, err := syscall.InotifyAddWatch(fd, path, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		// the descriptor is nonblocking, reads wait in the runtime poller
+		// and are interrupted when the file is closed
+		file:   os.NewFile(uintptr(fd), path),
+		events: make(chan struct{}, 1),
+	}
+	go w.run()
+	return w, nil
+}
+
+// run forwards the inotify events until the watcher is closed
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			select {
+			case w.events <- struct{}{}:
+			default:
+				// an event is already pending
+			}
+		}
+	}
+}
+
+// Events receives a value when the file changed
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+// Close stops watching the file
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
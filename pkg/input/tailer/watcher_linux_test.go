@@ -0,0 +1,57 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleTailerWakesOnFileWrite(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "watcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	testPath := filepath.Join(testDir, "idle.log")
+	f, err := os.Create(testPath)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	outputChan := make(chan message.Message, chanSize)
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: testPath}
+	tl := NewTailer(outputChan, source)
+	tl.useFileEvents = true
+	// polling alone would not notice the write before the end of the test
+	tl.sleepDuration = time.Hour
+	assert.Nil(t, tl.tailFromEnd())
+	assert.NotNil(t, tl.watcher)
+
+	// let the tailer reach EOF and go idle
+	time.Sleep(50 * time.Millisecond)
+	_, err = f.WriteString("hello world\n")
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-outputChan:
+		assert.Equal(t, "hello world", string(msg.Content()))
+	case <-time.After(time.Second):
+		assert.Fail(t, "the tailer was not woken up by the write")
+	}
+
+	// stopping wakes the tailer up as well
+	tl.Stop(false)
+	select {
+	case <-tl.done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the tailer did not stop")
+	}
+}
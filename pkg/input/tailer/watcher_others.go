@@ -0,0 +1,14 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+//go:build !linux
+// +build !linux
+
+package tailer
+
+// newFileWatcher returns an error, tailers poll their file instead
+func newFileWatcher(path string) (fileWatcher, error) {
+	return nil, errWatchUnsupported
+}
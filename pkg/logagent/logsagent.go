@@ -6,6 +6,9 @@
 package main
 
 import (
+	"log"
+	"time"
+
 	"github.com/DataDog/datadog-log-agent/pkg/auditor"
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/input/container"
@@ -14,10 +17,13 @@ import (
 	"github.com/DataDog/datadog-log-agent/pkg/message"
 	"github.com/DataDog/datadog-log-agent/pkg/pipeline"
 	"github.com/DataDog/datadog-log-agent/pkg/sender"
+	"github.com/DataDog/datadog-log-agent/pkg/shutdown"
+	"github.com/DataDog/datadog-log-agent/pkg/status"
 )
 
-// Start starts the forwarder
-func Start() {
+// Start starts the forwarder, and returns the coordinator
+// in charge of stopping it
+func Start() *shutdown.Coordinator {
 
 	cm := sender.NewConnectionManager(
 		config.LogsAgent.GetString("log_dd_url"),
@@ -25,14 +31,35 @@ func Start() {
 		config.LogsAgent.GetBool("skip_ssl_validation"),
 	)
 
+	newDestination, err := sender.NewDestinationFactory(
+		config.LogsAgent.GetString("destination"),
+		config.LogsAgent.GetString("destination_path"),
+		config.LogsAgent.GetString("destination_format"),
+		cm,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	auditorChan := make(chan message.Message, config.ChanSizes)
 	a := auditor.New(auditorChan)
 	a.Start()
 
 	pp := pipeline.NewPipelineProvider()
-	pp.Start(cm, auditorChan)
+	for _, output := range config.GetOutputs() {
+		newOutputDestination, err := sender.NewDestinationFactory(output.Destination, output.Path, output.Format, cm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output.Tee {
+			pp.AddTeeOutput(newOutputDestination, output.MustAck)
+		} else {
+			pp.AddOutput(output.Name, newOutputDestination)
+		}
+	}
+	pp.Start(newDestination, auditorChan)
 
-	l := listener.New(config.GetLogsSources(), pp)
+	l := listener.New(config.GetLogsSources(), pp, a)
 	l.Start()
 
 	s := tailer.New(config.GetLogsSources(), pp, a)
@@ -40,4 +67,23 @@ func Start() {
 
 	c := container.New(config.GetLogsSources(), pp, a)
 	c.Start()
+
+	// inputs are stopped first, once they forwarded what they read, then pending batches
+	// are sent and acknowledged until shutdown_drain_timeout, and the auditor flushes the registry last
+	stoppers := []shutdown.Stopper{l, s, c, pp, a}
+
+	status.PublishCommitLags(s, a)
+
+	if statusAddr := config.LogsAgent.GetString("status_addr"); statusAddr != "" {
+		statusServer := status.NewServer(statusAddr, s, a)
+		err = statusServer.Start()
+		if err != nil {
+			log.Println("Can't start status server:", err)
+		} else {
+			stoppers = append([]shutdown.Stopper{statusServer}, stoppers...)
+		}
+	}
+
+	shutdownTimeout := time.Duration(config.LogsAgent.GetInt("shutdown_timeout")) * time.Second
+	return shutdown.NewCoordinator(shutdownTimeout, stoppers...)
 }
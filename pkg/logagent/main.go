@@ -7,27 +7,49 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/logger"
+	"github.com/DataDog/datadog-log-agent/pkg/preflight"
+	"github.com/DataDog/datadog-log-agent/pkg/shutdown"
 )
 
 var ddconfigPath = flag.String("ddconfig", "", "Path to the datadog.yaml configuration file")
 var ddconfdPath = flag.String("ddconfd", "", "Path to the conf.d directory that contains all integration config files")
+var runPreflight = flag.Bool("preflight", false, "Check that the agent can run with its configuration, and exit")
 
 // main starts the logs agent
 func main() {
 	flag.Parse()
 
 	err := config.BuildLogsAgentConfig(*ddconfigPath, *ddconfdPath)
+	if *runPreflight {
+		if err != nil {
+			fmt.Println("FAIL config:", err)
+			os.Exit(1)
+		}
+		report := preflight.Preflight(config.GetLogsSources())
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Println(err)
 		log.Println("Not starting logs-agent")
 	} else if config.LogsAgent.GetBool("log_enabled") {
+		logger.SetLevel(config.LogsAgent.GetString("log_level"))
+		logger.SetRepeatInterval(time.Duration(config.LogsAgent.GetInt("log_repeat_interval")) * time.Second)
 		log.Println("Starting logs-agent")
-		Start()
+		coordinator := Start()
+		shutdown.HandleSignals(coordinator)
 
 		if config.LogsAgent.GetBool("log_profiling_enabled") {
 			log.Println("starting logs-agent profiling")
@@ -0,0 +1,138 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+)
+
+const (
+	DEBUG_LEVEL = "debug"
+	INFO_LEVEL  = "info"
+	WARN_LEVEL  = "warn"
+	ERROR_LEVEL = "error"
+)
+
+var levels = map[string]int{
+	DEBUG_LEVEL: 0,
+	INFO_LEVEL:  1,
+	WARN_LEVEL:  2,
+	ERROR_LEVEL: 3,
+}
+
+const defaultRepeatInterval = time.Minute
+
+// maxRepeated is the number of distinct warnings and errors remembered
+// before the ones that can't be repeated anymore are forgotten
+const maxRepeated = 1000
+
+// A repeated is a warning or an error that was logged recently
+type repeated struct {
+	loggedAt   time.Time
+	suppressed int
+}
+
+var (
+	mutex sync.Mutex
+	level = levels[INFO_LEVEL]
+	// a warning or an error identical to one logged less than repeatInterval
+	// ago is suppressed, the number of suppressed ones is logged afterwards
+	repeatInterval = defaultRepeatInterval
+	repeats        = make(map[string]*repeated)
+	clk            = clock.New()
+)
+
+// SetLevel sets the lowest level of the messages logged, messages are logged
+// from the info level by default
+func SetLevel(name string) error {
+	l, ok := levels[name]
+	if !ok {
+		return fmt.Errorf("Unknown log level: %s", name)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	level = l
+	return nil
+}
+
+// SetRepeatInterval sets for how long identical warnings and errors are
+// suppressed, they are never suppressed when it is zero
+func SetRepeatInterval(interval time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	repeatInterval = interval
+}
+
+// Debug logs the events that are only useful to find out what the agent
+// is doing, like the files being opened and closed
+func Debug(v ...interface{}) {
+	output(DEBUG_LEVEL, v...)
+}
+
+// Info logs the events of the life of the agent
+func Info(v ...interface{}) {
+	output(INFO_LEVEL, v...)
+}
+
+// Warn logs the failures that the agent recovers from
+func Warn(v ...interface{}) {
+	output(WARN_LEVEL, v...)
+}
+
+// Error logs the failures that lose or delay logs
+func Error(v ...interface{}) {
+	output(ERROR_LEVEL, v...)
+}
+
+// output logs a message with its level, the operands are formatted like log.Println
+func output(name string, v ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if levels[name] < level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	if levels[name] >= levels[WARN_LEVEL] && repeatInterval > 0 {
+		suppressed, ok := checkRepeat(name + msg)
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			msg = fmt.Sprintf("%s (repeated %d times)", msg, suppressed)
+		}
+	}
+	log.Println(strings.ToUpper(name)+":", msg)
+}
+
+// checkRepeat returns false if msg was logged less than repeatInterval ago,
+// and how many times it was suppressed since it was last logged otherwise
+func checkRepeat(msg string) (int, bool) {
+	now := clk.Now()
+	r, ok := repeats[msg]
+	if ok && now.Sub(r.loggedAt) < repeatInterval {
+		r.suppressed++
+		return 0, false
+	}
+	if len(repeats) >= maxRepeated {
+		for key, r := range repeats {
+			if now.Sub(r.loggedAt) >= repeatInterval {
+				delete(repeats, key)
+			}
+		}
+	}
+	suppressed := 0
+	if ok {
+		suppressed = r.suppressed
+	}
+	repeats[msg] = &repeated{loggedAt: now}
+	return suppressed, true
+}
@@ -0,0 +1,80 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package logger
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs returns the lines logged by f
+func captureLogs(f func()) []string {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+}
+
+// reset forgets the warnings and errors logged by the previous tests
+func reset() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	repeats = make(map[string]*repeated)
+}
+
+func TestLoggerSkipsTheMessagesBelowItsLevel(t *testing.T) {
+	reset()
+	defer SetLevel(INFO_LEVEL)
+	lines := captureLogs(func() {
+		Debug("Opening", "/var/log/app.log")
+		Info("Starting")
+		Error("Can't open", "/var/log/app.log", ":", "permission denied")
+	})
+	assert.Equal(t, []string{"INFO: Starting", "ERROR: Can't open /var/log/app.log : permission denied"}, lines)
+
+	assert.Nil(t, SetLevel(DEBUG_LEVEL))
+	lines = captureLogs(func() {
+		Debug("Opening", "/var/log/app.log")
+	})
+	assert.Equal(t, []string{"DEBUG: Opening /var/log/app.log"}, lines)
+
+	assert.NotNil(t, SetLevel("verbose"))
+}
+
+func TestLoggerSuppressesRepeatedWarnings(t *testing.T) {
+	reset()
+	mock := clock.NewMock(time.Now())
+	clk = mock
+	defer func() { clk = clock.New() }()
+
+	lines := captureLogs(func() {
+		for i := 0; i < 3; i++ {
+			Warn("Can't open", "/var/log/app.log")
+			Info("Retrying")
+		}
+		Warn("Can't open", "/var/log/other.log")
+		mock.Add(defaultRepeatInterval)
+		Warn("Can't open", "/var/log/app.log")
+	})
+	assert.Equal(t, []string{
+		"WARN: Can't open /var/log/app.log",
+		"INFO: Retrying",
+		"INFO: Retrying",
+		"INFO: Retrying",
+		"WARN: Can't open /var/log/other.log",
+		"WARN: Can't open /var/log/app.log (repeated 2 times)",
+	}, lines)
+}
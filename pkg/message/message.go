@@ -6,23 +6,65 @@
 package message
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 )
 
+const (
+	// CAUGHT_UP_STATUS is emitted once by a source that has read its existing content
+	CAUGHT_UP_STATUS = "caught_up"
+	// SOURCE_ERROR_STATUS is emitted by a source that can't be tailed or that stopped on an error, with the reason
+	SOURCE_ERROR_STATUS = "source_error"
+)
+
 // Message represents a log line sent to datadog, with its metadata
 type Message interface {
 	Content() []byte
 	SetContent([]byte)
 	GetOrigin() *MessageOrigin
 	SetOrigin(*MessageOrigin)
+	Clone() Message
 }
 
-// MessageOrigin represents the Origin of a message
+// MessageOrigin represents the Origin of a message.
+// For a file, Offset is the offset of the end of the line, newline included:
+// committing it means that everything up to and including this line is done
 type MessageOrigin struct {
 	Identifier string
 	LogSource  *config.IntegrationConfigLogSource
 	Offset     int64
 	Timestamp  string
+	// InFlightBytes is the size accounted for the message in the in-flight bytes,
+	// until it is commited or dropped
+	InFlightBytes int64
+	// Replay is true for lines sent again on demand
+	Replay bool
+	// WALSeq is the sequence number of the message in the WAL, it is acked
+	// once the message is commited. Zero when the message is not in the WAL
+	WALSeq uint64
+	// ID identifies the message when its destination acknowledges the messages
+	// it accepted, it is assigned each time the message is sent
+	ID uint64
+	// Stream identifies the tailer that read the message, and Seq numbers the messages
+	// it forwarded from 1: the auditor commits the messages of a stream in this order.
+	// Both are zero when the message is not part of a stream
+	Stream uint64
+	Seq    uint64
+	// Tags are added to the tags of the source of the message
+	Tags []string
+	// OffsetReset is true when the file was rotated or truncated before the message
+	// was read, its offset can be lower than the one commited
+	OffsetReset bool
+	// Partial is true for the beginning of a line sent before its end was read
+	Partial bool
+	// Line is the number of the line in its file, starting at 1,
+	// or zero when the source doesn't number its lines
+	Line int64
+	// HeaderLen is the length of the api key and of the header put before
+	// the line in the content by the processor, zero before it is processed
+	HeaderLen int
 }
 
 type message struct {
@@ -50,6 +92,33 @@ func (m *message) SetOrigin(Origin *MessageOrigin) {
 	m.Origin = Origin
 }
 
+// clone returns a copy of the message, that can be updated
+// without altering the original one
+func (m *message) clone() *message {
+	var content []byte
+	if m.content != nil {
+		content = make([]byte, len(m.content))
+		copy(content, m.content)
+	}
+	var origin *MessageOrigin
+	if m.Origin != nil {
+		o := *m.Origin
+		if o.Tags != nil {
+			o.Tags = append([]string{}, o.Tags...)
+		}
+		origin = &o
+	}
+	return &message{
+		content: content,
+		Origin:  origin,
+	}
+}
+
+// Clone returns a copy of the message
+func (m *message) Clone() Message {
+	return m.clone()
+}
+
 // NewMessage returns a new message
 func NewMessage(content []byte) *message {
 	return &message{
@@ -57,7 +126,7 @@ func NewMessage(content []byte) *message {
 	}
 }
 
-// NewFileOrigin returns a new MessageOrigin
+// NewOrigin returns a new empty MessageOrigin, see OriginBuilder to set its fields
 func NewOrigin() *MessageOrigin {
 	return &MessageOrigin{}
 }
@@ -73,6 +142,145 @@ func NewStopMessage() *StopMessage {
 	}
 }
 
+// Clone returns a copy of the message
+func (m *StopMessage) Clone() Message {
+	return &StopMessage{message: m.clone()}
+}
+
+// StatusMessage is an internal event describing the state of a source,
+// it must not be ingested as a log line
+type StatusMessage struct {
+	*message
+	Status string
+}
+
+// NewStatusMessage returns a new StatusMessage
+func NewStatusMessage(status string, content []byte) *StatusMessage {
+	return &StatusMessage{
+		message: NewMessage(content),
+		Status:  status,
+	}
+}
+
+// Clone returns a copy of the message
+func (m *StatusMessage) Clone() Message {
+	return &StatusMessage{message: m.clone(), Status: m.Status}
+}
+
+// HeartbeatMessage is emitted by an idle source to notify it is still healthy,
+// at the offset of its origin. It is never sent to a destination, nor commited:
+// the auditor records it
+type HeartbeatMessage struct {
+	*message
+}
+
+// NewHeartbeatMessage returns a new HeartbeatMessage
+func NewHeartbeatMessage(content []byte) *HeartbeatMessage {
+	return &HeartbeatMessage{
+		message: NewMessage(content),
+	}
+}
+
+// Clone returns a copy of the message
+func (m *HeartbeatMessage) Clone() Message {
+	return &HeartbeatMessage{message: m.clone()}
+}
+
+// JSONMessage is a message whose content is a JSON object,
+// it carries the parsed fields along with the original content
+type JSONMessage struct {
+	*message
+	fields map[string]interface{}
+	// Timestamp is the time of the event read from the timestamp field
+	// of the source, or the zero time when it has none
+	Timestamp time.Time
+}
+
+// NewJSONMessage parses content and returns a new JSONMessage,
+// or an error if content is not a valid JSON object
+func NewJSONMessage(content []byte) (*JSONMessage, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(content, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONMessage{
+		message: NewMessage(content),
+		fields:  fields,
+	}, nil
+}
+
+// Fields returns the parsed fields of the message
+func (m *JSONMessage) Fields() map[string]interface{} {
+	return m.fields
+}
+
+// Clone returns a copy of the message, parsed fields are shared
+func (m *JSONMessage) Clone() Message {
+	return &JSONMessage{message: m.clone(), fields: m.fields, Timestamp: m.Timestamp}
+}
+
+// CSVMessage is a row of a csv file, it carries its fields
+// keyed by the header of the file along with the original content
+type CSVMessage struct {
+	*message
+	fields map[string]string
+}
+
+// NewCSVMessage returns a new CSVMessage
+func NewCSVMessage(content []byte, fields map[string]string) *CSVMessage {
+	return &CSVMessage{
+		message: NewMessage(content),
+		fields:  fields,
+	}
+}
+
+// Fields returns the fields of the row
+func (m *CSVMessage) Fields() map[string]string {
+	return m.fields
+}
+
+// Clone returns a copy of the message, fields are shared
+func (m *CSVMessage) Clone() Message {
+	return &CSVMessage{message: m.clone(), fields: m.fields}
+}
+
+// CRIMessage is a line written by a container runtime, its content
+// is the line logged by the container
+type CRIMessage struct {
+	*message
+	// Timestamp is the time at which the runtime received the line
+	Timestamp time.Time
+	// Stream is stdout or stderr
+	Stream string
+}
+
+// NewCRIMessage returns a new CRIMessage
+func NewCRIMessage(content []byte, timestamp time.Time, stream string) *CRIMessage {
+	return &CRIMessage{
+		message:   NewMessage(content),
+		Timestamp: timestamp,
+		Stream:    stream,
+	}
+}
+
+// Clone returns a copy of the message
+func (m *CRIMessage) Clone() Message {
+	return &CRIMessage{message: m.clone(), Timestamp: m.Timestamp, Stream: m.Stream}
+}
+
+// EventTimestamp returns the time of the event logged by a message, as parsed
+// by the decoder, or the zero time when the decoder didn't find one
+func EventTimestamp(msg Message) time.Time {
+	switch m := msg.(type) {
+	case *CRIMessage:
+		return m.Timestamp
+	case *JSONMessage:
+		return m.Timestamp
+	}
+	return time.Time{}
+}
+
 // FileMessage is a message coming from a File
 type FileMessage struct {
 	*message
@@ -84,7 +292,12 @@ func NewFileMessage(content []byte) *FileMessage {
 	}
 }
 
-// FileMessage is a message coming from a network Source
+// Clone returns a copy of the message
+func (m *FileMessage) Clone() Message {
+	return &FileMessage{message: m.clone()}
+}
+
+// NetworkMessage is a message coming from a network Source
 type NetworkMessage struct {
 	*message
 }
@@ -95,6 +308,11 @@ func NewNetworkMessage(content []byte) *NetworkMessage {
 	}
 }
 
+// Clone returns a copy of the message
+func (m *NetworkMessage) Clone() Message {
+	return &NetworkMessage{message: m.clone()}
+}
+
 // ContainerMessage is a message coming from a container Source
 type ContainerMessage struct {
 	*message
@@ -105,3 +323,50 @@ func NewContainerMessage(content []byte) *ContainerMessage {
 		message: NewMessage(content),
 	}
 }
+
+// Clone returns a copy of the message
+func (m *ContainerMessage) Clone() Message {
+	return &ContainerMessage{message: m.clone()}
+}
+
+// MessageBatch is a group of processed messages sent at once to the intake,
+// its content is the content of all its messages and each message keeps its origin
+type MessageBatch struct {
+	*message
+	messages []Message
+}
+
+// NewMessageBatch returns a new MessageBatch holding messages,
+// its origin is the origin of the last message of the batch
+func NewMessageBatch(messages []Message) *MessageBatch {
+	size := 0
+	for _, msg := range messages {
+		size += len(msg.Content())
+	}
+	content := make([]byte, 0, size)
+	for _, msg := range messages {
+		content = append(content, msg.Content()...)
+	}
+	batch := &MessageBatch{
+		message:  NewMessage(content),
+		messages: messages,
+	}
+	if len(messages) > 0 {
+		batch.SetOrigin(messages[len(messages)-1].GetOrigin())
+	}
+	return batch
+}
+
+// Messages returns the messages of the batch
+func (m *MessageBatch) Messages() []Message {
+	return m.messages
+}
+
+// Clone returns a copy of the message
+func (m *MessageBatch) Clone() Message {
+	messages := make([]Message, len(m.messages))
+	for i, msg := range m.messages {
+		messages[i] = msg.Clone()
+	}
+	return &MessageBatch{message: m.clone(), messages: messages}
+}
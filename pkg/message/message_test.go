@@ -18,3 +18,57 @@ func TestMessage(t *testing.T) {
 	message.SetContent([]byte("world"))
 	assert.Equal(t, "world", string(message.Content()))
 }
+
+func TestJSONMessage(t *testing.T) {
+	message, err := NewJSONMessage([]byte(`{"hello":"world"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"hello":"world"}`, string(message.Content()))
+	assert.Equal(t, map[string]interface{}{"hello": "world"}, message.Fields())
+
+	_, err = NewJSONMessage([]byte("hello world"))
+	assert.NotNil(t, err)
+}
+
+func TestClone(t *testing.T) {
+	msg := NewFileMessage([]byte("hello"))
+	origin := NewOrigin()
+	origin.Offset = 42
+	msg.SetOrigin(origin)
+
+	clone := msg.Clone()
+	_, ok := clone.(*FileMessage)
+	assert.True(t, ok)
+	assert.Equal(t, "hello", string(clone.Content()))
+	assert.Equal(t, int64(42), clone.GetOrigin().Offset)
+
+	clone.Content()[0] = 'j'
+	clone.GetOrigin().Offset = 43
+	assert.Equal(t, "hello", string(msg.Content()))
+	assert.Equal(t, int64(42), msg.GetOrigin().Offset)
+
+	status := NewStatusMessage(CAUGHT_UP_STATUS, nil).Clone()
+	assert.Equal(t, CAUGHT_UP_STATUS, status.(*StatusMessage).Status)
+	assert.Nil(t, status.GetOrigin())
+}
+
+func TestOriginBuilder(t *testing.T) {
+	builder := NewOriginBuilder().
+		Identifier("file:/var/log/app.log").
+		Offset(42).
+		Timestamp("2017-01-12T01:01:01.000000Z").
+		Tags("env:prod", "team:logs")
+	origin := builder.Build()
+	assert.Equal(t, "file:/var/log/app.log", origin.Identifier)
+	assert.Equal(t, int64(42), origin.Offset)
+	assert.Equal(t, "2017-01-12T01:01:01.000000Z", origin.Timestamp)
+	assert.Equal(t, []string{"env:prod", "team:logs"}, origin.Tags)
+	assert.Nil(t, origin.LogSource)
+	assert.False(t, origin.Replay)
+
+	// the origins built don't share their fields
+	other := builder.Offset(43).Tags("region:eu").Build()
+	assert.Equal(t, int64(42), origin.Offset)
+	assert.Equal(t, []string{"env:prod", "team:logs"}, origin.Tags)
+	assert.Equal(t, int64(43), other.Offset)
+	assert.Equal(t, []string{"env:prod", "team:logs", "region:eu"}, other.Tags)
+}
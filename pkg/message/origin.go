@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package message
+
+import (
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+)
+
+// An OriginBuilder builds a MessageOrigin, for instance
+// NewOriginBuilder().LogSource(source).Offset(42).Build().
+// The fields that are not set keep their zero value
+type OriginBuilder struct {
+	origin MessageOrigin
+}
+
+// NewOriginBuilder returns a builder of an empty MessageOrigin
+func NewOriginBuilder() *OriginBuilder {
+	return &OriginBuilder{}
+}
+
+// Identifier sets the key under which the offset of the message is commited
+func (b *OriginBuilder) Identifier(identifier string) *OriginBuilder {
+	b.origin.Identifier = identifier
+	return b
+}
+
+// LogSource sets the source of the message
+func (b *OriginBuilder) LogSource(source *config.IntegrationConfigLogSource) *OriginBuilder {
+	b.origin.LogSource = source
+	return b
+}
+
+// Offset sets the offset commited with the message
+func (b *OriginBuilder) Offset(offset int64) *OriginBuilder {
+	b.origin.Offset = offset
+	return b
+}
+
+// Timestamp sets the timestamp commited with the message
+func (b *OriginBuilder) Timestamp(timestamp string) *OriginBuilder {
+	b.origin.Timestamp = timestamp
+	return b
+}
+
+// InFlightBytes sets the size accounted for the message in the in-flight bytes
+func (b *OriginBuilder) InFlightBytes(inFlightBytes int64) *OriginBuilder {
+	b.origin.InFlightBytes = inFlightBytes
+	return b
+}
+
+// Replay flags the message as sent again on demand
+func (b *OriginBuilder) Replay(replay bool) *OriginBuilder {
+	b.origin.Replay = replay
+	return b
+}
+
+// WALSeq sets the sequence number of the message in the WAL
+func (b *OriginBuilder) WALSeq(seq uint64) *OriginBuilder {
+	b.origin.WALSeq = seq
+	return b
+}
+
+// OffsetReset flags the message as read after its file was rotated or truncated
+func (b *OriginBuilder) OffsetReset(reset bool) *OriginBuilder {
+	b.origin.OffsetReset = reset
+	return b
+}
+
+// Partial flags the message as the beginning of a line sent before its end was read
+func (b *OriginBuilder) Partial(partial bool) *OriginBuilder {
+	b.origin.Partial = partial
+	return b
+}
+
+// Line sets the number of the line in its file
+func (b *OriginBuilder) Line(line int64) *OriginBuilder {
+	b.origin.Line = line
+	return b
+}
+
+// Seq sets the stream of the message and its number in the stream
+func (b *OriginBuilder) Seq(stream, seq uint64) *OriginBuilder {
+	b.origin.Stream = stream
+	b.origin.Seq = seq
+	return b
+}
+
+// Tags adds tags to the message
+func (b *OriginBuilder) Tags(tags ...string) *OriginBuilder {
+	b.origin.Tags = append(b.origin.Tags, tags...)
+	return b
+}
+
+// Build returns a new MessageOrigin, the builder can be reused
+func (b *OriginBuilder) Build() *MessageOrigin {
+	origin := b.origin
+	if origin.Tags != nil {
+		origin.Tags = append([]string{}, origin.Tags...)
+	}
+	return &origin
+}
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package metrics
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// A Histogram counts the values observed under each of its bounds, it is
+// exposed as {"buckets": {"<bound>": count, "+Inf": count}, "count": n, "sum": s}
+// where the count of a bound includes all the values lower or equal to it
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	// counts has one more bucket than bounds, for the values over the last bound
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewHistogram returns a histogram with the given bounds, in increasing order
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// Count returns the number of values observed
+func (h *Histogram) Count() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+// Reset forgets the values observed
+func (h *Histogram) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts = make([]int64, len(h.bounds)+1)
+	h.count = 0
+	h.sum = 0
+}
+
+// String returns the histogram in json, it makes the histogram an expvar.Var
+func (h *Histogram) String() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	buckets := make(map[string]int64, len(h.counts))
+	var cumulated int64
+	for i, count := range h.counts {
+		cumulated += count
+		if i < len(h.bounds) {
+			buckets[strconv.FormatFloat(h.bounds[i], 'g', -1, 64)] = cumulated
+		} else {
+			buckets["+Inf"] = cumulated
+		}
+	}
+	b, _ := json.Marshal(struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+	}{buckets, h.count, h.sum})
+	return string(b)
+}
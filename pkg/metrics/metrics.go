@@ -0,0 +1,73 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package metrics
+
+import (
+	"expvar"
+)
+
+var (
+	// LogsExpvars contains metrics for the logs agent, they are
+	// exposed on /debug/vars when profiling is enabled
+	LogsExpvars *expvar.Map
+
+	// InFlightBytes is the size of the lines read from files
+	// that are not commited or dropped yet
+	InFlightBytes = expvar.Int{}
+	// DedupSuppressed is the number of duplicated lines that were not forwarded
+	DedupSuppressed = expvar.Int{}
+	// LinesOverLimit is the number of lines dropped by the sources line rate limits
+	LinesOverLimit = expvar.Int{}
+	// RegistryFlushErrors is the number of times the registry could not be saved
+	RegistryFlushErrors = expvar.Int{}
+	// OffsetRegressions is the number of offsets commited lower than the previous ones,
+	// while their file was neither rotated nor truncated
+	OffsetRegressions = expvar.Int{}
+	// PayloadsDropped is the number of payloads read from files that were dropped
+	// because their decoder couldn't keep up
+	PayloadsDropped = expvar.Int{}
+	// DecoderPanics is the number of lines whose decoding panicked,
+	// they are forwarded as plain lines
+	DecoderPanics = expvar.Int{}
+	// CommitEventsDropped is the number of commit events that
+	// a subscriber of the auditor didn't receive in time
+	CommitEventsDropped = expvar.Int{}
+	// TimestampFieldErrors is the number of json lines whose timestamp_field
+	// is missing or can't be parsed, they are timestamped when processed
+	TimestampFieldErrors = expvar.Int{}
+	// RegistryFlushDuration is the distribution of the durations
+	// of the flushes of the registry, in seconds
+	RegistryFlushDuration = NewHistogram(0.001, 0.01, 0.1, 1, 10)
+	// RegistrySize is the size in bytes of the registry last saved
+	RegistrySize = expvar.Int{}
+	// PathsOutsideAllowedRoots is the number of times a file was not opened
+	// because it resolved to a path outside of the allowed_roots
+	PathsOutsideAllowedRoots = expvar.Int{}
+	// FencedMessages is the number of messages whose offset is not commited
+	// yet because a message read before them is not
+	FencedMessages = expvar.Int{}
+	// OversizeDropped is the number of messages over max_payload_size
+	// dropped by the drop oversize_policy
+	OversizeDropped = expvar.Int{}
+)
+
+func init() {
+	LogsExpvars = expvar.NewMap("logs-agent")
+	LogsExpvars.Set("InFlightBytes", &InFlightBytes)
+	LogsExpvars.Set("DedupSuppressed", &DedupSuppressed)
+	LogsExpvars.Set("LinesOverLimit", &LinesOverLimit)
+	LogsExpvars.Set("RegistryFlushErrors", &RegistryFlushErrors)
+	LogsExpvars.Set("OffsetRegressions", &OffsetRegressions)
+	LogsExpvars.Set("PayloadsDropped", &PayloadsDropped)
+	LogsExpvars.Set("DecoderPanics", &DecoderPanics)
+	LogsExpvars.Set("CommitEventsDropped", &CommitEventsDropped)
+	LogsExpvars.Set("TimestampFieldErrors", &TimestampFieldErrors)
+	LogsExpvars.Set("RegistryFlushDuration", RegistryFlushDuration)
+	LogsExpvars.Set("RegistrySize", &RegistrySize)
+	LogsExpvars.Set("PathsOutsideAllowedRoots", &PathsOutsideAllowedRoots)
+	LogsExpvars.Set("FencedMessages", &FencedMessages)
+	LogsExpvars.Set("OversizeDropped", &OversizeDropped)
+}
@@ -0,0 +1,120 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// A Batcher groups the messages of its input channel into batches,
+// sent to its output channel when they reach maxCount messages or maxSize bytes,
+// or when they are older than flushInterval, whichever comes first
+type Batcher struct {
+	inputChan     chan message.Message
+	outputChan    chan message.Message
+	maxCount      int
+	maxSize       int
+	flushInterval time.Duration
+
+	messages []message.Message
+	size     int
+
+	done    chan struct{}
+	runDone chan struct{}
+}
+
+// NewBatcher returns an initialized Batcher
+func NewBatcher(inputChan, outputChan chan message.Message, maxCount, maxSize int, flushInterval time.Duration) *Batcher {
+	return &Batcher{
+		inputChan:     inputChan,
+		outputChan:    outputChan,
+		maxCount:      maxCount,
+		maxSize:       maxSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+		runDone:       make(chan struct{}),
+	}
+}
+
+// Start starts the Batcher
+func (b *Batcher) Start() {
+	go b.run()
+}
+
+// Stop stops the Batcher, sending the pending batch if any
+func (b *Batcher) Stop() {
+	close(b.done)
+	<-b.runDone
+}
+
+// run accumulates messages and flushes batches
+func (b *Batcher) run() {
+	defer close(b.runDone)
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-b.inputChan:
+			if !ok {
+				b.flush()
+				return
+			}
+			b.add(msg)
+		case <-ticker.C:
+			b.flush()
+		case <-b.done:
+			b.drain()
+			b.flush()
+			return
+		}
+	}
+}
+
+// drain adds the messages that are already buffered in the input channel
+func (b *Batcher) drain() {
+	for {
+		select {
+		case msg, ok := <-b.inputChan:
+			if !ok {
+				return
+			}
+			b.add(msg)
+		default:
+			return
+		}
+	}
+}
+
+// add adds a message to the pending batch, flushing it when it is full.
+// A message that would make the batch too big starts a new one
+func (b *Batcher) add(msg message.Message) {
+	if _, ok := msg.(*message.HeartbeatMessage); ok {
+		// a heartbeat is never sent, it is not part of a batch
+		b.outputChan <- msg
+		return
+	}
+	msgSize := len(msg.Content())
+	if len(b.messages) > 0 && b.maxSize > 0 && b.size+msgSize > b.maxSize {
+		b.flush()
+	}
+	b.messages = append(b.messages, msg)
+	b.size += msgSize
+	if (b.maxCount > 0 && len(b.messages) >= b.maxCount) || (b.maxSize > 0 && b.size >= b.maxSize) {
+		b.flush()
+	}
+}
+
+// flush sends the pending batch
+func (b *Batcher) flush() {
+	if len(b.messages) == 0 {
+		return
+	}
+	b.outputChan <- message.NewMessageBatch(b.messages)
+	b.messages = nil
+	b.size = 0
+}
@@ -0,0 +1,90 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBatchedMessage(content string, offset int64) message.Message {
+	msg := message.NewFileMessage([]byte(content))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = "file:batch.log"
+	msgOrigin.Offset = offset
+	msg.SetOrigin(msgOrigin)
+	return msg
+}
+
+func TestBatcherFlushesOnCount(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	b := NewBatcher(inputChan, outputChan, 3, 0, time.Hour)
+	b.Start()
+	defer b.Stop()
+
+	for i := int64(1); i <= 4; i++ {
+		inputChan <- newBatchedMessage("line\n", i*5)
+	}
+	batch := (<-outputChan).(*message.MessageBatch)
+	assert.Equal(t, 3, len(batch.Messages()))
+	assert.Equal(t, "line\nline\nline\n", string(batch.Content()))
+	assert.Equal(t, int64(15), batch.GetOrigin().Offset)
+	assert.Equal(t, int64(5), batch.Messages()[0].GetOrigin().Offset)
+	assert.Equal(t, 0, len(outputChan))
+}
+
+func TestBatcherFlushesOnSize(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	b := NewBatcher(inputChan, outputChan, 100, 10, time.Hour)
+	b.Start()
+	defer b.Stop()
+
+	inputChan <- newBatchedMessage("four\n", 5)
+	inputChan <- newBatchedMessage("four\n", 10)
+	batch := (<-outputChan).(*message.MessageBatch)
+	assert.Equal(t, 2, len(batch.Messages()))
+
+	// a message that doesn't fit starts a new batch
+	inputChan <- newBatchedMessage("four\n", 15)
+	inputChan <- newBatchedMessage("sixsix\n", 22)
+	batch = (<-outputChan).(*message.MessageBatch)
+	assert.Equal(t, 1, len(batch.Messages()))
+	assert.Equal(t, int64(15), batch.GetOrigin().Offset)
+}
+
+func TestBatcherFlushesOnInterval(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	b := NewBatcher(inputChan, outputChan, 100, 0, 10*time.Millisecond)
+	b.Start()
+	defer b.Stop()
+
+	inputChan <- newBatchedMessage("line\n", 5)
+	select {
+	case msg := <-outputChan:
+		assert.Equal(t, 1, len(msg.(*message.MessageBatch).Messages()))
+	case <-time.After(time.Second):
+		assert.Fail(t, "the batch was not flushed")
+	}
+}
+
+func TestBatcherFlushesOnStop(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	b := NewBatcher(inputChan, outputChan, 100, 0, time.Hour)
+	b.Start()
+
+	inputChan <- newBatchedMessage("line\n", 5)
+	inputChan <- newBatchedMessage("line\n", 10)
+	b.Stop()
+	batch := (<-outputChan).(*message.MessageBatch)
+	assert.Equal(t, 2, len(batch.Messages()))
+}
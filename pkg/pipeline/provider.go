@@ -6,7 +6,9 @@
 package pipeline
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
@@ -14,10 +16,20 @@ import (
 	"github.com/DataDog/datadog-log-agent/pkg/sender"
 )
 
+// defaultBatchFlushInterval is how long a batch waits for more messages when batch_flush_interval is unset
+const defaultBatchFlushInterval = 1 * time.Second
+
 type PipelineProvider struct {
 	numberOfPipelines int32
 	chanSizes         int
 	pipelinesChans    [](chan message.Message)
+	batchers          []*Batcher
+	reorderers        []*Reorderer
+	senders           []*sender.Sender
+	// outputs are the destinations the sources can send their lines to instead of the main one
+	outputs map[string]sender.DestinationFactory
+	// tees are the destinations getting a copy of all the lines
+	tees []teeDestination
 
 	currentChanIdx int32
 }
@@ -29,29 +41,141 @@ func NewPipelineProvider() *PipelineProvider {
 		chanSizes:         config.ChanSizes,
 		pipelinesChans:    [](chan message.Message){},
 		currentChanIdx:    0,
+		outputs:           make(map[string]sender.DestinationFactory),
 	}
 }
 
+// AddOutput adds a destination the sources with this output send their lines to,
+// it must be called before the pipelines are started
+func (pp *PipelineProvider) AddOutput(name string, newDestination sender.DestinationFactory) {
+	pp.outputs[name] = newDestination
+}
+
+// teeDestination is a destination getting a copy of all the lines, mustAck is true
+// when a line can only be commited once it was handed to it
+type teeDestination struct {
+	newDestination sender.DestinationFactory
+	mustAck        bool
+}
+
+// AddTeeOutput adds a destination all the lines are copied to,
+// it must be called before the pipelines are started
+func (pp *PipelineProvider) AddTeeOutput(newDestination sender.DestinationFactory, mustAck bool) {
+	pp.tees = append(pp.tees, teeDestination{newDestination: newDestination, mustAck: mustAck})
+}
+
+// startSender starts a sender to a new destination, behind a batcher when the
+// messages are batched. It returns the channel of the messages to send
+func (pp *PipelineProvider) startSender(newDestination sender.DestinationFactory, auditorChan chan message.Message) chan message.Message {
+	senderChan := make(chan message.Message, pp.chanSizes)
+	f := sender.New(senderChan, auditorChan, newDestination())
+	f.Start()
+	pp.senders = append(pp.senders, f)
+
+	batchMaxCount := config.LogsAgent.GetInt("batch_max_count")
+	batchMaxSize := config.LogsAgent.GetInt("batch_max_size")
+	batchFlushInterval := time.Duration(config.LogsAgent.GetInt("batch_flush_interval")) * time.Millisecond
+	if batchMaxCount > 0 || batchMaxSize > 0 || batchFlushInterval > 0 {
+		// the settings that are not set fall back to their default
+		if batchMaxSize <= 0 {
+			batchMaxSize = config.MaxMessageLen
+		}
+		if batchFlushInterval <= 0 {
+			batchFlushInterval = defaultBatchFlushInterval
+		}
+		batcherChan := make(chan message.Message, pp.chanSizes)
+		b := NewBatcher(batcherChan, senderChan, batchMaxCount, batchMaxSize, batchFlushInterval)
+		b.Start()
+		pp.batchers = append(pp.batchers, b)
+		return batcherChan
+	}
+	return senderChan
+}
+
 // Start initializes the pipelines
-func (pp *PipelineProvider) Start(cm *sender.ConnectionManager, auditorChan chan message.Message) {
+func (pp *PipelineProvider) Start(newDestination sender.DestinationFactory, auditorChan chan message.Message) {
 
 	for i := int32(0); i < pp.numberOfPipelines; i++ {
 
-		senderChan := make(chan message.Message, pp.chanSizes)
-		f := sender.New(senderChan, auditorChan, cm)
-		f.Start()
+		processedChan := pp.startSender(newDestination, auditorChan)
+		if len(pp.outputs) > 0 {
+			// the messages are routed to the output of their source, all of them are commited
+			outputs := make(map[string]chan message.Message)
+			for name, newOutputDestination := range pp.outputs {
+				outputs[name] = pp.startSender(newOutputDestination, auditorChan)
+			}
+			routerChan := make(chan message.Message, pp.chanSizes)
+			NewRouter(routerChan, processedChan, outputs).Start()
+			processedChan = routerChan
+		}
+		if len(pp.tees) > 0 {
+			// the lines are copied to the tee outputs, and commited by the main destination
+			// once they were handed to all the tee outputs that must ack them
+			outputs := []*TeeOutput{}
+			for _, tee := range pp.tees {
+				outputChan := pp.startSender(tee.newDestination, newDiscardChan(pp.chanSizes))
+				outputs = append(outputs, &TeeOutput{OutputChan: outputChan, MustAck: tee.mustAck})
+			}
+			teeChan := make(chan message.Message, pp.chanSizes)
+			NewTee(teeChan, processedChan, outputs).Start()
+			processedChan = teeChan
+		}
 
 		processorChan := make(chan message.Message, pp.chanSizes)
 		p := processor.New(
 			processorChan,
-			senderChan,
+			processedChan,
 			config.LogsAgent.GetString("api_key"),
 			config.LogsAgent.GetString("logset"),
 		)
 		p.Start()
 
-		pp.pipelinesChans = append(pp.pipelinesChans, processorChan)
+		inputChan := processorChan
+		if reorderWindow := config.LogsAgent.GetInt("reorder_window"); reorderWindow > 0 {
+			inputChan = make(chan message.Message, pp.chanSizes)
+			r := NewReorderer(
+				inputChan,
+				processorChan,
+				time.Duration(reorderWindow)*time.Millisecond,
+				config.LogsAgent.GetInt("reorder_max_messages"),
+			)
+			r.Start()
+			pp.reorderers = append(pp.reorderers, r)
+		}
+
+		pp.pipelinesChans = append(pp.pipelinesChans, inputChan)
+	}
+}
+
+// Stop stops the pipelines, held messages and pending batches are sent,
+// then all the senders drain their messages within the same deadline
+func (pp *PipelineProvider) Stop() {
+	for _, r := range pp.reorderers {
+		r.Stop()
 	}
+	for _, b := range pp.batchers {
+		b.Stop()
+	}
+	var wg sync.WaitGroup
+	for _, s := range pp.senders {
+		wg.Add(1)
+		go func(s *sender.Sender) {
+			defer wg.Done()
+			s.Stop()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// newDiscardChan returns a channel whose messages are dropped,
+// the copies sent to the tee outputs are never commited
+func newDiscardChan(size int) chan message.Message {
+	discardChan := make(chan message.Message, size)
+	go func() {
+		for range discardChan {
+		}
+	}()
+	return discardChan
 }
 
 func (pp *PipelineProvider) MockPipelineChans() {
@@ -7,10 +7,26 @@ package pipeline
 
 import (
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/sender"
 	"github.com/stretchr/testify/suite"
 )
 
+// recordingDestination keeps the messages it was sent
+type recordingDestination struct {
+	msgs chan message.Message
+}
+
+func (d *recordingDestination) Send(msg message.Message) error {
+	d.msgs <- msg
+	return nil
+}
+
+func (d *recordingDestination) Flush() {}
+
 type PipelineProviderTestSuite struct {
 	suite.Suite
 	pp *PipelineProvider
@@ -22,7 +38,9 @@ func (suite *PipelineProviderTestSuite) SetupTest() {
 
 func (suite *PipelineProviderTestSuite) TestPipelineProvider() {
 	suite.pp.numberOfPipelines = 3
-	suite.pp.Start(nil, nil)
+	newDestination, err := sender.NewDestinationFactory(sender.INTAKE_DESTINATION, "", "", nil)
+	suite.Nil(err)
+	suite.pp.Start(newDestination, nil)
 	suite.Equal(3, len(suite.pp.pipelinesChans))
 
 	c := suite.pp.NextPipelineChan()
@@ -33,6 +51,113 @@ func (suite *PipelineProviderTestSuite) TestPipelineProvider() {
 	suite.Equal(c, suite.pp.NextPipelineChan())
 }
 
+func (suite *PipelineProviderTestSuite) TestPipelineProviderRoutesSourcesToTheirOutput() {
+	suite.pp.numberOfPipelines = 1
+	prod := &recordingDestination{msgs: make(chan message.Message, 10)}
+	audit := &recordingDestination{msgs: make(chan message.Message, 10)}
+	suite.pp.AddOutput("audit", func() sender.Destination { return audit })
+	auditorChan := make(chan message.Message, 10)
+	suite.pp.Start(func() sender.Destination { return prod }, auditorChan)
+
+	sources := map[string]*config.IntegrationConfigLogSource{
+		"app.log":    {Type: config.FILE_TYPE, Path: "app.log"},
+		"access.log": {Type: config.FILE_TYPE, Path: "access.log", Output: "audit"},
+	}
+	for _, identifier := range []string{"app.log", "access.log"} {
+		msg := message.NewFileMessage([]byte("hello"))
+		msg.SetOrigin(message.NewOriginBuilder().LogSource(sources[identifier]).Identifier(identifier).Offset(6).Build())
+		suite.pp.NextPipelineChan() <- msg
+	}
+	suite.Equal("app.log", (<-prod.msgs).GetOrigin().Identifier)
+	suite.Equal("access.log", (<-audit.msgs).GetOrigin().Identifier)
+
+	// both messages are commited, whatever their destination
+	commited := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		commited[(<-auditorChan).GetOrigin().Identifier] = true
+	}
+	suite.Equal(map[string]bool{"app.log": true, "access.log": true}, commited)
+	suite.Equal(0, len(prod.msgs))
+	suite.Equal(0, len(audit.msgs))
+}
+
+func (suite *PipelineProviderTestSuite) TestPipelineProviderCopiesLinesToTheTeeOutputs() {
+	suite.pp.numberOfPipelines = 1
+	prod := &recordingDestination{msgs: make(chan message.Message, 10)}
+	archive := &recordingDestination{msgs: make(chan message.Message, 10)}
+	suite.pp.AddTeeOutput(func() sender.Destination { return archive }, true)
+	auditorChan := make(chan message.Message, 10)
+	suite.pp.Start(func() sender.Destination { return prod }, auditorChan)
+
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "app.log"}
+	msg := message.NewFileMessage([]byte("hello"))
+	msg.SetOrigin(message.NewOriginBuilder().LogSource(source).Identifier("app.log").Offset(6).Build())
+	suite.pp.NextPipelineChan() <- msg
+
+	suite.Equal("app.log", (<-archive.msgs).GetOrigin().Identifier)
+	suite.Equal("app.log", (<-prod.msgs).GetOrigin().Identifier)
+	// the line is commited once, by the main destination
+	suite.Equal(int64(6), (<-auditorChan).GetOrigin().Offset)
+	time.Sleep(10 * time.Millisecond)
+	suite.Equal(0, len(auditorChan))
+}
+
+func (suite *PipelineProviderTestSuite) TestPipelineProviderBatchesWhenAnyBatchSettingIsSet() {
+	config.LogsAgent.Set("batch_flush_interval", 200)
+	defer config.LogsAgent.Set("batch_flush_interval", 0)
+	suite.pp.numberOfPipelines = 1
+	prod := &recordingDestination{msgs: make(chan message.Message, 10)}
+	suite.pp.Start(func() sender.Destination { return prod }, make(chan message.Message, 10))
+	suite.Equal(1, len(suite.pp.batchers))
+
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "app.log"}
+	for _, offset := range []int64{6, 12} {
+		msg := message.NewFileMessage([]byte("hello"))
+		msg.SetOrigin(message.NewOriginBuilder().LogSource(source).Identifier("app.log").Offset(offset).Build())
+		suite.pp.NextPipelineChan() <- msg
+	}
+	batch, ok := (<-prod.msgs).(*message.MessageBatch)
+	suite.True(ok)
+	suite.Equal(2, len(batch.Messages()))
+}
+
+func (suite *PipelineProviderTestSuite) TestPipelineProviderNeverSendsTheHeartbeats() {
+	config.LogsAgent.Set("batch_flush_interval", 10)
+	defer config.LogsAgent.Set("batch_flush_interval", 0)
+	suite.pp.numberOfPipelines = 1
+	prod := &recordingDestination{msgs: make(chan message.Message, 10)}
+	archive := &recordingDestination{msgs: make(chan message.Message, 10)}
+	suite.pp.AddTeeOutput(func() sender.Destination { return archive }, true)
+	auditorChan := make(chan message.Message, 10)
+	suite.pp.Start(func() sender.Destination { return prod }, auditorChan)
+
+	source := &config.IntegrationConfigLogSource{Type: config.FILE_TYPE, Path: "app.log"}
+	heartbeat := message.NewHeartbeatMessage([]byte("tailer healthy at offset 0"))
+	heartbeat.SetOrigin(message.NewOriginBuilder().LogSource(source).Identifier("app.log").Build())
+	suite.pp.NextPipelineChan() <- heartbeat
+	msg := message.NewFileMessage([]byte("hello"))
+	msg.SetOrigin(message.NewOriginBuilder().LogSource(source).Identifier("app.log").Offset(6).Build())
+	suite.pp.NextPipelineChan() <- msg
+
+	// only the line reaches the destinations, the heartbeat goes to the auditor
+	for _, d := range []*recordingDestination{prod, archive} {
+		batch, ok := (<-d.msgs).(*message.MessageBatch)
+		suite.True(ok)
+		suite.Equal(1, len(batch.Messages()))
+		suite.Equal(int64(6), batch.Messages()[0].GetOrigin().Offset)
+	}
+	heartbeats := 0
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-auditorChan).(*message.HeartbeatMessage); ok {
+			heartbeats++
+		}
+	}
+	suite.Equal(1, heartbeats)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(0, len(prod.msgs))
+	suite.Equal(0, len(archive.msgs))
+}
+
 func (suite *PipelineProviderTestSuite) TestPipelineProviderMock() {
 	suite.pp.MockPipelineChans()
 	suite.Equal(1, len(suite.pp.pipelinesChans))
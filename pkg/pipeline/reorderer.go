@@ -0,0 +1,177 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// heldMessage is a message waiting in the reorderer
+type heldMessage struct {
+	msg       message.Message
+	timestamp time.Time
+	arrival   time.Time
+}
+
+// A Reorderer holds the messages of several sources for a short window,
+// and forwards them in the order of their timestamps. The messages of a source
+// keep their order, so that their offsets are commited in order: only messages
+// of different sources are reordered. A message is forwarded once the oldest
+// message held has waited for window, once its timestamp is older than window,
+// or once more than maxSize messages are held, so an idle source never blocks the others
+type Reorderer struct {
+	inputChan  chan message.Message
+	outputChan chan message.Message
+	window     time.Duration
+	maxSize    int
+	clock      clock.Clock
+
+	queues map[*config.IntegrationConfigLogSource][]*heldMessage
+	size   int
+
+	done    chan struct{}
+	runDone chan struct{}
+}
+
+// NewReorderer returns an initialized Reorderer
+func NewReorderer(inputChan, outputChan chan message.Message, window time.Duration, maxSize int) *Reorderer {
+	return &Reorderer{
+		inputChan:  inputChan,
+		outputChan: outputChan,
+		window:     window,
+		maxSize:    maxSize,
+		clock:      clock.New(),
+		queues:     make(map[*config.IntegrationConfigLogSource][]*heldMessage),
+		done:       make(chan struct{}),
+		runDone:    make(chan struct{}),
+	}
+}
+
+// Start starts the Reorderer
+func (r *Reorderer) Start() {
+	go r.run()
+}
+
+// Stop stops the Reorderer, the messages held are forwarded
+func (r *Reorderer) Stop() {
+	close(r.done)
+	<-r.runDone
+}
+
+// run lets the Reorderer hold the messages of the inputChan until they can be forwarded
+func (r *Reorderer) run() {
+	defer close(r.runDone)
+	for {
+		var wakeUp <-chan time.Time
+		if r.size > 0 {
+			wakeUp = r.clock.After(r.nextDeadline().Sub(r.clock.Now()))
+		}
+		select {
+		case msg, ok := <-r.inputChan:
+			if !ok {
+				r.flushAll()
+				return
+			}
+			r.add(msg)
+		case <-wakeUp:
+		case <-r.done:
+			r.flushAll()
+			return
+		}
+		r.flushReady()
+	}
+}
+
+// add holds a message at the end of the queue of its source
+func (r *Reorderer) add(msg message.Message) {
+	arrival := r.clock.Now()
+	var source *config.IntegrationConfigLogSource
+	if msg.GetOrigin() != nil {
+		source = msg.GetOrigin().LogSource
+	}
+	r.queues[source] = append(r.queues[source], &heldMessage{
+		msg:       msg,
+		timestamp: messageTimestamp(msg, arrival),
+		arrival:   arrival,
+	})
+	r.size++
+}
+
+// messageTimestamp returns the time of the event of a message,
+// or its arrival time when it has none
+func messageTimestamp(msg message.Message, arrival time.Time) time.Time {
+	if timestamp := message.EventTimestamp(msg); !timestamp.IsZero() {
+		return timestamp
+	}
+	if msg.GetOrigin() != nil && msg.GetOrigin().Timestamp != "" {
+		if timestamp, err := time.Parse(time.RFC3339Nano, msg.GetOrigin().Timestamp); err == nil {
+			return timestamp
+		}
+	}
+	return arrival
+}
+
+// earliest returns the source whose next message has the earliest timestamp,
+// and the earliest arrival of the messages held
+func (r *Reorderer) earliest() (*config.IntegrationConfigLogSource, time.Time) {
+	var earliestSource *config.IntegrationConfigLogSource
+	var earliest *heldMessage
+	var oldestArrival time.Time
+	for source, queue := range r.queues {
+		head := queue[0]
+		if earliest == nil || head.timestamp.Before(earliest.timestamp) {
+			earliestSource, earliest = source, head
+		}
+		if oldestArrival.IsZero() || head.arrival.Before(oldestArrival) {
+			oldestArrival = head.arrival
+		}
+	}
+	return earliestSource, oldestArrival
+}
+
+// nextDeadline returns when the next message can be forwarded
+func (r *Reorderer) nextDeadline() time.Time {
+	source, oldestArrival := r.earliest()
+	deadline := oldestArrival.Add(r.window)
+	if expiry := r.queues[source][0].timestamp.Add(r.window); expiry.Before(deadline) {
+		deadline = expiry
+	}
+	return deadline
+}
+
+// flushReady forwards the messages that can't wait any longer, in order
+func (r *Reorderer) flushReady() {
+	for r.size > 0 {
+		if r.size <= r.maxSize && r.nextDeadline().After(r.clock.Now()) {
+			return
+		}
+		r.forwardEarliest()
+	}
+}
+
+// flushAll forwards all the messages held, in order
+func (r *Reorderer) flushAll() {
+	for r.size > 0 {
+		r.forwardEarliest()
+	}
+}
+
+// forwardEarliest forwards the message with the earliest timestamp
+func (r *Reorderer) forwardEarliest() {
+	source, _ := r.earliest()
+	queue := r.queues[source]
+	r.outputChan <- queue[0].msg
+	if len(queue) == 1 {
+		delete(r.queues, source)
+	} else {
+		r.queues[source] = queue[1:]
+	}
+	r.size--
+}
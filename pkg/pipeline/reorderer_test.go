@@ -0,0 +1,94 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/clock"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTimestampedMessage(content string, timestamp time.Time, source *config.IntegrationConfigLogSource) message.Message {
+	msg := message.NewCRIMessage([]byte(content), timestamp, "stdout")
+	msgOrigin := message.NewOrigin()
+	msgOrigin.LogSource = source
+	msg.SetOrigin(msgOrigin)
+	return msg
+}
+
+func newTestReorderer(window time.Duration, maxSize int, start time.Time) (*Reorderer, *clock.Mock, chan message.Message, chan message.Message) {
+	inputChan := make(chan message.Message)
+	outputChan := make(chan message.Message, 10)
+	r := NewReorderer(inputChan, outputChan, window, maxSize)
+	mock := clock.NewMock(start)
+	r.clock = mock
+	r.Start()
+	return r, mock, inputChan, outputChan
+}
+
+func TestReordererSortsSourcesByTimestamp(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	r, mock, inputChan, outputChan := newTestReorderer(time.Second, 100, start)
+	defer r.Stop()
+
+	a := &config.IntegrationConfigLogSource{Path: "a.log"}
+	b := &config.IntegrationConfigLogSource{Path: "b.log"}
+	inputChan <- newTimestampedMessage("a1", start.Add(-400*time.Millisecond), a)
+	inputChan <- newTimestampedMessage("a3", start.Add(-200*time.Millisecond), a)
+	inputChan <- newTimestampedMessage("b2", start.Add(-300*time.Millisecond), b)
+	inputChan <- newTimestampedMessage("b4", start.Add(-100*time.Millisecond), b)
+	// the messages are held until the first one has waited for the window
+	mock.BlockUntil(4)
+	assert.Equal(t, 0, len(outputChan))
+
+	mock.Add(time.Second)
+	for _, content := range []string{"a1", "b2", "a3", "b4"} {
+		assert.Equal(t, content, string((<-outputChan).Content()))
+	}
+}
+
+func TestReordererKeepsTheOrderOfASource(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	r, mock, inputChan, outputChan := newTestReorderer(time.Second, 100, start)
+	defer r.Stop()
+
+	// the offsets of a source must be commited in order, whatever the timestamps
+	a := &config.IntegrationConfigLogSource{Path: "a.log"}
+	inputChan <- newTimestampedMessage("late", start.Add(time.Millisecond), a)
+	inputChan <- newTimestampedMessage("early", start, a)
+	mock.BlockUntil(2)
+
+	mock.Add(time.Second)
+	assert.Equal(t, "late", string((<-outputChan).Content()))
+	assert.Equal(t, "early", string((<-outputChan).Content()))
+}
+
+func TestReordererFlushesOldAndOverflowingMessages(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	r, _, inputChan, outputChan := newTestReorderer(time.Second, 2, start)
+
+	// a message older than the window is forwarded right away
+	a := &config.IntegrationConfigLogSource{Path: "a.log"}
+	inputChan <- newTimestampedMessage("old", start.Add(-time.Minute), a)
+	assert.Equal(t, "old", string((<-outputChan).Content()))
+
+	// past maxSize, the earliest message is forwarded
+	b := &config.IntegrationConfigLogSource{Path: "b.log"}
+	inputChan <- newTimestampedMessage("b1", start.Add(2*time.Millisecond), b)
+	inputChan <- newTimestampedMessage("a1", start.Add(time.Millisecond), a)
+	inputChan <- newTimestampedMessage("b2", start.Add(3*time.Millisecond), b)
+	assert.Equal(t, "a1", string((<-outputChan).Content()))
+	assert.Equal(t, 0, len(outputChan))
+
+	// the messages held are forwarded on stop
+	r.Stop()
+	assert.Equal(t, "b1", string((<-outputChan).Content()))
+	assert.Equal(t, "b2", string((<-outputChan).Content()))
+}
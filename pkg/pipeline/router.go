@@ -0,0 +1,53 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// A Router sends the messages of each source to the output named by the output
+// of the source, and the other messages to the primary output.
+// Every output forwards the messages it handled to the auditor, to commit them
+type Router struct {
+	inputChan chan message.Message
+	primary   chan message.Message
+	outputs   map[string]chan message.Message
+}
+
+// NewRouter returns an initialized Router
+func NewRouter(inputChan, primary chan message.Message, outputs map[string]chan message.Message) *Router {
+	return &Router{
+		inputChan: inputChan,
+		primary:   primary,
+		outputs:   outputs,
+	}
+}
+
+// Start starts the Router
+func (r *Router) Start() {
+	go r.run()
+}
+
+// run dispatches the messages of the input channel to their output
+func (r *Router) run() {
+	for msg := range r.inputChan {
+		r.outputOf(msg) <- msg
+	}
+}
+
+// outputOf returns the channel of the output of a message,
+// the primary one when its source doesn't name a known output
+func (r *Router) outputOf(msg message.Message) chan message.Message {
+	origin := msg.GetOrigin()
+	if origin == nil || origin.LogSource == nil || origin.LogSource.Output == "" {
+		return r.primary
+	}
+	if outputChan, ok := r.outputs[origin.LogSource.Output]; ok {
+		return outputChan
+	}
+	return r.primary
+}
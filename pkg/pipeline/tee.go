@@ -0,0 +1,132 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// A TeeOutput is a destination of a Tee
+type TeeOutput struct {
+	OutputChan chan message.Message
+	// MustAck is true when a message can only be commited
+	// once it has been handed to this output
+	MustAck bool
+
+	queue   chan *teeEntry
+	dropped int64
+}
+
+// Dropped returns the number of messages an optional output could not keep up with
+func (o *TeeOutput) Dropped() int64 {
+	return atomic.LoadInt64(&o.dropped)
+}
+
+// trackedMessage is a message waiting to be handed to all the outputs that must ack it
+type trackedMessage struct {
+	msg     message.Message
+	pending int
+}
+
+// teeEntry is the copy of a message for one output
+type teeEntry struct {
+	msg     message.Message
+	tracked *trackedMessage
+}
+
+// A Tee duplicates each message of its input channel to several outputs.
+// Each output has its own queue, so that a slow output doesn't block the others:
+// when the queue of an output that must ack is full, the Tee waits,
+// when the queue of an optional output is full, the message is dropped for this output.
+// Once a message has been handed to all the outputs that must ack it,
+// it is forwarded to the commit channel
+type Tee struct {
+	inputChan  chan message.Message
+	commitChan chan message.Message
+	outputs    []*TeeOutput
+	numMustAck int
+	commitMu   sync.Mutex
+}
+
+// NewTee returns an initialized Tee
+func NewTee(inputChan, commitChan chan message.Message, outputs []*TeeOutput) *Tee {
+	numMustAck := 0
+	for _, output := range outputs {
+		output.queue = make(chan *teeEntry, config.ChanSizes)
+		if output.MustAck {
+			numMustAck++
+		}
+	}
+	return &Tee{
+		inputChan:  inputChan,
+		commitChan: commitChan,
+		outputs:    outputs,
+		numMustAck: numMustAck,
+	}
+}
+
+// Start starts the Tee
+func (t *Tee) Start() {
+	for _, output := range t.outputs {
+		go t.forward(output)
+	}
+	go t.run()
+}
+
+// run duplicates the messages of the input channel to the outputs queues
+func (t *Tee) run() {
+	for msg := range t.inputChan {
+		tracked := &trackedMessage{msg: msg, pending: t.numMustAck}
+		for _, output := range t.outputs {
+			dup := msg.Clone()
+			if origin := dup.GetOrigin(); origin != nil {
+				// the bytes in flight are released once the original is commited
+				origin.InFlightBytes = 0
+			}
+			entry := &teeEntry{msg: dup, tracked: tracked}
+			if output.MustAck {
+				output.queue <- entry
+				continue
+			}
+			select {
+			case output.queue <- entry:
+			default:
+				atomic.AddInt64(&output.dropped, 1)
+			}
+		}
+		if t.numMustAck == 0 {
+			t.commitChan <- msg
+		}
+	}
+	for _, output := range t.outputs {
+		close(output.queue)
+	}
+}
+
+// forward hands the messages queued for an output
+func (t *Tee) forward(output *TeeOutput) {
+	for entry := range output.queue {
+		output.OutputChan <- entry.msg
+		if output.MustAck {
+			t.ack(entry.tracked)
+		}
+	}
+}
+
+// ack notes that a message was handed to an output that must ack it,
+// and commits it if it was the last one
+func (t *Tee) ack(tracked *trackedMessage) {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	tracked.pending--
+	if tracked.pending == 0 {
+		t.commitChan <- tracked.msg
+	}
+}
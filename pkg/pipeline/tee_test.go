@@ -0,0 +1,73 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMessage(offset int64) message.Message {
+	msg := message.NewFileMessage([]byte("hello"))
+	origin := message.NewOrigin()
+	origin.Offset = offset
+	msg.SetOrigin(origin)
+	return msg
+}
+
+func TestTeeSlowOptionalOutputDoesNotBlockPrimary(t *testing.T) {
+	inputChan := make(chan message.Message)
+	commitChan := make(chan message.Message, 10)
+	primary := &TeeOutput{OutputChan: make(chan message.Message, 10), MustAck: true}
+	archive := &TeeOutput{OutputChan: make(chan message.Message), MustAck: false}
+	tee := NewTee(inputChan, commitChan, []*TeeOutput{primary, archive})
+	tee.Start()
+
+	for i := int64(1); i <= 5; i++ {
+		inputChan <- newTestMessage(i)
+	}
+	// the archive never reads, the primary and the commits are not delayed
+	for i := int64(1); i <= 5; i++ {
+		msg := <-primary.OutputChan
+		assert.Equal(t, i, msg.GetOrigin().Offset)
+		assert.Equal(t, i, (<-commitChan).GetOrigin().Offset)
+	}
+
+	// each output gets its own copy
+	msg := <-archive.OutputChan
+	msg.GetOrigin().Offset = 42
+	assert.Equal(t, int64(2), (<-archive.OutputChan).GetOrigin().Offset)
+	close(inputChan)
+}
+
+func TestTeeCommitsOnceAllMustAckOutputsGotMessages(t *testing.T) {
+	inputChan := make(chan message.Message)
+	commitChan := make(chan message.Message, 10)
+	primary := &TeeOutput{OutputChan: make(chan message.Message, 10), MustAck: true}
+	archive := &TeeOutput{OutputChan: make(chan message.Message), MustAck: true}
+	tee := NewTee(inputChan, commitChan, []*TeeOutput{primary, archive})
+	tee.Start()
+
+	for i := int64(1); i <= 3; i++ {
+		inputChan <- newTestMessage(i)
+	}
+	for i := int64(1); i <= 3; i++ {
+		assert.Equal(t, i, (<-primary.OutputChan).GetOrigin().Offset)
+	}
+
+	// the slow archive holds the commits back
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, len(commitChan))
+	for i := int64(1); i <= 3; i++ {
+		assert.Equal(t, i, (<-archive.OutputChan).GetOrigin().Offset)
+		assert.Equal(t, i, (<-commitChan).GetOrigin().Offset)
+	}
+	assert.Equal(t, int64(0), archive.Dropped())
+	close(inputChan)
+}
@@ -0,0 +1,267 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package preflight
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/decoder"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// sampleSize is the number of bytes read at the beginning of a file to decode its first lines
+const sampleSize = 64 * 1024
+
+// decodeTimeout bounds the decoding of the sample of a file
+const decodeTimeout = 5 * time.Second
+
+// A CheckResult is the result of one check of the preflight,
+// Source is the path of the source it checks, empty for the checks of the agent
+type CheckResult struct {
+	Name   string
+	Source string
+	Err    error
+}
+
+// A PreflightReport holds the results of all the checks of the preflight
+type PreflightReport struct {
+	Checks []CheckResult
+}
+
+// OK returns true when all the checks passed
+func (r PreflightReport) OK() bool {
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Failures returns the checks that failed
+func (r PreflightReport) Failures() []CheckResult {
+	failures := []CheckResult{}
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			failures = append(failures, check)
+		}
+	}
+	return failures
+}
+
+func (r PreflightReport) String() string {
+	var b strings.Builder
+	for _, check := range r.Checks {
+		status := "ok  "
+		if check.Err != nil {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s %s", status, check.Name)
+		if check.Source != "" {
+			fmt.Fprintf(&b, " %s", check.Source)
+		}
+		if check.Err != nil {
+			fmt.Fprintf(&b, ": %v", check.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// add records the result of a check
+func (r *PreflightReport) add(name, source string, err error) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Source: source, Err: err})
+}
+
+// Preflight checks that the agent can run with the sources: that run_path is writable,
+// that the registry can be flushed and read again, and for each file or directory source,
+// that its path is accessible, that its rules compile and that its first lines can be decoded.
+// It doesn't change the registry, nor anything in run_path
+func Preflight(sources []*config.IntegrationConfigLogSource) PreflightReport {
+	report := PreflightReport{}
+	report.add("run_path_writable", "", checkWritable(config.LogsAgent.GetString("run_path")))
+	report.add("registry_round_trip", "", checkRegistryRoundTrip())
+	for _, source := range sources {
+		report.add("rules_compile", source.Path, checkRules(source.ProcessingRules))
+		if source.Type != config.FILE_TYPE && source.Type != config.DIRECTORY_TYPE {
+			continue
+		}
+		paths, err := sourcePaths(source)
+		report.add("path_accessible", source.Path, err)
+		if err != nil {
+			continue
+		}
+		report.add("sample_decoded", source.Path, checkSample(source, paths))
+	}
+	return report
+}
+
+// checkWritable creates a file in dir and removes it
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkRegistryRoundTrip flushes a registry in a temporary directory and reads it again
+func checkRegistryRoundTrip() error {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store := auditor.NewFileRegistryStore(filepath.Join(dir, "registry.json"))
+	entry := auditor.RegistryEntry{Offset: 42, LastUpdated: time.Now().UTC(), Kind: auditor.OFFSET_ENTRY}
+	if err := store.Flush(map[string]auditor.RegistryEntry{"preflight": entry}); err != nil {
+		return err
+	}
+	recovered, ok := store.Recover()["preflight"]
+	if !ok || recovered.Offset != entry.Offset {
+		return fmt.Errorf("the registry read again doesn't match the one flushed")
+	}
+	return nil
+}
+
+// checkRules compiles the patterns of the processing rules of a source
+func checkRules(rules []config.LogsProcessingRule) error {
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("the pattern of the rule %s doesn't compile: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// sourcePaths returns the files of a source, it fails when there are none
+// or when the first one can't be opened
+func sourcePaths(source *config.IntegrationConfigLogSource) ([]string, error) {
+	pattern := source.Path
+	if source.Type == config.DIRECTORY_TYPE {
+		pattern = filepath.Join(source.Path, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, match)
+		}
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(source.Path); err != nil && source.Type == config.DIRECTORY_TYPE {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no file matches %s", pattern)
+	}
+	f, err := os.Open(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return paths, nil
+}
+
+// checkSample decodes the first lines of the first file of a source,
+// they must be parsed in the format of the source
+func checkSample(source *config.IntegrationConfigLogSource, paths []string) error {
+	sample, err := readSample(paths[0])
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		// there is nothing to decode yet
+		return nil
+	}
+	d := decoder.InitializedDecoderFromSource(source)
+	d.Start()
+	d.InputChan <- decoder.NewPayload(sample, 0)
+	d.Stop()
+	timeout := time.After(decodeTimeout)
+	for {
+		select {
+		case msg := <-d.OutputChan:
+			if _, ok := msg.(*message.StopMessage); ok {
+				return fmt.Errorf("no line of %s could be decoded", paths[0])
+			}
+			if len(msg.Content()) == 0 {
+				// a header only carries an offset
+				continue
+			}
+			if err := checkFormat(source.Format, msg); err != nil {
+				return fmt.Errorf("the first line of %s %v", paths[0], err)
+			}
+			// the decoder is drained so that it stops
+			go func() {
+				for msg := range d.OutputChan {
+					if _, ok := msg.(*message.StopMessage); ok {
+						return
+					}
+				}
+			}()
+			return nil
+		case <-timeout:
+			return fmt.Errorf("decoding %s took more than %v", paths[0], decodeTimeout)
+		}
+	}
+}
+
+// readSample returns the complete lines at the beginning of a file,
+// or its only line when it is not ended yet
+func readSample(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sample := make([]byte, sampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	sample = sample[:n]
+	if i := bytes.LastIndexByte(sample, '\n'); i >= 0 {
+		return sample[:i+1], nil
+	}
+	if len(sample) > 0 {
+		sample = append(sample, '\n')
+	}
+	return sample, nil
+}
+
+// checkFormat returns an error when a line decoded by the decoder
+// fell back to a raw line instead of being parsed in format
+func checkFormat(format string, msg message.Message) error {
+	var ok bool
+	switch format {
+	case config.JSON_FORMAT:
+		_, ok = msg.(*message.JSONMessage)
+	case config.CSV_FORMAT:
+		_, ok = msg.(*message.CSVMessage)
+	case config.CRI_FORMAT:
+		_, ok = msg.(*message.CRIMessage)
+	default:
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("is not in the %s format", format)
+	}
+	return nil
+}
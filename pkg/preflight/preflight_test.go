@@ -0,0 +1,69 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package preflight
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreflightOfAHealthyConfig(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "preflight")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	config.LogsAgent.Set("run_path", testDir)
+	defer config.LogsAgent.Set("run_path", "")
+	logsDir := filepath.Join(testDir, "logs")
+	assert.Nil(t, os.Mkdir(logsDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(logsDir, "app.log"), []byte("hello\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(logsDir, "app.json"), []byte(`{"message":"hello"}`+"\n"), 0644))
+
+	report := Preflight([]*config.IntegrationConfigLogSource{
+		{Type: config.FILE_TYPE, Path: filepath.Join(logsDir, "*.log"), ProcessingRules: []config.LogsProcessingRule{{Name: "digits", Type: config.MASK_SEQUENCES, Pattern: `\d+`}}},
+		{Type: config.FILE_TYPE, Path: filepath.Join(logsDir, "app.json"), Format: config.JSON_FORMAT},
+		{Type: config.DIRECTORY_TYPE, Path: logsDir},
+		{Type: config.TCP_TYPE, Port: 10514},
+	})
+	assert.True(t, report.OK(), report.String())
+	assert.Equal(t, 12, len(report.Checks))
+
+	// nothing is left in run_path
+	files, err := ioutil.ReadDir(testDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestPreflightReportsFailingChecks(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "preflight")
+	assert.Nil(t, err)
+	defer os.RemoveAll(testDir)
+	config.LogsAgent.Set("run_path", filepath.Join(testDir, "missing"))
+	defer config.LogsAgent.Set("run_path", "")
+	notJSON := filepath.Join(testDir, "app.json")
+	assert.Nil(t, ioutil.WriteFile(notJSON, []byte("hello\n"), 0644))
+
+	report := Preflight([]*config.IntegrationConfigLogSource{
+		{Type: config.FILE_TYPE, Path: filepath.Join(testDir, "missing.log")},
+		{Type: config.FILE_TYPE, Path: notJSON, Format: config.JSON_FORMAT, ProcessingRules: []config.LogsProcessingRule{{Name: "broken", Type: config.EXCLUDE_AT_MATCH, Pattern: "("}}},
+	})
+	assert.False(t, report.OK())
+	failures := map[string]string{}
+	for _, failure := range report.Failures() {
+		failures[failure.Name] = failure.Source
+	}
+	assert.Equal(t, map[string]string{
+		"run_path_writable": "",
+		"path_accessible":   filepath.Join(testDir, "missing.log"),
+		"rules_compile":     notJSON,
+		"sample_decoded":    notJSON,
+	}, failures)
+	assert.Contains(t, report.String(), "FAIL sample_decoded "+notJSON+": the first line of "+notJSON+" is not in the json format")
+}
@@ -0,0 +1,143 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package processor
+
+import (
+	"strings"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// A MessageProcessor updates a message before it is sent,
+// it returns false when the message must be dropped
+type MessageProcessor interface {
+	Process(message.Message) (message.Message, bool)
+}
+
+// MessageProcessorFunc lets a function be used as a MessageProcessor
+type MessageProcessorFunc func(message.Message) (message.Message, bool)
+
+// Process calls f(msg)
+func (f MessageProcessorFunc) Process(msg message.Message) (message.Message, bool) {
+	return f(msg)
+}
+
+// A Chain runs a message through its processors in order,
+// until one of them drops it
+type Chain []MessageProcessor
+
+// Process returns the message updated by all the processors of the chain,
+// or false as soon as one of them drops it
+func (c Chain) Process(msg message.Message) (message.Message, bool) {
+	for _, processor := range c {
+		var keep bool
+		msg, keep = processor.Process(msg)
+		if !keep {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+// buildChain returns the chain of processors declared by source,
+// or the default one when it doesn't declare any.
+// A declared chain always applies the rules of the source
+func (p *Processor) buildChain(source *config.IntegrationConfigLogSource) Chain {
+	if len(source.Processors) == 0 {
+		return Chain{
+			MessageProcessorFunc(p.sample),
+			MessageProcessorFunc(p.deduplicate),
+			p.rulesProcessor(config.EXCLUDE_AT_MATCH, config.MASK_SEQUENCES),
+			MessageProcessorFunc(p.prefix),
+		}
+	}
+	chain := make(Chain, 0, len(source.Processors)+1)
+	// the rules are never skipped, the ones whose processor is not declared
+	// are applied first, so that excluded lines and secrets are not sent
+	if missingRules := missingRuleTypes(source.Processors); len(missingRules) > 0 {
+		chain = append(chain, p.rulesProcessor(missingRules...))
+	}
+	for _, name := range source.Processors {
+		switch name {
+		case config.SCRUB_PROCESSOR:
+			chain = append(chain, p.rulesProcessor(config.MASK_SEQUENCES))
+		case config.FILTER_PROCESSOR:
+			chain = append(chain, p.rulesProcessor(config.EXCLUDE_AT_MATCH))
+		case config.SAMPLE_PROCESSOR:
+			chain = append(chain, MessageProcessorFunc(p.sample))
+		case config.PREFIX_PROCESSOR:
+			chain = append(chain, MessageProcessorFunc(p.prefix))
+		case config.DEDUP_PROCESSOR:
+			chain = append(chain, MessageProcessorFunc(p.deduplicate))
+		}
+	}
+	return chain
+}
+
+// missingRuleTypes returns the types of the rules whose processor is not in processors
+func missingRuleTypes(processors []string) []string {
+	var ruleTypes []string
+	if !hasProcessor(processors, config.FILTER_PROCESSOR) {
+		ruleTypes = append(ruleTypes, config.EXCLUDE_AT_MATCH)
+	}
+	if !hasProcessor(processors, config.SCRUB_PROCESSOR) {
+		ruleTypes = append(ruleTypes, config.MASK_SEQUENCES)
+	}
+	return ruleTypes
+}
+
+// hasProcessor returns true if name is one of processors
+func hasProcessor(processors []string, name string) bool {
+	for _, processor := range processors {
+		if processor == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chainOf returns the chain of processors of source, built the first time
+// a source declares its processors. The processors read the source of each message,
+// so a chain only depends on their names
+func (p *Processor) chainOf(source *config.IntegrationConfigLogSource) Chain {
+	key := strings.Join(source.Processors, ",")
+	chain, ok := p.chains[key]
+	if !ok {
+		chain = p.buildChain(source)
+		p.chains[key] = chain
+	}
+	return chain
+}
+
+// sample drops the messages not sampled given the sampling rate of their source
+func (p *Processor) sample(msg message.Message) (message.Message, bool) {
+	return msg, p.isSampled(msg)
+}
+
+// deduplicate drops the messages seen recently, when deduplication is enabled
+func (p *Processor) deduplicate(msg message.Message) (message.Message, bool) {
+	return msg, !p.isDuplicate(msg)
+}
+
+// prefix prepends the line prefix of their source to the messages
+func (p *Processor) prefix(msg message.Message) (message.Message, bool) {
+	msg.SetContent(p.applyLinePrefix(msg, msg.Content()))
+	return msg, true
+}
+
+// rulesProcessor returns a processor applying the processing rules of the given types,
+// in the order the source declares them
+func (p *Processor) rulesProcessor(ruleTypes ...string) MessageProcessor {
+	return MessageProcessorFunc(func(msg message.Message) (message.Message, bool) {
+		shouldProcess, redactedMessage := p.applyRules(msg, ruleTypes)
+		if !shouldProcess {
+			return msg, false
+		}
+		msg.SetContent(redactedMessage)
+		return msg, true
+	})
+}
@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package processor
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// dedupEntry is a line seen by the deduplicator
+type dedupEntry struct {
+	hash     uint64
+	seenTime time.Time
+}
+
+// A deduplicator suppresses the lines of a source identical to a line
+// seen less than window ago. It remembers at most maxEntries lines,
+// the oldest ones being forgotten first
+type deduplicator struct {
+	window     time.Duration
+	maxEntries int
+	seen       map[uint64]time.Time
+	entries    []dedupEntry
+	hasher     contenthash.Hasher
+	now        func() time.Time
+}
+
+// newDeduplicator returns an initialized deduplicator
+func newDeduplicator(window time.Duration, maxEntries int) *deduplicator {
+	return &deduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		seen:       make(map[uint64]time.Time),
+		hasher:     contenthash.Configured(),
+		now:        time.Now,
+	}
+}
+
+// isDuplicate returns true if the same line from the same origin was seen within the window.
+// A line is remembered from the first time it is seen, so that a line repeated
+// forever is forwarded once per window
+func (d *deduplicator) isDuplicate(msg message.Message) bool {
+	now := d.now()
+	d.expire(now)
+
+	hash := d.hasher.Sum([]byte(msg.GetOrigin().Identifier), []byte{0}, msg.Content())
+
+	if _, ok := d.seen[hash]; ok {
+		return true
+	}
+	d.seen[hash] = now
+	d.entries = append(d.entries, dedupEntry{hash: hash, seenTime: now})
+	if d.maxEntries > 0 && len(d.entries) > d.maxEntries {
+		d.forgetOldest()
+	}
+	return false
+}
+
+// expire forgets the lines seen before the window
+func (d *deduplicator) expire(now time.Time) {
+	for len(d.entries) > 0 && now.Sub(d.entries[0].seenTime) >= d.window {
+		d.forgetOldest()
+	}
+}
+
+// forgetOldest forgets the oldest line seen
+func (d *deduplicator) forgetOldest() {
+	delete(d.seen, d.entries[0].hash)
+	d.entries = d.entries[1:]
+}
@@ -0,0 +1,62 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDedupMessage(identifier, content string) message.Message {
+	msg := newNetworkMessage([]byte(content), &config.IntegrationConfigLogSource{})
+	msg.GetOrigin().Identifier = identifier
+	return msg
+}
+
+func TestDeduplicatorSuppressesWithinWindow(t *testing.T) {
+	now := time.Date(2017, time.January, 12, 1, 1, 1, 0, time.UTC)
+	d := newDeduplicator(10*time.Second, 100)
+	d.now = func() time.Time { return now }
+
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+	assert.True(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "world")))
+	// the same line in another file is not a duplicate
+	assert.False(t, d.isDuplicate(newDedupMessage("file:b", "hello")))
+
+	now = now.Add(9 * time.Second)
+	assert.True(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+}
+
+func TestDeduplicatorForwardsOutsideWindow(t *testing.T) {
+	now := time.Date(2017, time.January, 12, 1, 1, 1, 0, time.UTC)
+	d := newDeduplicator(10*time.Second, 100)
+	d.now = func() time.Time { return now }
+
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+	now = now.Add(5 * time.Second)
+	assert.True(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+	// the window starts when the line was first seen
+	now = now.Add(5 * time.Second)
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "hello")))
+	assert.Equal(t, 1, len(d.entries))
+}
+
+func TestDeduplicatorIsBounded(t *testing.T) {
+	d := newDeduplicator(time.Hour, 2)
+
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "1")))
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "2")))
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "3")))
+	assert.Equal(t, 2, len(d.seen))
+	// the oldest line was forgotten
+	assert.False(t, d.isDuplicate(newDedupMessage("file:a", "1")))
+	assert.True(t, d.isDuplicate(newDedupMessage("file:a", "3")))
+}
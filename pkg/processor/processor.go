@@ -6,11 +6,15 @@
 package processor
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
 )
 
 // A Processor updates messages from an inputChan and pushes
@@ -21,6 +25,14 @@ type Processor struct {
 	apikey       string
 	logset       string
 	apikeyString []byte
+	dedup        *deduplicator
+	// hasher hashes the content of the lines to sample them
+	hasher contenthash.Hasher
+	// runTag is added to the tags of all the messages when tag_agent_run is set
+	runTag string
+	// chains are the chains of processors built so far, by the processors their sources declare,
+	// so that the copies of a source made for each of its files share one chain
+	chains map[string]Chain
 }
 
 // New returns an initialized Processor
@@ -31,12 +43,24 @@ func New(inputChan, outputChan chan message.Message, apikey, logset string) *Pro
 	} else {
 		apikeyString = fmt.Sprintf("%s", apikey)
 	}
+	var dedup *deduplicator
+	if dedupWindow := config.LogsAgent.GetInt("dedup_window"); dedupWindow > 0 {
+		dedup = newDeduplicator(time.Duration(dedupWindow)*time.Second, config.LogsAgent.GetInt("dedup_max_entries"))
+	}
+	var runTag string
+	if config.LogsAgent.GetBool("tag_agent_run") {
+		runTag = "agent_run:" + config.LogsAgent.GetString("agent_run_id")
+	}
 	return &Processor{
 		inputChan:    inputChan,
 		outputChan:   outputChan,
 		apikey:       apikey,
 		logset:       logset,
 		apikeyString: []byte(apikeyString),
+		dedup:        dedup,
+		hasher:       contenthash.Configured(),
+		runTag:       runTag,
+		chains:       make(map[string]Chain),
 	}
 }
 
@@ -48,15 +72,68 @@ func (p *Processor) Start() {
 // run starts the processing of the inputChan
 func (p *Processor) run() {
 	for msg := range p.inputChan {
-		shouldProcess, redactedMessage := p.applyRedactingRules(msg)
-		if shouldProcess {
-			extraContent := p.computeExtraContent(msg)
-			apikeyString := p.computeApiKeyString(msg)
-			payload := p.buildPayload(apikeyString, redactedMessage, extraContent)
-			msg.SetContent(payload)
+		if _, ok := msg.(*message.HeartbeatMessage); ok {
+			// a heartbeat is never sent, it goes as is to the auditor
+			p.outputChan <- msg
+			continue
+		}
+		if len(msg.Content()) == 0 {
+			// the message was dropped upstream, only its offset is left to commit
 			p.outputChan <- msg
+			continue
+		}
+		// the extra content depends on the line as it was read
+		extraContent := p.computeExtraContent(msg)
+		if _, ok := msg.(*message.StatusMessage); !ok {
+			var keep bool
+			msg, keep = p.chainOf(msg.GetOrigin().LogSource).Process(msg)
+			if !keep {
+				// the message is forwarded without content so that
+				// its offset still gets commited after the previous ones
+				msg.SetContent(nil)
+				p.outputChan <- msg
+				continue
+			}
 		}
+		// the offset still refers to the bytes of the file, whatever the processors
+		apikeyString := p.computeApiKeyString(msg)
+		payload := p.buildPayload(apikeyString, msg.Content(), extraContent)
+		msg.SetContent(payload)
+		msg.GetOrigin().HeaderLen = len(apikeyString) + 1 + len(extraContent)
+		p.outputChan <- msg
+	}
+}
+
+// samplingBuckets is the number of buckets the hashes of the lines are spread in to sample them
+const samplingBuckets = 1 << 20
+
+// isSampled returns true if the message should be forwarded given the sampling rate
+// of its source. The content is hashed so that identical lines are sampled consistently
+func (p *Processor) isSampled(msg message.Message) bool {
+	if _, ok := msg.(*message.StatusMessage); ok {
+		return true
+	}
+	samplingRate := msg.GetOrigin().LogSource.SamplingRate
+	if samplingRate == nil || *samplingRate >= 1 {
+		return true
 	}
+	return float64(p.hasher.Sum(msg.Content())%samplingBuckets) < *samplingRate*samplingBuckets
+}
+
+// isDuplicate returns true if deduplication is enabled and
+// the message was recently seen
+func (p *Processor) isDuplicate(msg message.Message) bool {
+	if p.dedup == nil {
+		return false
+	}
+	if _, ok := msg.(*message.StatusMessage); ok {
+		return false
+	}
+	if p.dedup.isDuplicate(msg) {
+		metrics.DedupSuppressed.Add(1)
+		return true
+	}
+	return false
 }
 
 // computeExtraContent returns additional content to add to a log line.
@@ -66,7 +143,7 @@ func (p *Processor) computeExtraContent(msg message.Message) []byte {
 	if len(msg.Content()) > 0 && msg.Content()[0] != '<' {
 		// fit RFC5424
 		// <%pri%>%protocol-version% %timestamp:::date-rfc3339% %HOSTNAME% %$!new-appname% - - - %msg%\n
-		timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000000+00:00")
+		timestamp := p.computeTimestamp(msg).UTC().Format("2006-01-02T15:04:05.000000+00:00")
 		extraContent := []byte("<46>0 ")
 		extraContent = append(extraContent, []byte(timestamp)...)
 		extraContent = append(extraContent, ' ')
@@ -79,13 +156,58 @@ func (p *Processor) computeExtraContent(msg message.Message) []byte {
 			extraContent = append(extraContent, '-')
 		}
 		extraContent = append(extraContent, []byte(" - - ")...)
-		extraContent = append(extraContent, msg.GetOrigin().LogSource.TagsPayload...)
+		extraContent = append(extraContent, p.computeTagsPayload(msg)...)
 		extraContent = append(extraContent, ' ')
 		return extraContent
 	}
 	return nil
 }
 
+// computeTagsPayload returns the structured data to add to a log line,
+// status messages are flagged so that they are not ingested as logs
+func (p *Processor) computeTagsPayload(msg message.Message) []byte {
+	statusMsg, ok := msg.(*message.StatusMessage)
+	if ok {
+		return []byte(fmt.Sprintf("[dd ddstatus=\"%s\"]", statusMsg.Status))
+	}
+	tagsPayload := msg.GetOrigin().LogSource.TagsPayload
+	extraTags := msg.GetOrigin().Tags
+	if criMsg, ok := msg.(*message.CRIMessage); ok && criMsg.Stream != "" {
+		// the stream is added to the tags of the source
+		extraTags = append(append([]string{}, extraTags...), "stream:"+criMsg.Stream)
+	}
+	if p.runTag != "" {
+		extraTags = append(append([]string{}, extraTags...), p.runTag)
+	}
+	if len(extraTags) > 0 {
+		source := msg.GetOrigin().LogSource
+		tags := strings.Join(extraTags, ",")
+		if source.Tags != "" {
+			tags = source.Tags + "," + tags
+		}
+		tagsPayload = config.BuildTagsPayload(tags, source.Source, source.SourceCategory)
+	}
+	if msg.GetOrigin().Replay {
+		// replayed lines are flagged so that they can be deduplicated
+		replayTag := []byte("[dd ddreplay=\"true\"]")
+		if len(tagsPayload) == 1 && tagsPayload[0] == '-' {
+			return replayTag
+		}
+		return append(append([]byte{}, tagsPayload...), replayTag...)
+	}
+	return tagsPayload
+}
+
+// computeTimestamp returns the time of a log line, the time at which
+// the container runtime received it for a cri line, the time read from
+// the timestamp field of a json line, or now
+func (p *Processor) computeTimestamp(msg message.Message) time.Time {
+	if timestamp := message.EventTimestamp(msg); !timestamp.IsZero() {
+		return timestamp
+	}
+	return time.Now()
+}
+
 func (p *Processor) computeApiKeyString(msg message.Message) []byte {
 	sourceLogset := msg.GetOrigin().LogSource.Logset
 	if sourceLogset != "" {
@@ -94,22 +216,55 @@ func (p *Processor) computeApiKeyString(msg message.Message) []byte {
 	return p.apikeyString
 }
 
-// buildPayload returns a processed payload from a raw message
+// buildPayload returns a processed payload from a raw message,
+// ending with the line ending kept by the source or with a `\n`
 func (p *Processor) buildPayload(apikeyString, redactedMessage, extraContent []byte) []byte {
 	payload := append(apikeyString, ' ')
 	if extraContent != nil {
 		payload = append(payload, extraContent...)
 	}
 	payload = append(payload, redactedMessage...)
-	payload = append(payload, '\n')
+	if !bytes.HasSuffix(redactedMessage, []byte{'\n'}) {
+		payload = append(payload, '\n')
+	}
 	return payload
 }
 
+// applyLinePrefix returns the content prepended with the line prefix of its source
+func (p *Processor) applyLinePrefix(msg message.Message, content []byte) []byte {
+	if _, ok := msg.(*message.StatusMessage); ok {
+		return content
+	}
+	source := msg.GetOrigin().LogSource
+	if source.LinePrefix == "" {
+		return content
+	}
+	prefix := strings.NewReplacer(
+		"${hostname}", config.LogsAgent.GetString("hostname"),
+		"${service}", source.Service,
+		"${source}", source.Source,
+		"${path}", source.Path,
+	).Replace(source.LinePrefix)
+	return append([]byte(prefix), content...)
+}
+
 // applyRedactingRules returns given a message if we should process it or not,
 // and a copy of the message with some fields redacted, depending on config
 func (p *Processor) applyRedactingRules(msg message.Message) (bool, []byte) {
+	return p.applyRules(msg, []string{config.EXCLUDE_AT_MATCH, config.MASK_SEQUENCES})
+}
+
+// applyRules is applyRedactingRules restricted to the rules of the given types
+func (p *Processor) applyRules(msg message.Message, ruleTypes []string) (bool, []byte) {
 	content := msg.Content()
+	if _, ok := msg.(*message.StatusMessage); ok {
+		// status messages are generated by the agent, no need to redact them
+		return true, content
+	}
 	for _, rule := range msg.GetOrigin().LogSource.ProcessingRules {
+		if !hasType(rule, ruleTypes) {
+			continue
+		}
 		switch rule.Type {
 		case config.EXCLUDE_AT_MATCH:
 			if rule.Reg.Match(content) {
@@ -121,3 +276,13 @@ func (p *Processor) applyRedactingRules(msg message.Message) (bool, []byte) {
 	}
 	return true, content
 }
+
+// hasType returns true if rule is of one of the types
+func hasType(rule config.LogsProcessingRule, ruleTypes []string) bool {
+	for _, ruleType := range ruleTypes {
+		if rule.Type == ruleType {
+			return true
+		}
+	}
+	return false
+}
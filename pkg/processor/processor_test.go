@@ -6,6 +6,7 @@
 package processor
 
 import (
+	"fmt"
 	"math"
 	"regexp"
 	"strings"
@@ -13,12 +14,14 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/contenthash"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
 func NewTestProcessor() Processor {
-	return Processor{nil, nil, "", "", nil}
+	return Processor{nil, nil, "", "", nil, nil, contenthash.Configured(), "", make(map[string]Chain)}
 }
 
 func buildTestProcessingRule(ruleType, replacePlaceholder, pattern string, p *Processor) config.IntegrationConfigLogSource {
@@ -114,6 +117,14 @@ func TestComputeExtraContent(t *testing.T) {
 	assert.Nil(t, extraContent)
 }
 
+func TestBuildPayloadEndsWithASingleLineEnding(t *testing.T) {
+	p := New(nil, nil, "apikey", "")
+	assert.Equal(t, "apikey - hello\n", string(p.buildPayload([]byte("apikey"), []byte("hello"), []byte("- "))))
+	// the line ending kept by the source is not doubled
+	assert.Equal(t, "apikey - hello\n", string(p.buildPayload([]byte("apikey"), []byte("hello\n"), []byte("- "))))
+	assert.Equal(t, "apikey - hello\r\n", string(p.buildPayload([]byte("apikey"), []byte("hello\r\n"), []byte("- "))))
+}
+
 func TestComputeApiKeyString(t *testing.T) {
 	p := New(nil, nil, "hello", "world")
 
@@ -125,3 +136,285 @@ func TestComputeApiKeyString(t *testing.T) {
 	extraContent = p.computeApiKeyString(newNetworkMessage(nil, source))
 	assert.Equal(t, "hello/hi", string(extraContent))
 }
+
+func TestStatusMessagesAreFlagged(t *testing.T) {
+	p := NewTestProcessor()
+	source := buildTestProcessingRule("exclude_at_match", "", "caught up", &p)
+
+	msg := message.NewStatusMessage(message.CAUGHT_UP_STATUS, []byte("tailer caught up at offset 0"))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.LogSource = &source
+	msg.SetOrigin(msgOrigin)
+
+	shouldProcess, content := p.applyRedactingRules(msg)
+	assert.Equal(t, true, shouldProcess)
+	assert.Equal(t, "tailer caught up at offset 0", string(content))
+	assert.Equal(t, "[dd ddstatus=\"caught_up\"]", string(p.computeTagsPayload(msg)))
+	assert.Equal(t, "-", string(p.computeTagsPayload(newNetworkMessage(nil, &source))))
+}
+
+func TestReplayedMessagesAreFlagged(t *testing.T) {
+	p := NewTestProcessor()
+
+	msg := newNetworkMessage(nil, &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}})
+	msg.GetOrigin().Replay = true
+	assert.Equal(t, "[dd ddreplay=\"true\"]", string(p.computeTagsPayload(msg)))
+
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte("[dd ddsource=\"nginx\"]")}
+	msg = newNetworkMessage(nil, source)
+	msg.GetOrigin().Replay = true
+	assert.Equal(t, "[dd ddsource=\"nginx\"][dd ddreplay=\"true\"]", string(p.computeTagsPayload(msg)))
+	assert.Equal(t, "[dd ddsource=\"nginx\"]", string(source.TagsPayload))
+}
+
+func TestCRIMessagesKeepTheirTimestampAndStream(t *testing.T) {
+	p := NewTestProcessor()
+	source := &config.IntegrationConfigLogSource{Source: "nginx", Tags: "env:prod", TagsPayload: []byte("-")}
+	timestamp := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := message.NewCRIMessage([]byte("message"), timestamp, "stderr")
+	msgOrigin := message.NewOrigin()
+	msgOrigin.LogSource = source
+	msg.SetOrigin(msgOrigin)
+
+	extraContentParts := strings.Split(string(p.computeExtraContent(msg)), " ")
+	assert.Equal(t, "2024-06-01T12:00:00.000000+00:00", extraContentParts[1])
+	assert.Equal(t, "[dd ddsource=\"nginx\"][dd ddtags=\"env:prod,stream:stderr\"]", string(p.computeTagsPayload(msg)))
+}
+
+func TestOriginTagsAreAddedToSourceTags(t *testing.T) {
+	p := NewTestProcessor()
+	source := &config.IntegrationConfigLogSource{Source: "nginx", Tags: "env:prod", TagsPayload: []byte("-")}
+	msg := message.NewFileMessage([]byte("message"))
+	msg.SetOrigin(message.NewOriginBuilder().LogSource(source).Offset(8).Tags("team:web").Build())
+	assert.Equal(t, "[dd ddsource=\"nginx\"][dd ddtags=\"env:prod,team:web\"]", string(p.computeTagsPayload(msg)))
+}
+
+func TestAllMessagesOfARunAreTaggedWithItsIdentifier(t *testing.T) {
+	config.LogsAgent.Set("tag_agent_run", true)
+	config.LogsAgent.Set("agent_run_id", "blue")
+	defer config.LogsAgent.Set("tag_agent_run", false)
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	p := New(inputChan, outputChan, "hello", "")
+	p.Start()
+	defer close(inputChan)
+
+	source := &config.IntegrationConfigLogSource{Source: "nginx", Tags: "env:prod", TagsPayload: []byte("-")}
+	inputChan <- newNetworkMessage([]byte("first"), source)
+	msg := message.NewFileMessage([]byte("second"))
+	msg.SetOrigin(message.NewOriginBuilder().LogSource(source).Tags("team:web").Build())
+	inputChan <- msg
+	for _, tags := range []string{"env:prod,agent_run:blue", "env:prod,team:web,agent_run:blue"} {
+		msg := <-outputChan
+		assert.Contains(t, string(msg.Content()), "[dd ddtags=\""+tags+"\"]")
+	}
+	assert.Equal(t, "-", string(source.TagsPayload))
+}
+
+func TestSampling(t *testing.T) {
+	p := NewTestProcessor()
+	samplingRate := 0.1
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}, SamplingRate: &samplingRate}
+
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if p.isSampled(newNetworkMessage([]byte(fmt.Sprintf("debug line %d", i)), source)) {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 1000, sampled, 150)
+
+	// identical lines are sampled consistently
+	msg := newNetworkMessage([]byte("debug line 42"), source)
+	assert.Equal(t, p.isSampled(msg), p.isSampled(msg))
+
+	// all the lines are dropped with a sampling_rate of 0, and forwarded when it is unset
+	samplingRate = 0
+	assert.False(t, p.isSampled(newNetworkMessage([]byte("debug line 42"), source)))
+	source.SamplingRate = nil
+	assert.True(t, p.isSampled(newNetworkMessage([]byte("debug line 42"), source)))
+}
+
+func TestContentHashChangesTheSampledLinesConsistently(t *testing.T) {
+	defer config.LogsAgent.Set("content_hash", contenthash.FNV)
+	samplingRate := 0.5
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}, SamplingRate: &samplingRate}
+	sampledLines := make(map[string][]bool)
+	for _, name := range []string{contenthash.CRC32, contenthash.FNV, contenthash.SHA256} {
+		config.LogsAgent.Set("content_hash", name)
+		p := New(nil, nil, "", "")
+		d := newDeduplicator(time.Hour, 100)
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			msg := newNetworkMessage([]byte(fmt.Sprintf("debug line %d", i)), source)
+			isSampled := p.isSampled(msg)
+			// identical lines are sampled and deduplicated consistently
+			assert.Equal(t, isSampled, p.isSampled(msg), name)
+			assert.False(t, d.isDuplicate(msg), name)
+			assert.True(t, d.isDuplicate(msg), name)
+			sampledLines[name] = append(sampledLines[name], isSampled)
+			if isSampled {
+				sampled++
+			}
+		}
+		assert.InDelta(t, 500, sampled, 100, name)
+	}
+	assert.NotEqual(t, sampledLines[contenthash.CRC32], sampledLines[contenthash.FNV])
+	assert.NotEqual(t, sampledLines[contenthash.FNV], sampledLines[contenthash.SHA256])
+}
+
+func TestSampledOutMessagesKeepOffsetsAdvancing(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	p := New(inputChan, outputChan, "hello", "")
+	p.Start()
+
+	samplingRate := 0.5
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}, SamplingRate: &samplingRate}
+	for i := 1; i <= 10; i++ {
+		msg := newNetworkMessage([]byte(fmt.Sprintf("debug line %d", i)), source)
+		msg.GetOrigin().Offset = int64(i)
+		inputChan <- msg
+	}
+
+	forwarded := 0
+	for i := 1; i <= 10; i++ {
+		msg := <-outputChan
+		assert.Equal(t, int64(i), msg.GetOrigin().Offset)
+		if len(msg.Content()) > 0 {
+			forwarded++
+		}
+	}
+	assert.True(t, forwarded > 0 && forwarded < 10)
+	close(inputChan)
+}
+
+func TestDuplicatesKeepOffsetsAdvancing(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	p := New(inputChan, outputChan, "hello", "")
+	p.dedup = newDeduplicator(time.Hour, 100)
+	p.Start()
+
+	suppressed := metrics.DedupSuppressed.Value()
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}}
+	for i, content := range []string{"hello", "hello", "world"} {
+		msg := newNetworkMessage([]byte(content), source)
+		msg.GetOrigin().Offset = int64(i)
+		inputChan <- msg
+	}
+	for i, forwarded := range []bool{true, false, true} {
+		msg := <-outputChan
+		assert.Equal(t, int64(i), msg.GetOrigin().Offset)
+		assert.Equal(t, forwarded, len(msg.Content()) > 0)
+	}
+	assert.Equal(t, suppressed+1, metrics.DedupSuppressed.Value())
+	close(inputChan)
+}
+
+func TestLinePrefixKeepsFileOffsets(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	p := New(inputChan, outputChan, "hello", "")
+	p.Start()
+
+	config.LogsAgent.Set("hostname", "web-1")
+	source := &config.IntegrationConfigLogSource{TagsPayload: []byte{'-'}, Service: "billing", LinePrefix: "tenant=acme ${service}@${hostname} "}
+	msg := newNetworkMessage([]byte("<42>payment done"), source)
+	msg.GetOrigin().Offset = 17
+	inputChan <- msg
+
+	msg = <-outputChan
+	assert.Equal(t, "hello tenant=acme billing@web-1 <42>payment done\n", string(msg.Content()))
+	assert.Equal(t, int64(17), msg.GetOrigin().Offset)
+	close(inputChan)
+}
+
+func TestChainRunsProcessorsInOrder(t *testing.T) {
+	p := NewTestProcessor()
+	config.LogsAgent.Set("hostname", "web-1")
+	source := buildTestProcessingRule("mask_sequences", "[host]", "web-[0-9]+", &p)
+	source.LinePrefix = "${hostname} "
+
+	// the prefix is added after the line is scrubbed
+	source.Processors = []string{config.SCRUB_PROCESSOR, config.PREFIX_PROCESSOR}
+	msg, keep := p.buildChain(&source).Process(newNetworkMessage([]byte("request from web-2"), &source))
+	assert.True(t, keep)
+	assert.Equal(t, "web-1 request from [host]", string(msg.Content()))
+
+	// the prefix is scrubbed along with the line
+	source.Processors = []string{config.PREFIX_PROCESSOR, config.SCRUB_PROCESSOR}
+	msg, keep = p.buildChain(&source).Process(newNetworkMessage([]byte("request from web-2"), &source))
+	assert.True(t, keep)
+	assert.Equal(t, "[host] request from [host]", string(msg.Content()))
+}
+
+func TestDeclaredChainAlwaysAppliesTheRules(t *testing.T) {
+	p := NewTestProcessor()
+	config.LogsAgent.Set("hostname", "web-1")
+	source := buildTestProcessingRule("mask_sequences", "[password]", "password=[^ ]+", &p)
+	source.LinePrefix = "${hostname} "
+	source.ProcessingRules = append(source.ProcessingRules, config.LogsProcessingRule{Type: config.EXCLUDE_AT_MATCH, Reg: regexp.MustCompile("debug")})
+
+	// neither scrub nor filter is declared, the rules are still applied
+	source.Processors = []string{config.SAMPLE_PROCESSOR, config.PREFIX_PROCESSOR}
+	msg, keep := p.buildChain(&source).Process(newNetworkMessage([]byte("login password=hunter2"), &source))
+	assert.True(t, keep)
+	assert.Equal(t, "web-1 login [password]", string(msg.Content()))
+	_, keep = p.buildChain(&source).Process(newNetworkMessage([]byte("debug login"), &source))
+	assert.False(t, keep)
+}
+
+func TestChainStopsAtDroppedMessages(t *testing.T) {
+	calls := 0
+	count := MessageProcessorFunc(func(msg message.Message) (message.Message, bool) {
+		calls++
+		return msg, true
+	})
+	drop := MessageProcessorFunc(func(msg message.Message) (message.Message, bool) {
+		return msg, false
+	})
+	source := &config.IntegrationConfigLogSource{}
+	_, keep := Chain{count, drop, count}.Process(newNetworkMessage([]byte("hello"), source))
+	assert.False(t, keep)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCopiesOfASourceShareTheirChain(t *testing.T) {
+	p := NewTestProcessor()
+	source := &config.IntegrationConfigLogSource{Processors: []string{config.SCRUB_PROCESSOR}}
+	p.chainOf(source)
+
+	// each file of a glob is tailed with its own copy of the source
+	for _, path := range []string{"/var/log/a.log", "/var/log/b.log"} {
+		fileSource := *source
+		fileSource.Path = path
+		p.chainOf(&fileSource)
+	}
+	assert.Equal(t, 1, len(p.chains))
+
+	p.chainOf(&config.IntegrationConfigLogSource{Processors: []string{config.FILTER_PROCESSOR}})
+	assert.Equal(t, 2, len(p.chains))
+}
+
+func TestFilteredMessagesKeepOffsetsAdvancing(t *testing.T) {
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	p := New(inputChan, outputChan, "hello", "")
+	p.Start()
+
+	source := buildTestProcessingRule("exclude_at_match", "", "debug", p)
+	source.LinePrefix = "prefix "
+	source.Processors = []string{config.FILTER_PROCESSOR, config.PREFIX_PROCESSOR}
+	for i, content := range []string{"<42>info", "<42>debug", "<42>error"} {
+		msg := newNetworkMessage([]byte(content), &source)
+		msg.GetOrigin().Offset = int64(i)
+		inputChan <- msg
+	}
+	for i, content := range []string{"hello prefix <42>info\n", "", "hello prefix <42>error\n"} {
+		msg := <-outputChan
+		assert.Equal(t, int64(i), msg.GetOrigin().Offset)
+		assert.Equal(t, content, string(msg.Content()))
+	}
+	close(inputChan)
+}
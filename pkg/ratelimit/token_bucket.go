@@ -0,0 +1,56 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// A TokenBucket limits the rate of events: it holds up to burst tokens,
+// refilled at rate tokens per second, and each event consumes some tokens.
+// It can limit lines (one token per line) as well as bytes (one token per byte)
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+// NewTokenBucket returns a full TokenBucket
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	return newTokenBucket(rate, burst, time.Now)
+}
+
+func newTokenBucket(rate, burst float64, now func() time.Time) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now(),
+		now:    now,
+	}
+}
+
+// Allow consumes n tokens and returns true if they are available,
+// otherwise it returns false and consumes nothing
+func (b *TokenBucket) Allow(n float64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
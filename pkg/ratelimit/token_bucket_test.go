@@ -0,0 +1,36 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2017, time.January, 12, 1, 1, 1, 0, time.UTC)
+	b := newTokenBucket(10, 5, func() time.Time { return now })
+
+	// the bucket starts full
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.Allow(1))
+	}
+	assert.False(t, b.Allow(1))
+
+	// it is refilled at rate
+	now = now.Add(200 * time.Millisecond)
+	assert.True(t, b.Allow(1))
+	assert.True(t, b.Allow(1))
+	assert.False(t, b.Allow(1))
+
+	// up to burst
+	now = now.Add(time.Hour)
+	assert.False(t, b.Allow(6))
+	assert.True(t, b.Allow(5))
+	assert.False(t, b.Allow(1))
+}
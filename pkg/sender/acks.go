@@ -0,0 +1,114 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"log"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+// An acknowledger is a destination that confirms the messages it accepted,
+// by sending back their ids, like a file destination with destination_ack_on_sync.
+// A message sent to it is only commited once acknowledged, the messages
+// that never are get read again after a restart
+type acknowledger interface {
+	Acks() <-chan uint64
+	// StopAcks is called once the acknowledgments are no longer read
+	StopAcks()
+}
+
+// acksOf returns the acknowledgments of destination, or nil when it doesn't send any
+func acksOf(destination Destination) <-chan uint64 {
+	if d, ok := destination.(acknowledger); ok {
+		return d.Acks()
+	}
+	return nil
+}
+
+// stopAcks lets the destination know that its acknowledgments are no longer read,
+// once the sender stopped
+func (s *Sender) stopAcks() {
+	if d, ok := s.destination.(acknowledger); ok {
+		d.StopAcks()
+	}
+}
+
+// An unackedMessage is a message sent to the destination, waiting for its
+// acknowledgment or for the ones of the messages sent before it
+type unackedMessage struct {
+	payload message.Message
+	acked   bool
+	// sentAt is when the message was last sent
+	sentAt time.Time
+}
+
+// assignID gives a new id to a message before it is sent, an attempt
+// that failed is never acknowledged
+func (s *Sender) assignID(payload message.Message) {
+	s.lastID++
+	payload.GetOrigin().ID = s.lastID
+}
+
+// commit forwards a message that was sent, or that doesn't need to be, to the auditor.
+// When the destination acknowledges the messages, it waits for its acknowledgment,
+// the offsets are still commited in order
+func (s *Sender) commit(payload message.Message, acked bool) {
+	if s.acks == nil {
+		s.outputChan <- payload
+		return
+	}
+	s.unacked = append(s.unacked, unackedMessage{payload: payload, acked: acked, sentAt: time.Now()})
+	s.commitAcked()
+}
+
+// ack records the acknowledgment of the message with id
+func (s *Sender) ack(id uint64) {
+	for i := range s.unacked {
+		if s.unacked[i].payload.GetOrigin().ID == id {
+			s.unacked[i].acked = true
+			break
+		}
+	}
+	s.commitAcked()
+}
+
+// commitAcked forwards the acknowledged messages that were not sent after an unacknowledged one
+func (s *Sender) commitAcked() {
+	for len(s.unacked) > 0 && s.unacked[0].acked {
+		s.outputChan <- s.unacked[0].payload
+		s.unacked = s.unacked[1:]
+	}
+}
+
+// tooManyUnacked returns true once retry_buffer_size messages wait for their
+// acknowledgment, the destination is then flushed for them to be acknowledged
+func (s *Sender) tooManyUnacked() bool {
+	return s.maxPending > 0 && len(s.unacked) >= s.maxPending
+}
+
+// ackDeadline returns a channel receiving the time once the first message waiting
+// for its acknowledgment has waited for ackTimeout, nil when there is none
+func (s *Sender) ackDeadline() <-chan time.Time {
+	if len(s.unacked) == 0 {
+		return nil
+	}
+	return time.After(time.Until(s.unacked[0].sentAt.Add(s.ackTimeout)))
+}
+
+// resendUnacked sends again the first message waiting for its acknowledgment,
+// it may have been lost. The destination may then get the message twice,
+// but the messages after it can't be commited until it is acknowledged
+func (s *Sender) resendUnacked() {
+	head := &s.unacked[0]
+	log.Println("Sending again a message that was not acknowledged within", s.ackTimeout)
+	err := s.send(head.payload)
+	if err != nil {
+		log.Println("Can't send message again, retrying in", s.ackTimeout, ":", err)
+	}
+	head.sentAt = time.Now()
+}
@@ -0,0 +1,381 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+)
+
+const (
+	INTAKE_DESTINATION = "intake"
+	STDOUT_DESTINATION = "stdout"
+	FILE_DESTINATION   = "file"
+
+	// RAW_FORMAT writes the content of the messages as is
+	RAW_FORMAT = "raw"
+	// JSON_FORMAT writes one JSON object per message and per line
+	JSON_FORMAT = "json"
+)
+
+// A Destination is where the processed messages are sent
+type Destination interface {
+	// Send sends the content of a message, a message is only commited
+	// once Send returned without error, and once it was acknowledged
+	// when the destination sends acknowledgments
+	Send(msg message.Message) error
+	// Flush writes the messages that may be buffered by the destination
+	Flush()
+}
+
+// A compressionSupporter is a destination that can receive compressed payloads
+type compressionSupporter interface {
+	SupportsCompression() bool
+}
+
+// supportsCompression returns true if destination declares that it accepts compressed payloads
+func supportsCompression(destination Destination) bool {
+	d, ok := destination.(compressionSupporter)
+	return ok && d.SupportsCompression()
+}
+
+// A DestinationFactory returns the destination of a new pipeline
+type DestinationFactory func() Destination
+
+// NewDestinationFactory returns a factory for destinationType.
+// Each pipeline gets its own connection to the intake,
+// other destinations are shared by all the pipelines.
+// format only applies to a file destination, that acknowledges
+// the messages of each pipeline once synced with destination_ack_on_sync
+func NewDestinationFactory(destinationType, path, format string, connManager *ConnectionManager) (DestinationFactory, error) {
+	switch destinationType {
+	case "", INTAKE_DESTINATION:
+		return func() Destination {
+			return NewIntakeDestination(connManager)
+		}, nil
+	case STDOUT_DESTINATION:
+		d := newStdoutDestination()
+		return func() Destination {
+			return d
+		}, nil
+	case FILE_DESTINATION:
+		var d *fileDestination
+		var err error
+		if config.LogsAgent.GetBool("destination_compress") {
+			d, err = newGzipFileDestination(path, format, int64(config.LogsAgent.GetInt("destination_max_file_bytes")), config.LogsAgent.GetInt("compression_level"))
+		} else {
+			d, err = newFileDestination(path, format)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if config.LogsAgent.GetBool("destination_ack_on_sync") {
+			return func() Destination {
+				return newSyncAckDestination(d)
+			}, nil
+		}
+		return func() Destination {
+			return d
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown destination: %s", destinationType)
+	}
+}
+
+// IntakeDestination sends messages to datadog's intake,
+// handling connections and retries
+type IntakeDestination struct {
+	connManager *ConnectionManager
+	conn        net.Conn
+}
+
+// NewIntakeDestination returns an initialized IntakeDestination
+func NewIntakeDestination(connManager *ConnectionManager) *IntakeDestination {
+	return &IntakeDestination{
+		connManager: connManager,
+	}
+}
+
+// Send sends a message to the intake, the connection is
+// reset when it fails so that the next attempt uses a new one
+func (d *IntakeDestination) Send(payload message.Message) error {
+	if d.conn == nil {
+		d.conn = d.connManager.NewConnection() // blocks until a new conn is ready
+	}
+	_, err := d.conn.Write(payload.Content())
+	if err != nil {
+		d.connManager.CloseConnection(d.conn)
+		d.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Flush does nothing, messages are written right away
+func (d *IntakeDestination) Flush() {}
+
+// writerDestination writes messages to a writer, it is safe
+// to share it between several pipelines
+type writerDestination struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+// newWriterDestination returns a destination writing to w
+func newWriterDestination(w io.Writer) *writerDestination {
+	return &writerDestination{
+		writer: w,
+	}
+}
+
+// Send writes the content of a message
+func (d *writerDestination) Send(payload message.Message) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.writer.Write(payload.Content())
+	return err
+}
+
+// Flush does nothing, messages are written right away
+func (d *writerDestination) Flush() {}
+
+// stdoutDestination prints messages on the standard output, to test a configuration
+type stdoutDestination struct {
+	*writerDestination
+}
+
+// newStdoutDestination returns an initialized stdoutDestination
+func newStdoutDestination() *stdoutDestination {
+	return &stdoutDestination{newWriterDestination(os.Stdout)}
+}
+
+// A syncWriter is where a file destination writes, a file or a rotatingGzipFile
+type syncWriter interface {
+	io.Writer
+	Sync() error
+}
+
+// fileDestination appends messages to a local file
+type fileDestination struct {
+	*writerDestination
+	file   syncWriter
+	format string
+	// compressed is true when the destination compresses the messages itself
+	compressed bool
+}
+
+// newFileDestination returns a fileDestination appending to path,
+// messages are written as is unless format is JSON_FORMAT
+func newFileDestination(path, format string) (*fileDestination, error) {
+	if err := checkFileFormat(format); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDestination{
+		writerDestination: newWriterDestination(file),
+		file:              file,
+		format:            format,
+	}, nil
+}
+
+// newGzipFileDestination returns a fileDestination compressing the messages
+// in the numbered files path.1.gz, path.2.gz... of maxBytes each
+func newGzipFileDestination(path, format string, maxBytes int64, level int) (*fileDestination, error) {
+	if err := checkFileFormat(format); err != nil {
+		return nil, err
+	}
+	file, err := newRotatingGzipFile(path, maxBytes, level)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDestination{
+		writerDestination: newWriterDestination(file),
+		file:              file,
+		format:            format,
+		compressed:        true,
+	}, nil
+}
+
+// checkFileFormat fails when format is not a format of the file destination
+func checkFileFormat(format string) error {
+	switch format {
+	case "", RAW_FORMAT, JSON_FORMAT:
+		return nil
+	default:
+		return fmt.Errorf("Unknown destination format: %s", format)
+	}
+}
+
+// jsonRecord is a message written by a file destination in JSON_FORMAT
+type jsonRecord struct {
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status,omitempty"`
+	Tags      string `json:"tags,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Offset    int64  `json:"offset"`
+}
+
+// Send writes a message, as a line of JSON in JSON_FORMAT.
+// Each message of a batch gets its own line
+func (d *fileDestination) Send(payload message.Message) error {
+	if d.format != JSON_FORMAT {
+		return d.writerDestination.Send(payload)
+	}
+	messages := []message.Message{payload}
+	if batch, ok := payload.(*message.MessageBatch); ok {
+		messages = batch.Messages()
+	}
+	var lines []byte
+	for _, msg := range messages {
+		line, err := json.Marshal(newJSONRecord(msg))
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.writer.Write(lines)
+	return err
+}
+
+// newJSONRecord returns the record of a message and its origin
+func newJSONRecord(payload message.Message) jsonRecord {
+	content := payload.Content()
+	if origin := payload.GetOrigin(); origin == nil || origin.LogSource == nil || !origin.LogSource.KeepLineEnding {
+		// the line ending is only kept when the source keeps it
+		content = bytes.TrimRight(content, "\n")
+	}
+	record := jsonRecord{
+		Content:   string(content),
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if statusMsg, ok := payload.(*message.StatusMessage); ok {
+		record.Status = statusMsg.Status
+	}
+	if timestamp := message.EventTimestamp(payload); !timestamp.IsZero() {
+		record.Timestamp = timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	if origin := payload.GetOrigin(); origin != nil {
+		if origin.Timestamp != "" {
+			record.Timestamp = origin.Timestamp
+		}
+		if origin.LogSource != nil {
+			record.Tags = origin.LogSource.Tags
+			record.Source = origin.LogSource.Source
+		}
+		record.Offset = origin.Offset
+	}
+	return record
+}
+
+// SupportsCompression returns true, compressed payloads are appended
+// as gzip members that can be read back as a single stream.
+// JSON lines are kept readable, and a destination that compresses
+// the messages itself doesn't compress them twice
+func (d *fileDestination) SupportsCompression() bool {
+	return d.format != JSON_FORMAT && !d.compressed
+}
+
+// Flush commits the content of the file to the disk, along with
+// the messages buffered when the destination compresses them
+func (d *fileDestination) Flush() {
+	err := d.sync()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sync commits the content of the file to the disk
+func (d *fileDestination) sync() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.file.Sync()
+}
+
+// syncAckDestination is the destination of a pipeline writing to a file destination,
+// it acknowledges the messages it wrote once the file is synced to the disk,
+// so that no offset is commited for lines that could be lost on a crash
+type syncAckDestination struct {
+	*fileDestination
+	// unsynced are the ids of the messages written since the last sync
+	unsynced []uint64
+	acks     chan uint64
+	// done is closed once the acknowledgments are no longer read
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// newSyncAckDestination returns a syncAckDestination writing to d
+func newSyncAckDestination(d *fileDestination) *syncAckDestination {
+	return &syncAckDestination{
+		fileDestination: d,
+		acks:            make(chan uint64),
+		done:            make(chan struct{}),
+	}
+}
+
+// Send writes a message, it is acknowledged on the next Flush
+func (d *syncAckDestination) Send(payload message.Message) error {
+	err := d.fileDestination.Send(payload)
+	if err != nil {
+		return err
+	}
+	d.unsynced = append(d.unsynced, payload.GetOrigin().ID)
+	return nil
+}
+
+// Flush syncs the file and acknowledges the messages written before.
+// They are acknowledged from another goroutine, as the sender flushing
+// the destination is the one reading the acknowledgments, until it stopped
+func (d *syncAckDestination) Flush() {
+	err := d.sync()
+	if err != nil {
+		log.Println("Can't sync destination file, its messages are acknowledged on the next sync:", err)
+		return
+	}
+	if len(d.unsynced) == 0 {
+		return
+	}
+	ids := d.unsynced
+	d.unsynced = nil
+	go func() {
+		for _, id := range ids {
+			select {
+			case d.acks <- id:
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+// Acks returns the ids of the messages synced to the disk
+func (d *syncAckDestination) Acks() <-chan uint64 {
+	return d.acks
+}
+
+// StopAcks drops the acknowledgments not read yet, the offsets of their messages
+// are not commited and they are read again on the next start
+func (d *syncAckDestination) StopAcks() {
+	d.doneOnce.Do(func() {
+		close(d.done)
+	})
+}
@@ -0,0 +1,294 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMessage(content string, offset int64) message.Message {
+	msg := message.NewFileMessage([]byte(content))
+	msgOrigin := message.NewOrigin()
+	msgOrigin.Identifier = "file:test.log"
+	msgOrigin.Offset = offset
+	msg.SetOrigin(msgOrigin)
+	return msg
+}
+
+func TestSenderForwardsSentMessages(t *testing.T) {
+	var buf bytes.Buffer
+	d := &stdoutDestination{newWriterDestination(&buf)}
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	s := New(inputChan, outputChan, d)
+	s.Start()
+
+	inputChan <- newTestMessage("hello\n", 6)
+	inputChan <- newTestMessage("", 12)
+	inputChan <- newTestMessage("world\n", 18)
+	for _, offset := range []int64{6, 12, 18} {
+		msg := <-outputChan
+		assert.Equal(t, offset, msg.GetOrigin().Offset)
+	}
+	close(inputChan)
+	assert.Equal(t, "hello\nworld\n", buf.String())
+}
+
+func TestFileDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	newDestination, err := NewDestinationFactory(FILE_DESTINATION, path, "", nil)
+	assert.Nil(t, err)
+	// all the pipelines share the file
+	assert.Equal(t, newDestination(), newDestination())
+
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	New(inputChan, outputChan, newDestination()).Start()
+	for i := 0; i < 3; i++ {
+		inputChan <- newTestMessage(fmt.Sprintf("line %d\n", i), int64(i))
+	}
+	for i := 0; i < 3; i++ {
+		<-outputChan
+	}
+	close(inputChan)
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "line 0\nline 1\nline 2\n", string(content))
+}
+
+func TestFileDestinationAcknowledgesSyncedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	config.LogsAgent.Set("destination_ack_on_sync", true)
+	defer config.LogsAgent.Set("destination_ack_on_sync", false)
+
+	newDestination, err := NewDestinationFactory(FILE_DESTINATION, path, "", nil)
+	assert.Nil(t, err)
+	// each pipeline gets its own acknowledgments
+	d := newDestination()
+	assert.IsType(t, &syncAckDestination{}, d)
+	assert.NotEqual(t, acksOf(d), acksOf(newDestination()))
+
+	// the messages are only acknowledged once synced
+	msg := newTestMessage("hello\n", 6)
+	msg.GetOrigin().ID = 1
+	assert.Nil(t, d.Send(msg))
+	select {
+	case <-acksOf(d):
+		assert.Fail(t, "the message was acknowledged before it was synced")
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.Flush()
+	assert.Equal(t, uint64(1), <-acksOf(d))
+
+	// through a sender, the offsets are commited once synced
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	New(inputChan, outputChan, d).Start()
+	defer close(inputChan)
+	inputChan <- newTestMessage("world\n", 12)
+	assert.Equal(t, int64(12), (<-outputChan).GetOrigin().Offset)
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nworld\n", string(content))
+}
+
+func TestFileDestinationDropsTheAcknowledgmentsOnceTheSenderStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	d, err := newFileDestination(filepath.Join(dir, "out.log"), RAW_FORMAT)
+	assert.Nil(t, err)
+	ackDestination := newSyncAckDestination(d)
+
+	inputChan := make(chan message.Message, 10)
+	s := New(inputChan, make(chan message.Message, 10), ackDestination)
+	s.Start()
+	s.Stop()
+
+	// nothing reads the acknowledgments anymore, flushing doesn't leave a goroutine blocked
+	msg := newTestMessage("hello\n", 6)
+	msg.GetOrigin().ID = 1
+	assert.Nil(t, ackDestination.Send(msg))
+	ackDestination.Flush()
+	assert.Eventually(t, func() bool {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		return !bytes.Contains(stacks, []byte("(*syncAckDestination).Flush.func"))
+	}, time.Second, time.Millisecond)
+}
+
+func TestDestinationFactory(t *testing.T) {
+	newDestination, err := NewDestinationFactory("", "", "", nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &IntakeDestination{}, newDestination())
+
+	newDestination, err = NewDestinationFactory(STDOUT_DESTINATION, "", "", nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &stdoutDestination{}, newDestination())
+
+	_, err = NewDestinationFactory("kafka", "", "", nil)
+	assert.NotNil(t, err)
+	_, err = NewDestinationFactory(FILE_DESTINATION, "/does/not/exist/out.log", "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestFileDestinationReceivesCompressedBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	d, err := newFileDestination(path, RAW_FORMAT)
+	assert.Nil(t, err)
+	assert.True(t, supportsCompression(d))
+	assert.False(t, supportsCompression(newStdoutDestination()))
+
+	inputChan := make(chan message.Message, 10)
+	outputChan := make(chan message.Message, 10)
+	s := New(inputChan, outputChan, d)
+	s.useCompression = true
+	s.compressionLevel = gzip.BestCompression
+	s.Start()
+
+	batches := []*message.MessageBatch{
+		message.NewMessageBatch([]message.Message{newTestMessage("line 0\n", 7), newTestMessage("line 1\n", 14)}),
+		message.NewMessageBatch([]message.Message{newTestMessage("line 2\n", 21)}),
+	}
+	for _, batch := range batches {
+		inputChan <- batch
+	}
+	// offsets are the ones of the uncompressed lines
+	for _, offset := range []int64{14, 21} {
+		msg := <-outputChan
+		assert.Equal(t, offset, msg.GetOrigin().Offset)
+	}
+	close(inputChan)
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "line 0\nline 1\nline 2\n", string(content))
+}
+
+func TestFileDestinationWritesJSONLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.jsonl")
+
+	newDestination, err := NewDestinationFactory(FILE_DESTINATION, path, JSON_FORMAT, nil)
+	assert.Nil(t, err)
+	d := newDestination()
+	assert.False(t, supportsCompression(d))
+
+	source := &config.IntegrationConfigLogSource{Source: "nginx", Tags: "env:prod"}
+	msg := newTestMessage("hello\n", 6)
+	msg.GetOrigin().LogSource = source
+	status := message.NewStatusMessage(message.CAUGHT_UP_STATUS, []byte("tailer caught up at offset 6"))
+	status.SetOrigin(message.NewOrigin())
+	status.GetOrigin().LogSource = source
+	batch := message.NewMessageBatch([]message.Message{newTestMessage("a\n", 8), newTestMessage("b\n", 10)})
+	kept := newTestMessage("windows\r\n", 19)
+	kept.GetOrigin().LogSource = &config.IntegrationConfigLogSource{KeepLineEnding: true}
+	for _, m := range []message.Message{msg, status, batch, kept} {
+		assert.Nil(t, d.Send(m))
+	}
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := bytes.Split(bytes.TrimRight(content, "\n"), []byte("\n"))
+	assert.Equal(t, 5, len(lines))
+	records := make([]jsonRecord, len(lines))
+	for i, line := range lines {
+		assert.Nil(t, json.Unmarshal(line, &records[i]))
+		assert.NotEqual(t, "", records[i].Timestamp)
+	}
+	assert.Equal(t, "hello", records[0].Content)
+	assert.Equal(t, "nginx", records[0].Source)
+	assert.Equal(t, "env:prod", records[0].Tags)
+	assert.Equal(t, int64(6), records[0].Offset)
+	assert.Equal(t, message.CAUGHT_UP_STATUS, records[1].Status)
+	assert.Equal(t, "a", records[2].Content)
+	assert.Equal(t, int64(10), records[3].Offset)
+	assert.Equal(t, "windows\r\n", records[4].Content)
+
+	_, err = NewDestinationFactory(FILE_DESTINATION, path, "xml", nil)
+	assert.NotNil(t, err)
+}
+
+func TestGzipFileDestinationRotatesCompressedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	d, err := newGzipFileDestination(path, RAW_FORMAT, 4096, gzip.DefaultCompression)
+	assert.Nil(t, err)
+	// payloads are not compressed twice
+	assert.False(t, supportsCompression(d))
+
+	var forwarded bytes.Buffer
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 2000; i++ {
+		line := fmt.Sprintf("line %d %x\n", i, r.Int63())
+		forwarded.WriteString(line)
+		assert.Nil(t, d.Send(newTestMessage(line, int64(forwarded.Len()))))
+		if i%500 == 0 {
+			// each flush ends a gzip member
+			d.Flush()
+		}
+	}
+	d.Flush()
+
+	files, err := filepath.Glob(path + ".*.gz")
+	assert.Nil(t, err)
+	assert.True(t, len(files) > 1)
+	var content bytes.Buffer
+	for seq := 1; seq <= len(files); seq++ {
+		f, err := os.Open(fmt.Sprintf("%s.%d.gz", path, seq))
+		assert.Nil(t, err)
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		_, err = content.ReadFrom(gz)
+		assert.Nil(t, err)
+		f.Close()
+	}
+	assert.Equal(t, forwarded.String(), content.String())
+
+	// a new destination doesn't overwrite the files already written
+	d, err = newGzipFileDestination(path, RAW_FORMAT, 4096, gzip.DefaultCompression)
+	assert.Nil(t, err)
+	assert.Nil(t, d.Send(newTestMessage("again\n", 6)))
+	d.Flush()
+	_, err = os.Stat(fmt.Sprintf("%s.%d.gz", path, len(files)+1))
+	assert.Nil(t, err)
+}
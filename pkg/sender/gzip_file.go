@@ -0,0 +1,135 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxFileBytes is the size of the files of a compressing file destination
+const defaultMaxFileBytes = 100 * 1024 * 1024
+
+// A rotatingGzipFile compresses what is written to it in numbered files,
+// path.1.gz, path.2.gz... A new file is started once the current one reaches
+// maxBytes. Each Sync ends a gzip member, the members of a file are read back
+// as a single stream, so that nothing written before is lost if the agent stops
+type rotatingGzipFile struct {
+	path     string
+	maxBytes int64
+	level    int
+	seq      int
+	file     *os.File
+	// written is the number of compressed bytes written in file
+	written int64
+	gz      *gzip.Writer
+}
+
+// newRotatingGzipFile returns a rotatingGzipFile writing the files after the ones
+// already written at path, compressed with level
+func newRotatingGzipFile(path string, maxBytes int64, level int) (*rotatingGzipFile, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxFileBytes
+	}
+	f := &rotatingGzipFile{path: path, maxBytes: maxBytes, level: level, seq: lastGzipSeq(path)}
+	if err := f.openNext(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// lastGzipSeq returns the number of the last file written at path, 0 when there is none
+func lastGzipSeq(path string) int {
+	matches, _ := filepath.Glob(path + ".*.gz")
+	last := 0
+	for _, match := range matches {
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz"))
+		if err == nil && seq > last {
+			last = seq
+		}
+	}
+	return last
+}
+
+// fileName returns the name of the file number seq
+func (f *rotatingGzipFile) fileName(seq int) string {
+	return fmt.Sprintf("%s.%d.gz", f.path, seq)
+}
+
+// openNext opens the next file in the sequence
+func (f *rotatingGzipFile) openNext() error {
+	file, err := os.OpenFile(f.fileName(f.seq+1), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.seq++
+	f.file = file
+	f.written = 0
+	return nil
+}
+
+// Write compresses p, and starts a new file once the current one is full
+func (f *rotatingGzipFile) Write(p []byte) (int, error) {
+	if f.gz == nil {
+		gz, err := gzip.NewWriterLevel(&countingWriter{f}, f.level)
+		if err != nil {
+			return 0, err
+		}
+		f.gz = gz
+	}
+	n, err := f.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if f.written >= f.maxBytes {
+		err = f.rotate()
+	}
+	return n, err
+}
+
+// Sync ends the current gzip member and commits the file to the disk
+func (f *rotatingGzipFile) Sync() error {
+	if err := f.endMember(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// endMember writes what is buffered by the gzip writer and the end of the member
+func (f *rotatingGzipFile) endMember() error {
+	if f.gz == nil {
+		return nil
+	}
+	err := f.gz.Close()
+	f.gz = nil
+	return err
+}
+
+// rotate closes the current file and opens the next one
+func (f *rotatingGzipFile) rotate() error {
+	if err := f.endMember(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return f.openNext()
+}
+
+// countingWriter writes to the file of a rotatingGzipFile, counting the bytes written
+type countingWriter struct {
+	f *rotatingGzipFile
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.f.file.Write(p)
+	w.f.written += int64(n)
+	return n, err
+}
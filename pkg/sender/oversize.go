@@ -0,0 +1,123 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+const (
+	// TRUNCATE_OVERSIZE cuts the messages over max_payload_size
+	TRUNCATE_OVERSIZE = "truncate"
+	// SPLIT_OVERSIZE sends the messages over max_payload_size in several parts
+	SPLIT_OVERSIZE = "split"
+	// DROP_OVERSIZE discards the messages over max_payload_size
+	DROP_OVERSIZE = "drop"
+)
+
+// oversizeTruncatedMarker ends the content of a truncated message
+var oversizeTruncatedMarker = []byte("...TRUNCATED...")
+
+// isOversize returns true when the line of a payload, without its newline, is over
+// maxPayloadSize. Batches are bounded by batch_max_size, they are sent as they are
+func (s *Sender) isOversize(payload message.Message) bool {
+	if _, ok := payload.(*message.MessageBatch); ok || s.maxPayloadSize <= 0 {
+		return false
+	}
+	line := bytes.TrimSuffix(payload.Content()[headerLen(payload):], []byte{'\n'})
+	return len(line) > s.maxPayloadSize
+}
+
+// headerLen returns the length of the api key and of the header
+// put before the line of a payload by the processor
+func headerLen(payload message.Message) int {
+	origin := payload.GetOrigin()
+	if origin == nil || origin.HeaderLen > len(payload.Content()) {
+		return 0
+	}
+	return origin.HeaderLen
+}
+
+// dropsOversize returns true when a payload is over maxPayloadSize and the
+// oversize_policy drops it, its offset is commited without sending it
+func (s *Sender) dropsOversize(payload message.Message) bool {
+	if s.oversizePolicy != DROP_OVERSIZE || !s.isOversize(payload) {
+		return false
+	}
+	metrics.OversizeDropped.Add(1)
+	return true
+}
+
+// fitPayload returns the messages to send for a payload so that none of their lines is
+// over maxPayloadSize: the payload itself when it fits, and otherwise, depending on
+// the oversize_policy, the payload truncated or its parts. Each part keeps the api key
+// and the header of the payload. The parts are copies of the payload, its offset is
+// commited once they are all sent
+func (s *Sender) fitPayload(payload message.Message) []message.Message {
+	if !s.isOversize(payload) {
+		return []message.Message{payload}
+	}
+	content := payload.Content()
+	header := content[:headerLen(payload)]
+	line := content[len(header):]
+	// the newline ending the payload ends each of its parts
+	body := bytes.TrimSuffix(line, []byte{'\n'})
+	end := line[len(body):]
+	var contents [][]byte
+	if s.oversizePolicy == SPLIT_OVERSIZE {
+		contents = splitContent(body, end, s.maxPayloadSize)
+	}
+	if contents == nil {
+		contents = [][]byte{truncateContent(body, end, s.maxPayloadSize)}
+	}
+	messages := make([]message.Message, len(contents))
+	for i, c := range contents {
+		messages[i] = payload.Clone()
+		messages[i].SetContent(append(append([]byte{}, header...), c...))
+	}
+	return messages
+}
+
+// truncateContent cuts body so that it fits in maxSize along with the marker and end
+func truncateContent(body, end []byte, maxSize int) []byte {
+	n := maxSize - len(oversizeTruncatedMarker) - len(end)
+	if n < 0 {
+		n = 0
+	}
+	if n > len(body) {
+		n = len(body)
+	}
+	truncated := append([]byte{}, body[:n]...)
+	truncated = append(truncated, oversizeTruncatedMarker...)
+	return append(truncated, end...)
+}
+
+// splitContent splits body into parts that fit in maxSize, each ends with
+// its number out of the number of parts, like [part 1/3], and with end.
+// It returns nil when maxSize is too small to hold a part marker
+func splitContent(body, end []byte, maxSize int) [][]byte {
+	// the marker of a part can't be longer than the one of a part per byte
+	partSize := maxSize - len(fmt.Sprintf(" [part %d/%d]", len(body), len(body))) - len(end)
+	if partSize <= 0 {
+		return nil
+	}
+	n := (len(body) + partSize - 1) / partSize
+	parts := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		start, stop := i*partSize, (i+1)*partSize
+		if stop > len(body) {
+			stop = len(body)
+		}
+		part := append([]byte{}, body[start:stop]...)
+		part = append(part, fmt.Sprintf(" [part %d/%d]", i+1, n)...)
+		parts = append(parts, append(part, end...))
+	}
+	return parts
+}
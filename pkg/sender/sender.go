@@ -6,26 +6,121 @@
 package sender
 
 import (
-	"net"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/DataDog/datadog-log-agent/pkg/config"
 	"github.com/DataDog/datadog-log-agent/pkg/message"
 )
 
-// A Sender sends messages from an inputChan to datadog's intake,
-// handling connections and retries
+const defaultMinBackoff = 1 * time.Second
+const defaultMaxBackoff = 30 * time.Second
+const defaultDrainTimeout = 5 * time.Second
+const defaultAckTimeout = 30 * time.Second
+
+// A Sender sends messages from an inputChan to a destination,
+// and forwards the messages successfully sent to an outputChan.
+// Messages that can't be sent are kept in a bounded buffer and retried
+// with an exponential backoff. Until they are sent, or acknowledged by a destination
+// that acknowledges the messages it accepted, no offset is commited,
+// so that they are read again after a restart. When the buffer overflows,
+// its oldest messages are written to a dead letter file. A message that is
+// not acknowledged within ack_timeout is sent again
 type Sender struct {
 	inputChan   chan message.Message
 	outputChan  chan message.Message
-	connManager *ConnectionManager
-	conn        net.Conn
+	destination Destination
+
+	pending        []message.Message
+	maxPending     int
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	backoff        time.Duration
+	retryAt        time.Time
+	deadLetterPath string
+	deadLetter     Destination
+
+	// maxPayloadSize is the size of the largest line the destination accepts,
+	// oversizePolicy tells what to do with the larger ones
+	maxPayloadSize int
+	oversizePolicy string
+	// partsSent is the number of parts of the partial message that were sent
+	// before one of them failed, they are not sent again when it is retried
+	partial   message.Message
+	partsSent int
+
+	// payloads are compressed when the destination supports it
+	useCompression   bool
+	compressionLevel int
+
+	// acks are the ids of the messages accepted by the destination,
+	// nil when it doesn't acknowledge them
+	acks       <-chan uint64
+	lastID     uint64
+	unacked    []unackedMessage
+	ackTimeout time.Duration
+
+	// on stop, the messages already received are sent and acknowledged until drainTimeout
+	drainTimeout time.Duration
+	stop         chan struct{}
+	stopped      chan struct{}
+	stopOnce     sync.Once
 }
 
 // New returns an initialized Sender
-func New(inputChan, outputChan chan message.Message, connManager *ConnectionManager) *Sender {
+func New(inputChan, outputChan chan message.Message, destination Destination) *Sender {
+	minBackoff := time.Duration(config.LogsAgent.GetInt("retry_min_backoff")) * time.Millisecond
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	maxBackoff := time.Duration(config.LogsAgent.GetInt("retry_max_backoff")) * time.Millisecond
+	if maxBackoff < minBackoff {
+		maxBackoff = defaultMaxBackoff
+	}
+	maxPayloadSize := config.LogsAgent.GetInt("max_payload_size")
+	if maxPayloadSize <= 0 {
+		maxPayloadSize = config.MaxMessageLen
+	}
+	oversizePolicy := config.LogsAgent.GetString("oversize_policy")
+	if oversizePolicy == "" {
+		oversizePolicy = TRUNCATE_OVERSIZE
+	}
+	drainTimeout := time.Duration(config.LogsAgent.GetInt("shutdown_drain_timeout")) * time.Millisecond
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	ackTimeout := time.Duration(config.LogsAgent.GetInt("ack_timeout")) * time.Millisecond
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckTimeout
+	}
+	deadLetterPath := config.LogsAgent.GetString("dead_letter_path")
+	if deadLetterPath == "" {
+		deadLetterPath = filepath.Join(config.LogsAgent.GetString("run_path"), "dead_letter.log")
+	}
 	return &Sender{
 		inputChan:   inputChan,
 		outputChan:  outputChan,
-		connManager: connManager,
+		destination: destination,
+
+		maxPending:     config.LogsAgent.GetInt("retry_buffer_size"),
+		minBackoff:     minBackoff,
+		maxBackoff:     maxBackoff,
+		deadLetterPath: deadLetterPath,
+
+		maxPayloadSize: maxPayloadSize,
+		oversizePolicy: oversizePolicy,
+
+		useCompression:   config.LogsAgent.GetBool("use_compression") && supportsCompression(destination),
+		compressionLevel: config.LogsAgent.GetInt("compression_level"),
+
+		acks:       acksOf(destination),
+		ackTimeout: ackTimeout,
+
+		drainTimeout: drainTimeout,
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 }
 
@@ -34,27 +129,248 @@ func (s *Sender) Start() {
 	go s.run()
 }
 
-// run lets the sender wire messages
+// Stop stops the Sender once it drained the messages it already received,
+// or once shutdown_drain_timeout is over. The offsets of the messages left
+// unacknowledged are not commited, they are read again on the next start.
+// The Sender must be started, it is safe to call Stop several times
+func (s *Sender) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+}
+
+// run lets the sender wire messages, the destination is flushed
+// when there is no more message waiting
 func (s *Sender) run() {
-	for payload := range s.inputChan {
-		s.wireMessage(payload)
+	defer close(s.stopped)
+	defer s.stopAcks()
+	for {
+		if len(s.pending) == 0 {
+			select {
+			case payload, ok := <-s.inputChan:
+				if !ok {
+					s.destination.Flush()
+					return
+				}
+				s.wireMessage(payload)
+			case id := <-s.acks:
+				s.ack(id)
+			case <-s.ackDeadline():
+				s.resendUnacked()
+			case <-s.stop:
+				s.drain()
+				return
+			}
+		} else {
+			select {
+			case payload, ok := <-s.inputChan:
+				if !ok {
+					s.retryPending()
+					s.deadLetterPending()
+					s.destination.Flush()
+					return
+				}
+				s.bufferMessage(payload)
+			case id := <-s.acks:
+				s.ack(id)
+			case <-s.ackDeadline():
+				s.resendUnacked()
+			case <-time.After(time.Until(s.retryAt)):
+				s.retryPending()
+			case <-s.stop:
+				s.drain()
+				return
+			}
+		}
+		if len(s.inputChan) == 0 || s.tooManyUnacked() {
+			s.destination.Flush()
+		}
 	}
 }
 
-// wireMessage lets the Sender send a message to datadog's intake
+// drain sends the messages already received and waits for their acknowledgments,
+// until there is none left or until the drain deadline
+func (s *Sender) drain() {
+	deadline := time.After(s.drainTimeout)
+	inputChan := s.inputChan
+	for len(inputChan) > 0 || len(s.pending) > 0 || len(s.unacked) > 0 {
+		var retry <-chan time.Time
+		if len(s.pending) > 0 {
+			retry = time.After(time.Until(s.retryAt))
+		}
+		select {
+		case payload, ok := <-inputChan:
+			if !ok {
+				inputChan = nil
+			} else if len(s.pending) == 0 {
+				s.wireMessage(payload)
+			} else {
+				s.bufferMessage(payload)
+			}
+		case id := <-s.acks:
+			s.ack(id)
+		case <-retry:
+			s.retryPending()
+		case <-deadline:
+			left := len(inputChan) + len(s.pending) + len(s.unacked)
+			log.Println("Stopping sender with", left, "messages left unacked, they will be read again on the next start")
+			s.destination.Flush()
+			return
+		}
+		if len(inputChan) == 0 {
+			s.destination.Flush()
+		}
+	}
+	s.destination.Flush()
+}
+
+// wireMessage lets the Sender send a message to its destination
 func (s *Sender) wireMessage(payload message.Message) {
-	for {
-		if s.conn == nil {
-			s.conn = s.connManager.NewConnection() // blocks until a new conn is ready
+	if isHeartbeat(payload) || len(payload.Content()) == 0 || s.dropsOversize(payload) {
+		// nothing to send, the message only carries an offset to commit or a heartbeat
+		s.commit(payload, true)
+		return
+	}
+	err := s.send(payload)
+	if err != nil {
+		log.Println("Can't send message, retrying in", s.nextBackoff(), ":", err)
+		s.bufferMessage(payload)
+		return
+	}
+	s.commit(payload, false)
+}
+
+// send sends a message to the destination, compressed if needed,
+// and truncated or split when it is over max_payload_size.
+// The original message is kept as it is, to commit its offset.
+// When a part of a split message fails, the parts sent before it are
+// not sent again when the message is retried
+func (s *Sender) send(payload message.Message) error {
+	if s.acks != nil {
+		s.assignID(payload)
+	}
+	parts := s.fitPayload(payload)
+	start := 0
+	if s.partial == payload {
+		start = s.partsSent
+	}
+	for i := start; i < len(parts); i++ {
+		if err := s.sendFitted(parts[i]); err != nil {
+			s.partial, s.partsSent = payload, i
+			return err
 		}
-		_, err := s.conn.Write(payload.Content())
-		if err != nil {
-			s.connManager.CloseConnection(s.conn)
-			s.conn = nil
-			continue
+	}
+	s.partial, s.partsSent = nil, 0
+	return nil
+}
+
+// sendFitted sends a message that fits in max_payload_size to the destination
+func (s *Sender) sendFitted(payload message.Message) error {
+	if !s.useCompression {
+		return s.destination.Send(payload)
+	}
+	content, err := compress(payload.Content(), s.compressionLevel)
+	if err != nil {
+		return err
+	}
+	compressed := message.NewMessage(content)
+	compressed.SetOrigin(payload.GetOrigin())
+	return s.destination.Send(compressed)
+}
+
+// bufferMessage keeps a message until the pending ones are sent,
+// to commit offsets in order
+func (s *Sender) bufferMessage(payload message.Message) {
+	if isHeartbeat(payload) {
+		// a heartbeat is not sent, it doesn't wait for the pending messages
+		s.commit(payload, true)
+		return
+	}
+	if s.maxPending > 0 && len(s.pending) >= s.maxPending {
+		s.writeDeadLetter(s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, payload)
+}
+
+// isHeartbeat returns true for the heartbeats of the sources,
+// they are never sent to the destination, only handed to the auditor
+func isHeartbeat(payload message.Message) bool {
+	_, ok := payload.(*message.HeartbeatMessage)
+	return ok
+}
+
+// retryPending sends the pending messages in order, until one fails
+func (s *Sender) retryPending() {
+	for len(s.pending) > 0 {
+		payload := s.pending[0]
+		skipped := len(payload.Content()) == 0 || s.dropsOversize(payload)
+		if !skipped {
+			err := s.send(payload)
+			if err != nil {
+				log.Println("Can't send message, retrying in", s.nextBackoff(), ":", err)
+				return
+			}
 		}
+		s.commit(payload, skipped)
+		s.pending = s.pending[1:]
+	}
+	s.backoff = 0
+}
 
-		s.outputChan <- payload
+// nextBackoff doubles the time to wait before the next retry, up to maxBackoff,
+// and schedules the next retry
+func (s *Sender) nextBackoff() time.Duration {
+	if s.backoff == 0 {
+		s.backoff = s.minBackoff
+	} else {
+		s.backoff *= 2
+	}
+	if s.backoff > s.maxBackoff {
+		s.backoff = s.maxBackoff
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+	return s.backoff
+}
+
+// deadLetterPending writes all the pending messages to the dead letter file
+func (s *Sender) deadLetterPending() {
+	for _, payload := range s.pending {
+		s.writeDeadLetter(payload)
+	}
+	s.pending = nil
+}
+
+// writeDeadLetter writes a message that can't be sent to the dead letter file.
+// Once written there, its offset can be commited
+func (s *Sender) writeDeadLetter(payload message.Message) {
+	if s.deadLetter == nil && s.deadLetterPath != "" {
+		d, err := newFileDestination(s.deadLetterPath, RAW_FORMAT)
+		if err != nil {
+			log.Println("Can't open dead letter file:", err)
+		} else {
+			s.deadLetter = d
+		}
+	}
+	if s.deadLetter == nil {
+		log.Println("Dropping message that can't be sent")
+		s.commitDropped(payload)
 		return
 	}
+	err := s.deadLetter.Send(payload)
+	if err != nil {
+		log.Println("Can't write dead letter:", err)
+		s.commitDropped(payload)
+		return
+	}
+	s.deadLetter.Flush()
+	s.commit(payload, true)
+}
+
+// commitDropped commits the offset of a message that was dropped, without its content:
+// the messages of its stream after it could not be commited otherwise
+func (s *Sender) commitDropped(payload message.Message) {
+	payload.SetContent(nil)
+	s.commit(payload, true)
 }
@@ -0,0 +1,487 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package sender
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/config"
+	"github.com/DataDog/datadog-log-agent/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDestination fails to send messages while it is down
+type flakyDestination struct {
+	mutex    sync.Mutex
+	down     bool
+	sent     []string
+	attempts int
+}
+
+func (d *flakyDestination) Send(payload message.Message) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.attempts++
+	if d.down {
+		return fmt.Errorf("intake unreachable")
+	}
+	d.sent = append(d.sent, string(payload.Content()))
+	return nil
+}
+
+func (d *flakyDestination) Flush() {}
+
+func (d *flakyDestination) setDown(down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down = down
+}
+
+func newTestSender(destination Destination, outputChan chan message.Message) (*Sender, chan message.Message) {
+	inputChan := make(chan message.Message, 10)
+	s := New(inputChan, outputChan, destination)
+	s.minBackoff = time.Millisecond
+	s.maxBackoff = 4 * time.Millisecond
+	s.maxPending = 3
+	return s, inputChan
+}
+
+func TestSenderRetriesUntilTheDestinationRecovers(t *testing.T) {
+	d := &flakyDestination{down: true}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.Start()
+
+	inputChan <- newTestMessage("hello\n", 6)
+	inputChan <- newTestMessage("world\n", 12)
+	time.Sleep(20 * time.Millisecond)
+	// nothing is commited while the destination is down
+	assert.Equal(t, 0, len(outputChan))
+
+	d.setDown(false)
+	for _, offset := range []int64{6, 12} {
+		select {
+		case msg := <-outputChan:
+			assert.Equal(t, offset, msg.GetOrigin().Offset)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the message was not sent")
+		}
+	}
+	d.mutex.Lock()
+	assert.Equal(t, []string{"hello\n", "world\n"}, d.sent)
+	assert.True(t, d.attempts > 3)
+	d.mutex.Unlock()
+	close(inputChan)
+}
+
+func TestSenderBackoffIsCapped(t *testing.T) {
+	s := New(nil, nil, nil)
+	s.minBackoff = time.Second
+	s.maxBackoff = 5 * time.Second
+	assert.Equal(t, time.Second, s.nextBackoff())
+	assert.Equal(t, 2*time.Second, s.nextBackoff())
+	assert.Equal(t, 4*time.Second, s.nextBackoff())
+	assert.Equal(t, 5*time.Second, s.nextBackoff())
+	assert.Equal(t, 5*time.Second, s.nextBackoff())
+}
+
+func TestSenderWritesOverflowToDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sender")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	d := &flakyDestination{down: true}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.deadLetterPath = filepath.Join(dir, "dead_letter.log")
+	s.Start()
+
+	for i := int64(1); i <= 5; i++ {
+		inputChan <- newTestMessage(fmt.Sprintf("line %d\n", i), i)
+	}
+	// the two oldest messages overflow, they are commited once written
+	for _, offset := range []int64{1, 2} {
+		select {
+		case msg := <-outputChan:
+			assert.Equal(t, offset, msg.GetOrigin().Offset)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the message was not written to the dead letter file")
+		}
+	}
+	content, err := ioutil.ReadFile(s.deadLetterPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "line 1\nline 2\n", string(content))
+	assert.Equal(t, 0, len(outputChan))
+
+	d.setDown(false)
+	for _, offset := range []int64{3, 4, 5} {
+		select {
+		case msg := <-outputChan:
+			assert.Equal(t, offset, msg.GetOrigin().Offset)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the message was not sent")
+		}
+	}
+	close(inputChan)
+}
+
+func TestSenderCommitsTheMessagesDroppedWithoutDeadLetter(t *testing.T) {
+	d := &flakyDestination{down: true}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.deadLetterPath = ""
+	s.Start()
+
+	for i := int64(1); i <= 5; i++ {
+		inputChan <- newTestMessage(fmt.Sprintf("line %d\n", i), i)
+	}
+	// the two oldest messages overflow, they are commited without their content
+	// for the offsets of the messages after them to be commited
+	for _, offset := range []int64{1, 2} {
+		select {
+		case msg := <-outputChan:
+			assert.Equal(t, offset, msg.GetOrigin().Offset)
+			assert.Equal(t, 0, len(msg.Content()))
+		case <-time.After(time.Second):
+			assert.Fail(t, "the dropped message was not commited")
+		}
+	}
+
+	d.setDown(false)
+	for _, offset := range []int64{3, 4, 5} {
+		select {
+		case msg := <-outputChan:
+			assert.Equal(t, offset, msg.GetOrigin().Offset)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the message was not sent")
+		}
+	}
+	d.mutex.Lock()
+	assert.Equal(t, []string{"line 3\n", "line 4\n", "line 5\n"}, d.sent)
+	d.mutex.Unlock()
+	close(inputChan)
+}
+
+func TestSenderNeverSendsTheHeartbeats(t *testing.T) {
+	d := &flakyDestination{down: true}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.Start()
+
+	inputChan <- newTestMessage("hello\n", 6)
+	heartbeat := message.NewHeartbeatMessage([]byte("tailer healthy at offset 6"))
+	heartbeat.SetOrigin(message.NewOrigin())
+	inputChan <- heartbeat
+	// the heartbeat is handed to the auditor without waiting for the line
+	select {
+	case msg := <-outputChan:
+		assert.Equal(t, heartbeat, msg)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the heartbeat was not handed to the auditor")
+	}
+
+	d.setDown(false)
+	select {
+	case msg := <-outputChan:
+		assert.Equal(t, int64(6), msg.GetOrigin().Offset)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the message was not sent")
+	}
+	inputChan <- heartbeat
+	<-outputChan
+	d.mutex.Lock()
+	assert.Equal(t, []string{"hello\n"}, d.sent)
+	d.mutex.Unlock()
+	close(inputChan)
+}
+
+// ackingDestination acknowledges the messages it accepted on demand
+type ackingDestination struct {
+	mutex sync.Mutex
+	ids   map[string]uint64
+	acks  chan uint64
+}
+
+func newAckingDestination() *ackingDestination {
+	return &ackingDestination{ids: make(map[string]uint64), acks: make(chan uint64, 10)}
+}
+
+func (d *ackingDestination) Send(payload message.Message) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.ids[string(payload.Content())] = payload.GetOrigin().ID
+	return nil
+}
+
+func (d *ackingDestination) Flush() {}
+
+func (d *ackingDestination) Acks() <-chan uint64 {
+	return d.acks
+}
+
+func (d *ackingDestination) StopAcks() {}
+
+// ack acknowledges the message with content, once it was sent
+func (d *ackingDestination) ack(t *testing.T, content string) {
+	assert.Eventually(t, func() bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		id, ok := d.ids[content]
+		if ok {
+			d.acks <- id
+		}
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestSenderOnlyCommitsAcknowledgedMessages(t *testing.T) {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, 10)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	d := newAckingDestination()
+	s, inputChan := newTestSender(d, auditorChan)
+	s.Start()
+	defer close(inputChan)
+
+	inputChan <- newTestMessage("hello\n", 6)
+	inputChan <- newTestMessage("world\n", 12)
+	inputChan <- newTestMessage("again\n", 18)
+	d.ack(t, "hello\n")
+	assert.Eventually(t, func() bool {
+		offset, _ := a.GetLastCommitedOffset("file:test.log")
+		return offset == 6
+	}, time.Second, time.Millisecond)
+
+	// world is sent but never acknowledged, nothing after it is commited
+	d.ack(t, "again\n")
+	time.Sleep(20 * time.Millisecond)
+	offset, _ := a.GetLastCommitedOffset("file:test.log")
+	assert.Equal(t, int64(6), offset)
+}
+
+func TestSenderSendsAgainTheMessagesNotAcknowledgedInTime(t *testing.T) {
+	d := newAckingDestination()
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.ackTimeout = 20 * time.Millisecond
+	s.Start()
+	defer close(inputChan)
+
+	inputChan <- newTestMessage("hello\n", 6)
+	var firstID uint64
+	assert.Eventually(t, func() bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		firstID = d.ids["hello\n"]
+		return firstID > 0
+	}, time.Second, time.Millisecond)
+
+	// the acknowledgment was lost, the message is sent again with a new id
+	assert.Eventually(t, func() bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return d.ids["hello\n"] != firstID
+	}, time.Second, time.Millisecond)
+	d.ack(t, "hello\n")
+	assert.Equal(t, int64(6), (<-outputChan).GetOrigin().Offset)
+}
+
+func TestSenderStopsWithinTheDrainTimeoutWhenTheDestinationIsDead(t *testing.T) {
+	config.LogsAgent.Set("registry_type", auditor.MEMORY_REGISTRY)
+	defer config.LogsAgent.Set("registry_type", auditor.FILE_REGISTRY)
+	auditorChan := make(chan message.Message, 10)
+	a := auditor.New(auditorChan)
+	a.Start()
+	defer a.Stop()
+
+	// the destination accepts the messages but stops acknowledging them
+	d := newAckingDestination()
+	s, inputChan := newTestSender(d, auditorChan)
+	s.drainTimeout = 50 * time.Millisecond
+	s.Start()
+
+	inputChan <- newTestMessage("hello\n", 6)
+	inputChan <- newTestMessage("world\n", 12)
+	d.ack(t, "hello\n")
+	assert.Eventually(t, func() bool {
+		offset, _ := a.GetLastCommitedOffset("file:test.log")
+		return offset == 6
+	}, time.Second, time.Millisecond)
+
+	start := time.Now()
+	s.Stop()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 50*time.Millisecond)
+	assert.True(t, elapsed < time.Second)
+	// world is read again on the next start
+	a.Stop()
+	offset, _ := a.GetLastCommitedOffset("file:test.log")
+	assert.Equal(t, int64(6), offset)
+}
+
+func TestSenderSendsItsPendingMessagesWhenStopped(t *testing.T) {
+	d := &flakyDestination{down: true}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.drainTimeout = time.Second
+	s.Start()
+
+	inputChan <- newTestMessage("hello\n", 6)
+	time.Sleep(10 * time.Millisecond)
+	d.setDown(false)
+	s.Stop()
+	// the pending message was sent before the sender stopped
+	assert.Equal(t, 1, len(outputChan))
+	assert.Equal(t, int64(6), (<-outputChan).GetOrigin().Offset)
+}
+
+func TestSenderFitsOversizeMessagesInTheMaxPayloadSize(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{TRUNCATE_OVERSIZE, []string{"abcdefghijklmnopqrstuvwxyz", "0123456789...TRUNCATED...\n"}},
+		{SPLIT_OVERSIZE, []string{"abcdefghijklmnopqrstuvwxyz", "0123456789ab [part 1/3]\n", "cdefghijklmn [part 2/3]\n", "opqrstuvwxyz [part 3/3]\n"}},
+		{DROP_OVERSIZE, []string{"abcdefghijklmnopqrstuvwxyz"}},
+	} {
+		d := &flakyDestination{}
+		outputChan := make(chan message.Message, 10)
+		s, inputChan := newTestSender(d, outputChan)
+		s.maxPayloadSize = 26
+		s.oversizePolicy = tc.policy
+		s.Start()
+
+		// a message of the max size is sent as is
+		inputChan <- newTestMessage("abcdefghijklmnopqrstuvwxyz", 26)
+		inputChan <- newTestMessage("0123456789abcdefghijklmnopqrstuvwxyz\n", 63)
+		// the offset of the oversize message is commited once, whatever the policy
+		for _, offset := range []int64{26, 63} {
+			select {
+			case msg := <-outputChan:
+				assert.Equal(t, offset, msg.GetOrigin().Offset, tc.policy)
+			case <-time.After(time.Second):
+				assert.Fail(t, "the message was not commited", tc.policy)
+			}
+		}
+		d.mutex.Lock()
+		assert.Equal(t, tc.expected, d.sent, tc.policy)
+		for _, sent := range d.sent {
+			assert.True(t, len(sent) <= 26, tc.policy)
+		}
+		d.mutex.Unlock()
+		close(inputChan)
+	}
+}
+
+func TestSenderKeepsTheHeaderOfTheOversizeMessages(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{TRUNCATE_OVERSIZE, []string{"apikey <46>0 0123456789...TRUNCATED...\n"}},
+		{SPLIT_OVERSIZE, []string{"apikey <46>0 0123456789ab [part 1/3]\n", "apikey <46>0 cdefghijklmn [part 2/3]\n", "apikey <46>0 opqrstuvwxyz [part 3/3]\n"}},
+	} {
+		d := &flakyDestination{}
+		outputChan := make(chan message.Message, 10)
+		s, inputChan := newTestSender(d, outputChan)
+		s.maxPayloadSize = 26
+		s.oversizePolicy = tc.policy
+		s.Start()
+
+		// the line fits in the max size, whatever the length of its header
+		msg := newTestMessage("apikey <46>0 abcdefghijklmnopqrstuvwxyz", 26)
+		msg.GetOrigin().HeaderLen = 13
+		inputChan <- msg
+		msg = newTestMessage("apikey <46>0 0123456789abcdefghijklmnopqrstuvwxyz\n", 63)
+		msg.GetOrigin().HeaderLen = 13
+		inputChan <- msg
+		for range []int64{26, 63} {
+			select {
+			case <-outputChan:
+			case <-time.After(time.Second):
+				assert.Fail(t, "the message was not commited", tc.policy)
+			}
+		}
+		d.mutex.Lock()
+		assert.Equal(t, append([]string{"apikey <46>0 abcdefghijklmnopqrstuvwxyz"}, tc.expected...), d.sent, tc.policy)
+		d.mutex.Unlock()
+		close(inputChan)
+	}
+}
+
+func TestSenderDoesNotTruncateTheLinesTruncatedByTheDecoder(t *testing.T) {
+	d := &flakyDestination{}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	// the default max_payload_size and oversize_policy
+	s.maxPayloadSize = config.MaxMessageLen
+	s.oversizePolicy = TRUNCATE_OVERSIZE
+	s.Start()
+
+	// the decoder truncated the line to the max message length
+	line := strings.Repeat("a", config.MaxMessageLen-len("...TRUNCATED...")) + "...TRUNCATED..."
+	msg := newTestMessage("apikey <46>0 "+line+"\n", int64(config.MaxMessageLen))
+	msg.GetOrigin().HeaderLen = 13
+	inputChan <- msg
+	<-outputChan
+	d.mutex.Lock()
+	assert.Equal(t, []string{"apikey <46>0 " + line + "\n"}, d.sent)
+	d.mutex.Unlock()
+	close(inputChan)
+}
+
+// partDestination fails to send the part with a given number once
+type partDestination struct {
+	mutex  sync.Mutex
+	failAt int
+	sent   []string
+}
+
+func (d *partDestination) Send(payload message.Message) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.failAt == len(d.sent)+1 {
+		d.failAt = 0
+		return fmt.Errorf("intake unreachable")
+	}
+	d.sent = append(d.sent, string(payload.Content()))
+	return nil
+}
+
+func (d *partDestination) Flush() {}
+
+func TestSenderDoesNotSendAgainThePartsAlreadySent(t *testing.T) {
+	d := &partDestination{failAt: 2}
+	outputChan := make(chan message.Message, 10)
+	s, inputChan := newTestSender(d, outputChan)
+	s.maxPayloadSize = 26
+	s.oversizePolicy = SPLIT_OVERSIZE
+	s.Start()
+
+	inputChan <- newTestMessage("0123456789abcdefghijklmnopqrstuvwxyz\n", 37)
+	select {
+	case msg := <-outputChan:
+		assert.Equal(t, int64(37), msg.GetOrigin().Offset)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the message was not commited")
+	}
+	d.mutex.Lock()
+	assert.Equal(t, []string{"0123456789ab [part 1/3]\n", "cdefghijklmn [part 2/3]\n", "opqrstuvwxyz [part 3/3]\n"}, d.sent)
+	d.mutex.Unlock()
+	close(inputChan)
+}
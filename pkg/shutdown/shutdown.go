@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package shutdown
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Stopper is a component that needs to be stopped when the agent exits
+type Stopper interface {
+	Stop()
+}
+
+// A Coordinator stops the components of the agent in order:
+// inputs first, so that they stop reading, and the auditor last,
+// so that it flushes the registry once everything is drained
+type Coordinator struct {
+	stoppers []Stopper
+	timeout  time.Duration
+
+	once sync.Once
+	err  error
+}
+
+// NewCoordinator returns an initialized Coordinator
+func NewCoordinator(timeout time.Duration, stoppers ...Stopper) *Coordinator {
+	return &Coordinator{
+		stoppers: stoppers,
+		timeout:  timeout,
+	}
+}
+
+// Shutdown stops all the components, giving up after the shutdown timeout.
+// It is safe to call Shutdown several times, components are stopped only once
+func (c *Coordinator) Shutdown() error {
+	c.once.Do(func() {
+		done := make(chan struct{})
+		go func() {
+			for _, stopper := range c.stoppers {
+				stopper.Stop()
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(c.timeout):
+			c.err = fmt.Errorf("shutdown did not complete after %v", c.timeout)
+		}
+	})
+	return c.err
+}
+
+// HandleSignals makes the agent shutdown gracefully and exit
+// when it receives SIGTERM or SIGINT
+func HandleSignals(c *Coordinator) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go handleSignals(c, signals, os.Exit)
+}
+
+// handleSignals waits for a signal, then shuts the agent down and exits
+func handleSignals(c *Coordinator, signals <-chan os.Signal, exit func(int)) {
+	sig := <-signals
+	log.Println("Received", sig, "- stopping logs-agent")
+	err := c.Shutdown()
+	if err != nil {
+		log.Println(err)
+		exit(1)
+		return
+	}
+	exit(0)
+}
@@ -0,0 +1,63 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package shutdown
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockStopper struct {
+	name     string
+	delay    time.Duration
+	stopped  *[]string
+	numStops int
+}
+
+func (s *mockStopper) Stop() {
+	time.Sleep(s.delay)
+	s.numStops++
+	*s.stopped = append(*s.stopped, s.name)
+}
+
+func TestShutdownStopsComponentsInOrderOnce(t *testing.T) {
+	stopped := []string{}
+	tailers := &mockStopper{name: "tailers", stopped: &stopped}
+	auditor := &mockStopper{name: "auditor", stopped: &stopped}
+	c := NewCoordinator(time.Second, tailers, auditor)
+
+	assert.Nil(t, c.Shutdown())
+	assert.Nil(t, c.Shutdown())
+	assert.Equal(t, []string{"tailers", "auditor"}, stopped)
+	assert.Equal(t, 1, tailers.numStops)
+	assert.Equal(t, 1, auditor.numStops)
+}
+
+func TestShutdownRespectsTimeout(t *testing.T) {
+	stopped := []string{}
+	c := NewCoordinator(10*time.Millisecond, &mockStopper{name: "slow", delay: time.Second, stopped: &stopped})
+
+	start := time.Now()
+	assert.NotNil(t, c.Shutdown())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestHandleSignalsShutsDownAndExits(t *testing.T) {
+	stopped := []string{}
+	c := NewCoordinator(time.Second, &mockStopper{name: "auditor", stopped: &stopped})
+
+	signals := make(chan os.Signal, 1)
+	exitCodes := make(chan int, 1)
+	go handleSignals(c, signals, func(code int) { exitCodes <- code })
+
+	signals <- syscall.SIGTERM
+	assert.Equal(t, 0, <-exitCodes)
+	assert.Equal(t, []string{"auditor"}, stopped)
+}
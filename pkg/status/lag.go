@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package status
+
+import (
+	"expvar"
+
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+)
+
+// commitLag returns the number of bytes read from a file that are not commited yet,
+// they would be read again on restart. An offset commited before the file was
+// truncated can be ahead of the tailer, there is no lag then
+func commitLag(offset, commitedOffset int64) int64 {
+	if offset < commitedOffset {
+		return 0
+	}
+	return offset - commitedOffset
+}
+
+// CommitLags returns the commit lag of all the tailers by path
+func CommitLags(tailers TailersProvider, registry RegistryProvider) map[string]int64 {
+	snapshot := registry.GetRegistrySnapshot()
+	lags := make(map[string]int64)
+	for _, stats := range tailers.Stats() {
+		lags[stats.Path] = commitLag(stats.Offset, snapshot[stats.Identifier].Offset)
+	}
+	return lags
+}
+
+// PublishCommitLags exposes the commit lag of all the tailers as the CommitLag gauge,
+// it is computed each time it is read. A lag that keeps growing means that
+// the lines are not sent or that the registry can't be saved
+func PublishCommitLags(tailers TailersProvider, registry RegistryProvider) {
+	metrics.LogsExpvars.Set("CommitLag", expvar.Func(func() interface{} {
+		return CommitLags(tailers, registry)
+	}))
+}
@@ -0,0 +1,225 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/input/tailer"
+)
+
+// A TailersProvider gives access to the stats of the running tailers
+type TailersProvider interface {
+	Stats() []tailer.TailerStats
+	// RecentLines returns the last lines read from the file at path
+	RecentLines(path string) ([]string, error)
+	// Replay sends again the lines of the file at path, from fromOffset to its end
+	Replay(path string, fromOffset int64) error
+}
+
+// A RegistryProvider gives access to the commited offsets
+type RegistryProvider interface {
+	GetRegistrySnapshot() map[string]auditor.RegistryEntry
+	// Health returns an error while the offsets can't be saved, or take too long to
+	Health() error
+	// GetLastHeartbeat returns when an idle source last notified it was healthy
+	GetLastHeartbeat(identifier string) time.Time
+}
+
+// TailerStatus is the state of a tailer, as exposed by the status endpoint
+type TailerStatus struct {
+	Path            string    `json:"path"`
+	Offset          int64     `json:"offset"`
+	CommitedOffset  int64     `json:"committed_offset"`
+	CommitLag       int64     `json:"commit_lag"`
+	BytesRead       int64     `json:"bytes_read"`
+	LinesRead       int64     `json:"lines_read"`
+	LastReadTime    time.Time `json:"last_read_time"`
+	LastHeartbeat   time.Time `json:"last_heartbeat"`
+	QueueDepth      int       `json:"queue_depth"`
+	BlockedDuration string    `json:"blocked_duration"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// RecentLines are the last lines read from a file, as exposed by the status endpoint
+type RecentLines struct {
+	Path  string   `json:"path"`
+	Lines []string `json:"lines"`
+}
+
+// A Server exposes the state of all the tailers over http,
+// to find out which files are stuck when logs stop flowing
+type Server struct {
+	addr     string
+	tailers  TailersProvider
+	registry RegistryProvider
+	listener net.Listener
+}
+
+// NewServer returns an initialized Server
+func NewServer(addr string, tailers TailersProvider, registry RegistryProvider) *Server {
+	return &Server{
+		addr:     addr,
+		tailers:  tailers,
+		registry: registry,
+	}
+}
+
+// Start starts listening on the status address
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tailers", s.handleTailers)
+	mux.HandleFunc("/tailers/", s.handleTailer)
+	mux.HandleFunc("/health", s.handleHealth)
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Println("Status server stopped:", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops the Server
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// handleTailers writes the status of all the tailers, sorted by path
+func (s *Server) handleTailers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.tailersStatus())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// handleTailer serves the actions on a single file, requested as /tailers/{path}/{action}.
+// An absolute path loses its leading slash in the url
+func (s *Server) handleTailer(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tailers/")
+	switch {
+	case strings.HasSuffix(path, "/tail"):
+		s.handleRecentLines(w, r, strings.TrimSuffix(path, "/tail"))
+	case strings.HasSuffix(path, "/replay"):
+		s.handleReplay(w, r, strings.TrimSuffix(path, "/replay"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRecentLines writes the last lines read from the file at path
+func (s *Server) handleRecentLines(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lines, err := s.tailers.RecentLines(path)
+	if err != nil && !strings.HasPrefix(path, "/") {
+		if absLines, absErr := s.tailers.RecentLines("/" + path); absErr == nil {
+			path, lines, err = "/"+path, absLines, nil
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(RecentLines{Path: path, Lines: lines})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// handleReplay sends again the lines of the file at path from the offset
+// of the from parameter, 0 when it is missing
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var fromOffset int64
+	if from := r.URL.Query().Get("from"); from != "" {
+		var err error
+		fromOffset, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || fromOffset < 0 {
+			http.Error(w, fmt.Sprintf("from must be a positive offset (got %s)", from), http.StatusBadRequest)
+			return
+		}
+	}
+	err := s.tailers.Replay(path, fromOffset)
+	if err != nil && !strings.HasPrefix(path, "/") {
+		if absErr := s.tailers.Replay("/"+path, fromOffset); absErr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleHealth fails while the commited offsets can't be saved, or take too long to
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.registry.Health(); err != nil {
+		http.Error(w, fmt.Sprintf("unhealthy registry: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// tailersStatus assembles the tailers stats and their commited offsets
+func (s *Server) tailersStatus() []TailerStatus {
+	registry := s.registry.GetRegistrySnapshot()
+	statuses := []TailerStatus{}
+	for _, stats := range s.tailers.Stats() {
+		status := TailerStatus{
+			Path:            stats.Path,
+			Offset:          stats.Offset,
+			CommitedOffset:  registry[stats.Identifier].Offset,
+			CommitLag:       commitLag(stats.Offset, registry[stats.Identifier].Offset),
+			BytesRead:       stats.BytesRead,
+			LinesRead:       stats.LinesRead,
+			LastReadTime:    stats.LastReadTime,
+			LastHeartbeat:   s.registry.GetLastHeartbeat(stats.Identifier),
+			QueueDepth:      stats.QueueDepth,
+			BlockedDuration: stats.BlockedTime.String(),
+		}
+		if stats.Err != nil {
+			status.Error = stats.Err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+	return statuses
+}
@@ -0,0 +1,186 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-log-agent/pkg/auditor"
+	"github.com/DataDog/datadog-log-agent/pkg/input/tailer"
+	"github.com/DataDog/datadog-log-agent/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTailers struct {
+	stats       []tailer.TailerStats
+	recentLines map[string][]string
+	replays     map[string]int64
+}
+
+func (m *mockTailers) Stats() []tailer.TailerStats {
+	return m.stats
+}
+
+func (m *mockTailers) RecentLines(path string) ([]string, error) {
+	lines, ok := m.recentLines[path]
+	if !ok {
+		return nil, fmt.Errorf("%s is not tailed", path)
+	}
+	return lines, nil
+}
+
+func (m *mockTailers) Replay(path string, fromOffset int64) error {
+	if _, ok := m.recentLines[path]; !ok {
+		return fmt.Errorf("%s is not tailed", path)
+	}
+	if m.replays == nil {
+		m.replays = make(map[string]int64)
+	}
+	m.replays[path] = fromOffset
+	return nil
+}
+
+type mockRegistry struct {
+	registry   map[string]auditor.RegistryEntry
+	heartbeats map[string]time.Time
+	err        error
+}
+
+func (m *mockRegistry) GetRegistrySnapshot() map[string]auditor.RegistryEntry {
+	return m.registry
+}
+
+func (m *mockRegistry) Health() error {
+	return m.err
+}
+
+func (m *mockRegistry) GetLastHeartbeat(identifier string) time.Time {
+	return m.heartbeats[identifier]
+}
+
+func TestServerListsTailers(t *testing.T) {
+	lastRead := time.Date(2017, time.January, 12, 1, 1, 1, 0, time.UTC)
+	tailers := &mockTailers{stats: []tailer.TailerStats{
+		{Path: "/var/log/b.log", Identifier: "file:/var/log/b.log", Offset: 10, Err: fmt.Errorf("permission denied")},
+		{Path: "/var/log/a.log", Identifier: "file:/var/log/a.log", Offset: 42, BytesRead: 42, LinesRead: 3, LastReadTime: lastRead},
+	}}
+	registry := &mockRegistry{registry: map[string]auditor.RegistryEntry{
+		"file:/var/log/a.log": {Offset: 30},
+	}, heartbeats: map[string]time.Time{
+		"file:/var/log/b.log": lastRead,
+	}}
+	s := NewServer("", tailers, registry)
+
+	w := httptest.NewRecorder()
+	s.handleTailers(w, httptest.NewRequest("GET", "/tailers", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var statuses []TailerStatus
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, "/var/log/a.log", statuses[0].Path)
+	assert.Equal(t, int64(42), statuses[0].Offset)
+	assert.Equal(t, int64(30), statuses[0].CommitedOffset)
+	assert.Equal(t, int64(12), statuses[0].CommitLag)
+	assert.Equal(t, int64(3), statuses[0].LinesRead)
+	assert.Equal(t, lastRead, statuses[0].LastReadTime)
+	assert.Equal(t, "", statuses[0].Error)
+	assert.Equal(t, "/var/log/b.log", statuses[1].Path)
+	assert.Equal(t, int64(0), statuses[1].CommitedOffset)
+	assert.Equal(t, lastRead, statuses[1].LastHeartbeat)
+	assert.Equal(t, "permission denied", statuses[1].Error)
+
+	w = httptest.NewRecorder()
+	s.handleTailers(w, httptest.NewRequest("POST", "/tailers", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestCommitLagsAreTheBytesReadThatAreNotCommited(t *testing.T) {
+	tailers := &mockTailers{stats: []tailer.TailerStats{
+		{Path: "/var/log/a.log", Identifier: "file:/var/log/a.log", Offset: 42},
+		{Path: "/var/log/b.log", Identifier: "file:/var/log/b.log", Offset: 10},
+		// the file was truncated since its offset was commited
+		{Path: "/var/log/c.log", Identifier: "file:/var/log/c.log", Offset: 5},
+	}}
+	registry := &mockRegistry{registry: map[string]auditor.RegistryEntry{
+		"file:/var/log/a.log": {Offset: 30},
+		"file:/var/log/c.log": {Offset: 100},
+	}}
+	expected := map[string]int64{"/var/log/a.log": 12, "/var/log/b.log": 10, "/var/log/c.log": 0}
+	assert.Equal(t, expected, CommitLags(tailers, registry))
+
+	PublishCommitLags(tailers, registry)
+	var gauge map[string]int64
+	assert.Nil(t, json.Unmarshal([]byte(metrics.LogsExpvars.Get("CommitLag").String()), &gauge))
+	assert.Equal(t, expected, gauge)
+}
+
+func TestServerReportsRegistryHealth(t *testing.T) {
+	registry := &mockRegistry{}
+	s := NewServer("", &mockTailers{}, registry)
+
+	w := httptest.NewRecorder()
+	s.handleHealth(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	registry.err = fmt.Errorf("permission denied")
+	w = httptest.NewRecorder()
+	s.handleHealth(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "permission denied")
+}
+
+func TestServerShowsRecentLines(t *testing.T) {
+	tailers := &mockTailers{recentLines: map[string][]string{
+		"/var/log/a.log": {"hello", "world"},
+	}}
+	s := NewServer("", tailers, &mockRegistry{})
+
+	w := httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("GET", "/tailers/var/log/a.log/tail", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var recentLines RecentLines
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &recentLines))
+	assert.Equal(t, "/var/log/a.log", recentLines.Path)
+	assert.Equal(t, []string{"hello", "world"}, recentLines.Lines)
+
+	w = httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("GET", "/tailers/var/log/b.log/tail", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("GET", "/tailers/var/log/a.log", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServerReplaysFiles(t *testing.T) {
+	tailers := &mockTailers{recentLines: map[string][]string{
+		"/var/log/a.log": {},
+	}}
+	s := NewServer("", tailers, &mockRegistry{})
+
+	w := httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("POST", "/tailers/var/log/a.log/replay?from=42", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, map[string]int64{"/var/log/a.log": 42}, tailers.replays)
+
+	w = httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("GET", "/tailers/var/log/a.log/replay", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("POST", "/tailers/var/log/a.log/replay?from=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	s.handleTailer(w, httptest.NewRequest("POST", "/tailers/var/log/b.log/replay", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
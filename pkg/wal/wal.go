@@ -0,0 +1,250 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrFull is returned when appending a message would make the WAL exceed its size
+var ErrFull = errors.New("the WAL is full")
+
+// An Entry is a message appended to the WAL and not acked yet
+type Entry struct {
+	Seq     uint64 `json:"seq"`
+	Source  string `json:"source,omitempty"`
+	Content []byte `json:"content,omitempty"`
+	// Ack is true for the records that remove an entry
+	Ack bool `json:"ack,omitempty"`
+
+	// size is the size of the record of the entry in the file
+	size int64
+}
+
+// A WAL is a write-ahead log of the messages of the sources that can't be read again,
+// like FIFOs or network sources: a message is appended before it is sent, and removed
+// once it is acked. The entries still pending on startup are replayed by their source.
+// Pending entries take up to maxBytes, the file is compacted when it reaches twice maxBytes
+type WAL struct {
+	path     string
+	maxBytes int64
+
+	mutex        sync.Mutex
+	file         *os.File
+	size         int64
+	lastSeq      uint64
+	pending      map[uint64]*Entry
+	pendingBytes int64
+	// full is true while appends fail because of maxBytes
+	full bool
+	// recovered holds the entries of the previous run until their source replays them
+	recovered map[string][]Entry
+}
+
+// Open opens the WAL at path, creating it if needed,
+// and recovers the entries that were never acked
+func Open(path string, maxBytes int64) (*WAL, error) {
+	w := &WAL{
+		path:      path,
+		maxBytes:  maxBytes,
+		pending:   make(map[uint64]*Entry),
+		recovered: make(map[string][]Entry),
+	}
+	err := w.recover()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range w.sortedPending() {
+		w.recovered[entry.Source] = append(w.recovered[entry.Source], *entry)
+	}
+	err = w.compact()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// recover reads the records of the WAL file, a truncated last record is ignored
+func (w *WAL) recover() error {
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), int(w.maxBytes)+4096)
+	for scanner.Scan() {
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// the agent stopped while writing this record, it was never sent
+			log.Println("Ignoring a corrupted record of the WAL", w.path, ":", err)
+			continue
+		}
+		if entry.Seq > w.lastSeq {
+			w.lastSeq = entry.Seq
+		}
+		if entry.Ack {
+			if pending, ok := w.pending[entry.Seq]; ok {
+				w.pendingBytes -= pending.size
+				delete(w.pending, entry.Seq)
+			}
+			continue
+		}
+		entry.size = int64(len(scanner.Bytes())) + 1
+		w.pending[entry.Seq] = &entry
+		w.pendingBytes += entry.size
+	}
+	return scanner.Err()
+}
+
+// Append writes a message of source in the WAL and returns its sequence number,
+// or ErrFull when the pending entries already take maxBytes
+func (w *WAL) Append(source string, content []byte) (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	entry := &Entry{Seq: w.lastSeq + 1, Source: source, Content: content}
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	entry.size = int64(len(record)) + 1
+	if w.pendingBytes+entry.size > w.maxBytes {
+		if !w.full {
+			log.Println("The WAL is full, messages won't be recovered after a crash until some are commited")
+			w.full = true
+		}
+		return 0, ErrFull
+	}
+	if w.full {
+		log.Println("The WAL accepts messages again")
+		w.full = false
+	}
+	err = w.write(record)
+	if err != nil {
+		return 0, err
+	}
+	w.lastSeq = entry.Seq
+	w.pending[entry.Seq] = entry
+	w.pendingBytes += entry.size
+	return entry.Seq, nil
+}
+
+// Ack removes the entry seq from the WAL, it won't be replayed anymore
+func (w *WAL) Ack(seq uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	entry, ok := w.pending[seq]
+	if !ok {
+		return nil
+	}
+	delete(w.pending, seq)
+	w.pendingBytes -= entry.size
+	if w.size >= 2*w.maxBytes {
+		// the acked entries are dropped from the file
+		return w.compact()
+	}
+	record, err := json.Marshal(&Entry{Seq: seq, Ack: true})
+	if err != nil {
+		return err
+	}
+	return w.write(record)
+}
+
+// Recovered returns the entries of source that were pending when the WAL
+// was opened, in the order they were appended. They are returned only once
+// so that a source restarting doesn't replay its entries again
+func (w *WAL) Recovered(source string) []Entry {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	entries := w.recovered[source]
+	delete(w.recovered, source)
+	return entries
+}
+
+// Close closes the file of the WAL, the pending entries are kept for the next run
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// write appends a record to the WAL file
+func (w *WAL) write(record []byte) error {
+	if w.file == nil {
+		return fmt.Errorf("the WAL %s is closed", w.path)
+	}
+	n, err := w.file.Write(append(record, '\n'))
+	w.size += int64(n)
+	return err
+}
+
+// compact rewrites the WAL file with the pending entries only,
+// the new file replaces the previous one atomically
+func (w *WAL) compact() error {
+	tmpPath := w.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	var size int64
+	for _, entry := range w.sortedPending() {
+		record, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		n, _ := writer.Write(append(record, '\n'))
+		size += int64(n)
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = os.Rename(tmpPath, w.path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = f
+	w.size = size
+	return nil
+}
+
+// sortedPending returns the pending entries in the order they were appended
+func (w *WAL) sortedPending() []*Entry {
+	entries := make([]*Entry, 0, len(w.pending))
+	for _, entry := range w.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries
+}
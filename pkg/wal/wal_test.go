@@ -0,0 +1,123 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017 Datadog, Inc.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Nil(t, err)
+	return filepath.Join(dir, "wal.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestWALRecoversPendingEntries(t *testing.T) {
+	path, cleanup := newTestPath(t)
+	defer cleanup()
+
+	w, err := Open(path, 1024)
+	assert.Nil(t, err)
+	seq1, err := w.Append("fifo", []byte("first"))
+	assert.Nil(t, err)
+	seq2, err := w.Append("fifo", []byte("second"))
+	assert.Nil(t, err)
+	_, err = w.Append("tcp:10514", []byte("other"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Ack(seq1))
+	assert.Nil(t, w.Close())
+
+	w, err = Open(path, 1024)
+	assert.Nil(t, err)
+	defer w.Close()
+	entries := w.Recovered("fifo")
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, seq2, entries[0].Seq)
+	assert.Equal(t, "second", string(entries[0].Content))
+	// entries are recovered once
+	assert.Equal(t, 0, len(w.Recovered("fifo")))
+	assert.Equal(t, 1, len(w.Recovered("tcp:10514")))
+
+	// sequence numbers are not reused
+	seq, err := w.Append("fifo", []byte("third"))
+	assert.Nil(t, err)
+	assert.True(t, seq > seq2)
+}
+
+func TestWALIgnoresTruncatedRecord(t *testing.T) {
+	path, cleanup := newTestPath(t)
+	defer cleanup()
+
+	w, err := Open(path, 1024)
+	assert.Nil(t, err)
+	_, err = w.Append("fifo", []byte("first"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	// the agent crashed while appending a record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	f.WriteString(`{"seq":2,"source":"fi`)
+	f.Close()
+
+	w, err = Open(path, 1024)
+	assert.Nil(t, err)
+	defer w.Close()
+	entries := w.Recovered("fifo")
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "first", string(entries[0].Content))
+}
+
+func TestWALIsBounded(t *testing.T) {
+	path, cleanup := newTestPath(t)
+	defer cleanup()
+
+	w, err := Open(path, 100)
+	assert.Nil(t, err)
+	defer w.Close()
+	seq, err := w.Append("fifo", []byte("a message that fits"))
+	assert.Nil(t, err)
+	_, err = w.Append("fifo", []byte("a message that doesn't fit anymore"))
+	assert.Equal(t, ErrFull, err)
+
+	assert.Nil(t, w.Ack(seq))
+	_, err = w.Append("fifo", []byte("a message that fits again"))
+	assert.Nil(t, err)
+}
+
+func TestWALCompactsAckedEntries(t *testing.T) {
+	path, cleanup := newTestPath(t)
+	defer cleanup()
+
+	w, err := Open(path, 200)
+	assert.Nil(t, err)
+	defer w.Close()
+	var last uint64
+	for i := 0; i < 100; i++ {
+		seq, err := w.Append("fifo", []byte("hello world"))
+		assert.Nil(t, err)
+		if last > 0 {
+			assert.Nil(t, w.Ack(last))
+		}
+		last = seq
+	}
+	// only the last entry is pending, the acked ones were dropped from the file
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.True(t, info.Size() < 2*200+50)
+
+	assert.Nil(t, w.Close())
+	w, err = Open(path, 200)
+	assert.Nil(t, err)
+	defer w.Close()
+	entries := w.Recovered("fifo")
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, last, entries[0].Seq)
+}